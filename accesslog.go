@@ -0,0 +1,112 @@
+package socks5
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// AccessLogFormat is the format of the records of an AccessLog.
+type AccessLogFormat uint8
+
+const (
+	// AccessLogCommon is a format like the Common Log Format of web
+	// servers, the request is the command and destination of the session,
+	// the status its close reason, followed by the bytes up and down and
+	// the duration in milliseconds, then the quoted tags of the session
+	// if it has any:
+	//
+	//	192.0.2.1:50000 - alice [16/Oct/2026:10:00:00 +0000] "CONNECT example.com:443" - 517 4382 1203
+	//	192.0.2.1:50001 - bob [16/Oct/2026:10:00:01 +0000] "CONNECT example.org:443" - 48 903 87 "team=video"
+	AccessLogCommon AccessLogFormat = iota
+	// AccessLogJSON writes the ConnStat of sessions as JSON objects.
+	AccessLogJSON
+)
+
+// clfTime is the time layout of the Common Log Format.
+const clfTime = "02/Jan/2006:15:04:05 -0700"
+
+// AccessLog writes a record of each session once it ends, with its
+// client, user, command, destination, bytes, duration, close reason and
+// tags: set Server.AccessLog to it. Records are written one line each to
+// W, such as a lumberjack.Logger rotating files or a syslog.Writer,
+// records of concurrent sessions are not interleaved.
+//
+//	srv.AccessLog = &socks5.AccessLog{W: os.Stdout, Format: socks5.AccessLogJSON}
+type AccessLog struct {
+	// W receives the records.
+	W      io.Writer
+	Format AccessLogFormat
+
+	mu sync.Mutex
+}
+
+// Rotate make the access log write to w from then on, such as a file
+// reopened after logrotate moved the previous one, and return the writer
+// it replaced, which no record is written to afterwards.
+func (l *AccessLog) Rotate(w io.Writer) (old io.Writer) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	old, l.W = l.W, w
+	return old
+}
+
+// Log write the record of the session s.
+func (l *AccessLog) Log(s *Session) error {
+	stat := ConnStat{ID: s.ID, Start: s.start, Closed: true, CloseReason: s.CloseReason()}
+	if s.ClientAddr != nil {
+		stat.ClientAddr = s.ClientAddr.String()
+	}
+	stat.fill(s)
+	stat.count(s)
+
+	var line []byte
+	if l.Format == AccessLogJSON {
+		b, err := json.Marshal(stat)
+		if err != nil {
+			return err
+		}
+		line = append(b, '\n')
+	} else {
+		line = []byte(fmt.Sprintf("%s - %s [%s] %s %s %d %d %d",
+			orDash(stat.ClientAddr), orDash(stat.Username), stat.Start.Format(clfTime),
+			commonRequest(stat), orDash(stat.CloseReason),
+			stat.BytesUp, stat.BytesDown, stat.Duration/time.Millisecond))
+		if tags := s.Tags(); len(tags) > 0 {
+			line = append(line, fmt.Sprintf(" %q", formatTags(tags))...)
+		}
+		line = append(line, '\n')
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	_, err := l.W.Write(line)
+	return err
+}
+
+// commonRequest return the quoted request of stat, or - if the session
+// ended before its request.
+func commonRequest(stat ConnStat) string {
+	if stat.Command == "" {
+		return "-"
+	}
+	return fmt.Sprintf("%q", stat.Command+" "+stat.Dest)
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+// logAccess write the record of s to the AccessLog of the server if set.
+func (srv *Server) logAccess(s *Session) {
+	if srv.AccessLog == nil {
+		return
+	}
+	if err := srv.AccessLog.Log(s); err != nil {
+		srv.logf()("socks5: access log: %v", err)
+	}
+}
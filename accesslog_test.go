@@ -0,0 +1,79 @@
+package socks5
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+// accessLogTest serve a session of alice relaying ping through a server
+// logging to an AccessLog of format, and return its record.
+func accessLogTest(t *testing.T, format AccessLogFormat) (string, string) {
+	store := NewMemeryStore(sha256.New(), "")
+	store.Set("alice", "a")
+	lines := make(chan string, 1)
+	srv := &Server{
+		Authenticators: map[METHOD]Authenticator{USERNAME_PASSWORD: UserPwdAuth{store}},
+		MethodPriority: []METHOD{USERNAME_PASSWORD},
+		Hooks:          Hooks{OnAuthSuccess: func(s *Session) { s.Tag("team", "video") }},
+		AccessLog: &AccessLog{W: writerFunc(func(b []byte) (int, error) {
+			lines <- string(b)
+			return len(b), nil
+		}), Format: format},
+	}
+	echo := echoTest(t)
+	conn, err := (&Client{ProxyAddr: serveTest(t, srv), Username: "alice", Password: "a"}).Dial("tcp", echo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Write([]byte("ping"))
+	ReadNBytes(conn, 4)
+	conn.Close()
+	select {
+	case line := <-lines:
+		return line, echo
+	case <-time.After(5 * time.Second):
+		t.Fatal("no access log record")
+	}
+	return "", ""
+}
+
+func TestAccessLog_Common(t *testing.T) {
+	line, echo := accessLogTest(t, AccessLogCommon)
+	re := `^127\.0\.0\.1:\d+ - alice \[[^]]+\] "CONNECT ` + regexp.QuoteMeta(echo) + `" - 4 4 \d+ "team=video"\n$`
+	if !regexp.MustCompile(re).MatchString(line) {
+		t.Errorf("record %q", line)
+	}
+}
+
+func TestAccessLog_JSON(t *testing.T) {
+	line, echo := accessLogTest(t, AccessLogJSON)
+	var stat ConnStat
+	if err := json.Unmarshal([]byte(line), &stat); err != nil {
+		t.Fatal(err)
+	}
+	if stat.Username != "alice" || stat.Command != "CONNECT" || stat.Dest != echo || stat.BytesUp != 4 || stat.BytesDown != 4 || stat.Tags["team"] != "video" || !strings.HasSuffix(line, "\n") {
+		t.Errorf("record %q", line)
+	}
+}
+
+func TestAccessLog_Rotate(t *testing.T) {
+	var first, second bytes.Buffer
+	l := &AccessLog{W: &first}
+	s := &Session{start: time.Now()}
+	l.Log(s)
+	if old := l.Rotate(&second); old != &first {
+		t.Errorf("rotated from %v", old)
+	}
+	l.Log(s)
+	if strings.Count(first.String(), "\n") != 1 || strings.Count(second.String(), "\n") != 1 {
+		t.Errorf("first %q, second %q", first.String(), second.String())
+	}
+	if !strings.Contains(first.String(), ` - - [`) || !strings.Contains(first.String(), `] - - 0 0 `) {
+		t.Errorf("record of a session without request %q", first.String())
+	}
+}
@@ -0,0 +1,321 @@
+package socks5
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+)
+
+// Match is a RuleSet allowing the requests matching all its non-empty
+// criteria, and denying the others. The zero Match allows all requests.
+// Combine Matches with AllowList, DenyList, And, Or and Not.
+type Match struct {
+	// Clients are the networks of the client address.
+	Clients []*net.IPNet
+
+	// Users are the names of authenticated users, see Session.Username.
+	// Anonymous sessions do not match them.
+	Users []string
+
+	// Networks are the networks of IP address destinations. Domain name
+	// destinations do not match them.
+	Networks []*net.IPNet
+
+	// Domains are the domain name destinations, "example.com",
+	// ".example.com" and "*.example.com" all match example.com itself and
+	// any name under it. IP address destinations do not match them.
+	Domains []string
+
+	// Ports are the destination ports.
+	Ports []PortRange
+
+	// Commands are the request commands.
+	Commands []CMD
+}
+
+// Allow report whether req matches m.
+func (m *Match) Allow(s *Session, req *Request) bool {
+	if len(m.Clients) > 0 {
+		if ip := s.ClientIP(); ip == nil || !inNetworks(ip, m.Clients) {
+			return false
+		}
+	}
+	if len(m.Users) > 0 && (s.Username == "" || !hasString(s.Username, m.Users)) {
+		return false
+	}
+	dest := req.Address
+	if len(m.Networks) > 0 && (dest.ATYPE == DOMAINNAME || !inNetworks(dest.Addr, m.Networks)) {
+		return false
+	}
+	if len(m.Domains) > 0 && (dest.ATYPE != DOMAINNAME || !matchDomains(string(dest.Addr), m.Domains)) {
+		return false
+	}
+	if len(m.Ports) > 0 && !inPortRanges(dest.Port, m.Ports) {
+		return false
+	}
+	if len(m.Commands) > 0 && !hasCMD(req.CMD, m.Commands) {
+		return false
+	}
+	return true
+}
+
+func inNetworks(ip net.IP, networks []*net.IPNet) bool {
+	for _, n := range networks {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchDomains(name string, domains []string) bool {
+	name = canonicalHost(name)
+	for _, d := range domains {
+		if matchDomainSuffix(name, d) {
+			return true
+		}
+	}
+	return false
+}
+
+func inPortRanges(port uint16, ranges []PortRange) bool {
+	for _, r := range ranges {
+		if port >= r.Min && port <= r.Max {
+			return true
+		}
+	}
+	return false
+}
+
+func hasString(str string, strs []string) bool {
+	for _, s := range strs {
+		if s == str {
+			return true
+		}
+	}
+	return false
+}
+
+func hasCMD(cmd CMD, cmds []CMD) bool {
+	for _, c := range cmds {
+		if c == cmd {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseNetworks parse CIDR networks such as "10.0.0.0/8". A single
+// address is parsed as a network of itself.
+func ParseNetworks(cidrs ...string) ([]*net.IPNet, error) {
+	networks := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			ip := net.ParseIP(cidr)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid network %q", cidr)
+			}
+			bits := 8 * net.IPv6len
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 8*net.IPv4len
+			}
+			n = &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}
+		}
+		networks = append(networks, n)
+	}
+	return networks, nil
+}
+
+// And allows the requests allowed by all rules.
+func And(rules ...RuleSet) RuleSet {
+	return RuleSetFunc(func(s *Session, req *Request) bool {
+		for _, r := range rules {
+			if !r.Allow(s, req) {
+				return false
+			}
+		}
+		return true
+	})
+}
+
+// Or allows the requests allowed by any of rules.
+func Or(rules ...RuleSet) RuleSet {
+	return RuleSetFunc(func(s *Session, req *Request) bool {
+		for _, r := range rules {
+			if r.Allow(s, req) {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+// Not allows the requests r denies.
+func Not(r RuleSet) RuleSet {
+	return RuleSetFunc(func(s *Session, req *Request) bool {
+		return !r.Allow(s, req)
+	})
+}
+
+// AllowList allows only the requests matching one of rules.
+func AllowList(rules ...RuleSet) RuleSet {
+	return Or(rules...)
+}
+
+// DenyList denies the requests matching one of rules, and allows the
+// others.
+func DenyList(rules ...RuleSet) RuleSet {
+	return Not(Or(rules...))
+}
+
+// UserRules is a RuleSet applying different rules per authenticated
+// user, such as to only let user "crawler" CONNECT to port 443:
+//
+//	srv.Rules = &socks5.UserRules{
+//		Users: map[string]socks5.RuleSet{
+//			"crawler": &socks5.Match{
+//				Commands: []socks5.CMD{socks5.CONNECT},
+//				Ports:    []socks5.PortRange{{Min: 443, Max: 443}},
+//			},
+//		},
+//		Default: socks5.AllowList(),
+//	}
+type UserRules struct {
+	// Users maps user names, see Session.Username, to their rules.
+	Users map[string]RuleSet
+
+	// Default are the rules of the users not in Users and of anonymous
+	// sessions. If nil, their requests are allowed.
+	Default RuleSet
+}
+
+// Allow report whether the rules of the user of s allow req.
+func (u *UserRules) Allow(s *Session, req *Request) bool {
+	if s.Username != "" {
+		if rules, ok := u.Users[s.Username]; ok {
+			return rules.Allow(s, req)
+		}
+	}
+	if u.Default == nil {
+		return true
+	}
+	return u.Default.Allow(s, req)
+}
+
+// privateNetworks are the networks not reachable from the Internet:
+// private, shared, loopback, link local and unspecified addresses.
+var privateNetworks, _ = ParseNetworks(
+	"0.0.0.0/8", "10.0.0.0/8", "100.64.0.0/10", "127.0.0.0/8",
+	"169.254.0.0/16", "172.16.0.0/12", "192.168.0.0/16",
+	"::/128", "::1/128", "fc00::/7", "fe80::/10",
+)
+
+// IsPrivateIP report whether ip is in a private, shared (carrier-grade
+// NAT), loopback, link local or unspecified network.
+func IsPrivateIP(ip net.IP) bool {
+	return inNetworks(ip, privateNetworks)
+}
+
+// errPrivateNetwork is returned when the Dialer of BlockPrivateNetworks
+// refuses to connect to a private address.
+var errPrivateNetwork = errors.New("destination in a private network")
+
+// BlockPrivateNetworks is a RuleSet denying destinations in private
+// networks, see IsPrivateIP, so clients cannot reach the network of the
+// server. Domain names are resolved and denied if any of their addresses
+// is private, or if they fail to resolve.
+//
+// The server resolves names again to dial them, so a name changing its
+// addresses in between, such as by DNS rebinding, would slip through the
+// rule alone. Its Dialer checks the addresses it connects to as well:
+//
+//	block := &socks5.BlockPrivateNetworks{}
+//	srv.Rules = block
+//	srv.Dialer = block.Dialer(nil)
+//
+// UDP associations resolve each destination once, and check the address
+// they send datagrams to if the server dials with its Dialer.
+type BlockPrivateNetworks struct {
+	// Resolver resolves domain name destinations. If nil,
+	// net.DefaultResolver is used.
+	Resolver NameResolver
+}
+
+// Allow report whether the destination of req is public.
+func (b *BlockPrivateNetworks) Allow(s *Session, req *Request) bool {
+	dest := req.Address
+	if dest.ATYPE != DOMAINNAME {
+		return !IsPrivateIP(dest.Addr)
+	}
+	ips, err := b.resolver().Resolve(s.Context(), string(dest.Addr))
+	return err == nil && public(ips)
+}
+
+// Dialer return a Dialer connecting with d to public addresses only,
+// refusing private ones with CONNECTION_NOT_ALLOW_BY_RULESET. Domain names
+// are resolved with Resolver, and denied as Allow denies them. If d is
+// nil, a net.Dialer is used. Set it as Server.Dialer, and as the Dialer
+// of routes.
+func (b *BlockPrivateNetworks) Dialer(d Dialer) Dialer {
+	if d == nil {
+		d = &net.Dialer{}
+	}
+	return &privateDialer{b, d}
+}
+
+func (b *BlockPrivateNetworks) resolver() NameResolver {
+	if b.Resolver == nil {
+		return netResolver{net.DefaultResolver}
+	}
+	return b.Resolver
+}
+
+// public report whether ips has addresses, none of them private.
+func public(ips []net.IP) bool {
+	for _, ip := range ips {
+		if IsPrivateIP(ip) {
+			return false
+		}
+	}
+	return len(ips) > 0
+}
+
+// blocksPrivate report whether srv denies private networks, dialing with
+// the Dialer of BlockPrivateNetworks.
+func (srv *Server) blocksPrivate() bool {
+	_, ok := srv.Dialer.(*privateDialer)
+	return ok
+}
+
+// privateDialer is the Dialer of BlockPrivateNetworks.
+type privateDialer struct {
+	block *BlockPrivateNetworks
+	d     Dialer
+}
+
+// DialContext connect to address if it is public, trying each address of
+// a domain name in turn.
+func (d *privateDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	ips := []net.IP{net.ParseIP(host)}
+	if ips[0] == nil {
+		if ips, err = d.block.resolver().Resolve(ctx, host); err != nil {
+			return nil, err
+		}
+	}
+	if !public(ips) {
+		return nil, errPrivateNetwork
+	}
+	for _, ip := range ips {
+		var conn net.Conn
+		if conn, err = d.d.DialContext(ctx, network, net.JoinHostPort(ip.String(), port)); err == nil {
+			return conn, nil
+		}
+	}
+	return nil, err
+}
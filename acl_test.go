@@ -0,0 +1,150 @@
+package socks5
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"testing"
+)
+
+func TestRuleSets(t *testing.T) {
+	corp, err := ParseNetworks("10.0.0.0/8", "192.0.2.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ParseNetworks("10.0.0.0/33"); err == nil {
+		t.Error("invalid network parsed")
+	}
+	web := &Match{Ports: []PortRange{{80, 80}, {443, 443}}}
+	internal := &Match{Networks: corp}
+	example := &Match{Domains: []string{"*.example.com"}}
+	office := &Match{Clients: corp}
+	noBind := &Match{Commands: []CMD{CONNECT, UDP_ASSOCIATE}}
+	hosts := &HostsResolver{Hosts: map[string][]net.IP{
+		"intranet.test": {net.IPv4(192, 168, 1, 1)},
+		"public.test":   {net.IPv4(198, 51, 100, 1)},
+	}}
+	unresolved := NameResolverFunc(func(ctx context.Context, fqdn string) ([]net.IP, error) {
+		return nil, &net.DNSError{Err: "no such host", Name: fqdn, IsNotFound: true}
+	})
+
+	for _, c := range []struct {
+		name    string
+		rules   RuleSet
+		client  string
+		cmd     CMD
+		dest    string
+		allowed bool
+	}{
+		{"port", web, "203.0.113.1:1", CONNECT, "example.org:443", true},
+		{"other port", web, "203.0.113.1:1", CONNECT, "example.org:22", false},
+		{"network", internal, "203.0.113.1:1", CONNECT, "10.1.2.3:22", true},
+		{"single address", internal, "203.0.113.1:1", CONNECT, "192.0.2.1:22", true},
+		{"outside network", internal, "203.0.113.1:1", CONNECT, "192.0.2.2:22", false},
+		{"domain for network", internal, "203.0.113.1:1", CONNECT, "corp.test:22", false},
+		{"subdomain", example, "203.0.113.1:1", CONNECT, "WWW.Example.com.:80", true},
+		{"domain", example, "203.0.113.1:1", CONNECT, "example.com:80", true},
+		{"other domain", example, "203.0.113.1:1", CONNECT, "badexample.com:80", false},
+		{"client", office, "10.9.9.9:1", CONNECT, "example.org:80", true},
+		{"other client", office, "203.0.113.1:1", CONNECT, "example.org:80", false},
+		{"anonymous user", &Match{Users: []string{"alice"}}, "203.0.113.1:1", CONNECT, "example.org:80", false},
+		{"command", noBind, "203.0.113.1:1", BIND, "example.org:80", false},
+		{"and", And(web, example), "203.0.113.1:1", CONNECT, "www.example.com:443", true},
+		{"and fails", And(web, example), "203.0.113.1:1", CONNECT, "www.example.com:22", false},
+		{"or", Or(web, example), "203.0.113.1:1", CONNECT, "www.example.com:22", true},
+		{"allow list", AllowList(web, internal), "203.0.113.1:1", CONNECT, "10.0.0.1:22", true},
+		{"allow list denies", AllowList(web, internal), "203.0.113.1:1", CONNECT, "192.0.2.9:22", false},
+		{"deny list", DenyList(internal), "203.0.113.1:1", CONNECT, "10.0.0.1:80", false},
+		{"deny list allows", DenyList(internal), "203.0.113.1:1", CONNECT, "192.0.2.9:80", true},
+		{"office only to internal", Or(Not(internal), office), "203.0.113.1:1", CONNECT, "10.0.0.1:80", false},
+		{"private address", &BlockPrivateNetworks{hosts}, "203.0.113.1:1", CONNECT, "127.0.0.1:80", false},
+		{"private v6", &BlockPrivateNetworks{hosts}, "203.0.113.1:1", CONNECT, "[fd00::1]:80", false},
+		{"private name", &BlockPrivateNetworks{hosts}, "203.0.113.1:1", CONNECT, "intranet.test:80", false},
+		{"public name", &BlockPrivateNetworks{hosts}, "203.0.113.1:1", CONNECT, "public.test:80", true},
+		{"public address", &BlockPrivateNetworks{hosts}, "203.0.113.1:1", CONNECT, "198.51.100.1:80", true},
+		{"unresolved name", &BlockPrivateNetworks{unresolved}, "203.0.113.1:1", CONNECT, "missing.test:80", false},
+	} {
+		client, _ := net.ResolveTCPAddr("tcp", c.client)
+		dest, err := ParseAddress(c.dest)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s := &Session{ClientAddr: client}
+		if allowed := c.rules.Allow(s, &Request{VER: Version5, CMD: c.cmd, Address: dest}); allowed != c.allowed {
+			t.Errorf("%s: allowed %v", c.name, allowed)
+		}
+	}
+}
+
+func TestServer_DenyList(t *testing.T) {
+	echo := echoTest(t)
+	host, _, _ := net.SplitHostPort(echo)
+	loopback, err := ParseNetworks(host)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &Server{
+		Rules:    DenyList(&Match{Networks: loopback}),
+		ErrorLog: log.New(io.Discard, "", 0),
+	}
+	client := &Client{ProxyAddr: serveTest(t, srv)}
+	var rep *REPError
+	if _, err := client.Dial("tcp", echo); !errors.As(err, &rep) || rep.REP != CONNECTION_NOT_ALLOW_BY_RULESET {
+		t.Errorf("denied destination: %v", err)
+	}
+}
+
+func TestBlockPrivateNetworks_Rebinding(t *testing.T) {
+	echo := echoTest(t)
+	_, port, _ := net.SplitHostPort(echo)
+	// the name is public when checked, and private when dialed.
+	block := &BlockPrivateNetworks{&HostsResolver{Hosts: map[string][]net.IP{
+		"rebind.test": {net.IPv4(198, 51, 100, 1)},
+	}}}
+	srv := &Server{
+		Rules:    block,
+		Dialer:   block.Dialer(nil),
+		Resolver: &HostsResolver{Hosts: map[string][]net.IP{"rebind.test": {net.IPv4(127, 0, 0, 1)}}},
+		ErrorLog: log.New(io.Discard, "", 0),
+	}
+	client := &Client{ProxyAddr: serveTest(t, srv)}
+	var rep *REPError
+	if _, err := client.Dial("tcp", net.JoinHostPort("rebind.test", port)); !errors.As(err, &rep) || rep.REP != CONNECTION_NOT_ALLOW_BY_RULESET {
+		t.Errorf("rebound name: %v", err)
+	}
+	if _, err := block.Dialer(nil).DialContext(context.Background(), "tcp", echo); !errors.Is(err, errPrivateNetwork) {
+		t.Errorf("private address: %v", err)
+	}
+}
+
+func TestServer_UserRules(t *testing.T) {
+	store := NewMemeryStore(sha256.New(), "secret")
+	store.Set("crawler", "123456")
+	store.Set("admin", "123456")
+	srv := &Server{
+		Authenticators: map[METHOD]Authenticator{USERNAME_PASSWORD: UserPwdAuth{store}},
+		Rules: &UserRules{
+			Users: map[string]RuleSet{
+				"crawler": &Match{Users: []string{"crawler"}, Ports: []PortRange{{443, 443}}},
+			},
+		},
+		ErrorLog: log.New(io.Discard, "", 0),
+	}
+	addr := serveTest(t, srv)
+	echo := echoTest(t)
+
+	crawler := &Client{ProxyAddr: addr, Username: "crawler", Password: "123456"}
+	var rep *REPError
+	if _, err := crawler.Dial("tcp", echo); !errors.As(err, &rep) || rep.REP != CONNECTION_NOT_ALLOW_BY_RULESET {
+		t.Errorf("crawler: %v", err)
+	}
+	admin := &Client{ProxyAddr: addr, Username: "admin", Password: "123456"}
+	conn, err := admin.Dial("tcp", echo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+}
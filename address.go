@@ -5,9 +5,12 @@ import (
 	"encoding/binary"
 	"errors"
 	"fmt"
+	"io"
 	"net"
 	"strconv"
 	"sync"
+
+	"github.com/haochen233/socks5/internal/parser"
 )
 
 // Address represents address in socks protocol
@@ -38,6 +41,42 @@ func (a *Address) String() string {
 	return net.JoinHostPort(a.Addr.String(), strconv.Itoa(int(a.Port)))
 }
 
+// ParseAddress parse address in the form "host:port" to Address.
+// The host may be an IPv4, IPv6 address or a domain name, an empty host
+// is parsed as IPv4 unspecified address 0.0.0.0.
+func ParseAddress(address string) (*Address, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid port %q", port)
+	}
+
+	addr := &Address{Port: uint16(p)}
+	ip := net.ParseIP(host)
+	if host == "" {
+		addr.ATYPE = IPV4_ADDRESS
+		addr.Addr = net.IPv4zero.To4()
+	} else if ip == nil {
+		addr.ATYPE = DOMAINNAME
+		addr.Addr = []byte(host)
+	} else if ip.To4() != nil {
+		addr.ATYPE = IPV4_ADDRESS
+		addr.Addr = ip.To4()
+	} else {
+		addr.ATYPE = IPV6_ADDRESS
+		addr.Addr = ip.To16()
+	}
+	return addr, nil
+}
+
+// Network return "socks5", so Address implements net.Addr.
+func (a *Address) Network() string {
+	return "socks5"
+}
+
 var errDoaminMaxLengthLimit = errors.New("domain name out of max length")
 
 // Bytes return bytes slice of Address by ver param.
@@ -62,8 +101,11 @@ var errDoaminMaxLengthLimit = errors.New("domain name out of max length")
 // Socks4 server should not call this method if server address type is DOMAINNAME
 func (a *Address) Bytes(ver VER) ([]byte, error) {
 	buf := bufPool.Get().(*bytes.Buffer)
-	defer buf.Reset()
-	defer bufPool.Put(buf)
+	// reset buf before another goroutine may get it from the pool.
+	defer func() {
+		buf.Reset()
+		bufPool.Put(buf)
+	}()
 
 	// port
 	port := make([]byte, 2)
@@ -74,13 +116,13 @@ func (a *Address) Bytes(ver VER) ([]byte, error) {
 		// socks4a
 		buf.Write(port)
 		if a.ATYPE == DOMAINNAME {
-			buf.Write(net.IPv4(0, 0, 0, 1))
+			buf.Write(net.IPv4(0, 0, 0, 1).To4())
 			// NULL
 			buf.WriteByte(NULL)
 			// hostname
 			buf.Write(a.Addr)
 		} else if a.ATYPE == IPV4_ADDRESS {
-			buf.Write(a.Addr)
+			buf.Write(a.Addr.To4())
 		} else {
 			return nil, fmt.Errorf("socks4 unsupported address type: %#x", a.ATYPE)
 		}
@@ -88,18 +130,31 @@ func (a *Address) Bytes(ver VER) ([]byte, error) {
 	case Version5:
 		// address type
 		buf.WriteByte(a.ATYPE)
-		// domain name address type
-		if a.ATYPE == DOMAINNAME {
+		switch a.ATYPE {
+		case DOMAINNAME:
 			if len(a.Addr) > 255 {
 				return nil, errDoaminMaxLengthLimit
 			}
 			buf.WriteByte(byte(len(a.Addr)))
+			buf.Write(a.Addr)
+		case IPV4_ADDRESS:
+			buf.Write(a.Addr.To4())
+		default:
+			buf.Write(a.Addr.To16())
 		}
-		buf.Write(a.Addr)
 		buf.Write(port)
 	}
 
-	return buf.Bytes(), nil
+	// buf is reused once returned to the pool, return a copy.
+	return append([]byte(nil), buf.Bytes()...), nil
+}
+
+// remoteAddr return the remote address of r if it is a net.Conn.
+func remoteAddr(r io.Reader) net.Addr {
+	if conn, ok := r.(net.Conn); ok {
+		return conn.RemoteAddr()
+	}
+	return nil
 }
 
 // readAddress read address info from follows:
@@ -112,85 +167,28 @@ func (a *Address) Bytes(ver VER) ([]byte, error) {
 //    socks4 client's  request.
 //    socks4a server's  reply.
 //    socks4a client's  request
-func readAddress(r net.Conn, ver VER) (*Address, REP, error) {
-	addr := &Address{}
-
+func readAddress(r io.Reader, ver VER) (*Address, REP, error) {
+	var (
+		addr *parser.Address
+		err  error
+	)
 	switch ver {
 	case Version4:
-		// DST.PORT
-		port, err := ReadNBytes(r, 2)
-		if err != nil {
-			return nil, GENERAL_SOCKS_SERVER_FAILURE, &OpError{Version5, "read", nil, "client dest port", err}
-		}
-		addr.Port = binary.BigEndian.Uint16(port)
-		// DST.IP
-		ip, err := ReadNBytes(r, 4)
-		if err != nil {
-			return nil, GENERAL_SOCKS_SERVER_FAILURE, &OpError{Version4, "read", r.RemoteAddr(), "\"process request dest ip\"", err}
-		}
-
-		//Discard later bytes until read EOF
-		//Please see socks4 request format at(http://ftp.icm.edu.pl/packages/socks/socks4/SOCKS4.protocol)
-		_, err = ReadUntilNULL(r)
-		if err != nil {
-			return nil, GENERAL_SOCKS_SERVER_FAILURE, &OpError{Version4, "read", r.RemoteAddr(), "\"process request useless header \"", err}
-		}
-
-		//Socks4a extension
-		//    +----+----+----+----+----+----+----+----+----+----++----++-----+-----++----+
-		//    | VN | CD | DSTPORT |      DSTIP        | USERID   |NULL|  HOSTNAME   |NULL|
-		//    +----+----+----+----+----+----+----+----+----+----++----++-----+-----++----+
-		//       1    1      2              4           variable    1    variable    1
-		//The client sets the first three bytes of DSTIP to NULL and
-		//the last byte to non-zero. The corresponding IP address is
-		//0.0.0.x, where x is non-zero
-		if ip[0] == 0 && ip[1] == 0 && ip[2] == 0 &&
-			ip[3] != 0 {
-			ip, err = ReadUntilNULL(r)
-			if err != nil {
-				return nil, GENERAL_SOCKS_SERVER_FAILURE, &OpError{Version4, "read", r.RemoteAddr(), "\"process socks4a extension request\"", err}
-			}
-			addr.ATYPE = DOMAINNAME
-		}
-		addr.Addr = ip
-	case Version5:
-		// ATYP
-		aType, err := ReadNBytes(r, 1)
+		var req *parser.Socks4Request
+		req, err = parser.ReadSocks4Request(r)
 		if err != nil {
-			return nil, GENERAL_SOCKS_SERVER_FAILURE, &OpError{Version5, "read", nil, "dest address type", err}
+			return nil, GENERAL_SOCKS_SERVER_FAILURE, &OpError{Version4, "read", remoteAddr(r), "\"process request dest address\"", err}
 		}
-		addr.ATYPE = aType[0]
-
-		var addrLen int
-		switch addr.ATYPE {
-		case IPV4_ADDRESS:
-			addrLen = 4
-		case IPV6_ADDRESS:
-			addrLen = 16
-		case DOMAINNAME:
-			fqdnLength, err := ReadNBytes(r, 1)
-			if err != nil {
-				return nil, GENERAL_SOCKS_SERVER_FAILURE, &OpError{Version5, "read", nil, "\"dest domain name length\"", err}
-			}
-			addrLen = int(fqdnLength[0])
-		default:
-			return nil, ADDRESS_TYPE_NOT_SUPPORTED, &OpError{Version5, "", nil, "\"dest address\"", &AtypeError{aType[0]}}
+		addr = req.Address
+	default:
+		addr, err = parser.ReadAddress(r)
+		var atype *parser.AddressTypeError
+		if errors.As(err, &atype) {
+			return nil, ADDRESS_TYPE_NOT_SUPPORTED, &OpError{Version5, "", remoteAddr(r), "\"dest address\"", &AtypeError{atype.Type}}
 		}
-
-		// DST.ADDR
-		ip, err := ReadNBytes(r, addrLen)
 		if err != nil {
-			return nil, GENERAL_SOCKS_SERVER_FAILURE, err
+			return nil, GENERAL_SOCKS_SERVER_FAILURE, &OpError{Version5, "read", remoteAddr(r), "\"dest address\"", err}
 		}
-		addr.Addr = ip
-
-		// DST.PORT
-		port, err := ReadNBytes(r, 2)
-		if err != nil {
-			return nil, GENERAL_SOCKS_SERVER_FAILURE, &OpError{Version5, "read", nil, "client dest port", err}
-		}
-		addr.Port = binary.BigEndian.Uint16(port)
 	}
-
-	return addr, SUCCESSED, nil
+	return &Address{net.IP(addr.Host), addr.Type, addr.Port}, SUCCESSED, nil
 }
@@ -1,6 +1,7 @@
 package socks5
 
 import (
+	"bytes"
 	"net"
 	"testing"
 )
@@ -56,3 +57,51 @@ func TestAddress_String(t *testing.T) {
 		}
 	}
 }
+
+func TestParseAddress(t *testing.T) {
+	for _, a := range addressTests {
+		addr, err := ParseAddress(a.String)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if addr.ATYPE != a.ATYPE || !bytes.Equal(addr.Addr, a.Addr) || addr.Port != a.Port {
+			t.Errorf("parse %s: get %+v, want %+v", a.String, addr, a.Address)
+		}
+	}
+
+	for _, bad := range []string{"localhost", "127.0.0.1:65536", "127.0.0.1:http"} {
+		if _, err := ParseAddress(bad); err == nil {
+			t.Errorf("parse %s: want error", bad)
+		}
+	}
+}
+
+func TestAddress_Bytes(t *testing.T) {
+	tests := []struct {
+		*Address
+		ver   VER
+		Bytes []byte
+	}{
+		{&Address{net.IPv4(127, 0, 0, 1), IPV4_ADDRESS, 1080}, Version5, []byte{0x01, 127, 0, 0, 1, 0x04, 0x38}},
+		{&Address{net.IPv4zero, IPV4_ADDRESS, 0}, Version5, []byte{0x01, 0, 0, 0, 0, 0, 0}},
+		{&Address{net.IPv6loopback, IPV6_ADDRESS, 1080}, Version5, []byte{0x04, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1, 0x04, 0x38}},
+		{&Address{[]byte("localhost"), DOMAINNAME, 1080}, Version5, append(append([]byte{0x03, 9}, "localhost"...), 0x04, 0x38)},
+		{&Address{net.IPv4(127, 0, 0, 1), IPV4_ADDRESS, 1080}, Version4, []byte{0x04, 0x38, 127, 0, 0, 1, 0}},
+		{&Address{[]byte("localhost"), DOMAINNAME, 1080}, Version4, append(append([]byte{0x04, 0x38, 0, 0, 0, 1, 0}, "localhost"...), 0)},
+	}
+
+	var got [][]byte
+	for _, test := range tests {
+		b, err := test.Address.Bytes(test.ver)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, b)
+	}
+	// results must not share memory
+	for i, test := range tests {
+		if !bytes.Equal(got[i], test.Bytes) {
+			t.Errorf("%s: get %v, want %v", test.Address, got[i], test.Bytes)
+		}
+	}
+}
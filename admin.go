@@ -0,0 +1,160 @@
+package socks5
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Admin is an http.Handler serving an API to operate a server while it
+// runs. Mount it under a prefix with http.StripPrefix, on an internal
+// listener: it does not authenticate requests, wrap it to do so.
+//
+//	http.Handle("/admin/", http.StripPrefix("/admin", &socks5.Admin{Server: srv}))
+//
+// It serves
+//
+//	PUT    /users/{name}     set the password of a user, {"password": "..."}
+//	DELETE /users/{name}     remove a user and close its sessions
+//	GET    /sessions         list the active sessions
+//	DELETE /sessions/{id}    close a session
+//	GET    /counters         the counters of the sessions
+//
+// Unknown users and sessions are replied 404 Not Found, failures of the
+// store 500 Internal Server Error.
+//
+// Sessions and counters are detailed with their user, command,
+// destination and route if the server has Stats, otherwise sessions are
+// listed with their client, bytes and tags only.
+type Admin struct {
+	Server *Server
+
+	// Store is the store of the users managed by the API. If nil, it is
+	// Server.Store.
+	Store UserPwdStore
+}
+
+// AdminCounters are the counters served by Admin.
+type AdminCounters struct {
+	// Active is the number of sessions being served.
+	Active int `json:"active"`
+	// Stats are the counters of Server.Stats, nil without it.
+	Stats *StatsSnapshot `json:"stats,omitempty"`
+}
+
+var errNoStore = errors.New("no Username/Password store")
+
+// store return the store of the users managed by a.
+func (a *Admin) store() UserPwdStore {
+	if a.Store != nil {
+		return a.Store
+	}
+	return a.Server.Store()
+}
+
+// ServeHTTP serve the API.
+func (a *Admin) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	path := strings.Trim(r.URL.Path, "/")
+	resource, name := path, ""
+	if i := strings.IndexByte(path, '/'); i >= 0 {
+		resource, name = path[:i], path[i+1:]
+	}
+	switch {
+	case resource == "users" && name != "":
+		a.serveUser(w, r, name)
+	case resource == "sessions" && name == "":
+		if allowMethods(w, r, http.MethodGet) {
+			writeJSON(w, a.Server.SessionStats())
+		}
+	case resource == "sessions":
+		a.serveSession(w, r, name)
+	case resource == "counters" && name == "":
+		if allowMethods(w, r, http.MethodGet) {
+			writeJSON(w, a.counters())
+		}
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (a *Admin) serveUser(w http.ResponseWriter, r *http.Request, name string) {
+	store := a.store()
+	if store == nil {
+		http.Error(w, errNoStore.Error(), http.StatusNotImplemented)
+		return
+	}
+	var err error
+	switch r.Method {
+	case http.MethodPut:
+		var body struct {
+			Password string `json:"password"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.Password == "" {
+			http.Error(w, "invalid password", http.StatusBadRequest)
+			return
+		}
+		err = store.Set(name, body.Password)
+	case http.MethodDelete:
+		if err = store.Del(name); err == nil {
+			a.Server.CloseSessionsFor(name)
+		}
+	default:
+		allowMethods(w, r, http.MethodPut, http.MethodDelete)
+		return
+	}
+	var notExist UserNotExist
+	if errors.As(err, &notExist) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (a *Admin) serveSession(w http.ResponseWriter, r *http.Request, name string) {
+	id, err := strconv.ParseUint(name, 10, 64)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	if !allowMethods(w, r, http.MethodDelete) {
+		return
+	}
+	if !a.Server.CloseSession(id) {
+		http.NotFound(w, r)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (a *Admin) counters() AdminCounters {
+	c := AdminCounters{Active: len(a.Server.Sessions())}
+	if stats := a.Server.Stats; stats != nil {
+		snap := stats.Snapshot()
+		c.Stats = &snap
+	}
+	return c
+}
+
+// allowMethods report whether the method of r is one of methods,
+// replying 405 Method Not Allowed otherwise.
+func allowMethods(w http.ResponseWriter, r *http.Request, methods ...string) bool {
+	for _, m := range methods {
+		if r.Method == m {
+			return true
+		}
+	}
+	w.Header().Set("Allow", strings.Join(methods, ", "))
+	http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	return false
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,107 @@
+package socks5
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAdmin(t *testing.T) {
+	stats := &ConnStats{}
+	srv := &Server{
+		Authenticators: map[METHOD]Authenticator{USERNAME_PASSWORD: UserPwdAuth{NewMemeryStore(sha256.New(), "")}},
+		MethodPriority: []METHOD{USERNAME_PASSWORD},
+		Stats:          stats,
+		ErrorLog:       log.New(io.Discard, "", 0),
+	}
+	addr := serveTest(t, srv)
+	echo := echoTest(t)
+	admin := httptest.NewServer(http.StripPrefix("/admin", &Admin{Server: srv}))
+	defer admin.Close()
+	do := func(method, path, body string) *http.Response {
+		req, _ := http.NewRequest(method, admin.URL+"/admin"+path, strings.NewReader(body))
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { resp.Body.Close() })
+		return resp
+	}
+
+	if resp := do("PUT", "/users/carol", `{"password": "c"}`); resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("add user: %s", resp.Status)
+	}
+	conn, err := (&Client{ProxyAddr: addr, Username: "carol", Password: "c"}).Dial("tcp", echo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.Write([]byte("ping"))
+	ReadNBytes(conn, 4)
+
+	var sessions []ConnStat
+	if err := json.NewDecoder(do("GET", "/sessions", "").Body).Decode(&sessions); err != nil {
+		t.Fatal(err)
+	}
+	if len(sessions) != 1 || sessions[0].Username != "carol" || sessions[0].Dest != echo {
+		t.Fatalf("sessions %+v", sessions)
+	}
+	id := strconv.FormatUint(sessions[0].ID, 10)
+	if resp := do("DELETE", "/sessions/"+id, ""); resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("kill session: %s", resp.Status)
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("killed session read: %v", err)
+	}
+	if resp := do("DELETE", "/sessions/"+id, ""); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("kill closed session: %s", resp.Status)
+	}
+
+	var counters AdminCounters
+	deadline := time.Now().Add(5 * time.Second)
+	for counters.Stats == nil || len(counters.Stats.Recent) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("counters %+v", counters)
+		}
+		time.Sleep(10 * time.Millisecond)
+		json.NewDecoder(do("GET", "/counters", "").Body).Decode(&counters)
+	}
+	if counters.Active != 0 || counters.Stats.Recent[0].CloseReason != CloseKilled || counters.Stats.Users["carol"].BytesUp != 4 {
+		t.Errorf("counters %+v", counters)
+	}
+
+	if resp := do("DELETE", "/users/carol", ""); resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("remove user: %s", resp.Status)
+	}
+	if _, err := (&Client{ProxyAddr: addr, Username: "carol", Password: "c"}).Dial("tcp", echo); err == nil {
+		t.Error("removed user authenticated")
+	}
+	if resp := do("DELETE", "/users/carol", ""); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("remove unknown user: %s", resp.Status)
+	}
+	srv.SetStore(failingStore{})
+	if resp := do("DELETE", "/users/carol", ""); resp.StatusCode != http.StatusInternalServerError {
+		t.Errorf("remove user of a failing store: %s", resp.Status)
+	}
+	if resp := do("POST", "/sessions", ""); resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("POST sessions: %s", resp.Status)
+	}
+}
+
+// failingStore is an UserPwdStore whose backend is down.
+type failingStore struct{}
+
+var errStoreDown = errors.New("store down")
+
+func (failingStore) Set(username, password string) error      { return errStoreDown }
+func (failingStore) Del(username string) error                { return errStoreDown }
+func (failingStore) Validate(username, password string) error { return errStoreDown }
@@ -0,0 +1,169 @@
+package socks5
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// AuthEvent is an authentication attempt, the sub-negotiation of the
+// method selected for a client.
+type AuthEvent struct {
+	Time      time.Time `json:"time"`
+	SessionID uint64    `json:"session_id"`
+	ClientIP  net.IP    `json:"client_ip"`
+	// Username is the user name the client authenticated, or failed to
+	// authenticate, as. It is empty for methods without user names.
+	Username string `json:"username,omitempty"`
+	Method   string `json:"method"`
+	Success  bool   `json:"success"`
+	// Error is why the attempt failed.
+	Error string `json:"error,omitempty"`
+	// Latency is the time the sub-negotiation took.
+	Latency time.Duration `json:"latency"`
+}
+
+// AuthAuditor records the authentication attempts of a server for
+// security investigations, see Server.AuthAuditor and AuthLog. It is
+// called on the goroutines of sessions, concurrently.
+type AuthAuditor interface {
+	AuditAuth(e AuthEvent)
+}
+
+// AuthAuditorFunc is an adapter to allow the use of ordinary functions
+// as AuthAuditor.
+type AuthAuditorFunc func(e AuthEvent)
+
+// AuditAuth calls f(e).
+func (f AuthAuditorFunc) AuditAuth(e AuthEvent) {
+	f(e)
+}
+
+// auditAuth record the attempt of s to authenticate with m, which took
+// latency and failed with err if not nil.
+func (srv *Server) auditAuth(s *Session, m METHOD, latency time.Duration, err error) {
+	if srv.AuthAuditor == nil {
+		return
+	}
+	e := AuthEvent{
+		Time:      time.Now(),
+		SessionID: s.ID,
+		ClientIP:  s.ClientIP(),
+		Username:  s.Username,
+		Method:    methodString(m),
+		Success:   err == nil,
+		Latency:   latency,
+	}
+	if err != nil {
+		e.Username = s.authUser
+		e.Error = err.Error()
+	}
+	srv.AuthAuditor.AuditAuth(e)
+}
+
+// AuthLog is an AuthAuditor keeping the last authentication attempts in
+// memory, to query them. It is an http.Handler serving Query as JSON,
+// with the parameters user, ip, failed, since (RFC 3339) and limit:
+//
+//	audit := &socks5.AuthLog{}
+//	srv := &socks5.Server{AuthAuditor: audit}
+//	http.Handle("/debug/socks5/auth", audit)
+//
+// Several servers may share an AuthLog.
+type AuthLog struct {
+	// Size is the number of attempts kept, zero means 1000.
+	Size int
+
+	mu     sync.Mutex
+	events []AuthEvent
+	next   int
+}
+
+// AuthQuery selects authentication attempts of an AuthLog, its zero
+// value selects all of them.
+type AuthQuery struct {
+	// Username selects the attempts of a user name.
+	Username string
+	// ClientIP selects the attempts of a client IP address.
+	ClientIP net.IP
+	// Failed selects the failed attempts only.
+	Failed bool
+	// Since selects the attempts from then on.
+	Since time.Time
+	// Limit caps the number of attempts returned to the latest ones,
+	// zero means no limit.
+	Limit int
+}
+
+// AuditAuth implements AuthAuditor.
+func (l *AuthLog) AuditAuth(e AuthEvent) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	n := l.Size
+	if n <= 0 {
+		n = 1000
+	}
+	if len(l.events) < n {
+		l.events = append(l.events, e)
+		return
+	}
+	l.events[l.next] = e
+	l.next = (l.next + 1) % len(l.events)
+}
+
+// Query return the kept attempts selected by q, oldest first.
+func (l *AuthLog) Query(q AuthQuery) []AuthEvent {
+	l.mu.Lock()
+	ordered := make([]AuthEvent, 0, len(l.events))
+	ordered = append(ordered, l.events[l.next:]...)
+	ordered = append(ordered, l.events[:l.next]...)
+	l.mu.Unlock()
+
+	events := make([]AuthEvent, 0, len(ordered))
+	for _, e := range ordered {
+		if q.Username != "" && e.Username != q.Username ||
+			q.ClientIP != nil && !q.ClientIP.Equal(e.ClientIP) ||
+			q.Failed && e.Success ||
+			e.Time.Before(q.Since) {
+			continue
+		}
+		events = append(events, e)
+	}
+	if q.Limit > 0 && len(events) > q.Limit {
+		events = events[len(events)-q.Limit:]
+	}
+	return events
+}
+
+// ServeHTTP write the attempts selected by the query of r as JSON.
+func (l *AuthLog) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	v := r.URL.Query()
+	q := AuthQuery{Username: v.Get("user"), Failed: v.Get("failed") == "true"}
+	if ip := v.Get("ip"); ip != "" {
+		if q.ClientIP = net.ParseIP(ip); q.ClientIP == nil {
+			http.Error(w, "invalid ip", http.StatusBadRequest)
+			return
+		}
+	}
+	if since := v.Get("since"); since != "" {
+		t, err := time.Parse(time.RFC3339, since)
+		if err != nil {
+			http.Error(w, "invalid since", http.StatusBadRequest)
+			return
+		}
+		q.Since = t
+	}
+	if limit := v.Get("limit"); limit != "" {
+		n, err := strconv.Atoi(limit)
+		if err != nil || n < 0 {
+			http.Error(w, "invalid limit", http.StatusBadRequest)
+			return
+		}
+		q.Limit = n
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(l.Query(q))
+}
@@ -0,0 +1,68 @@
+package socks5
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"net"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestAuthLog(t *testing.T) {
+	store := NewMemeryStore(sha256.New(), "")
+	store.Set("alice", "a")
+	audit := &AuthLog{Size: 2}
+	srv := &Server{
+		Authenticators: map[METHOD]Authenticator{USERNAME_PASSWORD: UserPwdAuth{store}},
+		MethodPriority: []METHOD{USERNAME_PASSWORD},
+		AuthAuditor:    audit,
+	}
+	addr := serveTest(t, srv)
+	echo := echoTest(t)
+
+	for _, c := range []*Client{
+		{ProxyAddr: addr, Username: "mallory", Password: "x"},
+		{ProxyAddr: addr, Username: "bob", Password: "b"},
+		{ProxyAddr: addr, Username: "alice", Password: "a"},
+	} {
+		if conn, err := c.Dial("tcp", echo); err == nil {
+			conn.Close()
+		}
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for len(audit.Query(AuthQuery{})) < 2 || audit.Query(AuthQuery{Limit: 1})[0].Username != "alice" {
+		if time.Now().After(deadline) {
+			t.Fatalf("events %+v", audit.Query(AuthQuery{}))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// the first attempt was evicted.
+	events := audit.Query(AuthQuery{})
+	bob, alice := events[0], events[1]
+	if bob.Username != "bob" || bob.Success || bob.Error == "" || bob.Method != "USERNAME_PASSWORD" || !bob.ClientIP.Equal(net.IPv4(127, 0, 0, 1)) {
+		t.Errorf("failed attempt %+v", bob)
+	}
+	if alice.Username != "alice" || !alice.Success || alice.Error != "" || alice.Latency <= 0 {
+		t.Errorf("successful attempt %+v", alice)
+	}
+	if failed := audit.Query(AuthQuery{Failed: true}); len(failed) != 1 || failed[0].Username != "bob" {
+		t.Errorf("failed attempts %+v", failed)
+	}
+	if none := audit.Query(AuthQuery{ClientIP: net.IPv4(192, 0, 2, 1)}); len(none) != 0 {
+		t.Errorf("attempts of another IP %+v", none)
+	}
+
+	w := httptest.NewRecorder()
+	audit.ServeHTTP(w, httptest.NewRequest("GET", "/?user=alice&ip=127.0.0.1", nil))
+	var served []AuthEvent
+	if err := json.Unmarshal(w.Body.Bytes(), &served); err != nil || len(served) != 1 || served[0].Username != "alice" {
+		t.Errorf("served %s, %v", w.Body.String(), err)
+	}
+	w = httptest.NewRecorder()
+	audit.ServeHTTP(w, httptest.NewRequest("GET", "/?since=yesterday", nil))
+	if w.Code != 400 {
+		t.Errorf("invalid since: status %d", w.Code)
+	}
+}
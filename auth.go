@@ -1,11 +1,14 @@
 package socks5
 
 import (
-	"bytes"
+	"context"
 	"fmt"
 	"hash"
 	"io"
+	"net"
 	"sync"
+
+	"github.com/haochen233/socks5/internal/parser"
 )
 
 // Authenticator provides socks server's authentication.
@@ -13,6 +16,23 @@ type Authenticator interface {
 	Authenticate(in io.Reader, out io.Writer) error
 }
 
+// SessionAuthenticator is implemented by Authenticators that need the
+// session being authenticated, such as to record the authenticated user.
+// The server prefers AuthenticateSession to Authenticate if implemented.
+type SessionAuthenticator interface {
+	AuthenticateSession(s *Session, in io.Reader, out io.Writer) error
+}
+
+// ContextAuthenticator is implemented by Authenticators doing I/O which
+// should stop when the session ends, such as querying a remote user
+// store. ctx is the context of the session, done when the session is
+// closed or the server context is cancelled. The server prefers
+// AuthenticateContext to Authenticate if implemented, and
+// AuthenticateSession to both.
+type ContextAuthenticator interface {
+	AuthenticateContext(ctx context.Context, in io.Reader, out io.Writer) error
+}
+
 // NoAuth NO_AUTHENTICATION_REQUIRED implementation.
 type NoAuth struct {
 }
@@ -41,31 +61,124 @@ type UserPwdAuth struct {
 
 // Authenticate is Username/Password authentication method.
 func (u UserPwdAuth) Authenticate(in io.Reader, out io.Writer) error {
-	uname, passwd, err := u.ReadUserPwd(in)
+	_, err := u.authenticate(context.Background(), in, out)
+	return err
+}
+
+// AuthenticateContext is Username/Password authentication method, the
+// store validates the credentials with ctx if it is a ContextUserPwdStore.
+func (u UserPwdAuth) AuthenticateContext(ctx context.Context, in io.Reader, out io.Writer) error {
+	_, err := u.authenticate(ctx, in, out)
+	return err
+}
+
+// AuthenticateSession is Username/Password authentication method,
+// on success the user name is recorded in s, on failure the audit trail
+// of the server records it.
+func (u UserPwdAuth) AuthenticateSession(s *Session, in io.Reader, out io.Writer) error {
+	uname, err := u.authenticate(s.Context(), in, out)
 	if err != nil {
+		s.authUser = uname
 		return err
 	}
+	s.Username = uname
+	s.Set(MetaUser, uname)
+	return nil
+}
+
+// authenticate run the Username/Password sub-negotiation and return the
+// authenticated user name.
+func (u UserPwdAuth) authenticate(ctx context.Context, in io.Reader, out io.Writer) (string, error) {
+	return negotiateUserPwd(in, out, func(uname, passwd string) error {
+		if err := checkUser(ctx, uname); err != nil {
+			return err
+		}
+		if cs, ok := u.UserPwdStore.(ContextUserPwdStore); ok {
+			return cs.ValidateContext(ctx, uname, passwd)
+		}
+		return u.Validate(uname, passwd)
+	})
+}
+
+// userPassVersion is the version of the Username/Password sub-negotiation
+// (RFC 1929), in its requests and replies.
+const userPassVersion = 0x01
+
+// negotiateUserPwd run the Username/Password sub-negotiation, validating
+// the credentials with validate, and return the authenticated user name,
+// or the rejected one with the error of validate.
+func negotiateUserPwd(in io.Reader, out io.Writer, validate func(uname, passwd string) error) (string, error) {
+	req, err := parser.ReadUserPass(in)
+	if err != nil {
+		return "", err
+	}
 
-	err = u.Validate(string(uname), string(passwd))
+	err = validate(string(req.Username), string(req.Password))
 	if err != nil {
-		reply := []byte{Version5, 1}
+		reply := []byte{userPassVersion, 1}
 		_, err1 := out.Write(reply)
 		if err1 != nil {
-			return err
+			return string(req.Username), err
 		}
-		return err
+		return string(req.Username), err
 	}
 
 	//authentication successful,then send reply to client
-	reply := []byte{Version5, 0}
+	reply := []byte{userPassVersion, 0}
 	_, err = out.Write(reply)
 	if err != nil {
-		return err
+		return "", err
 	}
 
+	return string(req.Username), nil
+}
+
+// FuncAuth is a Username/Password Authenticator validating credentials
+// with a function, such as against LDAP, OAuth token introspection or an
+// internal service, without a UserPwdStore. The function returns nil to
+// accept the credentials. ctx is the context of the session and
+// clientAddr the address of the client, nil if the server did not give
+// the session, such as when Authenticate is called directly.
+type FuncAuth func(ctx context.Context, username, password string, clientAddr net.Addr) error
+
+// Authenticate is Username/Password authentication method.
+func (f FuncAuth) Authenticate(in io.Reader, out io.Writer) error {
+	return f.AuthenticateContext(context.Background(), in, out)
+}
+
+// AuthenticateContext is Username/Password authentication method.
+func (f FuncAuth) AuthenticateContext(ctx context.Context, in io.Reader, out io.Writer) error {
+	_, err := f.authenticate(ctx, in, out)
+	return err
+}
+
+// AuthenticateSession is Username/Password authentication method,
+// on success the user name is recorded in s, on failure the audit trail
+// of the server records it.
+func (f FuncAuth) AuthenticateSession(s *Session, in io.Reader, out io.Writer) error {
+	uname, err := f.authenticate(s.Context(), in, out)
+	if err != nil {
+		s.authUser = uname
+		return err
+	}
+	s.Username = uname
+	s.Set(MetaUser, uname)
 	return nil
 }
 
+func (f FuncAuth) authenticate(ctx context.Context, in io.Reader, out io.Writer) (string, error) {
+	var clientAddr net.Addr
+	if s := SessionFromContext(ctx); s != nil {
+		clientAddr = s.ClientAddr
+	}
+	return negotiateUserPwd(in, out, func(uname, passwd string) error {
+		if err := checkUser(ctx, uname); err != nil {
+			return err
+		}
+		return f(ctx, uname, passwd, clientAddr)
+	})
+}
+
 // ReadUserPwd read Username/Password request from client
 // return username and password.
 // Username/Password request format is as follows:
@@ -76,29 +189,11 @@ func (u UserPwdAuth) Authenticate(in io.Reader, out io.Writer) error {
 //    +----+------+----------+------+----------+
 // For standard details, please see (https://www.rfc-editor.org/rfc/rfc1929.html)
 func (u UserPwdAuth) ReadUserPwd(in io.Reader) ([]byte, []byte, error) {
-
-	ulen, err := ReadNBytes(in, 2)
-	if err != nil {
-		return nil, nil, err
-	}
-
-	uname, err := ReadNBytes(in, int(ulen[1]))
-	if err != nil {
-		return nil, nil, err
-	}
-
-	plen, err := ReadNBytes(in, 1)
+	req, err := parser.ReadUserPass(in)
 	if err != nil {
 		return nil, nil, err
 	}
-
-	passwd := make([]byte, plen[0])
-	passwd, err = ReadNBytes(in, int(plen[0]))
-	if err != nil {
-		return nil, nil, err
-	}
-
-	return uname, passwd, nil
+	return req.Username, req.Password, nil
 }
 
 // UserPwdStore provide username and password storage.
@@ -108,6 +203,14 @@ type UserPwdStore interface {
 	Validate(username string, password string) error
 }
 
+// ContextUserPwdStore is implemented by stores doing I/O to validate
+// credentials, such as remote databases. UserPwdAuth prefers
+// ValidateContext to Validate, with the context of the session.
+type ContextUserPwdStore interface {
+	UserPwdStore
+	ValidateContext(ctx context.Context, username string, password string) error
+}
+
 // MemoryStore store username&password in memory.
 // the password is encrypt with hash method.
 type MemoryStore struct {
@@ -115,6 +218,13 @@ type MemoryStore struct {
 	mu    sync.Mutex
 	hash.Hash
 	algoSecret string
+
+	// Hasher hashes the passwords if not nil, instead of Hash and the
+	// secret. See NewHashedMemoryStore. It must not change once the store
+	// is in use.
+	Hasher PasswordHasher
+	// dummy is compared for unknown users.
+	dummy dummyHash
 }
 
 // NewMemeryStore return a new MemoryStore
@@ -126,23 +236,52 @@ func NewMemeryStore(algo hash.Hash, secret string) *MemoryStore {
 	}
 }
 
+// NewHashedMemoryStore return a new MemoryStore hashing passwords with
+// hasher.
+func NewHashedMemoryStore(hasher PasswordHasher) *MemoryStore {
+	return &MemoryStore{
+		Users:  make(map[string][]byte),
+		Hasher: hasher,
+	}
+}
+
 // Set the mapping of username and password.
 func (m *MemoryStore) Set(username string, password string) error {
+	if m.Hasher != nil {
+		// hash outside the lock, slow hashers would serialize Validate.
+		hashed, err := m.Hasher.Hash(password)
+		if err != nil {
+			return err
+		}
+		m.mu.Lock()
+		m.Users[username] = []byte(hashed)
+		m.mu.Unlock()
+		return nil
+	}
 	m.mu.Lock()
 	defer m.mu.Unlock()
-	build := bytes.NewBuffer(nil)
-	build.WriteString(password + m.algoSecret)
-	cryptPasswd := m.Hash.Sum(build.Bytes())
-	m.Users[username] = cryptPasswd
+	hashed, _ := m.legacy().Hash(password)
+	m.Users[username] = []byte(hashed)
 	return nil
 }
 
+// legacy return the hasher of stores without Hasher.
+func (m *MemoryStore) legacy() LegacyHasher {
+	return LegacyHasher{m.Hash, m.algoSecret}
+}
+
 // UserNotExist the error type used in UserPwdStore.Del() method and
 // UserPwdStore.Validate method.
 type UserNotExist struct {
 	username string
 }
 
+// NewUserNotExist return the UserNotExist error of username, for the
+// stores of other packages.
+func NewUserNotExist(username string) UserNotExist {
+	return UserNotExist{username: username}
+}
+
 func (u UserNotExist) Error() string {
 	return fmt.Sprintf("user %s don't exist", u.username)
 }
@@ -161,16 +300,27 @@ func (m *MemoryStore) Del(username string) error {
 
 // Validate validate username and password.
 func (m *MemoryStore) Validate(username string, password string) error {
+	if m.Hasher != nil {
+		m.mu.Lock()
+		hashed, ok := m.Users[username]
+		m.mu.Unlock()
+		if !ok {
+			m.dummy.compare(m.Hasher, password)
+			return UserNotExist{username: username}
+		}
+		err := m.Hasher.Compare(string(hashed), password)
+		if err == ErrPasswordMismatch {
+			return fmt.Errorf("user %s has bad password", username)
+		}
+		return err
+	}
 	m.mu.Lock()
 	defer m.mu.Unlock()
 	if _, ok := m.Users[username]; !ok {
 		return UserNotExist{username: username}
 	}
 
-	build := bytes.NewBuffer(nil)
-	build.WriteString(password + m.algoSecret)
-	cryptPasswd := m.Hash.Sum(build.Bytes())
-	if !bytes.Equal(cryptPasswd, m.Users[username]) {
+	if m.legacy().Compare(string(m.Users[username]), password) != nil {
 		return fmt.Errorf("user %s has bad password", username)
 	}
 	return nil
@@ -0,0 +1,60 @@
+package socks5
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"testing"
+)
+
+func TestFuncAuth(t *testing.T) {
+	type call struct {
+		user, password string
+		clientAddr     net.Addr
+		session        *Session
+	}
+	calls := make(chan call, 2)
+	auth := FuncAuth(func(ctx context.Context, username, password string, clientAddr net.Addr) error {
+		calls <- call{username, password, clientAddr, SessionFromContext(ctx)}
+		if password != "token" {
+			return errors.New("invalid token")
+		}
+		return nil
+	})
+	users := make(chan string, 1)
+	srv := &Server{
+		Authenticators: map[METHOD]Authenticator{USERNAME_PASSWORD: auth},
+		Rules: RuleSetFunc(func(s *Session, req *Request) bool {
+			users <- s.Username
+			return true
+		}),
+		ErrorLog: log.New(io.Discard, "", 0),
+	}
+	addr := serveTest(t, srv)
+	echo := echoTest(t)
+
+	client := &Client{ProxyAddr: addr, Username: "alice", Password: "token"}
+	conn, err := client.Dial("tcp", echo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	local := conn.LocalAddr().String()
+	conn.Close()
+	c := <-calls
+	if c.user != "alice" || c.password != "token" || c.session == nil {
+		t.Errorf("call %+v", c)
+	}
+	if c.clientAddr == nil || c.clientAddr.String() != local {
+		t.Errorf("client address %v, want %s", c.clientAddr, local)
+	}
+	if user := <-users; user != "alice" {
+		t.Errorf("session user %q", user)
+	}
+
+	client.Password = "wrong"
+	if _, err := client.Dial("tcp", echo); !errors.Is(err, errAuthFailed) {
+		t.Errorf("wrong token: %v", err)
+	}
+}
@@ -0,0 +1,115 @@
+package socks5
+
+import (
+	"errors"
+	"net"
+	"time"
+)
+
+// errBindDenied is returned when Server.AllowBind denies a request.
+var errBindDenied = errors.New("bind denied")
+
+// bind serve the BIND request req: listen for the peer, reply the
+// address listened on, accept the connection of the peer and reply its
+// address. The returned connection of the peer is relayed as CONNECT.
+func (srv *Server) bind(s *Session, client net.Conn, req *Request) (net.Conn, error) {
+	const step = "\"process request bind\""
+	if srv.AllowBind != nil && !srv.AllowBind(s, req.Address) {
+		return nil, srv.refuse(client, req, CONNECTION_NOT_ALLOW_BY_RULESET, step, errBindDenied)
+	}
+	ln, err := srv.listenTCP(s, srv.relayIP(client))
+	if err != nil {
+		return nil, srv.refuse(client, req, GENERAL_SOCKS_SERVER_FAILURE, step, err)
+	}
+	defer ln.Close()
+
+	bnd := ln.Addr().(*net.TCPAddr)
+	err = srv.bindReply(client, req, srv.relayAddress(client, &net.UDPAddr{IP: bnd.IP, Port: bnd.Port}))
+	if err != nil {
+		return nil, &OpError{req.VER, "write", client.RemoteAddr(), step, err}
+	}
+
+	peer, err := srv.acceptPeer(s, ln, req.Address)
+	if err != nil {
+		_, rep := ClassifyDialError(err)
+		return nil, srv.refuse(client, req, rep, step, err)
+	}
+	addr, err := ParseAddress(peer.RemoteAddr().String())
+	if err == nil {
+		err = srv.bindReply(client, req, addr)
+	}
+	if err != nil {
+		peer.Close()
+		return nil, &OpError{req.VER, "write", client.RemoteAddr(), step, err}
+	}
+	return peer, nil
+}
+
+// bindReply send a successful reply to the BIND request req with addr.
+func (srv *Server) bindReply(client net.Conn, req *Request, addr *Address) error {
+	reply := &Reply{VER: req.VER, REP: SUCCESSED, Address: addr}
+	if req.VER == Version4 {
+		reply.REP = PERMIT
+		if addr.ATYPE != IPV4_ADDRESS {
+			// socks4 clients take 0.0.0.0 as the address of the server.
+			reply.Address = &Address{net.IPv4zero.To4(), IPV4_ADDRESS, addr.Port}
+		}
+	}
+	return srv.sendReply(client, reply)
+}
+
+// acceptPeer accept the connection of the peer of a BIND request to dest
+// on ln, within BindTimeout or until the session ends. Connections from
+// other addresses than dest are closed, unless dest is unspecified.
+func (srv *Server) acceptPeer(s *Session, ln *net.TCPListener, dest *Address) (net.Conn, error) {
+	timeout := srv.BindTimeout
+	if timeout <= 0 {
+		timeout = 2 * time.Minute
+	}
+	ln.SetDeadline(time.Now().Add(timeout))
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-s.Context().Done():
+			ln.Close()
+		case <-stop:
+		}
+	}()
+
+	var expected []net.IP
+	switch {
+	case dest.ATYPE == DOMAINNAME:
+		ips, err := resolve(s.Context(), srv.resolver(), dest)
+		if err != nil {
+			return nil, err
+		}
+		expected = ips
+	case !dest.Addr.IsUnspecified():
+		expected = []net.IP{dest.Addr}
+	}
+	for {
+		conn, err := ln.AcceptTCP()
+		if err != nil {
+			return nil, err
+		}
+		if peerExpected(conn.RemoteAddr().(*net.TCPAddr).IP, expected) {
+			return conn, nil
+		}
+		conn.Close()
+	}
+}
+
+// peerExpected report whether ip is one of expected, any ip is expected
+// if expected is empty.
+func peerExpected(ip net.IP, expected []net.IP) bool {
+	if len(expected) == 0 {
+		return true
+	}
+	for _, e := range expected {
+		if e.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,84 @@
+package socks5
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestServer_Bind(t *testing.T) {
+	client := &Client{ProxyAddr: serveTest(t, &Server{})}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	b, err := client.Bind(ctx, "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+
+	peer, err := net.Dial("tcp", b.Addr.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer peer.Close()
+	conn, addr, err := b.Accept(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if addr.String() != peer.LocalAddr().String() {
+		t.Errorf("peer address %s, expected %s", addr, peer.LocalAddr())
+	}
+
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	peer.SetDeadline(time.Now().Add(5 * time.Second))
+	peer.Write([]byte("ping"))
+	if b, err := ReadNBytes(conn, 4); err != nil || string(b) != "ping" {
+		t.Errorf("from peer: %q, %v", b, err)
+	}
+	conn.Write([]byte("pong"))
+	if b, err := ReadNBytes(peer, 4); err != nil || string(b) != "pong" {
+		t.Errorf("to peer: %q, %v", b, err)
+	}
+}
+
+func TestServer_BindRestricted(t *testing.T) {
+	srv := &Server{
+		AllowBind: func(s *Session, dest *Address) bool {
+			return dest.Port != 21
+		},
+		BindTimeout: 200 * time.Millisecond,
+		ErrorLog:    log.New(io.Discard, "", 0),
+	}
+	client := &Client{ProxyAddr: serveTest(t, srv)}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var rep *REPError
+	if _, err := client.Bind(ctx, "127.0.0.1:21"); !errors.As(err, &rep) || rep.REP != CONNECTION_NOT_ALLOW_BY_RULESET {
+		t.Errorf("denied bind: %v", err)
+	}
+
+	// connections from another address than the expected peer are closed.
+	b, err := client.Bind(ctx, "192.0.2.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	stranger, err := net.Dial("tcp", b.Addr.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stranger.Close()
+	stranger.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := stranger.Read(make([]byte, 1)); err == nil {
+		t.Error("stranger connection not closed")
+	}
+	if _, _, err := b.Accept(ctx); !errors.As(err, &rep) || rep.REP != TTL_EXPIRED {
+		t.Errorf("bind timeout: %v", err)
+	}
+}
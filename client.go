@@ -1 +1,591 @@
 package socks5
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// Client is a socks5 client, it connects to destinations through the
+// socks server at ProxyAddr.
+// Client usage:
+//
+//	client := &socks5.Client{ProxyAddr: "127.0.0.1:1080"}
+//	conn, err := client.Dial("tcp", "example.com:80")
+type Client struct {
+	// ProxyAddr is the socks server address, in the form "host:port".
+	ProxyAddr string
+
+	// Protocol is the protocol spoken with the server.
+	// If empty, ProtocolSOCKS5 is used.
+	Protocol Protocol
+
+	// Fallback are the protocols tried in order when the server failed
+	// to handshake with Protocol, so that one configuration works with
+	// proxies speaking different protocols on the same endpoint. Refusals
+	// of the destination by the server are not retried with a fallback.
+	// Some servers wait for more data on unknown requests, set Timeout
+	// to fall back from them.
+	Fallback []Protocol
+
+	// Username and Password authenticate the client with the
+	// Username/Password method. If Username is empty, the client only
+	// offers NO_AUTHENTICATION_REQUIRED.
+	Username string
+	Password string
+
+	// Dialer connects to the socks server.
+	// If nil, a zero net.Dialer is used.
+	Dialer Dialer
+
+	// TLSConfig enables TLS to the socks server. ServerName overrides the
+	// SNI, which defaults to the host of ProxyAddr, and NextProtos sets
+	// ALPN. If ClientSessionCache is nil, a cache shared by the dials of
+	// the Client is used, so repeated dials resume TLS sessions.
+	TLSConfig *tls.Config
+
+	// WebSocketURL tunnels the connection to the socks server in a
+	// WebSocket connection to this URL, served by WebSocketHandler, such
+	// as "ws://proxy.example/socks". ProxyAddr is still the address
+	// dialed, wss URLs need TLSConfig. UDP associations are not tunneled.
+	WebSocketURL string
+
+	// RaceDelay enables racing connections to the addresses of the socks
+	// server host, such as anycast or multi-region deployments: a
+	// connection attempt is started every RaceDelay until one succeeds,
+	// the fastest connection is kept. Zero dials the addresses one after
+	// another.
+	RaceDelay time.Duration
+
+	// UDPKeepAlive is the TCP keep-alive period of the control connection
+	// of UDP associations, which keeps the association alive through idle
+	// timeouts of the server and middleboxes.
+	// If zero, 15 seconds is used. If negative, keep-alive is disabled.
+	UDPKeepAlive time.Duration
+
+	// Retries is the number of times the proxy handshake is retried
+	// after a transient failure, such as the proxy being unreachable or
+	// the connection dropping. Replies of the server, method and
+	// authentication failures are not retried.
+	Retries int
+
+	// RetryBackoff is the wait before the first retry, doubled after each
+	// retry up to RetryMaxBackoff. If zero, 100ms and 5s are used.
+	RetryBackoff    time.Duration
+	RetryMaxBackoff time.Duration
+
+	// Timeout limits each attempt to connect to the socks server and
+	// complete the handshake, for each protocol tried. Zero means no limit
+	// other than the context.
+	Timeout time.Duration
+
+	// LocalDNS resolves domain name destinations on the client and sends
+	// their IP address to the server, like the socks5:// scheme of curl.
+	// By default, names are sent to the server to resolve (socks5h://).
+	// Only IPv4 addresses are used with ProtocolSOCKS4 and the "tcp4" and
+	// "udp4" networks, only IPv6 addresses with "tcp6" and "udp6".
+	LocalDNS bool
+
+	// Resolver resolves the names of destinations when LocalDNS is set.
+	// If nil, net.DefaultResolver is used.
+	Resolver NameResolver
+
+	// Hooks are callbacks invoked on client events.
+	Hooks ClientHooks
+
+	tlsOnce   sync.Once
+	tlsConfig *tls.Config
+}
+
+var errUnsupportedNetwork = errors.New("unsupported network")
+
+// withCredentials return a copy of the configuration of c authenticating
+// with username and password.
+func (c *Client) withCredentials(username, password string) *Client {
+	clone := c.clone()
+	clone.Username, clone.Password = username, password
+	return clone
+}
+
+// clone return a copy of the configuration of c.
+func (c *Client) clone() *Client {
+	return &Client{
+		ProxyAddr:       c.ProxyAddr,
+		Protocol:        c.Protocol,
+		Fallback:        c.Fallback,
+		Username:        c.Username,
+		Password:        c.Password,
+		Dialer:          c.Dialer,
+		TLSConfig:       c.TLSConfig,
+		WebSocketURL:    c.WebSocketURL,
+		RaceDelay:       c.RaceDelay,
+		UDPKeepAlive:    c.UDPKeepAlive,
+		Retries:         c.Retries,
+		RetryBackoff:    c.RetryBackoff,
+		RetryMaxBackoff: c.RetryMaxBackoff,
+		Timeout:         c.Timeout,
+		LocalDNS:        c.LocalDNS,
+		Resolver:        c.Resolver,
+		Hooks:           c.Hooks,
+	}
+}
+
+// Dial connects to address through the socks server.
+// Network must be "tcp", "tcp4", "tcp6", "udp", "udp4" or "udp6".
+func (c *Client) Dial(network, address string) (net.Conn, error) {
+	return c.DialContext(context.Background(), network, address)
+}
+
+// DialContext connects to address through the socks server using ctx.
+// Network must be "tcp", "tcp4", "tcp6", "udp", "udp4" or "udp6".
+// UDP connections are relayed by an UDP association, see DialUDP.
+func (c *Client) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+	case "udp", "udp4", "udp6":
+		return c.dialUDP(ctx, network, address)
+	default:
+		return nil, &net.OpError{Op: "dial", Net: network, Err: errUnsupportedNetwork}
+	}
+	dest, err := c.destination(ctx, network, address)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, _, err := c.handshake(ctx, CONNECT, dest)
+	return conn, err
+}
+
+// destination parse address, and resolve its host if LocalDNS is set.
+// The address is picked among those of the host by the family of network
+// and by the protocol of c.
+func (c *Client) destination(ctx context.Context, network, address string) (*Address, error) {
+	dest, err := ParseAddress(address)
+	if err != nil || !c.LocalDNS || dest.ATYPE != DOMAINNAME {
+		return dest, err
+	}
+	host := string(dest.Addr)
+	var ips []net.IP
+	if c.Resolver != nil {
+		ips, err = c.Resolver.Resolve(ctx, host)
+	} else {
+		ips, err = net.DefaultResolver.LookupIP(ctx, "ip", host)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	ip4Only := c.Protocol == ProtocolSOCKS4
+	ip6Only := false
+	switch network {
+	case "tcp4", "udp4":
+		ip4Only = true
+	case "tcp6", "udp6":
+		ip6Only = true
+	}
+	for _, ip := range ips {
+		if ip4 := ip.To4(); ip4 != nil {
+			if !ip6Only {
+				return &Address{ip4, IPV4_ADDRESS, dest.Port}, nil
+			}
+		} else if !ip4Only {
+			return &Address{ip.To16(), IPV6_ADDRESS, dest.Port}, nil
+		}
+	}
+	return nil, &net.AddrError{Err: "no suitable address found", Addr: host}
+}
+
+// handshake connect to the socks server and send the request, retrying
+// transient failures. It returns the connection and the bound address.
+func (c *Client) handshake(ctx context.Context, cmd CMD, dest *Address) (net.Conn, *Address, error) {
+	backoff, maxBackoff := c.RetryBackoff, c.RetryMaxBackoff
+	if backoff <= 0 {
+		backoff = 100 * time.Millisecond
+	}
+	if maxBackoff <= 0 {
+		maxBackoff = 5 * time.Second
+	}
+
+	for retry := 0; ; retry++ {
+		conn, bnd, err := c.tryHandshake(ctx, cmd, dest)
+		if err == nil || retry >= c.Retries || ctx.Err() != nil || !transient(err) {
+			return conn, bnd, err
+		}
+
+		timer := time.NewTimer(backoff)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, nil, err
+		}
+		backoff *= 2
+		if backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+}
+
+func (c *Client) tryHandshake(ctx context.Context, cmd CMD, dest *Address) (net.Conn, *Address, error) {
+	protocol := c.Protocol
+	if protocol == "" {
+		protocol = ProtocolSOCKS5
+	}
+	conn, bnd, err := c.handshakeProtocol(ctx, protocol, cmd, dest)
+	for _, fallback := range c.Fallback {
+		if err == nil || ctx.Err() != nil || !fallbackable(err) {
+			break
+		}
+		conn, bnd, err = c.handshakeProtocol(ctx, fallback, cmd, dest)
+	}
+	return conn, bnd, err
+}
+
+// handshakeProtocol connect to the server and send the request with
+// protocol.
+func (c *Client) handshakeProtocol(ctx context.Context, protocol Protocol, cmd CMD, dest *Address) (net.Conn, *Address, error) {
+	if c.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.Timeout)
+		defer cancel()
+	}
+	var request func(net.Conn, CMD, *Address) (*Address, error)
+	switch protocol {
+	case ProtocolSOCKS5:
+		request = c.request
+	case ProtocolSOCKS4:
+		request = c.request4
+	case ProtocolHTTP:
+		request = c.requestHTTP
+	default:
+		return nil, nil, fmt.Errorf("unsupported proxy protocol %q", protocol)
+	}
+
+	start := time.Now()
+	conn, err := c.dialProxy(ctx)
+	c.onPhase(PhaseConnect, start, err)
+	if err != nil {
+		return nil, nil, err
+	}
+	stop := interruptOnDone(ctx, conn)
+	var bnd *Address
+	if c.TLSConfig != nil {
+		start = time.Now()
+		tlsConn := tls.Client(conn, c.clientTLSConfig())
+		err = tlsConn.Handshake()
+		c.onPhase(PhaseTLS, start, err)
+		conn = tlsConn
+	}
+	if err == nil && c.WebSocketURL != "" {
+		start = time.Now()
+		var wsConn net.Conn
+		wsConn, err = websocketHandshake(conn, c.WebSocketURL)
+		c.onPhase(PhaseWebSocket, start, err)
+		if err == nil {
+			conn = wsConn
+		}
+	}
+	switch protocol {
+	case ProtocolSOCKS5:
+		if err == nil {
+			err = c.negotiate(conn)
+		}
+	case ProtocolHTTP:
+		conn = &httpConn{Conn: conn}
+	}
+	if err == nil {
+		start = time.Now()
+		bnd, err = request(conn, cmd, dest)
+		c.onPhase(PhaseReply, start, err)
+	}
+	if ctxErr := stop(); ctxErr != nil {
+		err = ctxErr
+	}
+	if err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	if hc, ok := conn.(*httpConn); ok && hc.r.Buffered() == 0 {
+		conn = hc.Conn
+	}
+	return conn, bnd, nil
+}
+
+// fallbackable report whether err may be fixed by using another protocol.
+func fallbackable(err error) bool {
+	var (
+		rep    *REPError
+		status *HTTPStatusError
+	)
+	return !errors.As(err, &rep) && !errors.As(err, &status)
+}
+
+// transient report whether err is a failure of the connection to the
+// socks server rather than a refusal of the server.
+func transient(err error) bool {
+	var (
+		rep     *REPError
+		method  *MethodError
+		version *VersionError
+		status  *HTTPStatusError
+	)
+	switch {
+	case errors.As(err, &rep), errors.As(err, &method), errors.As(err, &version), errors.As(err, &status):
+		return false
+	case errors.Is(err, errSocks4Command), errors.Is(err, errHTTPCommand):
+		return false
+	case errors.Is(err, errAuthFailed):
+		return false
+	}
+	return true
+}
+
+// interruptOnDone bound the I/O on conn by the deadline of ctx, and
+// interrupt it when ctx is done, until stop is called. stop return the
+// error of ctx if it interrupted the I/O.
+func interruptOnDone(ctx context.Context, conn net.Conn) (stop func() error) {
+	deadline, _ := ctx.Deadline()
+	conn.SetDeadline(deadline)
+
+	done := make(chan struct{})
+	exited := make(chan struct{})
+	interrupted := false
+	go func() {
+		defer close(exited)
+		select {
+		case <-ctx.Done():
+			// a deadline in the past unblocks pending reads and writes.
+			conn.SetDeadline(time.Unix(1, 0))
+			interrupted = true
+		case <-done:
+		}
+	}()
+
+	return func() error {
+		close(done)
+		<-exited
+		if interrupted || ctx.Err() != nil {
+			return ctx.Err()
+		}
+		// the deadline of ctx may have expired the I/O before Done.
+		if !deadline.IsZero() && !time.Now().Before(deadline) {
+			return context.DeadlineExceeded
+		}
+		conn.SetDeadline(time.Time{})
+		return nil
+	}
+}
+
+// clientTLSConfig return TLSConfig completed with the defaults.
+func (c *Client) clientTLSConfig() *tls.Config {
+	c.tlsOnce.Do(func() {
+		c.tlsConfig = c.TLSConfig.Clone()
+		if c.tlsConfig.ServerName == "" {
+			host, _, err := net.SplitHostPort(c.ProxyAddr)
+			if err == nil {
+				c.tlsConfig.ServerName = host
+			}
+		}
+		if c.tlsConfig.ClientSessionCache == nil {
+			c.tlsConfig.ClientSessionCache = tls.NewLRUClientSessionCache(0)
+		}
+	})
+	return c.tlsConfig
+}
+
+// dialProxy dial the socks server.
+func (c *Client) dialProxy(ctx context.Context) (net.Conn, error) {
+	dialer := c.Dialer
+	if dialer == nil {
+		dialer = &net.Dialer{}
+	}
+	if c.RaceDelay <= 0 {
+		return dialer.DialContext(ctx, "tcp", c.ProxyAddr)
+	}
+
+	host, port, err := net.SplitHostPort(c.ProxyAddr)
+	if err != nil {
+		return nil, err
+	}
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	if len(addrs) == 1 {
+		return dialer.DialContext(ctx, "tcp", net.JoinHostPort(addrs[0].IP.String(), port))
+	}
+	return race(ctx, dialer, addrs, port, c.RaceDelay, c.RaceDelay)
+}
+
+// race dial addrs, starting the second attempt after first and the
+// others every delay, or as soon as the previous one failed, and return
+// the first connection established.
+func race(ctx context.Context, dialer Dialer, addrs []net.IPAddr, port string, first, delay time.Duration) (net.Conn, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type result struct {
+		conn net.Conn
+		err  error
+	}
+	results := make(chan result, len(addrs))
+	dial := func(ip net.IP) {
+		conn, err := dialer.DialContext(ctx, "tcp", net.JoinHostPort(ip.String(), port))
+		results <- result{conn, err}
+	}
+
+	timer := time.NewTimer(first)
+	defer timer.Stop()
+	next, pending := 0, 0
+	var firstErr error
+	start := func() {
+		go dial(addrs[next].IP)
+		next++
+		pending++
+		if next == 1 {
+			timer.Reset(first)
+		} else {
+			timer.Reset(delay)
+		}
+	}
+	for {
+		if next < len(addrs) && (pending == 0 || next == 0) {
+			start()
+		}
+		select {
+		case r := <-results:
+			pending--
+			if r.err == nil {
+				// close the connections of the other attempts.
+				go func(n int) {
+					for ; n > 0; n-- {
+						if r := <-results; r.conn != nil {
+							r.conn.Close()
+						}
+					}
+				}(pending)
+				return r.conn, nil
+			}
+			if firstErr == nil {
+				firstErr = r.err
+			}
+			if pending == 0 && next == len(addrs) {
+				return nil, firstErr
+			}
+		case <-timer.C:
+			if next < len(addrs) {
+				start()
+			}
+		}
+	}
+}
+
+// selectMethod negotiate the authentication method with the server.
+func (c *Client) selectMethod(conn net.Conn) (METHOD, error) {
+	methods := []byte{NO_AUTHENTICATION_REQUIRED}
+	if c.Username != "" {
+		methods = append(methods, USERNAME_PASSWORD)
+	}
+	_, err := conn.Write(append([]byte{Version5, byte(len(methods))}, methods...))
+	if err != nil {
+		return 0, &OpError{Version5, "write", conn.RemoteAddr(), "\"method selection\"", err}
+	}
+
+	reply, err := ReadNBytes(conn, 2)
+	if err != nil {
+		return 0, &OpError{Version5, "read", conn.RemoteAddr(), "\"method selection\"", err}
+	}
+	if reply[0] != Version5 {
+		return 0, &OpError{Version5, "", conn.RemoteAddr(), "\"method selection\"", &VersionError{reply[0]}}
+	}
+	if reply[1] == NO_AUTHENTICATION_REQUIRED || reply[1] == USERNAME_PASSWORD && c.Username != "" {
+		return reply[1], nil
+	}
+	return 0, &OpError{Version5, "", conn.RemoteAddr(), "\"method selection\"", &MethodError{reply[1]}}
+}
+
+// negotiate select the authentication method with the server and
+// authenticate.
+func (c *Client) negotiate(conn net.Conn) error {
+	start := time.Now()
+	method, err := c.selectMethod(conn)
+	c.onPhase(PhaseNegotiate, start, err)
+	if err != nil || method != USERNAME_PASSWORD {
+		return err
+	}
+
+	start = time.Now()
+	err = c.authenticate(conn)
+	if err != nil {
+		err = &OpError{Version5, "", conn.RemoteAddr(), "\"authentication\"", err}
+	}
+	c.onPhase(PhaseAuth, start, err)
+	return err
+}
+
+var errAuthFailed = errors.New("username/password authentication failed")
+
+// authenticate run the Username/Password sub-negotiation (RFC 1929).
+func (c *Client) authenticate(conn net.Conn) error {
+	if len(c.Username) > 255 || len(c.Password) > 255 {
+		return errors.New("username or password longer than 255 bytes")
+	}
+	req := []byte{userPassVersion, byte(len(c.Username))}
+	req = append(req, c.Username...)
+	req = append(req, byte(len(c.Password)))
+	req = append(req, c.Password...)
+	_, err := conn.Write(req)
+	if err != nil {
+		return err
+	}
+
+	reply, err := ReadNBytes(conn, 2)
+	if err != nil {
+		return err
+	}
+	if reply[0] != userPassVersion {
+		return &VersionError{reply[0]}
+	}
+	if reply[1] != 0 {
+		return errAuthFailed
+	}
+	return nil
+}
+
+// request send the socks5 request and return the bound address of reply.
+func (c *Client) request(conn net.Conn, cmd CMD, dest *Address) (*Address, error) {
+
+	addr, err := dest.Bytes(Version5)
+	if err != nil {
+		return nil, err
+	}
+	_, err = conn.Write(append([]byte{Version5, cmd, 0}, addr...))
+	if err != nil {
+		return nil, &OpError{Version5, "write", conn.RemoteAddr(), "\"request\"", err}
+	}
+	return readReply(conn)
+}
+
+// readReply read a socks5 reply, it returns *REPError if the reply
+// reports a failure.
+func readReply(conn net.Conn) (*Address, error) {
+	reply, err := ReadNBytes(conn, 3)
+	if err != nil {
+		return nil, &OpError{Version5, "read", conn.RemoteAddr(), "\"reply\"", err}
+	}
+	if reply[0] != Version5 {
+		return nil, &OpError{Version5, "", conn.RemoteAddr(), "\"reply\"", &VersionError{reply[0]}}
+	}
+	if reply[1] != SUCCESSED {
+		return nil, &OpError{Version5, "", conn.RemoteAddr(), "\"reply\"", &REPError{reply[1]}}
+	}
+	bnd, _, err := readAddress(conn, Version5)
+	if err != nil {
+		return nil, &OpError{Version5, "read", conn.RemoteAddr(), "\"reply\"", err}
+	}
+	return bnd, nil
+}
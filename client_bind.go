@@ -0,0 +1,87 @@
+package socks5
+
+import (
+	"context"
+	"net"
+)
+
+// Binding is a pending BIND request. The server replies twice to BIND:
+// first with the address it listens on, then when the peer connected.
+// Binding exposes the first reply as Addr and delivers the second
+// through Done and Accept.
+type Binding struct {
+	// Addr is the address the server listens on for the peer, to be
+	// sent to the peer by the application protocol.
+	Addr *Address
+
+	conn net.Conn
+	done chan struct{}
+	peer *Address
+	err  error
+}
+
+// Bind asks the socks server to listen for a connection from address,
+// the expected peer. It returns after the first reply of the server.
+func (c *Client) Bind(ctx context.Context, address string) (*Binding, error) {
+	dest, err := c.destination(ctx, "tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	conn, bnd, err := c.handshake(ctx, BIND, dest)
+	if err != nil {
+		return nil, err
+	}
+
+	b := &Binding{Addr: bnd, conn: conn, done: make(chan struct{})}
+	go b.wait()
+	return b, nil
+}
+
+// wait read the second reply of the server.
+func (b *Binding) wait() {
+	b.peer, b.err = readReply(b.conn)
+	if b.err != nil {
+		b.conn.Close()
+	}
+	close(b.done)
+}
+
+// Done return a channel closed when the peer connected to the server,
+// or the binding failed.
+func (b *Binding) Done() <-chan struct{} {
+	return b.done
+}
+
+// Conn return the connection relayed with the peer and the peer address.
+// It must be called after Done is closed.
+func (b *Binding) Conn() (net.Conn, *Address, error) {
+	if b.err != nil {
+		return nil, nil, b.err
+	}
+	return b.conn, b.peer, nil
+}
+
+// Accept wait for the peer to connect, and return the relayed connection
+// and the peer address. If ctx is done first, the binding is closed.
+func (b *Binding) Accept(ctx context.Context) (net.Conn, *Address, error) {
+	select {
+	case <-b.done:
+		return b.Conn()
+	case <-ctx.Done():
+		b.Close()
+		return nil, nil, ctx.Err()
+	}
+}
+
+// Close cancel the binding. It does not close the connection returned
+// by Conn or Accept.
+func (b *Binding) Close() error {
+	select {
+	case <-b.done:
+		if b.err == nil {
+			return nil
+		}
+	default:
+	}
+	return b.conn.Close()
+}
@@ -0,0 +1,96 @@
+package socks5
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+// bindTest is a minimal socks server answering one BIND request, it
+// sends the second reply when peer receives.
+func bindTest(t *testing.T, peer chan *Address) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		ReadNBytes(conn, 3)
+		conn.Write([]byte{Version5, NO_AUTHENTICATION_REQUIRED})
+		ReadNBytes(conn, 3)
+		readAddress(conn, Version5)
+		bnd, _ := (&Address{net.IPv4(127, 0, 0, 1).To4(), IPV4_ADDRESS, 4000}).Bytes(Version5)
+		conn.Write(append([]byte{Version5, SUCCESSED, 0}, bnd...))
+		p, ok := <-peer
+		if !ok {
+			return
+		}
+		b, _ := p.Bytes(Version5)
+		conn.Write(append([]byte{Version5, SUCCESSED, 0}, b...))
+		conn.Write([]byte("hello"))
+		ReadNBytes(conn, 1)
+	}()
+	return ln.Addr().String()
+}
+
+func TestClient_Bind(t *testing.T) {
+	peer := make(chan *Address, 1)
+	client := &Client{ProxyAddr: bindTest(t, peer)}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	b, err := client.Bind(ctx, "192.0.2.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b.Addr.String() != "127.0.0.1:4000" {
+		t.Errorf("bind address: %s", b.Addr)
+	}
+	select {
+	case <-b.Done():
+		t.Fatal("done before the peer connected")
+	default:
+	}
+
+	peer <- &Address{net.IPv4(192, 0, 2, 1).To4(), IPV4_ADDRESS, 5000}
+	conn, addr, err := b.Accept(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if addr.String() != "192.0.2.1:5000" {
+		t.Errorf("peer address: %s", addr)
+	}
+	msg, err := ReadNBytes(conn, 5)
+	if err != nil || string(msg) != "hello" {
+		t.Errorf("read: %q, %v", msg, err)
+	}
+}
+
+func TestClient_BindCancel(t *testing.T) {
+	peer := make(chan *Address)
+	defer close(peer)
+	client := &Client{ProxyAddr: bindTest(t, peer)}
+	b, err := client.Bind(context.Background(), "192.0.2.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, _, err = b.Accept(ctx)
+	if err != context.DeadlineExceeded {
+		t.Errorf("accept: %v", err)
+	}
+	select {
+	case <-b.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("binding not closed")
+	}
+}
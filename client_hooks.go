@@ -0,0 +1,48 @@
+package socks5
+
+import "time"
+
+// Phase is a phase of the client handshake with the proxy.
+type Phase int
+
+const (
+	// PhaseConnect is the TCP connection to the proxy.
+	PhaseConnect Phase = iota
+	// PhaseNegotiate is the socks5 method selection.
+	PhaseNegotiate
+	// PhaseAuth is the socks5 Username/Password authentication.
+	PhaseAuth
+	// PhaseReply is the request, until the reply of the proxy: for
+	// CONNECT, it includes the connection of the proxy to the destination.
+	PhaseReply
+	// PhaseTLS is the TLS handshake with the proxy, after PhaseConnect.
+	PhaseTLS
+	// PhaseWebSocket is the WebSocket handshake with the proxy, after
+	// PhaseConnect and PhaseTLS.
+	PhaseWebSocket
+)
+
+var phaseNames = [...]string{"connect", "negotiate", "auth", "reply", "tls", "websocket"}
+
+func (p Phase) String() string {
+	if int(p) < len(phaseNames) {
+		return phaseNames[p]
+	}
+	return "unknown"
+}
+
+// ClientHooks are callbacks the Client invokes on handshake events.
+// Nil callbacks are skipped.
+type ClientHooks struct {
+	// OnPhase is called at the end of each handshake phase with its
+	// duration and error, so applications can attribute latency to the
+	// proxy or to the destination: the destination only weighs on
+	// PhaseReply of CONNECT requests.
+	OnPhase func(phase Phase, d time.Duration, err error)
+}
+
+func (c *Client) onPhase(phase Phase, start time.Time, err error) {
+	if c.Hooks.OnPhase != nil {
+		c.Hooks.OnPhase(phase, time.Since(start), err)
+	}
+}
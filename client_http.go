@@ -0,0 +1,75 @@
+package socks5
+
+import (
+	"bufio"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+)
+
+// ProtocolHTTP is the HTTP CONNECT method of HTTP proxies. It only
+// supports CONNECT, Client.Username and Password are sent with Basic
+// authentication.
+const ProtocolHTTP Protocol = "http"
+
+var errHTTPCommand = errors.New("http proxy supports CONNECT only")
+
+// HTTPStatusError is returned when an HTTP proxy refused a CONNECT request.
+type HTTPStatusError struct {
+	StatusCode int
+	Status     string
+}
+
+func (e *HTTPStatusError) Error() string {
+	return "http proxy reply: " + e.Status
+}
+
+// requestHTTP send a CONNECT request to an HTTP proxy. If conn is an
+// *httpConn, its reader is set to read the data following the response.
+func (c *Client) requestHTTP(conn net.Conn, cmd CMD, dest *Address) (*Address, error) {
+	if cmd != CONNECT {
+		return nil, errHTTPCommand
+	}
+
+	host := dest.String()
+	req := "CONNECT " + host + " HTTP/1.1\r\nHost: " + host + "\r\n"
+	if c.Username != "" {
+		auth := base64.StdEncoding.EncodeToString([]byte(c.Username + ":" + c.Password))
+		req += "Proxy-Authorization: Basic " + auth + "\r\n"
+	}
+	_, err := conn.Write([]byte(req + "\r\n"))
+	if err != nil {
+		return nil, fmt.Errorf("http connect write %s: %w", conn.RemoteAddr(), err)
+	}
+
+	hc, ok := conn.(*httpConn)
+	if ok {
+		conn = hc.Conn
+	}
+	r := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(r, &http.Request{Method: http.MethodConnect})
+	if err != nil {
+		return nil, fmt.Errorf("http connect read %s: %w", conn.RemoteAddr(), err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil, &HTTPStatusError{resp.StatusCode, resp.Status}
+	}
+	if ok {
+		hc.r = r
+	}
+	return nil, nil
+}
+
+// httpConn is a connection tunneled by an HTTP proxy, reading first the
+// data buffered while reading the proxy response.
+type httpConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *httpConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
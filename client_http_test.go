@@ -0,0 +1,89 @@
+package socks5
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// httpProxyTest start an HTTP proxy supporting CONNECT only, it greets
+// the client in the response packet.
+func httpProxyTest(t *testing.T) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go http.Serve(ln, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodConnect {
+			http.Error(w, "CONNECT only", http.StatusMethodNotAllowed)
+			return
+		}
+		user, pass, _ := basicProxyAuth(r)
+		if user != "admin" || pass != "123456" {
+			w.WriteHeader(http.StatusProxyAuthRequired)
+			return
+		}
+		remote, err := net.Dial("tcp", r.Host)
+		if err != nil {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		defer remote.Close()
+		conn, _, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.Write([]byte("HTTP/1.1 200 OK\r\n\r\nhello"))
+		go io.Copy(remote, conn)
+		io.Copy(conn, remote)
+	}))
+	return ln.Addr().String()
+}
+
+func basicProxyAuth(r *http.Request) (string, string, bool) {
+	req := &http.Request{Header: http.Header{"Authorization": r.Header["Proxy-Authorization"]}}
+	return req.BasicAuth()
+}
+
+func TestClient_HTTPFallback(t *testing.T) {
+	echo := echoTest(t)
+	tests := []struct {
+		name   string
+		client *Client
+	}{
+		{"http", &Client{ProxyAddr: httpProxyTest(t), Protocol: ProtocolHTTP}},
+		{"socks5 to http", &Client{ProxyAddr: httpProxyTest(t), Fallback: []Protocol{ProtocolHTTP}, Timeout: 200 * time.Millisecond}},
+		{"http to socks5", &Client{ProxyAddr: serveTest(t, &Server{}), Protocol: ProtocolHTTP, Fallback: []Protocol{ProtocolSOCKS5}}},
+	}
+	for _, test := range tests {
+		test.client.Username, test.client.Password = "admin", "123456"
+		conn, err := test.client.Dial("tcp", echo)
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		if _, ok := conn.(*httpConn); ok {
+			b, err := ReadNBytes(conn, 5)
+			if err != nil || string(b) != "hello" {
+				t.Errorf("%s: greeting %q, %v", test.name, b, err)
+			}
+		}
+		conn.Write([]byte("ping"))
+		b, err := ReadNBytes(conn, 4)
+		if err != nil || string(b) != "ping" {
+			t.Errorf("%s: echo %q, %v", test.name, b, err)
+		}
+		conn.Close()
+	}
+
+	client := &Client{ProxyAddr: httpProxyTest(t), Protocol: ProtocolHTTP}
+	_, err := client.Dial("tcp", echo)
+	if e, ok := err.(*HTTPStatusError); !ok || e.StatusCode != http.StatusProxyAuthRequired {
+		t.Errorf("unauthenticated: %v", err)
+	}
+}
@@ -0,0 +1,67 @@
+package socks5
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+)
+
+// Protocol is a proxy protocol spoken by the Client.
+type Protocol string
+
+const (
+	// ProtocolSOCKS5 is SOCKS version 5, RFC 1928.
+	ProtocolSOCKS5 Protocol = "socks5"
+	// ProtocolSOCKS4 is SOCKS version 4, and its 4a extension for domain
+	// name destinations. It only supports CONNECT and BIND, and has no
+	// authentication: Client.Username is sent as the USERID.
+	ProtocolSOCKS4 Protocol = "socks4"
+)
+
+var errSocks4Command = errors.New("socks4 supports CONNECT and BIND only")
+
+// request4 send the socks4 request and return the bound address of reply.
+// Domain name destinations are sent with socks4a.
+func (c *Client) request4(conn net.Conn, cmd CMD, dest *Address) (*Address, error) {
+	if cmd != CONNECT && cmd != BIND {
+		return nil, errSocks4Command
+	}
+	if dest.ATYPE == IPV6_ADDRESS {
+		return nil, errors.New("socks4 does not support IPv6 destinations")
+	}
+
+	req := []byte{Version4, cmd, 0, 0}
+	binary.BigEndian.PutUint16(req[2:], dest.Port)
+	if dest.ATYPE == DOMAINNAME {
+		req = append(req, 0, 0, 0, 1)
+	} else {
+		req = append(req, dest.Addr.To4()...)
+	}
+	req = append(req, c.Username...)
+	req = append(req, NULL)
+	if dest.ATYPE == DOMAINNAME {
+		req = append(req, dest.Addr...)
+		req = append(req, NULL)
+	}
+	_, err := conn.Write(req)
+	if err != nil {
+		return nil, &OpError{Version4, "write", conn.RemoteAddr(), "\"request\"", err}
+	}
+	return readReply4(conn)
+}
+
+// readReply4 read a socks4 reply, it returns *REPError if the server
+// rejected the request.
+func readReply4(conn net.Conn) (*Address, error) {
+	reply, err := ReadNBytes(conn, 8)
+	if err != nil {
+		return nil, &OpError{Version4, "read", conn.RemoteAddr(), "\"reply\"", err}
+	}
+	if reply[0] != 0 {
+		return nil, &OpError{Version4, "", conn.RemoteAddr(), "\"reply\"", &VersionError{reply[0]}}
+	}
+	if reply[1] != PERMIT {
+		return nil, &OpError{Version4, "", conn.RemoteAddr(), "\"reply\"", &REPError{reply[1]}}
+	}
+	return &Address{net.IP(reply[4:8]), IPV4_ADDRESS, binary.BigEndian.Uint16(reply[2:4])}, nil
+}
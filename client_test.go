@@ -0,0 +1,458 @@
+package socks5
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// echoTest start a TCP echo server and return its address.
+func echoTest(t *testing.T) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(conn, conn)
+				conn.Close()
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+func TestClient_Dial(t *testing.T) {
+	store := NewMemeryStore(sha256.New(), "secret")
+	store.Set("admin", "123456")
+	srv := &Server{Authenticators: map[METHOD]Authenticator{
+		USERNAME_PASSWORD: UserPwdAuth{store},
+	}}
+	proxy := serveTest(t, srv)
+	echo := echoTest(t)
+
+	client := &Client{ProxyAddr: proxy, Username: "admin", Password: "123456"}
+	conn, err := client.Dial("tcp", echo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	conn.Write([]byte("ping"))
+	b, err := ReadNBytes(conn, 4)
+	if err != nil || string(b) != "ping" {
+		t.Errorf("echo: %q, %v", b, err)
+	}
+
+	client.Password = "wrong"
+	_, err = client.Dial("tcp", echo)
+	if err == nil {
+		t.Error("dial with wrong password succeeded")
+	}
+
+	_, err = client.Dial("udp", echo)
+	if err == nil {
+		t.Error("dial udp succeeded")
+	}
+}
+
+// udpAssociateTest is a minimal socks server answering UDP ASSOCIATE
+// requests with an echoing relay. Closing a value received from ctrls
+// ends that association.
+func udpAssociateTest(t *testing.T) (addr string, ctrls chan net.Conn) {
+	relay, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { relay.Close() })
+	go func() {
+		buf := make([]byte, 65535)
+		for {
+			n, from, err := relay.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			// the datagram is sent back as coming from its destination.
+			relay.WriteToUDP(buf[:n], from)
+		}
+	}()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	ctrls = make(chan net.Conn, 4)
+	bnd := relay.LocalAddr().(*net.UDPAddr)
+	reply, _ := (&Address{bnd.IP.To4(), IPV4_ADDRESS, uint16(bnd.Port)}).Bytes(Version5)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			ReadNBytes(conn, 3)
+			conn.Write([]byte{Version5, NO_AUTHENTICATION_REQUIRED})
+			ReadNBytes(conn, 3)
+			readAddress(conn, Version5)
+			conn.Write(append([]byte{Version5, SUCCESSED, 0}, reply...))
+			ctrls <- conn
+		}
+	}()
+	return ln.Addr().String(), ctrls
+}
+
+func TestClient_ListenPacket(t *testing.T) {
+	proxy, ctrls := udpAssociateTest(t)
+	client := &Client{ProxyAddr: proxy}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	conn, err := client.ListenPacket(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	dest := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 53}
+	echo := func() {
+		t.Helper()
+		_, err := conn.WriteTo([]byte("ping"), dest)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b := make([]byte, 16)
+		n, from, err := conn.ReadFrom(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(b[:n]) != "ping" || from.String() != dest.String() {
+			t.Errorf("got %q from %s", b[:n], from)
+		}
+	}
+	echo()
+
+	(<-ctrls).Close()
+	select {
+	case <-conn.Lost():
+	case <-time.After(5 * time.Second):
+		t.Fatal("association loss not detected")
+	}
+	_, err = conn.WriteTo([]byte("ping"), dest)
+	if err != ErrAssociationLost {
+		t.Errorf("write after loss: %v", err)
+	}
+
+	local := conn.LocalAddr().String()
+	err = conn.Reassociate(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-ctrls
+	if conn.LocalAddr().String() != local {
+		t.Error("local socket changed")
+	}
+	echo()
+}
+
+func TestClient_DialUDP(t *testing.T) {
+	proxy, _ := udpAssociateTest(t)
+	client := &Client{ProxyAddr: proxy}
+	conn, err := client.Dial("udp", "192.0.2.1:53")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	if conn.RemoteAddr().String() != "192.0.2.1:53" {
+		t.Errorf("remote address: %s", conn.RemoteAddr())
+	}
+	_, err = conn.Write([]byte("ping"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := make([]byte, 16)
+	n, err := conn.Read(b)
+	if err != nil || string(b[:n]) != "ping" {
+		t.Errorf("read: %q, %v", b[:n], err)
+	}
+}
+
+func TestUDPConn_Encapsulation(t *testing.T) {
+	proxy, _ := udpAssociateTest(t)
+	client := &Client{ProxyAddr: proxy}
+	conn, err := client.ListenPacket(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	// the echo relay sends the fragment back, it must be dropped.
+	frag, _ := (&UDPHeader{FRAG: 1, ATYPE: IPV4_ADDRESS, DestAddr: net.IPv4(192, 0, 2, 1).To4(), DestPort: 53, Data: []byte("frag")}).Bytes()
+	conn.local.WriteToUDP(frag, conn.relay)
+
+	dest := &Address{[]byte("example.com"), DOMAINNAME, 53}
+	_, err = conn.WriteTo([]byte("ping"), dest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := make([]byte, 16)
+	n, from, err := conn.ReadFrom(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b[:n]) != "ping" || from.String() != "example.com:53" {
+		t.Errorf("got %q from %s", b[:n], from)
+	}
+
+	_, err = conn.WriteTo(make([]byte, maxUDPPayload), dest)
+	if err != ErrDatagramTooLarge {
+		t.Errorf("oversize datagram: %v", err)
+	}
+}
+
+func TestClient_Retries(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	srv := &Server{}
+	go func() {
+		// drop the first connections, serve the next one.
+		for i := 0; ; i++ {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			if i < 2 {
+				conn.Close()
+				continue
+			}
+			go srv.ServeConn(context.Background(), conn)
+		}
+	}()
+	echo := echoTest(t)
+
+	client := &Client{ProxyAddr: ln.Addr().String(), Retries: 1, RetryBackoff: time.Millisecond}
+	_, err = client.Dial("tcp", echo)
+	if err == nil {
+		t.Fatal("dial succeeded with too few retries")
+	}
+	conn, err := client.Dial("tcp", echo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+
+	client = &Client{ProxyAddr: serveTest(t, &Server{}), Retries: 3, RetryBackoff: time.Hour}
+	start := time.Now()
+	_, err = client.Dial("tcp", "127.0.0.1:1")
+	if err == nil || time.Since(start) > time.Minute {
+		t.Errorf("server reply retried: %v", err)
+	}
+}
+
+func TestClient_DialSocks4(t *testing.T) {
+	proxy := serveTest(t, &Server{})
+	_, port, _ := net.SplitHostPort(echoTest(t))
+	client := &Client{ProxyAddr: proxy, Protocol: ProtocolSOCKS4, Username: "admin"}
+	for _, dest := range []string{"127.0.0.1:" + port, "localhost:" + port} {
+		conn, err := client.Dial("tcp", dest)
+		if err != nil {
+			t.Errorf("%s: %v", dest, err)
+			continue
+		}
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		conn.Write([]byte("ping"))
+		b, err := ReadNBytes(conn, 4)
+		if err != nil || string(b) != "ping" {
+			t.Errorf("%s: echo %q, %v", dest, b, err)
+		}
+		conn.Close()
+	}
+
+	_, err := client.Dial("udp", "127.0.0.1:"+port)
+	if err == nil {
+		t.Error("socks4 udp succeeded")
+	}
+}
+
+func TestClient_LocalDNS(t *testing.T) {
+	proxy := serveTest(t, &Server{})
+	_, port, _ := net.SplitHostPort(echoTest(t))
+	dualStack := NameResolverFunc(func(ctx context.Context, fqdn string) ([]net.IP, error) {
+		return []net.IP{net.ParseIP("::1"), net.ParseIP("127.0.0.1")}, nil
+	})
+
+	client := &Client{ProxyAddr: proxy, Protocol: ProtocolSOCKS4, LocalDNS: true, Resolver: dualStack}
+	conn, err := client.Dial("tcp", "dual.test:"+port)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	conn.Write([]byte("ping"))
+	if b, err := ReadNBytes(conn, 4); err != nil || string(b) != "ping" {
+		t.Errorf("echo %q, %v", b, err)
+	}
+	conn.Close()
+	if _, err := client.destination(context.Background(), "tcp6", "dual.test:80"); err == nil {
+		t.Error("socks4 resolved an IPv6 destination")
+	}
+
+	client.Protocol = ProtocolSOCKS5
+	tests := map[string]string{"tcp": "::1", "tcp4": "127.0.0.1", "udp4": "127.0.0.1", "tcp6": "::1"}
+	for network, want := range tests {
+		dest, err := client.destination(context.Background(), network, "dual.test:80")
+		if err != nil || !net.IP(dest.Addr).Equal(net.ParseIP(want)) {
+			t.Errorf("%s: destination %v, %v, want %s", network, dest, err, want)
+		}
+	}
+}
+
+// dialContextFunc adapts a function to Dialer.
+type dialContextFunc func(ctx context.Context, network, address string) (net.Conn, error)
+
+func (f dialContextFunc) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	return f(ctx, network, address)
+}
+
+func TestRace(t *testing.T) {
+	proxy := serveTest(t, &Server{})
+	_, port, _ := net.SplitHostPort(proxy)
+	addrs := []net.IPAddr{{IP: net.IPv4(192, 0, 2, 2)}, {IP: net.IPv4(192, 0, 2, 1)}, {IP: net.IPv4(127, 0, 0, 1)}}
+	canceled := make(chan struct{})
+	dialer := dialContextFunc(func(ctx context.Context, network, address string) (net.Conn, error) {
+		switch address {
+		case net.JoinHostPort("192.0.2.1", port):
+			// blackholed: hangs until the race is over.
+			<-ctx.Done()
+			close(canceled)
+			return nil, ctx.Err()
+		case net.JoinHostPort("192.0.2.2", port):
+			return nil, errors.New("connection refused")
+		}
+		return net.Dial(network, address)
+	})
+
+	conn, err := race(context.Background(), dialer, addrs, port, 10*time.Millisecond, 10*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if conn.RemoteAddr().String() != proxy {
+		t.Errorf("connected to %s", conn.RemoteAddr())
+	}
+	select {
+	case <-canceled:
+	case <-time.After(5 * time.Second):
+		t.Error("losing attempt not canceled")
+	}
+
+	_, err = race(context.Background(), dialer, addrs[:1], port, 10*time.Millisecond, 10*time.Millisecond)
+	if err == nil {
+		t.Error("race of refused address succeeded")
+	}
+}
+
+// stallTest start a socks server stalling the handshake before phase.
+func stallTest(t *testing.T, phase string) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				ReadNBytes(conn, 4)
+				switch phase {
+				case "auth":
+					conn.Write([]byte{Version5, USERNAME_PASSWORD})
+				case "reply":
+					conn.Write([]byte{Version5, NO_AUTHENTICATION_REQUIRED})
+				}
+				io.Copy(io.Discard, conn)
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+func TestClient_DialContextCancel(t *testing.T) {
+	blocking := dialContextFunc(func(ctx context.Context, network, address string) (net.Conn, error) {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	})
+	tests := []struct {
+		phase  string
+		client *Client
+	}{
+		{"connect", &Client{ProxyAddr: "192.0.2.1:1080", Dialer: blocking}},
+		{"method selection", &Client{ProxyAddr: stallTest(t, "method selection")}},
+		{"auth", &Client{ProxyAddr: stallTest(t, "auth")}},
+		{"reply", &Client{ProxyAddr: stallTest(t, "reply")}},
+	}
+	for _, test := range tests {
+		test.client.Username, test.client.Password = "admin", "123456"
+		ctx, cancel := context.WithCancel(context.Background())
+		time.AfterFunc(50*time.Millisecond, cancel)
+		start := time.Now()
+		_, err := test.client.DialContext(ctx, "tcp", "192.0.2.2:80")
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("%s: %v", test.phase, err)
+		}
+		if time.Since(start) > 5*time.Second {
+			t.Errorf("%s: cancellation took %s", test.phase, time.Since(start))
+		}
+	}
+}
+
+func TestClient_OnPhase(t *testing.T) {
+	store := NewMemeryStore(sha256.New(), "secret")
+	store.Set("admin", "123456")
+	srv := &Server{Authenticators: map[METHOD]Authenticator{
+		USERNAME_PASSWORD: UserPwdAuth{store},
+	}}
+	var phases []Phase
+	client := &Client{
+		ProxyAddr: serveTest(t, srv),
+		Username:  "admin",
+		Password:  "123456",
+		Hooks: ClientHooks{OnPhase: func(phase Phase, d time.Duration, err error) {
+			if err != nil || d < 0 {
+				t.Errorf("%s: %s, %v", phase, d, err)
+			}
+			phases = append(phases, phase)
+		}},
+	}
+	conn, err := client.Dial("tcp", echoTest(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+
+	expected := []Phase{PhaseConnect, PhaseNegotiate, PhaseAuth, PhaseReply}
+	if fmt.Sprint(phases) != fmt.Sprint(expected) {
+		t.Errorf("phases: %v", phases)
+	}
+}
@@ -0,0 +1,75 @@
+package socks5
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"net/http/httptest"
+	"testing"
+)
+
+// tlsServeTest start srv behind a TLS listener, and return its address
+// and the pool of its certificate, valid for example.com.
+func tlsServeTest(t *testing.T, srv *Server) (string, *x509.CertPool) {
+	ts := httptest.NewUnstartedServer(nil)
+	ts.StartTLS()
+	config := ts.TLS.Clone()
+	config.NextProtos = []string{"socks5"}
+	pool := x509.NewCertPool()
+	pool.AddCert(ts.Certificate())
+	ts.Close()
+
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go srv.ServeConn(context.Background(), conn)
+		}
+	}()
+	return ln.Addr().String(), pool
+}
+
+func TestClient_TLS(t *testing.T) {
+	proxy, pool := tlsServeTest(t, &Server{})
+	echo := echoTest(t)
+	client := &Client{
+		ProxyAddr: proxy,
+		TLSConfig: &tls.Config{RootCAs: pool, ServerName: "example.com", NextProtos: []string{"socks5"}},
+	}
+
+	for i := 0; i < 2; i++ {
+		conn, err := client.Dial("tcp", echo)
+		if err != nil {
+			t.Fatal(err)
+		}
+		state := conn.(*tls.Conn).ConnectionState()
+		if state.NegotiatedProtocol != "socks5" {
+			t.Errorf("ALPN: %q", state.NegotiatedProtocol)
+		}
+		if i == 1 && !state.DidResume {
+			t.Error("TLS session not resumed")
+		}
+		conn.Close()
+	}
+
+	// the certificate is valid for the proxy address too.
+	client = &Client{ProxyAddr: proxy, TLSConfig: &tls.Config{RootCAs: pool}}
+	conn, err := client.Dial("tcp", echo)
+	if err != nil {
+		t.Fatalf("default server name: %v", err)
+	}
+	conn.Close()
+
+	client = &Client{ProxyAddr: proxy, TLSConfig: &tls.Config{RootCAs: pool, ServerName: "example.org"}}
+	_, err = client.Dial("tcp", echo)
+	if err == nil {
+		t.Error("server name override not verified")
+	}
+}
@@ -0,0 +1,307 @@
+package socks5
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+// ErrDatagramTooLarge is returned by UDPConn writes when the datagram
+// and its UDP request header do not fit in an UDP datagram.
+var ErrDatagramTooLarge = errors.New("socks5 udp datagram too large")
+
+// maxUDPPayload is the largest payload of an UDP datagram over IPv4.
+const maxUDPPayload = 65507
+
+// ErrAssociationLost is returned by UDPConn writes once the control
+// connection of the UDP association is lost, until Reassociate succeeds.
+var ErrAssociationLost = errors.New("socks5 udp association lost")
+
+// UDPConn is a net.PacketConn relaying datagrams through an UDP
+// association (UDP ASSOCIATE) of a socks server.
+//
+// The association lives as long as its TCP control connection. UDPConn
+// enables TCP keep-alive on it (Client.UDPKeepAlive) and watches it:
+// when the server closes it, Lost is closed and writes fail with
+// ErrAssociationLost. Reassociate establishes a new association while
+// keeping the local socket, so a long-lived UDPConn survives server side
+// idle timeouts.
+//
+// UDPConn does not implement fragmentation, which is optional (RFC 1928
+// section 7): it never fragments the datagrams it sends, and drops the
+// datagrams received with a non-zero FRAG field.
+type UDPConn struct {
+	client *Client
+	local  *net.UDPConn
+
+	mu    sync.Mutex
+	ctrl  net.Conn
+	relay *net.UDPAddr
+	lost  chan struct{}
+
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+// ListenPacket creates an UDP association through the socks server.
+func (c *Client) ListenPacket(ctx context.Context) (*UDPConn, error) {
+	local, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		return nil, err
+	}
+	u := &UDPConn{client: c, local: local, closed: make(chan struct{})}
+	err = u.Reassociate(ctx)
+	if err != nil {
+		local.Close()
+		return nil, err
+	}
+	return u, nil
+}
+
+// Reassociate establishes a new UDP association with the server and
+// replaces the current one. The local socket is kept.
+func (u *UDPConn) Reassociate(ctx context.Context) error {
+	select {
+	case <-u.closed:
+		return net.ErrClosed
+	default:
+	}
+
+	// DST.ADDR is the address the client sends datagrams from.
+	port := u.local.LocalAddr().(*net.UDPAddr).Port
+	ctrl, bnd, err := u.client.handshake(ctx, UDP_ASSOCIATE, &Address{net.IPv4zero.To4(), IPV4_ADDRESS, uint16(port)})
+	if err != nil {
+		return err
+	}
+	relay := udpAddr(bnd)
+	if relay == nil {
+		ctrl.Close()
+		return errors.New("socks5 udp relay address is not an IP address")
+	}
+	// An unspecified relay address means the server's own address.
+	if relay.IP.IsUnspecified() {
+		if ip := addrIP(ctrl.RemoteAddr()); ip != nil {
+			relay.IP = ip
+		}
+	}
+
+	if tcp, ok := ctrl.(*net.TCPConn); ok && u.client.UDPKeepAlive >= 0 {
+		period := u.client.UDPKeepAlive
+		if period == 0 {
+			period = 15 * time.Second
+		}
+		tcp.SetKeepAlive(true)
+		tcp.SetKeepAlivePeriod(period)
+	}
+
+	lost := make(chan struct{})
+	u.mu.Lock()
+	old := u.ctrl
+	u.ctrl, u.relay, u.lost = ctrl, relay, lost
+	u.mu.Unlock()
+	if old != nil {
+		old.Close()
+	}
+	go u.watch(ctrl, lost)
+	return nil
+}
+
+// watch wait for the control connection to be closed. The server sends
+// nothing on it, so any read result means the association is over.
+func (u *UDPConn) watch(ctrl net.Conn, lost chan struct{}) {
+	b := make([]byte, 1)
+	ctrl.Read(b)
+	ctrl.Close()
+	close(lost)
+}
+
+// Lost return a channel closed when the current association is lost.
+func (u *UDPConn) Lost() <-chan struct{} {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.lost
+}
+
+// association return the relay address, or an error if the association
+// is lost.
+func (u *UDPConn) association() (*net.UDPAddr, error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	select {
+	case <-u.lost:
+		return nil, ErrAssociationLost
+	default:
+		return u.relay, nil
+	}
+}
+
+// ReadFrom read a datagram relayed by the server, addr is the address of
+// its sender: *net.UDPAddr, or *Address if the server reports a domain
+// name. Datagrams not coming from the relay, malformed or fragmented are
+// dropped. As with net.UDPConn, the datagram is truncated if b is too
+// small.
+func (u *UDPConn) ReadFrom(b []byte) (n int, addr net.Addr, err error) {
+	// the pooled buffers have power of two sizes, 64KiB holds any
+	// datagram.
+	buf := getBuffer(64 << 10)
+	defer putBuffer(buf)
+	for {
+		n, from, err := u.local.ReadFromUDP(buf)
+		if err != nil {
+			return 0, nil, err
+		}
+		u.mu.Lock()
+		relay := u.relay
+		u.mu.Unlock()
+		if !from.IP.Equal(relay.IP) || from.Port != relay.Port {
+			continue
+		}
+
+		h, err := ParseUDPHeader(buf[:n])
+		if err != nil || h.FRAG != 0 {
+			continue
+		}
+		src := h.Address()
+		if ua := udpAddr(src); ua != nil {
+			return copy(b, h.Data), ua, nil
+		}
+		return copy(b, h.Data), src, nil
+	}
+}
+
+// WriteTo send b to addr through the relay. addr may be *net.UDPAddr,
+// *Address or any net.Addr whose String is "host:port".
+func (u *UDPConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	relay, err := u.association()
+	if err != nil {
+		return 0, err
+	}
+	dest, err := addressOf(addr)
+	if err != nil {
+		return 0, err
+	}
+	pkt, err := newUDPHeader(dest, b).Bytes()
+	if err != nil {
+		return 0, err
+	}
+	if len(pkt) > maxUDPPayload {
+		return 0, ErrDatagramTooLarge
+	}
+	_, err = u.local.WriteToUDP(pkt, relay)
+	if err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// addressOf convert addr to Address.
+func addressOf(addr net.Addr) (*Address, error) {
+	switch a := addr.(type) {
+	case *Address:
+		return a, nil
+	case *net.UDPAddr:
+		if ip4 := a.IP.To4(); ip4 != nil {
+			return &Address{ip4, IPV4_ADDRESS, uint16(a.Port)}, nil
+		}
+		return &Address{a.IP.To16(), IPV6_ADDRESS, uint16(a.Port)}, nil
+	}
+	return ParseAddress(addr.String())
+}
+
+// Close the association and the local socket.
+func (u *UDPConn) Close() error {
+	u.closeOnce.Do(func() {
+		close(u.closed)
+		u.mu.Lock()
+		u.ctrl.Close()
+		u.mu.Unlock()
+	})
+	return u.local.Close()
+}
+
+// LocalAddr return the local socket address.
+func (u *UDPConn) LocalAddr() net.Addr {
+	return u.local.LocalAddr()
+}
+
+// SetDeadline sets the read and write deadlines of the local socket.
+func (u *UDPConn) SetDeadline(t time.Time) error {
+	return u.local.SetDeadline(t)
+}
+
+// SetReadDeadline sets the read deadline of the local socket.
+func (u *UDPConn) SetReadDeadline(t time.Time) error {
+	return u.local.SetReadDeadline(t)
+}
+
+// SetWriteDeadline sets the write deadline of the local socket.
+func (u *UDPConn) SetWriteDeadline(t time.Time) error {
+	return u.local.SetWriteDeadline(t)
+}
+
+// DialUDP creates an UDP association connected to address, like
+// net.DialUDP: Write sends to address and Read only returns datagrams
+// coming from it, the UDP request header is handled internally.
+func (c *Client) DialUDP(address string) (net.Conn, error) {
+	return c.DialUDPContext(context.Background(), address)
+}
+
+// DialUDPContext is DialUDP using ctx for the association setup.
+func (c *Client) DialUDPContext(ctx context.Context, address string) (net.Conn, error) {
+	return c.dialUDP(ctx, "udp", address)
+}
+
+// dialUDP is DialUDPContext resolving address for network.
+func (c *Client) dialUDP(ctx context.Context, network, address string) (net.Conn, error) {
+	dest, err := c.destination(ctx, network, address)
+	if err != nil {
+		return nil, err
+	}
+	u, err := c.ListenPacket(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &connectedUDPConn{UDPConn: u, dest: dest}, nil
+}
+
+// connectedUDPConn is an UDPConn pinned to one destination.
+type connectedUDPConn struct {
+	*UDPConn
+	dest *Address
+}
+
+// Read a datagram from the destination. Datagrams from other senders
+// are dropped. The sender of datagrams to a domain name destination can
+// not be matched, so all datagrams are accepted in that case.
+func (c *connectedUDPConn) Read(b []byte) (int, error) {
+	for {
+		n, addr, err := c.ReadFrom(b)
+		if err != nil {
+			return 0, err
+		}
+		if c.dest.ATYPE == DOMAINNAME || c.from(addr) {
+			return n, nil
+		}
+	}
+}
+
+// from report whether addr is the destination.
+func (c *connectedUDPConn) from(addr net.Addr) bool {
+	ua, ok := addr.(*net.UDPAddr)
+	return ok && ua.IP.Equal(c.dest.Addr) && ua.Port == int(c.dest.Port)
+}
+
+// Write b to the destination.
+func (c *connectedUDPConn) Write(b []byte) (int, error) {
+	return c.WriteTo(b, c.dest)
+}
+
+// RemoteAddr return the destination address.
+func (c *connectedUDPConn) RemoteAddr() net.Addr {
+	if ua := udpAddr(c.dest); ua != nil {
+		return ua
+	}
+	return c.dest
+}
@@ -0,0 +1,73 @@
+// Command socks5-replay replays a negotiation trace recorded by a
+// socks5.Tracer against a running socks server, and prints the decoded
+// recorded and replayed negotiations.
+//
+// Usage:
+//
+//	socks5-replay -addr 127.0.0.1:1080 trace.txt
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"time"
+
+	"github.com/haochen233/socks5"
+)
+
+func main() {
+	addr := flag.String("addr", "127.0.0.1:1080", "socks server address")
+	timeout := flag.Duration("timeout", 10*time.Second, "replay timeout")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: %s [flags] trace-file\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	err := run(*addr, flag.Arg(0), *timeout)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+func run(addr, path string, timeout time.Duration) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	trace, err := socks5.ReadTrace(f)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	replayed, replayErr := socks5.Replay(ctx, conn, trace)
+
+	fmt.Println("recorded:")
+	err = trace.Decode(os.Stdout)
+	if err != nil {
+		return err
+	}
+	fmt.Println("\nreplayed:")
+	err = replayed.Decode(os.Stdout)
+	if err != nil {
+		return err
+	}
+	return replayErr
+}
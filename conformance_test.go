@@ -0,0 +1,179 @@
+package socks5
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"testing"
+	"time"
+)
+
+// Conformance vectors document the byte-level behavior of the server
+// and the client on valid and invalid input. BND addresses of the server
+// are 0.0.0.0:0 as the connections are pipes.
+
+// serverVectors are the bytes sent by a client and the bytes the server
+// answers. If open is set, the server is expected to keep the connection
+// open for the relay, otherwise to close it after answering.
+var serverVectors = []struct {
+	name string
+	in   string
+	out  string
+	open bool
+}{
+	{"connect ipv4", "\x05\x01\x00" + "\x05\x01\x00\x01\x7f\x00\x00\x01\x00\x50", "\x05\x00" + "\x05\x00\x00\x01\x00\x00\x00\x00\x00\x00", true},
+	{"connect domain", "\x05\x01\x00" + "\x05\x01\x00\x03\x09localhost\x00\x50", "\x05\x00" + "\x05\x00\x00\x01\x00\x00\x00\x00\x00\x00", true},
+	{"connect ipv6", "\x05\x01\x00" + "\x05\x01\x00\x04" + "\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x01" + "\x00\x50", "\x05\x00" + "\x05\x00\x00\x01\x00\x00\x00\x00\x00\x00", true},
+	{"no acceptable method", "\x05\x01\x02", "\x05\xff", false},
+	{"no methods", "\x05\x00", "\x05\xff", false},
+	{"unknown version", "\x06\x01\x00", "", false},
+	{"request version mismatch", "\x05\x01\x00" + "\x04\x01\x00\x01\x7f\x00\x00\x01\x00\x50", "\x05\x00", false},
+	{"unknown address type", "\x05\x01\x00" + "\x05\x01\x00\x02\x00\x00", "\x05\x00" + "\x05\x08\x00\x01\x00\x00\x00\x00\x00\x00", false},
+	{"empty domain", "\x05\x01\x00" + "\x05\x01\x00\x03\x00\x00\x50", "\x05\x00" + "\x05\x01\x00\x01\x00\x00\x00\x00\x00\x00", false},
+	{"unknown command", "\x05\x01\x00" + "\x05\x09\x00\x01\x7f\x00\x00\x01\x00\x50", "\x05\x00" + "\x05\x07\x00\x01\x00\x00\x00\x00\x00\x00", false},
+	{"socks4 connect", "\x04\x01\x00\x50\x7f\x00\x00\x01user\x00", "\x00\x5a\x00\x00\x00\x00\x00\x00", true},
+	{"socks4a connect", "\x04\x01\x00\x50\x00\x00\x00\x01\x00localhost\x00", "\x00\x5a\x00\x00\x00\x00\x00\x00", true},
+}
+
+// clientVectors are the bytes answered by a server to a CONNECT request
+// with Username/Password offered, and the error expected from the client.
+var clientVectors = []struct {
+	name string
+	in   string
+	err  interface{}
+}{
+	{"no authentication", "\x05\x00" + "\x05\x00\x00\x01\x7f\x00\x00\x01\x04\x38", nil},
+	{"username/password", "\x05\x02" + "\x01\x00" + "\x05\x00\x00\x03\x09localhost\x04\x38", nil},
+	{"bad credentials", "\x05\x02" + "\x01\x01", errAuthFailed},
+	{"authentication version", "\x05\x02" + "\x05\x00", new(*VersionError)},
+	{"no acceptable method", "\x05\xff", new(*MethodError)},
+	{"unknown method", "\x05\x80", new(*MethodError)},
+	{"socks4 server", "\x00\x5a", new(*VersionError)},
+	{"connection refused", "\x05\x00" + "\x05\x05\x00\x01\x00\x00\x00\x00\x00\x00", new(*REPError)},
+	{"short failure reply", "\x05\x00" + "\x05\x04\x00", new(*REPError)},
+	{"reply version", "\x05\x00" + "\x04\x00\x00\x01\x00\x00\x00\x00\x00\x00", new(*VersionError)},
+	{"unknown address type", "\x05\x00" + "\x05\x00\x00\x02\x00\x00", new(*AtypeError)},
+	{"truncated reply", "\x05\x00" + "\x05\x00\x00\x01\x7f\x00", io.ErrUnexpectedEOF},
+}
+
+// udpHeaderVectors are datagrams of UDP associations.
+var udpHeaderVectors = []struct {
+	name string
+	in   string
+	dest string
+	data string
+	frag byte
+	err  bool
+}{
+	{"ipv4", "\x00\x00\x00\x01\x0a\x00\x00\x01\x00\x35data", "10.0.0.1:53", "data", 0, false},
+	{"domain", "\x00\x00\x00\x03\x09localhost\x00\x35", "localhost:53", "", 0, false},
+	{"fragment", "\x00\x00\x02\x01\x0a\x00\x00\x01\x00\x35data", "10.0.0.1:53", "data", 2, false},
+	{"short", "\x00\x00\x00", "", "", 0, true},
+	{"truncated address", "\x00\x00\x00\x04\x00\x00", "", "", 0, true},
+	{"unknown address type", "\x00\x00\x00\x05\x00\x00\x00\x00\x00\x00", "", "", 0, true},
+}
+
+// pipeDialer connects to destinations with pipes.
+var pipeDialer = dialContextFunc(func(ctx context.Context, network, address string) (net.Conn, error) {
+	conn, _ := net.Pipe()
+	return conn, nil
+})
+
+func TestConformance_Server(t *testing.T) {
+	for _, v := range serverVectors {
+		srv := &Server{Router: RouterFunc(func(s *Session, dest *Address) []Route {
+			return []Route{{Name: "pipe", Dialer: pipeDialer}}
+		})}
+		srv.ErrorLog = log.New(io.Discard, "", 0)
+		client, server := net.Pipe()
+		done := make(chan struct{})
+		go func() {
+			srv.ServeConn(context.Background(), server)
+			close(done)
+		}()
+		go client.Write([]byte(v.in))
+
+		client.SetReadDeadline(time.Now().Add(time.Second))
+		out, err := ReadNBytes(client, len(v.out))
+		if err != nil || string(out) != v.out {
+			t.Errorf("%s: got %x, %v, expected %x", v.name, out, err, v.out)
+		}
+		client.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+		_, err = client.Read(make([]byte, 1))
+		var ne net.Error
+		timeout := errors.As(err, &ne) && ne.Timeout()
+		if v.open && !timeout {
+			t.Errorf("%s: connection closed: %v", v.name, err)
+		}
+		if !v.open && err != io.EOF {
+			t.Errorf("%s: connection not closed: %v", v.name, err)
+		}
+		client.Close()
+		<-done
+	}
+}
+
+func TestConformance_Client(t *testing.T) {
+	for _, v := range clientVectors {
+		in := v.in
+		client := &Client{
+			ProxyAddr: "proxy:1080",
+			Username:  "admin",
+			Password:  "123456",
+			Dialer: dialContextFunc(func(ctx context.Context, network, address string) (net.Conn, error) {
+				client, server := net.Pipe()
+				go io.Copy(io.Discard, server)
+				go func() {
+					server.Write([]byte(in))
+					server.Close()
+				}()
+				return client, nil
+			}),
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		conn, err := client.DialContext(ctx, "tcp", "192.0.2.1:80")
+		cancel()
+		switch expected := v.err.(type) {
+		case nil:
+			if err != nil {
+				t.Errorf("%s: %v", v.name, err)
+			} else {
+				conn.Close()
+			}
+		case error:
+			if !errors.Is(err, expected) {
+				t.Errorf("%s: got %v, expected %v", v.name, err, expected)
+			}
+		default:
+			if !errors.As(err, expected) {
+				t.Errorf("%s: got %v, expected %T", v.name, err, expected)
+			}
+		}
+	}
+}
+
+func TestConformance_UDPHeader(t *testing.T) {
+	for _, v := range udpHeaderVectors {
+		h, err := ParseUDPHeader([]byte(v.in))
+		if v.err {
+			if err == nil {
+				t.Errorf("%s: no error", v.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", v.name, err)
+			continue
+		}
+		if h.Address().String() != v.dest || string(h.Data) != v.data || h.FRAG != v.frag {
+			t.Errorf("%s: got %s %q frag %d", v.name, h.Address(), h.Data, h.FRAG)
+		}
+		// valid headers encode back to the same bytes.
+		b, err := h.Bytes()
+		if err != nil || string(b) != v.in {
+			t.Errorf("%s: encoded %x, %v", v.name, b, err)
+		}
+	}
+}
@@ -0,0 +1,72 @@
+package socks5
+
+import (
+	"context"
+	"io"
+	"log"
+	"net"
+	"testing"
+	"time"
+)
+
+// blockingStore is a ContextUserPwdStore blocking validations until their
+// context is done.
+type blockingStore struct {
+	UserPwdStore
+	cancelled chan error
+}
+
+func (b blockingStore) ValidateContext(ctx context.Context, username, password string) error {
+	<-ctx.Done()
+	b.cancelled <- ctx.Err()
+	return ctx.Err()
+}
+
+func TestServer_ConnContext(t *testing.T) {
+	store := blockingStore{NewMemeryStore(nil, ""), make(chan error, 1)}
+	srv := &Server{
+		Authenticators: map[METHOD]Authenticator{USERNAME_PASSWORD: UserPwdAuth{store}},
+		ConnContext: func(ctx context.Context, c net.Conn) context.Context {
+			ctx, cancel := context.WithTimeout(ctx, 100*time.Millisecond)
+			time.AfterFunc(time.Second, cancel)
+			return ctx
+		},
+		ErrorLog: log.New(io.Discard, "", 0),
+	}
+	client := &Client{ProxyAddr: serveTest(t, srv), Username: "admin", Password: "123456"}
+	if _, err := client.Dial("tcp", echoTest(t)); err == nil {
+		t.Error("dial succeeded")
+	}
+	select {
+	case err := <-store.cancelled:
+		if err != context.DeadlineExceeded {
+			t.Errorf("validation ended with %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("validation not cancelled")
+	}
+}
+
+func TestServer_BaseContext(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	srv := &Server{BaseContext: func(net.Listener) context.Context { return ctx }}
+	go srv.Serve(ln)
+
+	client := &Client{ProxyAddr: ln.Addr().String()}
+	conn, err := client.Dial("tcp", echoTest(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	cancel()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("relay not ended by the base context: %v", err)
+	}
+}
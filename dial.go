@@ -0,0 +1,254 @@
+package socks5
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// DialErrorClass classifies the failure of a dial to the destination.
+type DialErrorClass uint8
+
+const (
+	// DialErrorOther is any failure not covered by other classes.
+	DialErrorOther DialErrorClass = iota
+	// DialErrorDNSNotFound means the destination domain name does not
+	// exist (NXDOMAIN) or has no address.
+	DialErrorDNSNotFound
+	// DialErrorDNSTimeout means the resolution of destination timed out.
+	DialErrorDNSTimeout
+	// DialErrorDNSFailure means the resolver failed to answer, such as
+	// SERVFAIL or REFUSED.
+	DialErrorDNSFailure
+	// DialErrorTimeout means the connection attempt timed out.
+	DialErrorTimeout
+	// DialErrorRefused means the destination refused the connection.
+	DialErrorRefused
+	// DialErrorNetworkUnreachable means there is no route to the network.
+	DialErrorNetworkUnreachable
+	// DialErrorHostUnreachable means there is no route to the host.
+	DialErrorHostUnreachable
+)
+
+var dialErrorClass2Str = map[DialErrorClass]string{
+	DialErrorOther:              "other",
+	DialErrorDNSNotFound:        "dns not found",
+	DialErrorDNSTimeout:         "dns timeout",
+	DialErrorDNSFailure:         "dns failure",
+	DialErrorTimeout:            "timeout",
+	DialErrorRefused:            "refused",
+	DialErrorNetworkUnreachable: "network unreachable",
+	DialErrorHostUnreachable:    "host unreachable",
+}
+
+func (c DialErrorClass) String() string {
+	if str, ok := dialErrorClass2Str[c]; ok {
+		return str
+	}
+	return "unknown(" + strconv.Itoa(int(c)) + ")"
+}
+
+// IsDNS report whether c is a name resolution failure.
+func (c DialErrorClass) IsDNS() bool {
+	return c == DialErrorDNSNotFound || c == DialErrorDNSTimeout || c == DialErrorDNSFailure
+}
+
+// DialError describes a failed connection attempt to the destination
+// of a client request.
+type DialError struct {
+	// Route is the name of the route which failed.
+	Route string
+
+	// Dest is the destination requested by the client.
+	Dest *Address
+
+	// Tried are the resolved addresses which were tried, in order.
+	// It is empty if the resolution failed.
+	Tried []net.IP
+
+	// Class classifies Err.
+	Class DialErrorClass
+
+	// REP is the reply code sent to the client.
+	REP REP
+
+	// Err is the last error that occurred.
+	Err error
+}
+
+func (e *DialError) Error() string {
+	return fmt.Sprintf("dial %s via %s (%s): %v", e.Dest, e.Route, e.Class, e.Err)
+}
+
+func (e *DialError) Unwrap() error {
+	return e.Err
+}
+
+// rep2DialErrorClass map the failure replies of upstream proxies to the
+// class of the failure, DialErrorOther for the other replies.
+var rep2DialErrorClass = map[REP]DialErrorClass{
+	TTL_EXPIRED:         DialErrorTimeout,
+	CONNECTION_REFUSED:  DialErrorRefused,
+	NETWORK_UNREACHABLE: DialErrorNetworkUnreachable,
+	HOST_UNREACHABLE:    DialErrorHostUnreachable,
+}
+
+// ClassifyDialError map err, the failure to connect to a destination, to
+// its class and the socks5 reply code the server sends by default:
+//
+//	NXDOMAIN, no address             HOST_UNREACHABLE
+//	DNS timeout, connection timeout  TTL_EXPIRED
+//	SERVFAIL and other DNS failures  GENERAL_SOCKS_SERVER_FAILURE
+//	ECONNREFUSED                     CONNECTION_REFUSED
+//	ENETUNREACH, ENETDOWN            NETWORK_UNREACHABLE
+//	EHOSTUNREACH, EHOSTDOWN          HOST_UNREACHABLE
+//	no address of AddressFamily      NETWORK_UNREACHABLE
+//	private address                  CONNECTION_NOT_ALLOW_BY_RULESET
+//	others                           GENERAL_SOCKS_SERVER_FAILURE
+//
+// The reply of an upstream proxy, as *REPError, is kept. See
+// Server.DialErrorReply to change the reply codes.
+func ClassifyDialError(err error) (DialErrorClass, REP) {
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		switch {
+		case dnsErr.IsNotFound:
+			return DialErrorDNSNotFound, HOST_UNREACHABLE
+		case dnsErr.IsTimeout:
+			return DialErrorDNSTimeout, TTL_EXPIRED
+		default:
+			return DialErrorDNSFailure, GENERAL_SOCKS_SERVER_FAILURE
+		}
+	}
+	var repErr *REPError
+	if errors.As(err, &repErr) {
+		// the upstream proxy of the route failed, keep its reply.
+		return rep2DialErrorClass[repErr.REP], repErr.REP
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return DialErrorTimeout, TTL_EXPIRED
+	}
+	switch {
+	case errors.Is(err, errAddressFamily):
+		return DialErrorNetworkUnreachable, NETWORK_UNREACHABLE
+	case errors.Is(err, errPrivateNetwork):
+		return DialErrorOther, CONNECTION_NOT_ALLOW_BY_RULESET
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return DialErrorRefused, CONNECTION_REFUSED
+	case errors.Is(err, syscall.ENETUNREACH), errors.Is(err, syscall.ENETDOWN):
+		return DialErrorNetworkUnreachable, NETWORK_UNREACHABLE
+	case errors.Is(err, syscall.EHOSTUNREACH), errors.Is(err, syscall.EHOSTDOWN):
+		return DialErrorHostUnreachable, HOST_UNREACHABLE
+	}
+	return DialErrorOther, GENERAL_SOCKS_SERVER_FAILURE
+}
+
+// dialTCP connect to dest through the routes selected for s, falling back
+// to alternate routes within the retry budget. The OnDialError hook is
+// called for every failed route. On failure the returned error is the
+// *DialError of the last route tried.
+func (srv *Server) dialTCP(s *Session, dest *Address) (net.Conn, error) {
+	var e *DialError
+	start := time.Now()
+	for _, r := range srv.routes(s, dest) {
+		var conn net.Conn
+		attempt := time.Now()
+		conn, e = srv.dialRoute(s, r, dest)
+		if e == nil {
+			srv.dialed(s, r.Name, time.Since(attempt), nil)
+			if srv.Latency != nil {
+				srv.Latency.latency(dest).Dial.Observe(time.Since(start))
+			}
+			s.route = r
+			s.Set(MetaRoute, r.Name)
+			return conn, nil
+		}
+		latency := time.Since(attempt)
+		srv.dialed(s, r.Name, latency, e)
+		srv.logDialError(s, e, latency)
+		srv.onDialError(s, e)
+	}
+	return nil, e
+}
+
+// dialRoute connect to dest through r, trying each of its resolved
+// addresses in turn, or racing them if RaceDelay or FallbackDelay is
+// set.
+func (srv *Server) dialRoute(s *Session, r Route, dest *Address) (net.Conn, *DialError) {
+	ctx := s.Context()
+	if srv.DialTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, srv.DialTimeout)
+		defer cancel()
+	}
+	e := &DialError{Route: r.Name, Dest: dest}
+	if dest.ATYPE == DOMAINNAME && (r.RemoteDNS || srv.RemoteDNS) {
+		address := net.JoinHostPort(string(dest.Addr), strconv.Itoa(int(dest.Port)))
+		conn, err := srv.routeDialer(r).DialContext(ctx, "tcp", address)
+		if err == nil {
+			return conn, nil
+		}
+		srv.classify(e, err)
+		return nil, e
+	}
+	ips, err := resolve(ctx, srv.routeResolver(r), dest)
+	if err == nil && len(ips) == 0 {
+		err = &net.DNSError{Err: "no such host", Name: string(dest.Addr), IsNotFound: true}
+	}
+	if err == nil {
+		if ips = srv.AddressFamily.apply(ips); len(ips) == 0 {
+			err = errAddressFamily
+		}
+	}
+	if err == nil {
+		dialer := srv.routeDialer(r)
+		port := strconv.Itoa(int(dest.Port))
+		first, delay := srv.RaceDelay, srv.RaceDelay
+		if srv.FallbackDelay > 0 && len(ips) > 1 {
+			var mixed bool
+			if ips, mixed = interleave(ips); mixed {
+				first = srv.FallbackDelay
+				if delay <= 0 {
+					delay = srv.FallbackDelay
+				}
+			}
+		}
+		if first > 0 && len(ips) > 1 {
+			e.Tried = ips
+			addrs := make([]net.IPAddr, len(ips))
+			for i, ip := range ips {
+				addrs[i].IP = ip
+			}
+			var conn net.Conn
+			if conn, err = race(ctx, dialer, addrs, port, first, delay); err == nil {
+				return conn, nil
+			}
+		} else {
+			for _, ip := range ips {
+				var conn net.Conn
+				e.Tried = append(e.Tried, ip)
+				conn, err = dialer.DialContext(ctx, "tcp", net.JoinHostPort(ip.String(), port))
+				if err == nil {
+					return conn, nil
+				}
+			}
+		}
+	}
+
+	srv.classify(e, err)
+	return nil, e
+}
+
+// classify record err as the failure of e, with its class and reply.
+func (srv *Server) classify(e *DialError, err error) {
+	e.Err = err
+	e.Class, e.REP = ClassifyDialError(err)
+	if srv.DialErrorReply != nil {
+		e.REP = srv.DialErrorReply(e)
+	}
+}
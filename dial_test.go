@@ -0,0 +1,166 @@
+package socks5
+
+import (
+	"context"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestServer_OnDialError(t *testing.T) {
+	// get a port nobody listens on
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := ln.Addr().(*net.TCPAddr).Port
+	ln.Close()
+
+	errCh := make(chan *DialError, 1)
+	srv := &Server{
+		Hooks: Hooks{
+			OnDialError: func(s *Session, e *DialError) { errCh <- e },
+		},
+	}
+	addr := serveTest(t, srv)
+
+	dest := &Address{net.IPv4(127, 0, 0, 1).To4(), IPV4_ADDRESS, uint16(port)}
+	_, reply := connectTest(t, addr, dest)
+	if reply[1] != CONNECTION_REFUSED {
+		t.Errorf("reply: %#x, want: %#x", reply[1], CONNECTION_REFUSED)
+	}
+
+	e := <-errCh
+	if e.Class != DialErrorRefused || e.REP != CONNECTION_REFUSED {
+		t.Errorf("class: %s, rep: %#x", e.Class, e.REP)
+	}
+	if len(e.Tried) != 1 || !e.Tried[0].Equal(dest.Addr) {
+		t.Errorf("tried: %v, want: [%s]", e.Tried, dest.Addr)
+	}
+}
+
+func TestServer_DialErrorReply(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := ln.Addr().(*net.TCPAddr).Port
+	ln.Close()
+
+	errCh := make(chan *DialError, 1)
+	srv := &Server{
+		DialErrorReply: func(e *DialError) REP {
+			if e.Class != DialErrorRefused || e.REP != CONNECTION_REFUSED {
+				t.Errorf("class: %s, rep: %#x", e.Class, e.REP)
+			}
+			return GENERAL_SOCKS_SERVER_FAILURE
+		},
+		Hooks: Hooks{
+			OnDialError: func(s *Session, e *DialError) { errCh <- e },
+		},
+	}
+	addr := serveTest(t, srv)
+
+	dest := &Address{net.IPv4(127, 0, 0, 1).To4(), IPV4_ADDRESS, uint16(port)}
+	_, reply := connectTest(t, addr, dest)
+	if reply[1] != GENERAL_SOCKS_SERVER_FAILURE {
+		t.Errorf("reply: %#x, want: %#x", reply[1], GENERAL_SOCKS_SERVER_FAILURE)
+	}
+	if e := <-errCh; e.REP != GENERAL_SOCKS_SERVER_FAILURE {
+		t.Errorf("hook rep: %#x, want: %#x", e.REP, GENERAL_SOCKS_SERVER_FAILURE)
+	}
+}
+
+func TestClassifyDialError(t *testing.T) {
+	tests := []struct {
+		err   error
+		class DialErrorClass
+		rep   REP
+	}{
+		{&net.DNSError{Err: "no such host", IsNotFound: true}, DialErrorDNSNotFound, HOST_UNREACHABLE},
+		{&net.DNSError{Err: "i/o timeout", IsTimeout: true}, DialErrorDNSTimeout, TTL_EXPIRED},
+		{&net.DNSError{Err: "server misbehaving", IsTemporary: true}, DialErrorDNSFailure, GENERAL_SOCKS_SERVER_FAILURE},
+		{&net.OpError{Op: "dial", Err: &os.SyscallError{Syscall: "connect", Err: syscall.ECONNREFUSED}}, DialErrorRefused, CONNECTION_REFUSED},
+		{&net.OpError{Op: "dial", Err: &os.SyscallError{Syscall: "connect", Err: syscall.ENETUNREACH}}, DialErrorNetworkUnreachable, NETWORK_UNREACHABLE},
+		{&net.OpError{Op: "dial", Err: &os.SyscallError{Syscall: "connect", Err: syscall.EHOSTDOWN}}, DialErrorHostUnreachable, HOST_UNREACHABLE},
+		{&net.OpError{Op: "dial", Err: &os.SyscallError{Syscall: "connect", Err: syscall.ETIMEDOUT}}, DialErrorTimeout, TTL_EXPIRED},
+		{errAddressFamily, DialErrorNetworkUnreachable, NETWORK_UNREACHABLE},
+		{&REPError{HOST_UNREACHABLE}, DialErrorHostUnreachable, HOST_UNREACHABLE},
+		{&REPError{CONNECTION_NOT_ALLOW_BY_RULESET}, DialErrorOther, CONNECTION_NOT_ALLOW_BY_RULESET},
+	}
+	for _, test := range tests {
+		class, rep := ClassifyDialError(test.err)
+		if class != test.class || rep != test.rep {
+			t.Errorf("%v: got (%s, %#x), want (%s, %#x)", test.err, class, rep, test.class, test.rep)
+		}
+	}
+}
+
+func TestServer_Dialer(t *testing.T) {
+	echo := echoTest(t)
+	dialed := make(chan string, 1)
+	srv := &Server{Dialer: dialContextFunc(func(ctx context.Context, network, address string) (net.Conn, error) {
+		dialed <- address
+		return (&net.Dialer{}).DialContext(ctx, network, address)
+	})}
+	conn, err := (&Client{ProxyAddr: serveTest(t, srv)}).Dial("tcp", echo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	if address := <-dialed; address != echo {
+		t.Errorf("dialed %s, want %s", address, echo)
+	}
+}
+
+func TestServer_LocalIPs(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	peers := make(chan net.Addr, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		peers <- conn.RemoteAddr()
+		conn.Close()
+	}()
+	srv := &Server{LocalIPs: []net.IP{net.IPv6loopback, net.IPv4(127, 0, 0, 2)}}
+	conn, err := (&Client{ProxyAddr: serveTest(t, srv)}).Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	if peer := <-peers; !peer.(*net.TCPAddr).IP.Equal(net.IPv4(127, 0, 0, 2)) {
+		t.Errorf("dialed from %s, want 127.0.0.2", peer)
+	}
+}
+
+func TestServer_RaceDelay(t *testing.T) {
+	echo := echoTest(t)
+	_, port, _ := net.SplitHostPort(echo)
+	blackholed := net.JoinHostPort("192.0.2.1", port)
+	srv := &Server{
+		Resolver: NameResolverFunc(func(ctx context.Context, fqdn string) ([]net.IP, error) {
+			return []net.IP{net.ParseIP("192.0.2.1"), net.IPv4(127, 0, 0, 1)}, nil
+		}),
+		Dialer: dialContextFunc(func(ctx context.Context, network, address string) (net.Conn, error) {
+			if address == blackholed {
+				<-ctx.Done()
+				return nil, ctx.Err()
+			}
+			return (&net.Dialer{}).DialContext(ctx, network, address)
+		}),
+		RaceDelay: 10 * time.Millisecond,
+	}
+	conn, err := (&Client{ProxyAddr: serveTest(t, srv)}).Dial("tcp", "race.test:"+port)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+}
@@ -0,0 +1,169 @@
+package socks5
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"strings"
+)
+
+// DNS message constants, please see RFC 1035, RFC 6891 and RFC 7871.
+const (
+	dnsTypeA    uint16 = 1
+	dnsTypeAAAA uint16 = 28
+	dnsTypeOPT  uint16 = 41
+	dnsClassIN  uint16 = 1
+
+	dnsRcodeSuccess  = 0
+	dnsRcodeServFail = 2
+	dnsRcodeNXDomain = 3
+
+	ednsOptionECS = 8
+)
+
+var (
+	errDNSShortMessage = errors.New("dns message too short")
+	errDNSBadName      = errors.New("dns bad name")
+)
+
+// dnsQuery build a recursive query message for name and qtype. If ecs is
+// not nil an OPT record carrying the EDNS Client Subnet option is added.
+// The message ID is 0 as recommended for DNS over HTTPS.
+func dnsQuery(name string, qtype uint16, ecs *net.IPNet) ([]byte, error) {
+	msg := make([]byte, 12, 512)
+	// flags: RD
+	binary.BigEndian.PutUint16(msg[2:], 0x0100)
+	// QDCOUNT
+	binary.BigEndian.PutUint16(msg[4:], 1)
+
+	// QNAME
+	name = strings.TrimSuffix(name, ".")
+	if len(name) > 253 {
+		return nil, errDNSBadName
+	}
+	for _, label := range strings.Split(name, ".") {
+		if len(label) == 0 || len(label) > 63 {
+			return nil, errDNSBadName
+		}
+		msg = append(msg, byte(len(label)))
+		msg = append(msg, label...)
+	}
+	msg = append(msg, 0)
+	msg = appendUint16(msg, qtype)
+	msg = appendUint16(msg, dnsClassIN)
+
+	if ecs != nil {
+		// ARCOUNT
+		binary.BigEndian.PutUint16(msg[10:], 1)
+		msg = appendOPT(msg, ecs)
+	}
+	return msg, nil
+}
+
+// appendOPT append an OPT pseudo record with the client subnet option.
+//
+//	+---------------+---------------+---------------+---------------+
+//	|  OPTION-CODE  | OPTION-LENGTH |    FAMILY     |SOURCE|SCOPE   |
+//	+---------------+---------------+---------------+---------------+
+//	|                   ADDRESS (truncated to source prefix)        |
+//	+---------------------------------------------------------------+
+func appendOPT(msg []byte, ecs *net.IPNet) []byte {
+	family := uint16(1)
+	ip := ecs.IP.To4()
+	if ip == nil {
+		family = 2
+		ip = ecs.IP.To16()
+	}
+	prefix, _ := ecs.Mask.Size()
+	addr := ip.Mask(ecs.Mask)[:(prefix+7)/8]
+
+	// root name, TYPE, CLASS(udp payload size), TTL(extended rcode and flags)
+	msg = append(msg, 0)
+	msg = appendUint16(msg, dnsTypeOPT)
+	msg = appendUint16(msg, 4096)
+	msg = append(msg, 0, 0, 0, 0)
+	// RDLENGTH
+	msg = appendUint16(msg, uint16(4+4+len(addr)))
+	msg = appendUint16(msg, ednsOptionECS)
+	msg = appendUint16(msg, uint16(4+len(addr)))
+	msg = appendUint16(msg, family)
+	msg = append(msg, byte(prefix), 0)
+	return append(msg, addr...)
+}
+
+func appendUint16(b []byte, v uint16) []byte {
+	return append(b, byte(v>>8), byte(v))
+}
+
+// dnsAnswer is the result of parsing a response message.
+type dnsAnswer struct {
+	rcode int
+	ips   []net.IP
+	// ttl is the minimum TTL of address records, in seconds.
+	ttl uint32
+}
+
+// parseDNSResponse extract A and AAAA records from a response message.
+func parseDNSResponse(msg []byte) (*dnsAnswer, error) {
+	if len(msg) < 12 {
+		return nil, errDNSShortMessage
+	}
+	ans := &dnsAnswer{rcode: int(msg[3] & 0x0f)}
+	qdcount := int(binary.BigEndian.Uint16(msg[4:]))
+	ancount := int(binary.BigEndian.Uint16(msg[6:]))
+
+	off := 12
+	var err error
+	for i := 0; i < qdcount; i++ {
+		if off, err = skipDNSName(msg, off); err != nil {
+			return nil, err
+		}
+		// QTYPE, QCLASS
+		off += 4
+	}
+	for i := 0; i < ancount; i++ {
+		if off, err = skipDNSName(msg, off); err != nil {
+			return nil, err
+		}
+		if off+10 > len(msg) {
+			return nil, errDNSShortMessage
+		}
+		rtype := binary.BigEndian.Uint16(msg[off:])
+		ttl := binary.BigEndian.Uint32(msg[off+4:])
+		rdlen := int(binary.BigEndian.Uint16(msg[off+8:]))
+		off += 10
+		if off+rdlen > len(msg) {
+			return nil, errDNSShortMessage
+		}
+		rdata := msg[off : off+rdlen]
+		off += rdlen
+
+		if (rtype == dnsTypeA && rdlen == 4) || (rtype == dnsTypeAAAA && rdlen == 16) {
+			ans.ips = append(ans.ips, net.IP(append([]byte(nil), rdata...)))
+			if len(ans.ips) == 1 || ttl < ans.ttl {
+				ans.ttl = ttl
+			}
+		}
+	}
+	return ans, nil
+}
+
+// skipDNSName return the offset after the possibly compressed name at off.
+func skipDNSName(msg []byte, off int) (int, error) {
+	for {
+		if off >= len(msg) {
+			return 0, errDNSShortMessage
+		}
+		c := int(msg[off])
+		switch {
+		case c == 0:
+			return off + 1, nil
+		case c&0xc0 == 0xc0:
+			// compression pointer
+			return off + 2, nil
+		case c&0xc0 != 0:
+			return 0, errDNSBadName
+		}
+		off += c + 1
+	}
+}
@@ -0,0 +1,212 @@
+package socks5
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// maxDoHCacheEntries bounds the DoHResolver cache.
+const maxDoHCacheEntries = 4096
+
+// DoHResolver is a caching NameResolver using DNS over HTTPS (RFC 8484).
+// It can attach an EDNS Client Subnet (RFC 7871) to queries, so CDNs
+// answer with addresses close to the end client rather than the proxy.
+type DoHResolver struct {
+	// URL is the DoH endpoint, such as "https://1.1.1.1/dns-query".
+	URL string
+
+	// Client is the HTTP client to use. If nil, http.DefaultClient is used.
+	Client *http.Client
+
+	// ClientSubnet is the subnet sent in the EDNS Client Subnet option.
+	// If nil, no option is sent.
+	ClientSubnet *net.IPNet
+
+	// ForwardClientSubnet sends the subnet of the socks client's address
+	// instead of ClientSubnet, truncated to ClientSubnetPrefix4 or
+	// ClientSubnetPrefix6 bits. Clients on private or loopback networks,
+	// see IsPrivateIP, still use ClientSubnet.
+	ForwardClientSubnet bool
+
+	// ClientSubnetPrefix4 and ClientSubnetPrefix6 are the prefix lengths
+	// of forwarded client subnets. If zero, 24 and 56 are used.
+	ClientSubnetPrefix4 int
+	ClientSubnetPrefix6 int
+
+	mu    sync.Mutex
+	cache map[string]dohCacheEntry
+}
+
+type dohCacheEntry struct {
+	ips     []net.IP
+	expires time.Time
+}
+
+// Resolve the A and AAAA records of fqdn.
+func (r *DoHResolver) Resolve(ctx context.Context, fqdn string) ([]net.IP, error) {
+	ecs := r.clientSubnet(ctx)
+	key := fqdn
+	if ecs != nil {
+		key += "/" + ecs.String()
+	}
+	if ips, ok := r.lookupCache(key); ok {
+		return ips, nil
+	}
+
+	type result struct {
+		ans *dnsAnswer
+		err error
+	}
+	qtypes := []uint16{dnsTypeA, dnsTypeAAAA}
+	results := make([]chan result, len(qtypes))
+	for i, qtype := range qtypes {
+		results[i] = make(chan result, 1)
+		go func(ch chan result, qtype uint16) {
+			ans, err := r.exchange(ctx, fqdn, qtype, ecs)
+			ch <- result{ans, err}
+		}(results[i], qtype)
+	}
+
+	var ips []net.IP
+	var ttl uint32
+	var err error
+	for _, ch := range results {
+		res := <-ch
+		switch {
+		case res.err != nil:
+			err = res.err
+		case res.ans.rcode == dnsRcodeSuccess:
+			if len(res.ans.ips) > 0 && (len(ips) == 0 || res.ans.ttl < ttl) {
+				ttl = res.ans.ttl
+			}
+			ips = append(ips, res.ans.ips...)
+		case res.ans.rcode == dnsRcodeNXDomain:
+		default:
+			err = &net.DNSError{Err: "server misbehaving", Name: fqdn, Server: r.URL, IsTemporary: true}
+		}
+	}
+	if len(ips) == 0 {
+		if err != nil {
+			return nil, err
+		}
+		return nil, &net.DNSError{Err: "no such host", Name: fqdn, Server: r.URL, IsNotFound: true}
+	}
+
+	r.storeCache(key, ips, time.Duration(ttl)*time.Second)
+	return ips, nil
+}
+
+// exchange send a query to the DoH endpoint and parse the response.
+func (r *DoHResolver) exchange(ctx context.Context, fqdn string, qtype uint16, ecs *net.IPNet) (*dnsAnswer, error) {
+	msg, err := dnsQuery(fqdn, qtype, ecs)
+	if err != nil {
+		return nil, &net.DNSError{Err: err.Error(), Name: fqdn, Server: r.URL}
+	}
+
+	req, err := http.NewRequest(http.MethodPost, r.URL, bytes.NewReader(msg))
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/dns-message")
+	req.Header.Set("Accept", "application/dns-message")
+
+	client := r.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		var netErr net.Error
+		timeout := errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &netErr) && netErr.Timeout())
+		return nil, &net.DNSError{Err: err.Error(), Name: fqdn, Server: r.URL, IsTimeout: timeout, IsTemporary: true}
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, &net.DNSError{Err: "http status " + strconv.Itoa(resp.StatusCode), Name: fqdn, Server: r.URL, IsTemporary: true}
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 65535))
+	if err != nil {
+		return nil, &net.DNSError{Err: err.Error(), Name: fqdn, Server: r.URL, IsTemporary: true}
+	}
+	ans, err := parseDNSResponse(body)
+	if err != nil {
+		return nil, &net.DNSError{Err: err.Error(), Name: fqdn, Server: r.URL}
+	}
+	return ans, nil
+}
+
+// clientSubnet return the EDNS Client Subnet to send for the session in ctx.
+func (r *DoHResolver) clientSubnet(ctx context.Context) *net.IPNet {
+	if !r.ForwardClientSubnet {
+		return r.ClientSubnet
+	}
+	s := SessionFromContext(ctx)
+	if s == nil {
+		return r.ClientSubnet
+	}
+	ip := s.ClientIP()
+	if ip == nil || !ip.IsGlobalUnicast() || IsPrivateIP(ip) {
+		return r.ClientSubnet
+	}
+
+	if ip4 := ip.To4(); ip4 != nil {
+		prefix := r.ClientSubnetPrefix4
+		if prefix <= 0 || prefix > 32 {
+			prefix = 24
+		}
+		mask := net.CIDRMask(prefix, 32)
+		return &net.IPNet{IP: ip4.Mask(mask), Mask: mask}
+	}
+	prefix := r.ClientSubnetPrefix6
+	if prefix <= 0 || prefix > 128 {
+		prefix = 56
+	}
+	mask := net.CIDRMask(prefix, 128)
+	return &net.IPNet{IP: ip.Mask(mask), Mask: mask}
+}
+
+func (r *DoHResolver) lookupCache(key string) ([]net.IP, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	entry, ok := r.cache[key]
+	if !ok {
+		return nil, false
+	}
+	if time.Now().After(entry.expires) {
+		delete(r.cache, key)
+		return nil, false
+	}
+	return entry.ips, true
+}
+
+func (r *DoHResolver) storeCache(key string, ips []net.IP, ttl time.Duration) {
+	if ttl <= 0 {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.cache == nil {
+		r.cache = make(map[string]dohCacheEntry)
+	}
+	if len(r.cache) >= maxDoHCacheEntries {
+		now := time.Now()
+		for k, entry := range r.cache {
+			if now.After(entry.expires) {
+				delete(r.cache, k)
+			}
+		}
+		if len(r.cache) >= maxDoHCacheEntries {
+			r.cache = make(map[string]dohCacheEntry)
+		}
+	}
+	r.cache[key] = dohCacheEntry{ips: ips, expires: time.Now().Add(ttl)}
+}
@@ -0,0 +1,86 @@
+package socks5
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+)
+
+// dohTestHandler answer A queries of "example.com" with 93.184.216.34 and
+// NXDOMAIN for other names. The EDNS Client Subnet of queries is recorded.
+type dohTestHandler struct {
+	queries int32
+	ecs     atomic.Value
+}
+
+func (h *dohTestHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	atomic.AddInt32(&h.queries, 1)
+	query, _ := io.ReadAll(r.Body)
+	end, err := skipDNSName(query, 12)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	name := string(query[12 : end-1])
+	qtype := binary.BigEndian.Uint16(query[end:])
+	question := query[12 : end+4]
+
+	// OPT record: root name, type, class, ttl, rdlength, option code, option length
+	if opt := query[end+4:]; len(opt) > 15 {
+		h.ecs.Store(opt[15:])
+	}
+
+	resp := make([]byte, 12)
+	binary.BigEndian.PutUint16(resp[2:], 0x8180)
+	binary.BigEndian.PutUint16(resp[4:], 1)
+	resp = append(resp, question...)
+	switch {
+	case name != "\x07example\x03com":
+		resp[3] |= dnsRcodeNXDomain
+	case qtype == dnsTypeA:
+		binary.BigEndian.PutUint16(resp[6:], 1)
+		resp = append(resp, 0xc0, 12, 0, 1, 0, 1, 0, 0, 0, 60, 0, 4, 93, 184, 216, 34)
+	}
+	w.Header().Set("Content-Type", "application/dns-message")
+	w.Write(resp)
+}
+
+func TestDoHResolver(t *testing.T) {
+	h := &dohTestHandler{}
+	ts := httptest.NewServer(h)
+	defer ts.Close()
+
+	r := &DoHResolver{URL: ts.URL, ForwardClientSubnet: true}
+	s := &Session{ClientAddr: &net.TCPAddr{IP: net.IPv4(203, 0, 113, 77), Port: 40000}}
+	ctx := ContextWithSession(context.Background(), s)
+
+	for i := 0; i < 2; i++ {
+		ips, err := r.Resolve(ctx, "example.com")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(ips) != 1 || !ips[0].Equal(net.IPv4(93, 184, 216, 34)) {
+			t.Errorf("ips: %v", ips)
+		}
+	}
+	if n := atomic.LoadInt32(&h.queries); n != 2 {
+		t.Errorf("queries: %d, want 2 (A and AAAA, then cached)", n)
+	}
+
+	// family 1, source prefix 24, scope 0, 203.0.113
+	want := []byte{0, 1, 24, 0, 203, 0, 113}
+	if got, _ := h.ecs.Load().([]byte); string(got) != string(want) {
+		t.Errorf("client subnet option: %v, want: %v", got, want)
+	}
+
+	_, err := r.Resolve(ctx, "nonexistent.example")
+	dnsErr, ok := err.(*net.DNSError)
+	if !ok || !dnsErr.IsNotFound {
+		t.Errorf("error: %v, want not found *net.DNSError", err)
+	}
+}
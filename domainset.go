@@ -0,0 +1,122 @@
+package socks5
+
+import (
+	"fmt"
+	"strings"
+)
+
+// PublicSuffixList return the public suffix of domains, such as "co.uk"
+// for "www.example.co.uk". It is implemented by publicsuffix.List of
+// golang.org/x/net/publicsuffix, which the package does not depend on.
+type PublicSuffixList interface {
+	PublicSuffix(domain string) string
+}
+
+// DomainSet is a RuleSet allowing the requests to domain name
+// destinations in the set, and denying the others, including IP address
+// destinations. Its patterns are domain suffixes as in Match.Domains and
+// SplitTunnel: "example.com", ".example.com" and "*.example.com" all match
+// example.com itself and any name under it.
+//
+// Names are matched case insensitively, in time proportional to their
+// number of labels whatever the size of the set. Rules are evaluated
+// before the destination is resolved, and And and Or stop at the first
+// rule deciding: put a DomainSet before rules resolving names, such as
+// BlockPrivateNetworks, and blocked names are never resolved:
+//
+//	blocked, err := socks5.NewDomainSet("ads.example", "*.tracker.example")
+//	if err != nil {
+//		log.Fatal(err)
+//	}
+//	srv.Rules = socks5.And(socks5.DenyList(blocked), &socks5.BlockPrivateNetworks{})
+//
+// Add patterns before serving, or swap sets with Server.Reload.
+type DomainSet struct {
+	// PublicSuffixes optionally refuses patterns of a public suffix, such
+	// as "co.uk" or ".com", which would match the names of unrelated
+	// owners.
+	PublicSuffixes PublicSuffixList
+
+	root domainNode
+}
+
+// domainNode is the node of a label in the trie of the patterns of a
+// DomainSet, keyed by labels from the top-level domain down.
+type domainNode struct {
+	// match matches the name of the node and the names under it.
+	match    bool
+	children map[string]*domainNode
+}
+
+// NewDomainSet return the DomainSet of patterns.
+func NewDomainSet(patterns ...string) (*DomainSet, error) {
+	d := &DomainSet{}
+	if err := d.Add(patterns...); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// Add add patterns to the set.
+func (d *DomainSet) Add(patterns ...string) error {
+	for _, p := range patterns {
+		name := canonicalHost(p)
+		switch {
+		case strings.HasPrefix(name, "*."):
+			name = name[2:]
+		case strings.HasPrefix(name, "."):
+			name = name[1:]
+		}
+		labels := strings.Split(name, ".")
+		for _, label := range labels {
+			if label == "" || strings.ContainsAny(label, "* ") {
+				return fmt.Errorf("invalid domain pattern %q", p)
+			}
+		}
+		if d.PublicSuffixes != nil && d.PublicSuffixes.PublicSuffix(name) == name {
+			return fmt.Errorf("domain pattern %q covers the public suffix %s", p, name)
+		}
+		n := &d.root
+		for i := len(labels) - 1; i >= 0; i-- {
+			child, ok := n.children[labels[i]]
+			if !ok {
+				if n.children == nil {
+					n.children = make(map[string]*domainNode)
+				}
+				child = &domainNode{}
+				n.children[labels[i]] = child
+			}
+			n = child
+		}
+		n.match = true
+	}
+	return nil
+}
+
+// Contains report whether the domain name is in the set.
+func (d *DomainSet) Contains(name string) bool {
+	name = canonicalHost(name)
+	n := &d.root
+	for name != "" {
+		var label string
+		if i := strings.LastIndexByte(name, '.'); i >= 0 {
+			label, name = name[i+1:], name[:i]
+		} else {
+			label, name = name, ""
+		}
+		child, ok := n.children[label]
+		if !ok {
+			return false
+		}
+		if child.match {
+			return true
+		}
+		n = child
+	}
+	return false
+}
+
+// Allow report whether the destination of req is a domain name in d.
+func (d *DomainSet) Allow(s *Session, req *Request) bool {
+	return req.Address.ATYPE == DOMAINNAME && d.Contains(string(req.Address.Addr))
+}
@@ -0,0 +1,108 @@
+package socks5
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestDomainSet(t *testing.T) {
+	d, err := NewDomainSet("example.com", "*.tracker.test", ".Corp.Test.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, expected := range map[string]bool{
+		"example.com":       true,
+		"EXAMPLE.com.":      true,
+		"www.example.com":   true,
+		"tracker.test":      true,
+		"a.tracker.test":    true,
+		"a.b.tracker.test":  true,
+		"corp.test":         true,
+		"git.corp.test":     true,
+		"notcorp.test":      false,
+		"test":              false,
+		"":                  false,
+		"other.example.org": false,
+	} {
+		if got := d.Contains(name); got != expected {
+			t.Errorf("%q: %v, expected %v", name, got, expected)
+		}
+	}
+	// patterns mean what they mean in Match.Domains and SplitTunnel.
+	for _, pattern := range []string{"example.com", ".example.com", "*.example.com"} {
+		d, _ := NewDomainSet(pattern)
+		for _, name := range []string{"example.com", "www.example.com", "badexample.com", "com"} {
+			if got, expected := d.Contains(name), matchDomains(name, []string{pattern}); got != expected {
+				t.Errorf("%q in %q: %v, Match.Domains %v", name, pattern, got, expected)
+			}
+		}
+	}
+	for _, invalid := range []string{"", "*", "a..b", "*.*.example", "www.*.example"} {
+		if _, err := NewDomainSet(invalid); err == nil {
+			t.Errorf("%q: parsed", invalid)
+		}
+	}
+}
+
+// suffixesTest is a PublicSuffixList knowing co.uk and the top-level
+// domains.
+type suffixesTest struct{}
+
+func (suffixesTest) PublicSuffix(domain string) string {
+	if strings.HasSuffix(domain, ".co.uk") || domain == "co.uk" {
+		return "co.uk"
+	}
+	return domain[strings.LastIndexByte(domain, '.')+1:]
+}
+
+func TestDomainSet_PublicSuffixes(t *testing.T) {
+	d := &DomainSet{PublicSuffixes: suffixesTest{}}
+	for _, pattern := range []string{"*.co.uk", ".com", "co.uk"} {
+		if err := d.Add(pattern); err == nil {
+			t.Errorf("%q: added", pattern)
+		}
+	}
+	if err := d.Add("*.example.co.uk"); err != nil {
+		t.Fatal(err)
+	}
+	if !d.Contains("www.example.co.uk") || !d.Contains("example.co.uk") || d.Contains("co.uk") || d.Contains("other.co.uk") {
+		t.Error("Contains")
+	}
+}
+
+func TestDomainSet_NotResolved(t *testing.T) {
+	blocked, err := NewDomainSet(".blocked.test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var resolved []string
+	resolver := NameResolverFunc(func(ctx context.Context, fqdn string) ([]net.IP, error) {
+		resolved = append(resolved, fqdn)
+		return []net.IP{net.IPv4(198, 51, 100, 1)}, nil
+	})
+	rules := And(DenyList(blocked), &BlockPrivateNetworks{resolver})
+	s := &Session{}
+	for name, allowed := range map[string]bool{"www.blocked.test": false, "public.test": true} {
+		dest := &Address{[]byte(name), DOMAINNAME, 443}
+		if got := rules.Allow(s, &Request{VER: Version5, CMD: CONNECT, Address: dest}); got != allowed {
+			t.Errorf("%s: allowed %v", name, got)
+		}
+	}
+	if len(resolved) != 1 || resolved[0] != "public.test" {
+		t.Errorf("resolved %v", resolved)
+	}
+}
+
+func BenchmarkDomainSet(b *testing.B) {
+	d := &DomainSet{}
+	for i := 0; i < 100000; i++ {
+		d.Add("*.host" + strconv.Itoa(i) + ".example")
+	}
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		d.Contains("www.cdn.host4242.example")
+	}
+}
@@ -0,0 +1,112 @@
+package socks5
+
+import (
+	"errors"
+	"net"
+)
+
+// AddressFamily is the policy of the server on the IP families of the
+// destinations it connects to, applied to their resolved addresses.
+type AddressFamily uint8
+
+const (
+	// AnyFamily keeps the addresses in the order of the resolver.
+	AnyFamily AddressFamily = iota
+	// PreferIPv4 tries the IPv4 addresses before the IPv6 ones.
+	PreferIPv4
+	// PreferIPv6 tries the IPv6 addresses before the IPv4 ones.
+	PreferIPv6
+	// OnlyIPv4 connects to IPv4 addresses only.
+	OnlyIPv4
+	// OnlyIPv6 connects to IPv6 addresses only.
+	OnlyIPv6
+)
+
+var addressFamily2Str = map[AddressFamily]string{
+	AnyFamily:  "any",
+	PreferIPv4: "prefer ipv4",
+	PreferIPv6: "prefer ipv6",
+	OnlyIPv4:   "only ipv4",
+	OnlyIPv6:   "only ipv6",
+}
+
+func (f AddressFamily) String() string {
+	if str, ok := addressFamily2Str[f]; ok {
+		return str
+	}
+	return "unknown"
+}
+
+// errAddressFamily is the failure to connect to a destination without
+// addresses of the families allowed by Server.AddressFamily.
+var errAddressFamily = errors.New("no address of the allowed family")
+
+// apply return ips ordered and filtered by f, keeping the order of the
+// addresses of a family.
+func (f AddressFamily) apply(ips []net.IP) []net.IP {
+	if f == AnyFamily {
+		return ips
+	}
+	var v4, v6 []net.IP
+	for _, ip := range ips {
+		if ip.To4() != nil {
+			v4 = append(v4, ip)
+		} else {
+			v6 = append(v6, ip)
+		}
+	}
+	switch f {
+	case PreferIPv4:
+		return append(v4, v6...)
+	case PreferIPv6:
+		return append(v6, v4...)
+	case OnlyIPv4:
+		return v4
+	case OnlyIPv6:
+		return v6
+	}
+	return ips
+}
+
+// interleave return ips alternating their families from the family of
+// the first one, keeping the order of the addresses of a family, as
+// Happy Eyeballs (RFC 8305) does. It return false if ips are of a
+// single family.
+func interleave(ips []net.IP) ([]net.IP, bool) {
+	var first, other []net.IP
+	v4 := ips[0].To4() != nil
+	for _, ip := range ips {
+		if (ip.To4() != nil) == v4 {
+			first = append(first, ip)
+		} else {
+			other = append(other, ip)
+		}
+	}
+	if len(other) == 0 {
+		return ips, false
+	}
+	mixed := make([]net.IP, 0, len(ips))
+	for i := 0; i < len(first) || i < len(other); i++ {
+		if i < len(first) {
+			mixed = append(mixed, first[i])
+		}
+		if i < len(other) {
+			mixed = append(mixed, other[i])
+		}
+	}
+	return mixed, true
+}
+
+// boundAddress return the address the server reports in the reply to a
+// CONNECT request: the local address of its connection to the
+// destination, of the family of the destination, or the address of
+// the server if it is not a TCP address.
+func (srv *Server) boundAddress(client, remote net.Conn) *Address {
+	if addr, ok := remote.LocalAddr().(*net.TCPAddr); ok && addr.IP != nil && !addr.IP.IsUnspecified() {
+		if ip4 := addr.IP.To4(); ip4 != nil {
+			return &Address{ip4, IPV4_ADDRESS, uint16(addr.Port)}
+		}
+		return &Address{addr.IP.To16(), IPV6_ADDRESS, uint16(addr.Port)}
+	}
+	return srv.localAddress(client)
+}
@@ -0,0 +1,159 @@
+package socks5
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestAddressFamily_apply(t *testing.T) {
+	ips := []net.IP{net.ParseIP("2001:db8::1"), net.IPv4(192, 0, 2, 1), net.ParseIP("2001:db8::2"), net.IPv4(192, 0, 2, 2)}
+	tests := []struct {
+		family AddressFamily
+		want   string
+	}{
+		{AnyFamily, "[2001:db8::1 192.0.2.1 2001:db8::2 192.0.2.2]"},
+		{PreferIPv4, "[192.0.2.1 192.0.2.2 2001:db8::1 2001:db8::2]"},
+		{PreferIPv6, "[2001:db8::1 2001:db8::2 192.0.2.1 192.0.2.2]"},
+		{OnlyIPv4, "[192.0.2.1 192.0.2.2]"},
+		{OnlyIPv6, "[2001:db8::1 2001:db8::2]"},
+	}
+	for _, tt := range tests {
+		if got := fmt.Sprint(tt.family.apply(ips)); got != tt.want {
+			t.Errorf("%s: %s, want %s", tt.family, got, tt.want)
+		}
+	}
+}
+
+func TestInterleave(t *testing.T) {
+	v6a, v6b, v6c := net.ParseIP("2001:db8::1"), net.ParseIP("2001:db8::2"), net.ParseIP("2001:db8::3")
+	v4a, v4b := net.IPv4(192, 0, 2, 1), net.IPv4(192, 0, 2, 2)
+	tests := []struct {
+		ips   []net.IP
+		want  string
+		mixed bool
+	}{
+		{[]net.IP{v6a, v6b, v6c, v4a, v4b}, "[2001:db8::1 192.0.2.1 2001:db8::2 192.0.2.2 2001:db8::3]", true},
+		{[]net.IP{v4a, v4b, v6a}, "[192.0.2.1 2001:db8::1 192.0.2.2]", true},
+		{[]net.IP{v4a, v4b}, "[192.0.2.1 192.0.2.2]", false},
+	}
+	for _, tt := range tests {
+		got, mixed := interleave(tt.ips)
+		if fmt.Sprint(got) != tt.want || mixed != tt.mixed {
+			t.Errorf("interleave(%v) = %v, %v, want %s, %v", tt.ips, got, mixed, tt.want, tt.mixed)
+		}
+	}
+}
+
+func TestServer_FallbackDelay(t *testing.T) {
+	echo := echoTest(t)
+	_, port, _ := net.SplitHostPort(echo)
+	var mu sync.Mutex
+	dialed := map[string]time.Time{}
+	srv := &Server{
+		Resolver: NameResolverFunc(func(ctx context.Context, fqdn string) ([]net.IP, error) {
+			return []net.IP{net.ParseIP("2001:db8::1"), net.ParseIP("2001:db8::2"), net.IPv4(127, 0, 0, 1)}, nil
+		}),
+		Dialer: dialContextFunc(func(ctx context.Context, network, address string) (net.Conn, error) {
+			mu.Lock()
+			dialed[address] = time.Now()
+			mu.Unlock()
+			if address != net.JoinHostPort("127.0.0.1", port) {
+				// broken IPv6 path: hangs until the race is over.
+				<-ctx.Done()
+				return nil, ctx.Err()
+			}
+			return (&net.Dialer{}).DialContext(ctx, network, address)
+		}),
+		FallbackDelay: 50 * time.Millisecond,
+	}
+	start := time.Now()
+	conn, err := (&Client{ProxyAddr: serveTest(t, srv)}).Dial("tcp", "dual.test:"+port)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	mu.Lock()
+	defer mu.Unlock()
+	v4 := dialed[net.JoinHostPort("127.0.0.1", port)]
+	v6 := dialed[net.JoinHostPort("2001:db8::1", port)]
+	if len(dialed) != 2 || v4.Sub(v6) < srv.FallbackDelay {
+		t.Errorf("dialed %v, want 2001:db8::1 then 127.0.0.1 after %s", dialed, srv.FallbackDelay)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("connected in %s", elapsed)
+	}
+}
+
+func TestServer_AddressFamily(t *testing.T) {
+	echo := echoTest(t)
+	_, port, _ := net.SplitHostPort(echo)
+	var mu sync.Mutex
+	var dialed []string
+	srv := &Server{
+		Resolver: NameResolverFunc(func(ctx context.Context, fqdn string) ([]net.IP, error) {
+			if fqdn == "v4.test" {
+				return []net.IP{net.IPv4(127, 0, 0, 1)}, nil
+			}
+			return []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback}, nil
+		}),
+		Dialer: dialContextFunc(func(ctx context.Context, network, address string) (net.Conn, error) {
+			mu.Lock()
+			dialed = append(dialed, address)
+			mu.Unlock()
+			return (&net.Dialer{}).DialContext(ctx, network, address)
+		}),
+		AddressFamily: PreferIPv6,
+	}
+	addr := serveTest(t, srv)
+	// nothing listens on [::1]:port, the server falls back to IPv4.
+	conn, err := (&Client{ProxyAddr: addr}).Dial("tcp", "dual.test:"+port)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	mu.Lock()
+	if got := fmt.Sprint(dialed); got != fmt.Sprintf("[[::1]:%s 127.0.0.1:%s]", port, port) {
+		t.Errorf("dialed %s", got)
+	}
+	mu.Unlock()
+
+	srv.AddressFamily = OnlyIPv6
+	_, reply := connectTest(t, addr, &Address{[]byte("v4.test"), DOMAINNAME, 80})
+	if reply[1] != NETWORK_UNREACHABLE {
+		t.Errorf("reply %#x, want NETWORK_UNREACHABLE", reply[1])
+	}
+}
+
+func TestServer_BoundAddressIPv6(t *testing.T) {
+	ln, err := net.Listen("tcp", "[::1]:0")
+	if err != nil {
+		t.Skip("no IPv6 loopback:", err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+	dest, _ := ParseAddress(ln.Addr().String())
+	conn, reply := connectTest(t, serveTest(t, &Server{}), dest)
+	if reply[3] == IPV6_ADDRESS {
+		// connectTest reads the reply of an IPv4 address.
+		rest, err := ReadNBytes(conn, 12)
+		if err != nil {
+			t.Fatal(err)
+		}
+		reply = append(reply, rest...)
+	}
+	if reply[1] != SUCCESSED || reply[3] != IPV6_ADDRESS || !net.IP(reply[4:20]).Equal(net.IPv6loopback) {
+		t.Errorf("reply %v, want bound to ::1", reply)
+	}
+}
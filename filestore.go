@@ -0,0 +1,259 @@
+package socks5
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// FileStore is a UserPwdStore keeping the users of a file, such as to
+// rotate passwords without restarting the server: edit the file and the
+// store swaps its users atomically on Reload, or on its own with Watch.
+//
+// The file is either htpasswd-style, one "user:hash" line per user, with
+// blank lines and lines starting with '#' ignored, or a JSON object
+// mapping users to hashes, recognized by its leading '{'. Hashes are
+// compared by Hasher, such as passhash.Bcrypt for files written by
+// "htpasswd -B".
+type FileStore struct {
+	// Hasher hashes and compares the passwords, such as passhash.Scrypt.
+	// It must be set, and not change once the store is in use.
+	Hasher PasswordHasher
+
+	// OnReload is called after each reload by Watch with the number of
+	// users loaded, or the error which kept the previous users.
+	OnReload func(users int, err error)
+
+	filename string
+	// dummy is compared for unknown users.
+	dummy dummyHash
+	// users holds a fileUsers
+	users atomic.Value
+	// mu serializes Reload, Set and Del
+	mu sync.Mutex
+	// modTime and size of the file when last loaded
+	modTime time.Time
+	size    int64
+}
+
+// fileUsers are the users of a FileStore and the format of their file.
+type fileUsers struct {
+	hashes map[string]string
+	json   bool
+}
+
+// NewFileStore return a FileStore loading the users of filename, hashed
+// with hasher.
+func NewFileStore(filename string, hasher PasswordHasher) (*FileStore, error) {
+	f := &FileStore{Hasher: hasher, filename: filename}
+	if err := f.Reload(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// Reload read the file again and swap the users for its users. If the
+// file cannot be read or parsed, the users are kept.
+func (f *FileStore) Reload() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	info, err := os.Stat(f.filename)
+	if err != nil {
+		return err
+	}
+	data, err := os.ReadFile(f.filename)
+	if err != nil {
+		return err
+	}
+	// a malformed file is not reloaded again until it changes
+	f.modTime, f.size = info.ModTime(), info.Size()
+	users, err := parseUsers(data)
+	if err != nil {
+		return fmt.Errorf("%s: %w", f.filename, err)
+	}
+	f.users.Store(users)
+	return nil
+}
+
+// Watch check every interval whether the file changed, by its
+// modification time and size, and reload it, until ctx is done.
+func (f *FileStore) Watch(ctx context.Context, interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			return
+		}
+		if !f.changed() {
+			continue
+		}
+		err := f.Reload()
+		if f.OnReload != nil {
+			f.OnReload(len(f.load().hashes), err)
+		}
+	}
+}
+
+// changed report whether the file changed since it was loaded.
+func (f *FileStore) changed() bool {
+	info, err := os.Stat(f.filename)
+	if err != nil {
+		return true
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return !info.ModTime().Equal(f.modTime) || info.Size() != f.size
+}
+
+func (f *FileStore) load() fileUsers {
+	return f.users.Load().(fileUsers)
+}
+
+func (f *FileStore) hasher() PasswordHasher {
+	if f.Hasher == nil {
+		return noHasher{}
+	}
+	return f.Hasher
+}
+
+// Set the password of username and write the file.
+func (f *FileStore) Set(username string, password string) error {
+	if username == "" || strings.ContainsAny(username, ":\r\n") {
+		return fmt.Errorf("invalid user name %q", username)
+	}
+	hashed, err := f.hasher().Hash(password)
+	if err != nil {
+		return err
+	}
+	return f.update(func(hashes map[string]string) error {
+		hashes[username] = hashed
+		return nil
+	})
+}
+
+// Del delete username and write the file.
+func (f *FileStore) Del(username string) error {
+	return f.update(func(hashes map[string]string) error {
+		if _, ok := hashes[username]; !ok {
+			return UserNotExist{username: username}
+		}
+		delete(hashes, username)
+		return nil
+	})
+}
+
+// update apply change to a copy of the users, write them to the file,
+// replacing it atomically, and swap them.
+func (f *FileStore) update(change func(hashes map[string]string) error) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	users := f.load()
+	hashes := make(map[string]string, len(users.hashes)+1)
+	for u, h := range users.hashes {
+		hashes[u] = h
+	}
+	if err := change(hashes); err != nil {
+		return err
+	}
+	updated := fileUsers{hashes, users.json}
+	info, err := writeFileAtomic(f.filename, updated.marshal())
+	if err != nil {
+		return err
+	}
+	f.users.Store(updated)
+	f.modTime, f.size = info.ModTime(), info.Size()
+	return nil
+}
+
+// Validate validate username and password.
+func (f *FileStore) Validate(username string, password string) error {
+	hashed, ok := f.load().hashes[username]
+	if !ok {
+		f.dummy.compare(f.hasher(), password)
+		return UserNotExist{username: username}
+	}
+	err := f.hasher().Compare(hashed, password)
+	if err == ErrPasswordMismatch {
+		return fmt.Errorf("user %s has bad password", username)
+	}
+	return err
+}
+
+// parseUsers parse an htpasswd-style or JSON users file.
+func parseUsers(data []byte) (fileUsers, error) {
+	users := fileUsers{hashes: make(map[string]string)}
+	if trimmed := bytes.TrimSpace(data); len(trimmed) > 0 && trimmed[0] == '{' {
+		users.json = true
+		err := json.Unmarshal(trimmed, &users.hashes)
+		return users, err
+	}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		i := strings.IndexByte(line, ':')
+		if i <= 0 {
+			return users, fmt.Errorf("line %d: missing user:hash", n)
+		}
+		users.hashes[line[:i]] = line[i+1:]
+	}
+	return users, scanner.Err()
+}
+
+// marshal encode the users in the format of their file, sorted by user.
+func (u fileUsers) marshal() []byte {
+	if u.json {
+		data, _ := json.MarshalIndent(u.hashes, "", "  ")
+		return append(data, '\n')
+	}
+	names := make([]string, 0, len(u.hashes))
+	for name := range u.hashes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var b bytes.Buffer
+	for _, name := range names {
+		b.WriteString(name + ":" + u.hashes[name] + "\n")
+	}
+	return b.Bytes()
+}
+
+// writeFileAtomic replace filename with data through a temporary file
+// renamed over it, so readers never see it partially written.
+func writeFileAtomic(filename string, data []byte) (os.FileInfo, error) {
+	mode := os.FileMode(0600)
+	if info, err := os.Stat(filename); err == nil {
+		mode = info.Mode().Perm()
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(filename), "."+filepath.Base(filename)+".")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err = tmp.Write(data); err == nil {
+		err = tmp.Chmod(mode)
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Rename(tmp.Name(), filename); err != nil {
+		return nil, err
+	}
+	return os.Stat(filename)
+}
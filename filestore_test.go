@@ -0,0 +1,127 @@
+package socks5
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFileStore(t *testing.T) {
+	h := HMACHasher{Key: []byte("secret")}
+	admin, _ := h.Hash("123456")
+	guest, _ := h.Hash("guest")
+	for name, content := range map[string]string{
+		"htpasswd": "# users\nadmin:" + admin + "\n\nguest:" + guest + "\n",
+		"json":     `{"admin": "` + admin + `", "guest": "` + guest + `"}`,
+	} {
+		filename := filepath.Join(t.TempDir(), "users")
+		os.WriteFile(filename, []byte(content), 0600)
+		f, err := NewFileStore(filename, h)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if err := f.Validate("admin", "123456"); err != nil {
+			t.Errorf("%s: %v", name, err)
+		}
+		if err := f.Validate("admin", "guest"); err == nil {
+			t.Errorf("%s: wrong password validated", name)
+		}
+		if _, ok := f.Validate("nobody", "guest").(UserNotExist); !ok {
+			t.Errorf("%s: unknown user validated", name)
+		}
+
+		if err := f.Set("admin", "654321"); err != nil {
+			t.Fatal(err)
+		}
+		if err := f.Del("guest"); err != nil {
+			t.Fatal(err)
+		}
+		reloaded, err := NewFileStore(filename, h)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if err := reloaded.Validate("admin", "654321"); err != nil {
+			t.Errorf("%s: written password: %v", name, err)
+		}
+		if err := reloaded.Validate("guest", "guest"); err == nil {
+			t.Errorf("%s: deleted user validated", name)
+		}
+		data, _ := os.ReadFile(filename)
+		if json := strings.HasPrefix(string(data), "{"); json != (name == "json") {
+			t.Errorf("%s: written as %q", name, data)
+		}
+	}
+}
+
+func TestFileStore_Reload(t *testing.T) {
+	h := HMACHasher{Key: []byte("secret")}
+	old, _ := h.Hash("123456")
+	rotated, _ := h.Hash("654321")
+	filename := filepath.Join(t.TempDir(), "users")
+	os.WriteFile(filename, []byte("admin:"+old+"\n"), 0600)
+	f, err := NewFileStore(filename, h)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	os.WriteFile(filename, []byte("admin\n"), 0600)
+	if err := f.Reload(); err == nil {
+		t.Error("malformed file loaded")
+	}
+	if err := f.Validate("admin", "123456"); err != nil {
+		t.Errorf("users lost on failed reload: %v", err)
+	}
+
+	reloads := make(chan error, 10)
+	f.OnReload = func(users int, err error) { reloads <- err }
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go f.Watch(ctx, 10*time.Millisecond)
+	os.WriteFile(filename, []byte("admin:"+rotated+"\n"), 0600)
+	select {
+	case err := <-reloads:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("file change not detected")
+	}
+	if err := f.Validate("admin", "654321"); err != nil {
+		t.Errorf("rotated password: %v", err)
+	}
+}
+
+func TestFileStore_UnknownUser(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "users")
+	os.WriteFile(filename, nil, 0600)
+	h := &countingHasher{PasswordHasher: HMACHasher{Key: []byte("secret")}}
+	f, err := NewFileStore(filename, h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// unknown users are compared as long as known ones.
+	if _, ok := f.Validate("other", "pass").(UserNotExist); !ok {
+		t.Error("unknown user accepted")
+	}
+	if h.compares != 1 {
+		t.Errorf("%d compares", h.compares)
+	}
+}
+
+func TestFileStore_NoHasher(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "users")
+	os.WriteFile(filename, []byte("admin:$scrypt$ln=10,r=8,p=1$c2FsdA$a2V5\n"), 0600)
+	f, err := NewFileStore(filename, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Validate("admin", "123456"); err == nil {
+		t.Error("validated without hasher")
+	}
+	if err := f.Set("guest", "guest"); err == nil {
+		t.Error("set without hasher")
+	}
+}
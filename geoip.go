@@ -0,0 +1,207 @@
+package socks5
+
+import (
+	"context"
+	"net"
+	"strings"
+)
+
+// GeoIP locates IP addresses, such as with a MaxMind GeoIP2 or GeoLite2
+// Country database, see MMDBCountry.
+type GeoIP interface {
+	// Country return the ISO 3166-1 alpha-2 code of the country of ip,
+	// such as "US", or "" if unknown.
+	Country(ip net.IP) (string, error)
+}
+
+// GeoIPFunc is an adapter to allow the use of ordinary functions as
+// GeoIP.
+type GeoIPFunc func(ip net.IP) (string, error)
+
+// Country calls f(ip).
+func (f GeoIPFunc) Country(ip net.IP) (string, error) {
+	return f(ip)
+}
+
+// MMDBReader reads MaxMind DB files. It is implemented by
+// *maxminddb.Reader of github.com/oschwald/maxminddb-golang, which the
+// package does not depend on.
+type MMDBReader interface {
+	Lookup(ip net.IP, result interface{}) error
+}
+
+// mmdbCountry is the country record of GeoIP2 and GeoLite2 databases.
+type mmdbCountry struct {
+	Country struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"country"`
+}
+
+// MMDBCountry return a GeoIP reading the country of addresses from a
+// GeoIP2 or GeoLite2 Country or City database:
+//
+//	db, err := maxminddb.Open("GeoLite2-Country.mmdb")
+//	if err != nil {
+//		log.Fatal(err)
+//	}
+//	geo := socks5.MMDBCountry(db)
+func MMDBCountry(r MMDBReader) GeoIP {
+	return GeoIPFunc(func(ip net.IP) (string, error) {
+		var record mmdbCountry
+		if err := r.Lookup(ip, &record); err != nil {
+			return "", err
+		}
+		return record.Country.ISOCode, nil
+	})
+}
+
+// GeoMatch is a RuleSet allowing the requests whose client and
+// destination are in the countries of its non-empty criteria, and
+// denying the others, as Match does. Addresses GeoIP fails to locate or
+// does not know match no country, nor do domain name destinations
+// without Resolver. Combine it with AllowList, DenyList and the other
+// rules. Not of a GeoMatch allows what it does not locate, use GeoDeny
+// to deny countries.
+type GeoMatch struct {
+	GeoIP GeoIP
+
+	// ClientCountries are the countries of the client address.
+	ClientCountries []string
+
+	// Countries are the countries of the destination address.
+	Countries []string
+
+	// Resolver optionally resolves domain name destinations, which match
+	// Countries if any of their addresses does. If nil, domain name
+	// destinations do not match Countries.
+	Resolver NameResolver
+}
+
+// Allow report whether req matches m.
+func (m *GeoMatch) Allow(s *Session, req *Request) bool {
+	if len(m.ClientCountries) > 0 && !inCountries(m.GeoIP, s.ClientIP(), m.ClientCountries) {
+		return false
+	}
+	if len(m.Countries) == 0 {
+		return true
+	}
+	dest := req.Address
+	if dest.ATYPE != DOMAINNAME {
+		return inCountries(m.GeoIP, dest.Addr, m.Countries)
+	}
+	if m.Resolver == nil {
+		return false
+	}
+	ips, err := m.Resolver.Resolve(s.Context(), string(dest.Addr))
+	if err != nil {
+		return false
+	}
+	for _, ip := range ips {
+		if inCountries(m.GeoIP, ip, m.Countries) {
+			return true
+		}
+	}
+	return false
+}
+
+// GeoDeny is a RuleSet denying the requests whose client or destination
+// is in the countries of its non-empty criteria, and allowing the others:
+//
+//	srv.Rules = &socks5.GeoDeny{GeoIP: geo, Countries: []string{"KP"}, Resolver: resolver}
+//
+// Unlike Not of a GeoMatch, it denies what it cannot locate: addresses
+// GeoIP fails to locate or does not know, and domain name destinations
+// without Resolver or failing to resolve, so that denied countries are
+// not reached by name.
+type GeoDeny struct {
+	GeoIP GeoIP
+
+	// ClientCountries are the countries of the client address.
+	ClientCountries []string
+
+	// Countries are the countries of the destination address.
+	Countries []string
+
+	// Resolver resolves domain name destinations, which are denied if any
+	// of their addresses is. If nil, domain name destinations are denied
+	// when Countries is set.
+	Resolver NameResolver
+}
+
+// Allow report whether req is out of the countries of d.
+func (d *GeoDeny) Allow(s *Session, req *Request) bool {
+	if len(d.ClientCountries) > 0 && !outOfCountries(d.GeoIP, s.ClientIP(), d.ClientCountries) {
+		return false
+	}
+	if len(d.Countries) == 0 {
+		return true
+	}
+	dest := req.Address
+	if dest.ATYPE != DOMAINNAME {
+		return outOfCountries(d.GeoIP, dest.Addr, d.Countries)
+	}
+	if d.Resolver == nil {
+		return false
+	}
+	ips, err := d.Resolver.Resolve(s.Context(), string(dest.Addr))
+	if err != nil || len(ips) == 0 {
+		return false
+	}
+	for _, ip := range ips {
+		if !outOfCountries(d.GeoIP, ip, d.Countries) {
+			return false
+		}
+	}
+	return true
+}
+
+// AllowClientCountries is a Middleware closing the connections of
+// clients out of countries before the handshake, cheaper than denying
+// their requests with GeoMatch.
+func AllowClientCountries(geo GeoIP, countries ...string) Middleware {
+	return func(next ConnHandler) ConnHandler {
+		return ConnHandlerFunc(func(ctx context.Context, conn net.Conn) {
+			if ip := addrIP(conn.RemoteAddr()); ip == nil || !inCountries(geo, ip, countries) {
+				conn.Close()
+				return
+			}
+			next.ServeConn(ctx, conn)
+		})
+	}
+}
+
+// inCountries report whether geo locates ip in one of countries, case
+// insensitively.
+func inCountries(geo GeoIP, ip net.IP, countries []string) bool {
+	if ip == nil {
+		return false
+	}
+	country, err := geo.Country(ip)
+	if err != nil || country == "" {
+		return false
+	}
+	for _, c := range countries {
+		if strings.EqualFold(c, country) {
+			return true
+		}
+	}
+	return false
+}
+
+// outOfCountries report whether geo locates ip out of countries, case
+// insensitively. Addresses it fails to locate or does not know are not.
+func outOfCountries(geo GeoIP, ip net.IP, countries []string) bool {
+	if ip == nil {
+		return false
+	}
+	country, err := geo.Country(ip)
+	if err != nil || country == "" {
+		return false
+	}
+	for _, c := range countries {
+		if strings.EqualFold(c, country) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,129 @@
+package socks5
+
+import (
+	"errors"
+	"net"
+	"testing"
+)
+
+// geoTest locates 198.51.100.0/24 in France, 203.0.113.0/24 and the
+// loopback in the US, and fails for 192.0.2.0/24.
+var geoTest = GeoIPFunc(func(ip net.IP) (string, error) {
+	switch {
+	case ip.IsLoopback():
+		return "US", nil
+	case ip.To4() == nil:
+		return "", nil
+	case ip.To4()[2] == 100:
+		return "FR", nil
+	case ip.To4()[2] == 113:
+		return "US", nil
+	}
+	return "", errors.New("lookup failed")
+})
+
+func TestGeoMatch(t *testing.T) {
+	hosts := &HostsResolver{Hosts: map[string][]net.IP{
+		"fr.test": {net.IPv4(192, 0, 2, 1), net.IPv4(198, 51, 100, 1)},
+	}}
+	fromUS := &GeoMatch{GeoIP: geoTest, ClientCountries: []string{"us"}}
+	toFR := &GeoMatch{GeoIP: geoTest, Countries: []string{"FR"}}
+	toFRByName := &GeoMatch{GeoIP: geoTest, Countries: []string{"FR"}, Resolver: hosts}
+
+	for _, c := range []struct {
+		name    string
+		rules   RuleSet
+		client  string
+		dest    string
+		allowed bool
+	}{
+		{"client country", fromUS, "203.0.113.1:1", "192.0.2.9:80", true},
+		{"other client country", fromUS, "198.51.100.1:1", "192.0.2.9:80", false},
+		{"client lookup failure", fromUS, "192.0.2.1:1", "192.0.2.9:80", false},
+		{"destination country", toFR, "203.0.113.1:1", "198.51.100.9:80", true},
+		{"other destination country", toFR, "203.0.113.1:1", "203.0.113.9:80", false},
+		{"unknown destination country", toFR, "203.0.113.1:1", "[2001:db8::1]:80", false},
+		{"domain destination", toFR, "203.0.113.1:1", "fr.test:80", false},
+		{"resolved domain destination", toFRByName, "203.0.113.1:1", "fr.test:80", true},
+		{"unresolved domain destination", toFRByName, "203.0.113.1:1", "nowhere.test:80", false},
+		{"deny destination country", Not(toFR), "203.0.113.1:1", "198.51.100.9:80", false},
+	} {
+		client, _ := net.ResolveTCPAddr("tcp", c.client)
+		dest, err := ParseAddress(c.dest)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s := &Session{ClientAddr: client}
+		if allowed := c.rules.Allow(s, &Request{VER: Version5, CMD: CONNECT, Address: dest}); allowed != c.allowed {
+			t.Errorf("%s: allowed %v", c.name, allowed)
+		}
+	}
+}
+
+func TestGeoDeny(t *testing.T) {
+	hosts := &HostsResolver{Hosts: map[string][]net.IP{
+		"fr.test": {net.IPv4(203, 0, 113, 1), net.IPv4(198, 51, 100, 1)},
+		"us.test": {net.IPv4(203, 0, 113, 1)},
+	}}
+	fromFR := &GeoDeny{GeoIP: geoTest, ClientCountries: []string{"fr"}}
+	toFR := &GeoDeny{GeoIP: geoTest, Countries: []string{"FR"}}
+	toFRByName := &GeoDeny{GeoIP: geoTest, Countries: []string{"FR"}, Resolver: hosts}
+
+	for _, c := range []struct {
+		name    string
+		rules   RuleSet
+		client  string
+		dest    string
+		allowed bool
+	}{
+		{"client country", fromFR, "198.51.100.1:1", "203.0.113.9:80", false},
+		{"other client country", fromFR, "203.0.113.1:1", "203.0.113.9:80", true},
+		{"client lookup failure", fromFR, "192.0.2.1:1", "203.0.113.9:80", false},
+		{"destination country", toFR, "203.0.113.1:1", "198.51.100.9:80", false},
+		{"other destination country", toFR, "203.0.113.1:1", "203.0.113.9:80", true},
+		{"unknown destination country", toFR, "203.0.113.1:1", "[2001:db8::1]:80", false},
+		{"destination lookup failure", toFR, "203.0.113.1:1", "192.0.2.9:80", false},
+		{"domain destination", toFR, "203.0.113.1:1", "us.test:80", false},
+		{"resolved domain destination", toFRByName, "203.0.113.1:1", "fr.test:80", false},
+		{"other resolved domain destination", toFRByName, "203.0.113.1:1", "us.test:80", true},
+		{"unresolved domain destination", toFRByName, "203.0.113.1:1", "nowhere.test:80", false},
+	} {
+		client, _ := net.ResolveTCPAddr("tcp", c.client)
+		dest, err := ParseAddress(c.dest)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s := &Session{ClientAddr: client}
+		if allowed := c.rules.Allow(s, &Request{VER: Version5, CMD: CONNECT, Address: dest}); allowed != c.allowed {
+			t.Errorf("%s: allowed %v", c.name, allowed)
+		}
+	}
+}
+
+// mmdbTest is an MMDBReader of a single record.
+type mmdbTest string
+
+func (r mmdbTest) Lookup(ip net.IP, result interface{}) error {
+	result.(*mmdbCountry).Country.ISOCode = string(r)
+	return nil
+}
+
+func TestMMDBCountry(t *testing.T) {
+	if country, err := MMDBCountry(mmdbTest("DE")).Country(net.IPv4(192, 0, 2, 1)); country != "DE" || err != nil {
+		t.Errorf("country %q, %v", country, err)
+	}
+}
+
+func TestAllowClientCountries(t *testing.T) {
+	addr := serveTest(t, &Server{Middleware: []Middleware{AllowClientCountries(geoTest, "FR")}})
+	if _, err := (&Client{ProxyAddr: addr}).Dial("tcp", echoTest(t)); err == nil {
+		t.Error("client out of countries served")
+	}
+
+	addr = serveTest(t, &Server{Middleware: []Middleware{AllowClientCountries(geoTest, "FR", "US")}})
+	conn, err := (&Client{ProxyAddr: addr}).Dial("tcp", echoTest(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+}
@@ -0,0 +1,179 @@
+// Package grpcadmin implements a gRPC service operating a socks5 server
+// while it runs, for controllers managing fleets of proxies: users,
+// rules and sessions. It is the gRPC counterpart of socks5.Admin, and a
+// module of its own so that the socks5 package keeps no dependencies.
+//
+// The service is defined in admin.proto, socks5.admin.v1.Admin. Register
+// it on a gRPC server, which should authenticate its clients, such as
+// with mutual TLS:
+//
+//	g := grpc.NewServer(grpc.Creds(credentials.NewTLS(tlsConfig)))
+//	grpcadmin.RegisterAdminServer(g, &grpcadmin.Service{Server: srv})
+//	go g.Serve(ln)
+//
+// Regenerate admin.pb.go and admin_grpc.pb.go with
+//
+//	protoc --go_out=. --go_opt=paths=source_relative \
+//		--go-grpc_out=. --go-grpc_opt=paths=source_relative admin.proto
+package grpcadmin
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/haochen233/socks5"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/durationpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// Service is the AdminServer of a socks5 server.
+type Service struct {
+	UnimplementedAdminServer
+
+	Server *socks5.Server
+
+	// Store is the store of the users managed by the service. If nil, it
+	// is Server.Store.
+	Store socks5.UserPwdStore
+}
+
+var commands = map[string]socks5.CMD{
+	"CONNECT":       socks5.CONNECT,
+	"BIND":          socks5.BIND,
+	"UDP_ASSOCIATE": socks5.UDP_ASSOCIATE,
+}
+
+func (svc *Service) store() (socks5.UserPwdStore, error) {
+	if svc.Store != nil {
+		return svc.Store, nil
+	}
+	if store := svc.Server.Store(); store != nil {
+		return store, nil
+	}
+	return nil, status.Error(codes.FailedPrecondition, "no Username/Password store")
+}
+
+// SetUser implements AdminServer.
+func (svc *Service) SetUser(ctx context.Context, req *SetUserRequest) (*SetUserResponse, error) {
+	if req.Username == "" || req.Password == "" {
+		return nil, status.Error(codes.InvalidArgument, "empty username or password")
+	}
+	store, err := svc.store()
+	if err != nil {
+		return nil, err
+	}
+	if err := store.Set(req.Username, req.Password); err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	return &SetUserResponse{}, nil
+}
+
+// DeleteUser implements AdminServer, with Server.CloseSessionsFor. Unknown
+// users are NotFound.
+func (svc *Service) DeleteUser(ctx context.Context, req *DeleteUserRequest) (*DeleteUserResponse, error) {
+	store, err := svc.store()
+	if err != nil {
+		return nil, err
+	}
+	if err := store.Del(req.Username); err != nil {
+		var notExist socks5.UserNotExist
+		if errors.As(err, &notExist) {
+			return nil, status.Error(codes.NotFound, err.Error())
+		}
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	svc.Server.CloseSessionsFor(req.Username)
+	return &DeleteUserResponse{}, nil
+}
+
+// SetRules implements AdminServer, with Server.SetRules.
+func (svc *Service) SetRules(ctx context.Context, req *SetRulesRequest) (*SetRulesResponse, error) {
+	rules := &firstMatch{defaultDeny: req.DefaultDeny}
+	for i, r := range req.Rules {
+		m, err := match(r)
+		if err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "rule %d: %v", i, err)
+		}
+		rules.matches = append(rules.matches, m)
+		rules.deny = append(rules.deny, r.Deny)
+	}
+	svc.Server.SetRules(rules)
+	return &SetRulesResponse{}, nil
+}
+
+// ListSessions implements AdminServer, with Server.SessionStats.
+func (svc *Service) ListSessions(ctx context.Context, req *ListSessionsRequest) (*ListSessionsResponse, error) {
+	resp := &ListSessionsResponse{}
+	for _, stat := range svc.Server.SessionStats() {
+		resp.Sessions = append(resp.Sessions, &Session{
+			Id:         stat.ID,
+			ClientAddr: stat.ClientAddr,
+			Username:   stat.Username,
+			Command:    stat.Command,
+			Dest:       stat.Dest,
+			Route:      stat.Route,
+			Start:      timestamppb.New(stat.Start),
+			Duration:   durationpb.New(stat.Duration),
+			BytesUp:    stat.BytesUp,
+			BytesDown:  stat.BytesDown,
+			Tags:       stat.Tags,
+		})
+	}
+	return resp, nil
+}
+
+// CloseSession implements AdminServer, with Server.CloseSession.
+func (svc *Service) CloseSession(ctx context.Context, req *CloseSessionRequest) (*CloseSessionResponse, error) {
+	if !svc.Server.CloseSession(req.Id) {
+		return nil, status.Errorf(codes.NotFound, "no session %d", req.Id)
+	}
+	return &CloseSessionResponse{}, nil
+}
+
+// match return the socks5.Match of r.
+func match(r *Rule) (*socks5.Match, error) {
+	m := &socks5.Match{Users: r.Users, Domains: r.Domains}
+	var err error
+	if m.Clients, err = socks5.ParseNetworks(r.Clients...); err != nil {
+		return nil, err
+	}
+	if m.Networks, err = socks5.ParseNetworks(r.Networks...); err != nil {
+		return nil, err
+	}
+	for _, p := range r.Ports {
+		pr, err := socks5.ParsePortRange(p)
+		if err != nil {
+			return nil, err
+		}
+		m.Ports = append(m.Ports, pr)
+	}
+	for _, c := range r.Commands {
+		cmd, ok := commands[strings.ToUpper(c)]
+		if !ok {
+			return nil, fmt.Errorf("invalid command %q", c)
+		}
+		m.Commands = append(m.Commands, cmd)
+	}
+	return m, nil
+}
+
+// firstMatch is the socks5.RuleSet of a SetRulesRequest: the first
+// match of a request decides.
+type firstMatch struct {
+	matches     []*socks5.Match
+	deny        []bool
+	defaultDeny bool
+}
+
+func (f *firstMatch) Allow(s *socks5.Session, req *socks5.Request) bool {
+	for i, m := range f.matches {
+		if m.Allow(s, req) {
+			return !f.deny[i]
+		}
+	}
+	return !f.defaultDeny
+}
@@ -0,0 +1,135 @@
+package grpcadmin
+
+import (
+	"context"
+	"crypto/sha256"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/haochen233/socks5"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+func echoServer(t *testing.T) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+func TestService(t *testing.T) {
+	srv := &socks5.Server{
+		Authenticators: map[socks5.METHOD]socks5.Authenticator{socks5.USERNAME_PASSWORD: socks5.UserPwdAuth{UserPwdStore: socks5.NewMemeryStore(sha256.New(), "")}},
+		MethodPriority: []socks5.METHOD{socks5.USERNAME_PASSWORD},
+		Stats:          &socks5.ConnStats{},
+		Hooks:          socks5.Hooks{OnAuthSuccess: func(s *socks5.Session) { s.Tag("team", "video") }},
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.Serve(ln)
+	defer srv.Close()
+
+	lis := bufconn.Listen(1 << 16)
+	g := grpc.NewServer()
+	RegisterAdminServer(g, &Service{Server: srv})
+	go g.Serve(lis)
+	defer g.Stop()
+	cc, err := grpc.NewClient("passthrough:///bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return lis.DialContext(ctx) }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cc.Close()
+	admin := NewAdminClient(cc)
+	ctx := context.Background()
+
+	if _, err := admin.SetUser(ctx, &SetUserRequest{Username: "dave", Password: "d"}); err != nil {
+		t.Fatal(err)
+	}
+	echo := echoServer(t)
+	client := &socks5.Client{ProxyAddr: ln.Addr().String(), Username: "dave", Password: "d"}
+	conn, err := client.Dial("tcp", echo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.Write([]byte("ping"))
+	io.ReadFull(conn, make([]byte, 4))
+
+	list, err := admin.ListSessions(ctx, &ListSessionsRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list.Sessions) != 1 || list.Sessions[0].Username != "dave" || list.Sessions[0].Dest != echo || list.Sessions[0].Tags["team"] != "video" {
+		t.Fatalf("sessions %v", list.Sessions)
+	}
+	id := list.Sessions[0].Id
+	if _, err := admin.CloseSession(ctx, &CloseSessionRequest{Id: id}); err != nil {
+		t.Fatal(err)
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("closed session read: %v", err)
+	}
+	if _, err := admin.CloseSession(ctx, &CloseSessionRequest{Id: id}); status.Code(err) != codes.NotFound {
+		t.Errorf("close closed session: %v", err)
+	}
+
+	_, err = admin.SetRules(ctx, &SetRulesRequest{Rules: []*Rule{{Deny: true, Users: []string{"dave"}, Commands: []string{"connect"}}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Dial("tcp", echo); err == nil {
+		t.Error("denied request served")
+	}
+	if _, err := admin.SetRules(ctx, &SetRulesRequest{Rules: []*Rule{{Ports: []string{"1-"}}}}); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("invalid rule: %v", err)
+	}
+	if _, err := admin.SetRules(ctx, &SetRulesRequest{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := admin.DeleteUser(ctx, &DeleteUserRequest{Username: "dave"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Dial("tcp", echo); err == nil {
+		t.Error("deleted user authenticated")
+	}
+	if _, err := admin.DeleteUser(ctx, &DeleteUserRequest{Username: "dave"}); status.Code(err) != codes.NotFound {
+		t.Errorf("delete unknown user: %v", err)
+	}
+
+	// users are set in the store swapped by SetStore.
+	srv.SetStore(socks5.NewMemeryStore(sha256.New(), ""))
+	if _, err := admin.SetUser(ctx, &SetUserRequest{Username: "erin", Password: "e"}); err != nil {
+		t.Fatal(err)
+	}
+	client.Username, client.Password = "erin", "e"
+	conn, err = client.Dial("tcp", echo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+}
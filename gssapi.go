@@ -0,0 +1,251 @@
+package socks5
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+)
+
+// GSSAPI message types of RFC 1961.
+const (
+	gssapiVersion        = 0x01
+	gssapiAuthentication = 0x01
+	gssapiProtection     = 0x02
+	gssapiEncapsulation  = 0x03
+	gssapiAbort          = 0xff
+)
+
+// gssapiMaxChunk is the largest payload wrapped in one encapsulation
+// message, leaving room for the overhead of the mechanism in the 16-bit
+// token length.
+const gssapiMaxChunk = 32 << 10
+
+// GSSAPIProtection is a per-message protection level of RFC 1961.
+type GSSAPIProtection uint8
+
+const (
+	// GSSAPIIntegrity protects the integrity of messages.
+	GSSAPIIntegrity GSSAPIProtection = 0x01
+	// GSSAPIConfidentiality protects the integrity and confidentiality of
+	// messages.
+	GSSAPIConfidentiality GSSAPIProtection = 0x02
+	// GSSAPISelective lets each message choose its protection, the server
+	// encrypts every message it sends.
+	GSSAPISelective GSSAPIProtection = 0x03
+)
+
+// GSSAPIMechanism is the acceptor side of a GSS-API security context for
+// one client, such as Kerberos V5 with gokrb5. Wrap and Unwrap may be
+// called concurrently for the two directions of the session.
+type GSSAPIMechanism interface {
+	// AcceptSecContext process a context establishment token of the
+	// client, as gss_accept_sec_context. It returns the token to send
+	// back, if any, and whether the context is established.
+	AcceptSecContext(token []byte) (output []byte, established bool, err error)
+
+	// Wrap protect msg, with confidentiality if conf, as gss_wrap.
+	Wrap(msg []byte, conf bool) ([]byte, error)
+
+	// Unwrap verify and decode token, as gss_unwrap. conf reports
+	// whether the message was encrypted.
+	Unwrap(token []byte) (msg []byte, conf bool, err error)
+
+	// SrcName return the name of the authenticated client principal.
+	SrcName() string
+}
+
+// GSSAPIError is returned when the client aborted the GSSAPI
+// sub-negotiation or sent an invalid message.
+type GSSAPIError struct {
+	Reason string
+}
+
+func (e *GSSAPIError) Error() string {
+	return "gssapi: " + e.Reason
+}
+
+// GSSAPIAuth is the GSSAPI authentication method (RFC 1961). It
+// establishes a security context with the client, negotiates the
+// per-message protection level, then protects the rest of the session,
+// request, reply and relayed data, with it. The client principal is
+// recorded as the user name of the session. The datagrams of UDP
+// associations are not protected.
+type GSSAPIAuth struct {
+	// NewMechanism return the security context of the client of s.
+	NewMechanism func(s *Session) (GSSAPIMechanism, error)
+
+	// Protection return the protection level of the session given the
+	// one requested by the client. If nil, the requested level is used.
+	Protection func(s *Session, requested GSSAPIProtection) GSSAPIProtection
+}
+
+// Authenticate is not supported, GSSAPI needs the session to protect it.
+func (g GSSAPIAuth) Authenticate(in io.Reader, out io.Writer) error {
+	return errors.New("gssapi authentication requires a session")
+}
+
+// AuthenticateSession run the GSSAPI sub-negotiation of s.
+func (g GSSAPIAuth) AuthenticateSession(s *Session, in io.Reader, out io.Writer) error {
+	if g.NewMechanism == nil {
+		writeGSSAPIAbort(out)
+		return &GSSAPIError{"no mechanism"}
+	}
+	mech, err := g.NewMechanism(s)
+	if err != nil {
+		writeGSSAPIAbort(out)
+		return err
+	}
+
+	// context establishment
+	for established := false; !established; {
+		token, err := readGSSAPIMessage(in, gssapiAuthentication)
+		if err != nil {
+			return err
+		}
+		var output []byte
+		output, established, err = mech.AcceptSecContext(token)
+		if err != nil {
+			writeGSSAPIAbort(out)
+			return err
+		}
+		if len(output) > 0 {
+			if err := writeGSSAPIMessage(out, gssapiAuthentication, output); err != nil {
+				return err
+			}
+		}
+	}
+
+	// protection level negotiation, the level is wrapped without
+	// confidentiality.
+	token, err := readGSSAPIMessage(in, gssapiProtection)
+	if err != nil {
+		return err
+	}
+	msg, _, err := mech.Unwrap(token)
+	if err != nil || len(msg) != 1 {
+		writeGSSAPIAbort(out)
+		return &GSSAPIError{"invalid protection level message"}
+	}
+	level := GSSAPIProtection(msg[0])
+	if g.Protection != nil {
+		level = g.Protection(s, level)
+	}
+	if level < GSSAPIIntegrity || level > GSSAPISelective {
+		writeGSSAPIAbort(out)
+		return &GSSAPIError{fmt.Sprintf("unsupported protection level %d", level)}
+	}
+	token, err = mech.Wrap([]byte{byte(level)}, false)
+	if err != nil {
+		writeGSSAPIAbort(out)
+		return err
+	}
+	if err := writeGSSAPIMessage(out, gssapiProtection, token); err != nil {
+		return err
+	}
+
+	s.Username = mech.SrcName()
+	s.Set(MetaUser, s.Username)
+	s.encapsulate = func(conn net.Conn) net.Conn {
+		return &gssapiConn{Conn: conn, mech: mech, level: level}
+	}
+	return nil
+}
+
+// readGSSAPIMessage read a message of type mtyp and return its token.
+//
+//	+------+------+------+.......................+
+//	+ ver  | mtyp | len  |       token           |
+//	+------+------+------+.......................+
+//	+ 0x01 | 0x01 | 0x02 | up to 2^16 - 1 octets |
+//	+------+------+------+.......................+
+func readGSSAPIMessage(in io.Reader, mtyp byte) ([]byte, error) {
+	hdr := make([]byte, 2)
+	if _, err := io.ReadFull(in, hdr); err != nil {
+		return nil, err
+	}
+	if hdr[0] != gssapiVersion {
+		return nil, &GSSAPIError{fmt.Sprintf("unsupported version %#x", hdr[0])}
+	}
+	if hdr[1] == gssapiAbort {
+		return nil, &GSSAPIError{"aborted by peer"}
+	}
+	if hdr[1] != mtyp {
+		return nil, &GSSAPIError{fmt.Sprintf("unexpected message type %#x", hdr[1])}
+	}
+	if _, err := io.ReadFull(in, hdr); err != nil {
+		return nil, err
+	}
+	token := make([]byte, int(hdr[0])<<8|int(hdr[1]))
+	if _, err := io.ReadFull(in, token); err != nil {
+		return nil, err
+	}
+	return token, nil
+}
+
+// writeGSSAPIMessage write a message of type mtyp carrying token.
+func writeGSSAPIMessage(out io.Writer, mtyp byte, token []byte) error {
+	if len(token) > 0xffff {
+		return &GSSAPIError{"token too large"}
+	}
+	msg := append([]byte{gssapiVersion, mtyp, byte(len(token) >> 8), byte(len(token))}, token...)
+	_, err := out.Write(msg)
+	return err
+}
+
+// writeGSSAPIAbort tell the client the sub-negotiation failed.
+func writeGSSAPIAbort(out io.Writer) {
+	out.Write([]byte{gssapiVersion, gssapiAbort})
+}
+
+// gssapiConn protects the data of a connection with encapsulation
+// messages, at the negotiated protection level.
+type gssapiConn struct {
+	net.Conn
+	mech  GSSAPIMechanism
+	level GSSAPIProtection
+	// unread data of the last message read
+	pending []byte
+}
+
+func (c *gssapiConn) Read(b []byte) (int, error) {
+	for len(c.pending) == 0 {
+		token, err := readGSSAPIMessage(c.Conn, gssapiEncapsulation)
+		if err != nil {
+			return 0, err
+		}
+		msg, conf, err := c.mech.Unwrap(token)
+		if err != nil {
+			return 0, err
+		}
+		// the peer may not downgrade or upgrade the level of a message,
+		// but with GSSAPISelective.
+		if (c.level == GSSAPIConfidentiality && !conf) || (c.level == GSSAPIIntegrity && conf) {
+			return 0, &GSSAPIError{"message protection does not match the protection level"}
+		}
+		c.pending = msg
+	}
+	n := copy(b, c.pending)
+	c.pending = c.pending[n:]
+	return n, nil
+}
+
+func (c *gssapiConn) Write(b []byte) (int, error) {
+	written := 0
+	for len(b) > 0 {
+		chunk := b
+		if len(chunk) > gssapiMaxChunk {
+			chunk = chunk[:gssapiMaxChunk]
+		}
+		token, err := c.mech.Wrap(chunk, c.level != GSSAPIIntegrity)
+		if err != nil {
+			return written, err
+		}
+		if err := writeGSSAPIMessage(c.Conn, gssapiEncapsulation, token); err != nil {
+			return written, err
+		}
+		written += len(chunk)
+		b = b[len(chunk):]
+	}
+	return written, nil
+}
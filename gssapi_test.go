@@ -0,0 +1,190 @@
+package socks5
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"testing"
+	"time"
+)
+
+// fakeMechanism establishes a context with the tokens "hello" then
+// "done", and wraps messages with a flag byte and a xor mask.
+type fakeMechanism struct{}
+
+func (fakeMechanism) AcceptSecContext(token []byte) ([]byte, bool, error) {
+	switch string(token) {
+	case "hello":
+		return []byte("world"), false, nil
+	case "done":
+		return nil, true, nil
+	}
+	return nil, false, errors.New("bad token")
+}
+
+func (fakeMechanism) Wrap(msg []byte, conf bool) ([]byte, error) {
+	token := []byte{0}
+	if conf {
+		token[0] = 1
+	}
+	for _, b := range msg {
+		token = append(token, b^0x55)
+	}
+	return token, nil
+}
+
+func (fakeMechanism) Unwrap(token []byte) ([]byte, bool, error) {
+	if len(token) == 0 {
+		return nil, false, errors.New("empty token")
+	}
+	msg := make([]byte, len(token)-1)
+	for i, b := range token[1:] {
+		msg[i] = b ^ 0x55
+	}
+	return msg, token[0] == 1, nil
+}
+
+func (fakeMechanism) SrcName() string { return "alice@EXAMPLE.COM" }
+
+// gssapiHandshakeTest run the client side of the GSSAPI negotiation of a
+// fakeMechanism on raw, requesting level.
+func gssapiHandshakeTest(t *testing.T, raw net.Conn, level GSSAPIProtection) {
+	t.Helper()
+	raw.Write([]byte{Version5, 1, GSSAPI})
+	if b, err := ReadNBytes(raw, 2); err != nil || b[1] != GSSAPI {
+		t.Fatalf("method: %v, %v", b, err)
+	}
+	writeGSSAPIMessage(raw, gssapiAuthentication, []byte("hello"))
+	if token, err := readGSSAPIMessage(raw, gssapiAuthentication); err != nil || string(token) != "world" {
+		t.Fatalf("context: %q, %v", token, err)
+	}
+	writeGSSAPIMessage(raw, gssapiAuthentication, []byte("done"))
+	token, _ := fakeMechanism{}.Wrap([]byte{byte(level)}, false)
+	writeGSSAPIMessage(raw, gssapiProtection, token)
+	token, err := readGSSAPIMessage(raw, gssapiProtection)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg, _, _ := (fakeMechanism{}).Unwrap(token); len(msg) != 1 || GSSAPIProtection(msg[0]) != level {
+		t.Fatalf("protection level %v", msg)
+	}
+}
+
+func TestGSSAPIAuth(t *testing.T) {
+	users := make(chan string, 1)
+	srv := &Server{
+		Authenticators: map[METHOD]Authenticator{GSSAPI: GSSAPIAuth{
+			NewMechanism: func(s *Session) (GSSAPIMechanism, error) { return fakeMechanism{}, nil },
+		}},
+		Rules: RuleSetFunc(func(s *Session, req *Request) bool {
+			users <- s.Username
+			return true
+		}),
+		ErrorLog: log.New(io.Discard, "", 0),
+	}
+	addr := serveTest(t, srv)
+	echo := echoTest(t)
+
+	raw, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer raw.Close()
+	raw.SetDeadline(time.Now().Add(5 * time.Second))
+	gssapiHandshakeTest(t, raw, GSSAPIConfidentiality)
+
+	// the request, reply and relayed data are encapsulated.
+	conn := &gssapiConn{Conn: raw, mech: fakeMechanism{}, level: GSSAPIConfidentiality}
+	dest, _ := ParseAddress(echo)
+	b, _ := dest.Bytes(Version5)
+	conn.Write(append([]byte{Version5, CONNECT, 0}, b...))
+	reply, err := ReadNBytes(conn, 10)
+	if err != nil || reply[1] != SUCCESSED {
+		t.Fatalf("reply %v, %v", reply, err)
+	}
+	if user := <-users; user != "alice@EXAMPLE.COM" {
+		t.Errorf("user %q", user)
+	}
+	conn.Write([]byte("ping"))
+	if b, err := ReadNBytes(conn, 4); err != nil || string(b) != "ping" {
+		t.Errorf("echo: %q, %v", b, err)
+	}
+}
+
+func TestGSSAPIAuth_Abort(t *testing.T) {
+	srv := &Server{
+		Authenticators: map[METHOD]Authenticator{GSSAPI: GSSAPIAuth{
+			NewMechanism: func(s *Session) (GSSAPIMechanism, error) { return fakeMechanism{}, nil },
+		}},
+		ErrorLog: log.New(io.Discard, "", 0),
+	}
+	raw, err := net.Dial("tcp", serveTest(t, srv))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer raw.Close()
+	raw.SetDeadline(time.Now().Add(5 * time.Second))
+	raw.Write([]byte{Version5, 1, GSSAPI})
+	ReadNBytes(raw, 2)
+	writeGSSAPIMessage(raw, gssapiAuthentication, []byte("forged"))
+	if b, err := ReadNBytes(raw, 2); err != nil || b[0] != gssapiVersion || b[1] != gssapiAbort {
+		t.Errorf("abort: %v, %v", b, err)
+	}
+}
+
+func TestGSSAPIAuth_Downgrade(t *testing.T) {
+	srv := &Server{
+		Authenticators: map[METHOD]Authenticator{GSSAPI: GSSAPIAuth{
+			NewMechanism: func(s *Session) (GSSAPIMechanism, error) { return fakeMechanism{}, nil },
+		}},
+		ErrorLog: log.New(io.Discard, "", 0),
+	}
+	raw, err := net.Dial("tcp", serveTest(t, srv))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer raw.Close()
+	raw.SetDeadline(time.Now().Add(5 * time.Second))
+	gssapiHandshakeTest(t, raw, GSSAPIConfidentiality)
+
+	// a request protected for integrity only is rejected.
+	conn := &gssapiConn{Conn: raw, mech: fakeMechanism{}, level: GSSAPIIntegrity}
+	dest, _ := ParseAddress(echoTest(t))
+	b, _ := dest.Bytes(Version5)
+	conn.Write(append([]byte{Version5, CONNECT, 0}, b...))
+	if reply, err := ReadNBytes(raw, 1); err == nil {
+		t.Errorf("reply %v", reply)
+	}
+}
+
+func TestServerNegotiator_GSSAPI(t *testing.T) {
+	server := &ServerNegotiator{Authenticators: map[METHOD]Authenticator{GSSAPI: GSSAPIAuth{
+		NewMechanism: func(s *Session) (GSSAPIMechanism, error) { return fakeMechanism{}, nil },
+	}}}
+	srw, crw := net.Pipe()
+	defer srw.Close()
+	defer crw.Close()
+	crw.SetDeadline(time.Now().Add(5 * time.Second))
+	done := make(chan error, 1)
+	go func() {
+		s, err := server.Negotiate(context.Background(), srw)
+		if err == nil {
+			err = server.Reply(server.Protected(s, srw), SUCCESSED, nil)
+		}
+		done <- err
+	}()
+
+	gssapiHandshakeTest(t, crw, GSSAPIConfidentiality)
+	conn := &gssapiConn{Conn: crw, mech: fakeMechanism{}, level: GSSAPIConfidentiality}
+	dest, _ := ParseAddress("127.0.0.1:80")
+	b, _ := dest.Bytes(Version5)
+	conn.Write(append([]byte{Version5, CONNECT, 0}, b...))
+	if reply, err := ReadNBytes(conn, 10); err != nil || reply[1] != SUCCESSED {
+		t.Fatalf("reply %v, %v", reply, err)
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,117 @@
+package socks5
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"hash"
+	"strings"
+	"sync"
+)
+
+// ErrPasswordMismatch is returned by PasswordHasher.Compare when the
+// password does not match the hash.
+var ErrPasswordMismatch = errors.New("socks5 password mismatch")
+
+// errNoHasher is returned by the stores without PasswordHasher.
+var errNoHasher = errors.New("socks5: no password hasher")
+
+// noHasher is the PasswordHasher of stores without one, it fails.
+type noHasher struct{}
+
+func (noHasher) Hash(password string) (string, error) { return "", errNoHasher }
+
+func (noHasher) Compare(hash, password string) error { return errNoHasher }
+
+// dummyHash is a hash of the PasswordHasher of a store, compared with the
+// passwords of unknown users so that they take as long to validate as
+// known users, and do not tell which usernames exist.
+type dummyHash struct {
+	once sync.Once
+	hash string
+}
+
+// compare compare password with the dummy hash of h, hashed once.
+func (d *dummyHash) compare(h PasswordHasher, password string) {
+	d.once.Do(func() { d.hash, _ = h.Hash("socks5 dummy password") })
+	h.Compare(d.hash, password)
+}
+
+// PasswordHasher hashes the passwords of user stores, so that stores keep
+// hashes rather than passwords and share the hashing algorithms.
+//
+// HMACHasher and LegacyHasher are provided, the scrypt, bcrypt and
+// argon2id hashers of package github.com/haochen233/socks5/passhash
+// depend on golang.org/x/crypto. Other algorithms are plugged in by
+// implementing PasswordHasher.
+type PasswordHasher interface {
+	// Hash return the encoded hash of password, including the parameters
+	// needed to compare it, such as its salt.
+	Hash(password string) (string, error)
+
+	// Compare return nil if password matches hash, ErrPasswordMismatch if
+	// it does not, or another error if hash is malformed.
+	Compare(hash, password string) error
+}
+
+// HMACHasher hashes passwords with HMAC-SHA256 keyed with Key. It is fast
+// and unsalted: the same password always has the same hash, so Key must
+// stay secret. Hashes have the form "$hmac-sha256$<base64 mac>".
+type HMACHasher struct {
+	Key []byte
+}
+
+const hmacPrefix = "$hmac-sha256$"
+
+func (h HMACHasher) sum(password string) []byte {
+	mac := hmac.New(sha256.New, h.Key)
+	mac.Write([]byte(password))
+	return mac.Sum(nil)
+}
+
+// Hash return the HMAC of password.
+func (h HMACHasher) Hash(password string) (string, error) {
+	return hmacPrefix + base64.RawStdEncoding.EncodeToString(h.sum(password)), nil
+}
+
+// Compare compare the HMAC of password with hash in constant time.
+func (h HMACHasher) Compare(hash, password string) error {
+	if !strings.HasPrefix(hash, hmacPrefix) {
+		return fmt.Errorf("not an hmac-sha256 hash")
+	}
+	mac, err := base64.RawStdEncoding.DecodeString(hash[len(hmacPrefix):])
+	if err != nil {
+		return fmt.Errorf("malformed hmac-sha256 hash: %w", err)
+	}
+	if !hmac.Equal(mac, h.sum(password)) {
+		return ErrPasswordMismatch
+	}
+	return nil
+}
+
+// LegacyHasher is the scheme of MemoryStores created by NewMemeryStore,
+// kept to validate the passwords they stored: the "hash" is Algo.Sum of
+// the password followed by Secret, which appends the digest of nothing
+// to them and so keeps the password in clear. Only use it to read such
+// stores, and move their users to another hasher.
+type LegacyHasher struct {
+	Algo   hash.Hash
+	Secret string
+}
+
+// Hash return the legacy hash of password.
+func (h LegacyHasher) Hash(password string) (string, error) {
+	return string(h.Algo.Sum([]byte(password + h.Secret))), nil
+}
+
+// Compare compare the legacy hash of password with hash in constant time.
+func (h LegacyHasher) Compare(hash, password string) error {
+	sum, _ := h.Hash(password)
+	if subtle.ConstantTimeCompare([]byte(sum), []byte(hash)) != 1 {
+		return ErrPasswordMismatch
+	}
+	return nil
+}
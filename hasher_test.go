@@ -0,0 +1,86 @@
+package socks5
+
+import (
+	"crypto/sha256"
+	"strings"
+	"testing"
+)
+
+func TestHMACHasher(t *testing.T) {
+	h := HMACHasher{Key: []byte("secret")}
+	hashed, err := h.Hash("pass")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(hashed, "pass") {
+		t.Errorf("password in hash %q", hashed)
+	}
+	if err := h.Compare(hashed, "pass"); err != nil {
+		t.Error(err)
+	}
+	if err := h.Compare(hashed, "bad"); err != ErrPasswordMismatch {
+		t.Errorf("bad password: %v", err)
+	}
+	if err := h.Compare("$other$x", "pass"); err == nil || err == ErrPasswordMismatch {
+		t.Errorf("foreign hash: %v", err)
+	}
+}
+
+func TestMemoryStore_Hasher(t *testing.T) {
+	m := NewHashedMemoryStore(HMACHasher{Key: []byte("secret")})
+	if err := m.Set("user", "pass"); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(m.Users["user"]), "$hmac-sha256$") {
+		t.Errorf("stored %q", m.Users["user"])
+	}
+	if err := m.Validate("user", "pass"); err != nil {
+		t.Error(err)
+	}
+	if err := m.Validate("user", "bad"); err == nil {
+		t.Error("bad password accepted")
+	}
+	if _, ok := m.Validate("other", "pass").(UserNotExist); !ok {
+		t.Error("unknown user accepted")
+	}
+}
+
+// countingHasher counts the comparisons of a PasswordHasher.
+type countingHasher struct {
+	PasswordHasher
+	compares int
+}
+
+func (h *countingHasher) Compare(hash, password string) error {
+	h.compares++
+	return h.PasswordHasher.Compare(hash, password)
+}
+
+func TestMemoryStore_UnknownUser(t *testing.T) {
+	h := &countingHasher{PasswordHasher: HMACHasher{Key: []byte("secret")}}
+	m := NewHashedMemoryStore(h)
+	// unknown users are compared as long as known ones.
+	for i := 0; i < 2; i++ {
+		if _, ok := m.Validate("other", "pass").(UserNotExist); !ok {
+			t.Error("unknown user accepted")
+		}
+	}
+	if h.compares != 2 {
+		t.Errorf("%d compares", h.compares)
+	}
+}
+
+func TestLegacyHasher(t *testing.T) {
+	store := NewMemeryStore(sha256.New(), "secret")
+	store.Set("admin", "123456")
+	h := LegacyHasher{sha256.New(), "secret"}
+	if err := h.Compare(string(store.Users["admin"]), "123456"); err != nil {
+		t.Error(err)
+	}
+	if err := h.Compare(string(store.Users["admin"]), "654321"); err != ErrPasswordMismatch {
+		t.Errorf("wrong password: %v", err)
+	}
+	if err := store.Validate("admin", "654321"); err == nil {
+		t.Error("wrong password validated")
+	}
+}
@@ -0,0 +1,41 @@
+package socks5
+
+import "net"
+
+// Hijacker takes ownership of client connections once their request has
+// been read, so embedders can implement custom commands or splice the
+// connection into their own transports.
+type Hijacker interface {
+	// Hijack is called with the raw client connection and the parsed
+	// request before the server acts on the request. If Hijack returns
+	// true, the server stops serving the session without replying or
+	// closing conn; the hijacker is then responsible for sending the reply
+	// (see WriteReply), closing conn and calling s.Release once done with
+	// it. If Hijack returns false, the server handles the request as usual
+	// and Hijack must not have used conn nor called s.Release.
+	//
+	// Until s.Release is called, the session keeps counting toward the
+	// connection limits, is listed by Server.Sessions and Shutdown waits
+	// for it. s.Context is done when the server closes the session, such
+	// as by Server.Close or CloseSession: the server does not close conn
+	// then, the hijacker should.
+	Hijack(s *Session, conn net.Conn, req *Request) bool
+}
+
+// Release ends a session taken over by Server.Hijacker: it cancels the
+// context of the session and releases what the server holds for it, such
+// as its connection count, then calls Hooks.OnClose. It does nothing for
+// other sessions, and after the first call.
+func (s *Session) Release() {
+	if s.release != nil {
+		s.releaseOnce.Do(s.release)
+	}
+}
+
+// HijackerFunc is an adapter to allow the use of ordinary functions as Hijacker.
+type HijackerFunc func(s *Session, conn net.Conn, req *Request) bool
+
+// Hijack calls f(s, conn, req).
+func (f HijackerFunc) Hijack(s *Session, conn net.Conn, req *Request) bool {
+	return f(s, conn, req)
+}
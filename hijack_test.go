@@ -0,0 +1,81 @@
+package socks5
+
+import (
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestServer_Hijacker(t *testing.T) {
+	const echoCMD CMD = 0x09
+	var closed, cancelled int32
+	srv := &Server{
+		Hooks: Hooks{OnClose: func(s *Session) { atomic.AddInt32(&closed, 1) }},
+		Hijacker: HijackerFunc(func(s *Session, conn net.Conn, req *Request) bool {
+			if req.CMD != echoCMD {
+				return false
+			}
+			if s.Context().Err() != nil {
+				atomic.AddInt32(&cancelled, 1)
+			}
+			go func() {
+				defer s.Release()
+				defer conn.Close()
+				bnd := &Address{net.IPv4zero, IPV4_ADDRESS, 0}
+				WriteReply(conn, &Reply{VER: Version5, REP: SUCCESSED, Address: bnd})
+				io.Copy(conn, conn)
+			}()
+			return true
+		}),
+	}
+	addr := serveTest(t, srv)
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	conn.Write([]byte{Version5, 1, NO_AUTHENTICATION_REQUIRED})
+	ReadNBytes(conn, 2)
+	dest, _ := (&Address{[]byte("custom"), DOMAINNAME, 7}).Bytes(Version5)
+	conn.Write(append([]byte{Version5, echoCMD, 0}, dest...))
+	reply, err := ReadNBytes(conn, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reply[1] != SUCCESSED {
+		t.Fatalf("reply: %#x", reply[1])
+	}
+
+	conn.Write([]byte("hello"))
+	echo, err := ReadNBytes(conn, 5)
+	if err != nil || string(echo) != "hello" {
+		t.Errorf("echo: %q, %v", echo, err)
+	}
+	if n := atomic.LoadInt32(&closed); n != 0 {
+		t.Errorf("OnClose called %d times for a hijacked session", n)
+	}
+	if n := atomic.LoadInt32(&cancelled); n != 0 {
+		t.Error("hijacked session context cancelled")
+	}
+	if n := len(srv.Sessions()); n != 1 {
+		t.Errorf("%d sessions while hijacked, want 1", n)
+	}
+
+	// closing the connection ends the hijacker, which releases the session.
+	conn.Close()
+	deadline := time.Now().Add(5 * time.Second)
+	for (atomic.LoadInt32(&closed) != 1 || len(srv.Sessions()) != 0) && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if n := atomic.LoadInt32(&closed); n != 1 {
+		t.Errorf("OnClose called %d times for a released session, want 1", n)
+	}
+	if n := len(srv.Sessions()); n != 0 {
+		t.Errorf("%d sessions after release", n)
+	}
+}
@@ -0,0 +1,190 @@
+package socks5
+
+import (
+	"net"
+	"time"
+)
+
+// Hooks are callbacks the server invokes on connection events.
+// Nil callbacks are skipped. Callbacks run synchronously on the
+// connection's goroutine, so they should return quickly.
+type Hooks struct {
+	// OnHandshake is called when the handshake of a session ended: the
+	// method negotiation, the authentication and the reading of the
+	// request. err is nil if the request was read, in s.Request,
+	// otherwise it is why the handshake failed.
+	OnHandshake func(s *Session, err error)
+
+	// OnAuthSuccess is called when the client authenticated, with a
+	// method other than NO_AUTHENTICATION_REQUIRED, s.Method, and the
+	// user name in s.Username if the method has one.
+	OnAuthSuccess func(s *Session)
+
+	// OnAuthFailure is called when the client failed to authenticate
+	// with method, err is why, such as invalid credentials.
+	OnAuthFailure func(s *Session, method METHOD, err error)
+
+	// OnRequest is called when the request of the client was allowed by
+	// Rules and Policy, before the server connects to its destination.
+	// Calling s.Close denies the request without reply.
+	OnRequest func(s *Session, req *Request)
+
+	// OnRelayStart is called when the server replied to the request and
+	// starts relaying the session, TCP for CONNECT and BIND, datagrams
+	// for UDP ASSOCIATE.
+	OnRelayStart func(s *Session)
+
+	// OnClose is called when a session ended, whatever the stage it
+	// reached, after its relay if any, sessions refused by the connection
+	// limits included. s.CloseReason is set if the server closed it, and
+	// BytesUp and BytesDown if its bytes were counted, and s.Tags are the
+	// final tags of the session, such as to account usage per team.
+	// Sessions taken over by Server.Hijacker end when their hijacker
+	// calls Session.Release.
+	OnClose func(s *Session)
+
+	// OnMethods is called with the methods offered by the client as sent,
+	// duplicates and unknown methods included, before the server selects
+	// one. The list may serve to fingerprint clients.
+	OnMethods func(s *Session, offered []METHOD)
+
+	// OnNoAcceptableMethods is called when none of the methods offered by
+	// the client is acceptable, after the server replied
+	// NO_ACCEPTABLE_METHODS, such as to count rejected clients.
+	OnNoAcceptableMethods func(s *Session, offered []METHOD)
+
+	// OnDialError is called when the server failed to connect to the
+	// destination of a CONNECT request, before the failure reply is sent.
+	OnDialError func(s *Session, e *DialError)
+
+	// WrapLeg wraps the connection of each leg of a CONNECT session
+	// before the relay starts, such as to hash content, detect protocols
+	// or enforce data-loss-prevention rules; see WrapConn. It must return
+	// conn itself if it does not wrap the leg.
+	//
+	// See also Server.Interceptors, which wrap the streams of the legs.
+	//
+	// Wrapped legs are not relayed zero-copy, see PooledTransport, and
+	// are only half-closed if the wrapper implements CloseWrite: only wrap
+	// the legs you inspect.
+	WrapLeg func(s *Session, leg Leg, conn net.Conn) net.Conn
+
+	// OnUsage is called every Server.UsageInterval while a CONNECT session
+	// is relayed, with the bytes transferred up (client to destination)
+	// and down since the previous call, and once more when the relay
+	// ends. Intervals without traffic are skipped. s.Tags tell who to
+	// account the bytes to. It runs on a goroutine of its own, and counts
+	// the relayed bytes, see PooledTransport.
+	OnUsage func(s *Session, up, down uint64)
+
+	// OnWriteStall is called when a write of the CONNECT relay to leg was
+	// blocked for d, longer than Server.WriteStallThreshold, because the
+	// peer of leg did not read fast enough: a stall on ClientLeg points to
+	// a slow client, one on RemoteLeg to a slow destination. It runs on
+	// the relay goroutine and enables Server.MeasureWriteStalls.
+	OnWriteStall func(s *Session, leg Leg, d time.Duration)
+
+	// OnMemoryPressure is called when the memory usage goes over
+	// Server.MemoryLimit, over is true, and when it goes back under it.
+	// While over it, the server closes the connections it accepts.
+	OnMemoryPressure func(usage uint64, over bool)
+
+	// OnSessionShed is called before the server closes an idle session
+	// under memory pressure, see MemoryLimit.CloseIdle.
+	OnSessionShed func(s *Session)
+
+	// OnPortsExhausted is called when a request failed because all the
+	// ports of Server.RelayPorts are in use.
+	OnPortsExhausted func(s *Session)
+
+	// OnLimit is called when a session or the server crosses a soft or
+	// hard limit, see SoftLimits. It is called before the more specific
+	// hooks of hard limits, such as OnSessionExpired.
+	OnLimit func(e LimitEvent)
+
+	// OnSessionExpired is called when the server closes a session that
+	// outlived its lifetime limit, see Server.MaxSessionDuration.
+	OnSessionExpired func(s *Session)
+
+	// OnByteLimit is called when the server closes a session that
+	// transferred more than its byte limit, see Server.MaxSessionBytes.
+	OnByteLimit func(s *Session)
+}
+
+func (srv *Server) onHandshake(s *Session, err error) {
+	if srv.Hooks.OnHandshake != nil {
+		srv.Hooks.OnHandshake(s, err)
+	}
+}
+
+func (srv *Server) onAuthSuccess(s *Session) {
+	if srv.Hooks.OnAuthSuccess != nil {
+		srv.Hooks.OnAuthSuccess(s)
+	}
+}
+
+func (srv *Server) onAuthFailure(s *Session, method METHOD, err error) {
+	if srv.Hooks.OnAuthFailure != nil {
+		srv.Hooks.OnAuthFailure(s, method, err)
+	}
+}
+
+func (srv *Server) onRequest(s *Session, req *Request) {
+	if srv.Hooks.OnRequest != nil {
+		srv.Hooks.OnRequest(s, req)
+	}
+}
+
+func (srv *Server) onRelayStart(s *Session) {
+	if srv.Hooks.OnRelayStart != nil {
+		srv.Hooks.OnRelayStart(s)
+	}
+}
+
+func (srv *Server) onClose(s *Session) {
+	if srv.Hooks.OnClose != nil {
+		srv.Hooks.OnClose(s)
+	}
+}
+
+func (srv *Server) onMethods(s *Session, offered []METHOD) {
+	if srv.Hooks.OnMethods != nil {
+		srv.Hooks.OnMethods(s, offered)
+	}
+}
+
+func (srv *Server) onNoAcceptableMethods(s *Session, offered []METHOD) {
+	if srv.Hooks.OnNoAcceptableMethods != nil {
+		srv.Hooks.OnNoAcceptableMethods(s, offered)
+	}
+}
+
+func (srv *Server) onMemoryPressure(usage uint64, over bool) {
+	if srv.Hooks.OnMemoryPressure != nil {
+		srv.Hooks.OnMemoryPressure(usage, over)
+	}
+}
+
+func (srv *Server) onSessionShed(s *Session) {
+	if srv.Hooks.OnSessionShed != nil {
+		srv.Hooks.OnSessionShed(s)
+	}
+}
+
+func (srv *Server) onPortsExhausted(s *Session) {
+	if srv.Hooks.OnPortsExhausted != nil {
+		srv.Hooks.OnPortsExhausted(s)
+	}
+}
+
+func (srv *Server) onWriteStall(s *Session, leg Leg, d time.Duration) {
+	if srv.Hooks.OnWriteStall != nil {
+		srv.Hooks.OnWriteStall(s, leg, d)
+	}
+}
+
+func (srv *Server) onDialError(s *Session, e *DialError) {
+	if srv.Hooks.OnDialError != nil {
+		srv.Hooks.OnDialError(s, e)
+	}
+}
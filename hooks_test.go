@@ -0,0 +1,86 @@
+package socks5
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestServer_LifecycleHooks(t *testing.T) {
+	store := NewMemeryStore(sha256.New(), "secret")
+	store.Set("alice", "123456")
+	var mu sync.Mutex
+	var events []string
+	record := func(format string, args ...interface{}) {
+		mu.Lock()
+		events = append(events, fmt.Sprintf(format, args...))
+		mu.Unlock()
+	}
+	closed := make(chan struct{}, 4)
+	srv := &Server{
+		Authenticators: map[METHOD]Authenticator{USERNAME_PASSWORD: UserPwdAuth{store}},
+		Hooks: Hooks{
+			OnHandshake: func(s *Session, err error) {
+				record("handshake %v", err == nil)
+			},
+			OnAuthSuccess: func(s *Session) {
+				record("auth %s", s.Username)
+			},
+			OnAuthFailure: func(s *Session, method METHOD, err error) {
+				record("auth failure %s", methodString(method))
+			},
+			OnRequest: func(s *Session, req *Request) {
+				record("request %d", req.Address.Port)
+				if req.Address.Port == 1 {
+					s.Close()
+				}
+			},
+			OnRelayStart: func(s *Session) {
+				record("relay")
+			},
+			OnClose: func(s *Session) {
+				record("close")
+				closed <- struct{}{}
+			},
+		},
+		ErrorLog: log.New(io.Discard, "", 0),
+	}
+	addr := serveTest(t, srv)
+	echo := echoTest(t)
+	_, port, _ := net.SplitHostPort(echo)
+
+	conn, err := (&Client{ProxyAddr: addr, Username: "alice", Password: "123456"}).Dial("tcp", echo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	<-closed
+	if _, err := (&Client{ProxyAddr: addr, Username: "alice", Password: "wrong"}).Dial("tcp", echo); err == nil {
+		t.Error("wrong password accepted")
+	}
+	<-closed
+	if _, err := (&Client{ProxyAddr: addr, Username: "alice", Password: "123456"}).Dial("tcp", "127.0.0.1:1"); err == nil {
+		t.Error("request closed by OnRequest served")
+	}
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("session not closed")
+	}
+
+	want := []string{
+		"auth alice", "handshake true", "request " + port, "relay", "close",
+		"auth failure USERNAME_PASSWORD", "handshake false", "close",
+		"auth alice", "handshake true", "request 1", "close",
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if fmt.Sprint(events) != fmt.Sprint(want) {
+		t.Errorf("events\n%v\nwant\n%v", events, want)
+	}
+}
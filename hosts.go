@@ -0,0 +1,92 @@
+package socks5
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+)
+
+// HostsResolver resolves names from a static hosts table before falling
+// back to Next. It is useful for split-horizon names and for pinning
+// critical destinations to known addresses.
+type HostsResolver struct {
+	// Hosts maps host names to addresses. Names are matched case
+	// insensitively, without the trailing dot. Hosts must not be
+	// modified once the resolver is in use.
+	Hosts map[string][]net.IP
+
+	// Next resolves names not in Hosts.
+	// If nil, net.DefaultResolver is used.
+	Next NameResolver
+}
+
+// Resolve look up fqdn in Hosts, then with Next.
+func (h *HostsResolver) Resolve(ctx context.Context, fqdn string) ([]net.IP, error) {
+	if ips, ok := h.Hosts[canonicalHost(fqdn)]; ok {
+		return ips, nil
+	}
+	if h.Next == nil {
+		return netResolver{net.DefaultResolver}.Resolve(ctx, fqdn)
+	}
+	return h.Next.Resolve(ctx, fqdn)
+}
+
+// canonicalHost lower case name and trim its trailing dot.
+func canonicalHost(name string) string {
+	return strings.ToLower(strings.TrimSuffix(name, "."))
+}
+
+// ParseHosts read a hosts table in /etc/hosts format:
+//
+//	# comment
+//	10.0.0.10    git.corp.internal git
+//	fd00::10     git.corp.internal
+//
+// Each line holds an address followed by one or more host names.
+// Addresses of the same name are accumulated in order.
+func ParseHosts(r io.Reader) (map[string][]net.IP, error) {
+	hosts := make(map[string][]net.IP)
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line := scanner.Text()
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) < 2 {
+			return nil, fmt.Errorf("hosts line %d: missing host name", n)
+		}
+		ip := net.ParseIP(fields[0])
+		if ip == nil {
+			return nil, fmt.Errorf("hosts line %d: invalid address %q", n, fields[0])
+		}
+		if ip4 := ip.To4(); ip4 != nil {
+			ip = ip4
+		}
+		for _, name := range fields[1:] {
+			name = canonicalHost(name)
+			hosts[name] = append(hosts[name], ip)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return hosts, nil
+}
+
+// LoadHostsFile read the hosts table at path, please see ParseHosts.
+func LoadHostsFile(path string) (map[string][]net.IP, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ParseHosts(f)
+}
@@ -0,0 +1,50 @@
+package socks5
+
+import (
+	"context"
+	"net"
+	"strings"
+	"testing"
+)
+
+type staticResolver map[string][]net.IP
+
+func (r staticResolver) Resolve(ctx context.Context, fqdn string) ([]net.IP, error) {
+	if ips, ok := r[fqdn]; ok {
+		return ips, nil
+	}
+	return nil, &net.DNSError{Err: "no such host", Name: fqdn, IsNotFound: true}
+}
+
+func TestHostsResolver(t *testing.T) {
+	hosts, err := ParseHosts(strings.NewReader(`
+# pinned
+10.0.0.10   git.corp.internal  git  # trailing comment
+fd00::10    Git.Corp.Internal.
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := &HostsResolver{
+		Hosts: hosts,
+		Next:  staticResolver{"example.com": {net.IPv4(93, 184, 216, 34)}},
+	}
+
+	ips, err := r.Resolve(context.Background(), "GIT.corp.internal.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ips) != 2 || !ips[0].Equal(net.IPv4(10, 0, 0, 10)) || !ips[1].Equal(net.ParseIP("fd00::10")) {
+		t.Errorf("hosts table: %v", ips)
+	}
+
+	ips, err = r.Resolve(context.Background(), "example.com")
+	if err != nil || len(ips) != 1 {
+		t.Errorf("fallback: %v, %v", ips, err)
+	}
+
+	_, err = ParseHosts(strings.NewReader("10.0.0.300 bad\n"))
+	if err == nil {
+		t.Error("invalid address should fail")
+	}
+}
@@ -0,0 +1,152 @@
+package socks5
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// repStatus are the HTTP statuses of the replies to CONNECT requests of
+// HTTP clients. Other replies are 502 Bad Gateway.
+var repStatus = map[REP]int{
+	SUCCESSED:                       http.StatusOK,
+	CONNECTION_NOT_ALLOW_BY_RULESET: http.StatusForbidden,
+	TTL_EXPIRED:                     http.StatusGatewayTimeout,
+	COMMAND_NOT_SUPPORTED:           http.StatusNotImplemented,
+	ADDRESS_TYPE_NOT_SUPPORTED:      http.StatusBadRequest,
+}
+
+var errHTTPProxyAuth = errors.New("http proxy credentials too long")
+
+// isHTTPMethodStart report whether b may start the method of an HTTP
+// request, which is a token such as CONNECT.
+func isHTTPMethodStart(b byte) bool {
+	return b >= 'A' && b <= 'Z'
+}
+
+// connectConn is the connection of an HTTP CONNECT client. Replies to its
+// request are sent as HTTP responses, and the data it sent after the
+// request is read first.
+type connectConn struct {
+	httpConn
+}
+
+// writeStatus send a response of status code, with header. The client
+// must close the connection after error responses.
+func (c *connectConn) writeStatus(code int, header http.Header) error {
+	text := http.StatusText(code)
+	if code == http.StatusOK {
+		text = "Connection established"
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "HTTP/1.1 %d %s\r\n", code, text)
+	if code != http.StatusOK {
+		if header == nil {
+			header = http.Header{}
+		}
+		header.Set("Connection", "close")
+		header.Set("Content-Length", "0")
+	}
+	header.Write(&b)
+	b.WriteString("\r\n")
+	_, err := io.WriteString(c.Conn, b.String())
+	return err
+}
+
+// writeReply send the reply rep to the CONNECT request.
+func (c *connectConn) writeReply(rep REP) error {
+	code, ok := repStatus[rep]
+	if !ok {
+		code = http.StatusBadGateway
+	}
+	return c.writeStatus(code, nil)
+}
+
+// readHTTPRequest read the CONNECT request of an HTTP client whose first
+// byte was read already, authenticate it with the Username/Password
+// method and return it as a socks5 CONNECT request. The rest of the
+// session uses s.encapsulated, which answers with HTTP responses.
+func (srv *Server) readHTTPRequest(s *Session, client net.Conn, first byte) (*Request, error) {
+	r := bufio.NewReader(io.MultiReader(bytes.NewReader([]byte{first}), client))
+	conn := &connectConn{httpConn{client, r}}
+	hr, err := http.ReadRequest(r)
+	if err != nil {
+		conn.writeStatus(http.StatusBadRequest, nil)
+		return nil, &OpError{Version5, "read", client.RemoteAddr(), "\"http request\"", err}
+	}
+	hr.Body.Close()
+	if hr.Method != http.MethodConnect {
+		s.failure = FailureVersion
+		conn.writeStatus(http.StatusMethodNotAllowed, http.Header{"Allow": {http.MethodConnect}})
+		return nil, &OpError{Version5, "", client.RemoteAddr(), "\"http request\"", errHTTPCommand}
+	}
+	if err := srv.authenticateHTTP(s, conn, hr); err != nil {
+		return nil, err
+	}
+	addr, err := ParseAddress(hr.Host)
+	if err != nil {
+		conn.writeStatus(http.StatusBadRequest, nil)
+		return nil, &OpError{Version5, "", client.RemoteAddr(), "\"http request\"", err}
+	}
+	s.encapsulated = conn
+	return &Request{VER: Version5, CMD: CONNECT, Address: addr}, nil
+}
+
+// authenticateHTTP authenticate an HTTP client with the Basic credentials
+// of its Proxy-Authorization header, as the Username/Password method
+// offered before NO_AUTHENTICATION_REQUIRED, or none if it sent none.
+func (srv *Server) authenticateHTTP(s *Session, conn *connectConn, hr *http.Request) error {
+	offered := []METHOD{NO_AUTHENTICATION_REQUIRED}
+	username, password, ok := proxyBasicAuth(hr)
+	if ok {
+		offered = []METHOD{USERNAME_PASSWORD, NO_AUTHENTICATION_REQUIRED}
+	}
+	s.Methods = offered
+	srv.onMethods(s, offered)
+
+	var err error
+	switch m := srv.selectMethod(conn.RemoteAddr(), offered); m {
+	case NO_AUTHENTICATION_REQUIRED:
+		s.Method = m
+		return nil
+	case USERNAME_PASSWORD:
+		s.Method = m
+		if len(username) > 255 || len(password) > 255 {
+			err = errHTTPProxyAuth
+			s.authUser = username
+			srv.auditAuth(s, m, 0, err)
+			srv.authFailure(s, m, err)
+			break
+		}
+		// the Username/Password sub-negotiation of the credentials.
+		msg := []byte{0x01, byte(len(username))}
+		msg = append(msg, username...)
+		msg = append(msg, byte(len(password)))
+		msg = append(msg, password...)
+		if err = srv.authenticate(s, m, bytes.NewReader(msg), io.Discard); err == nil {
+			return nil
+		}
+	default:
+		s.failure = FailureMethods
+		srv.onNoAcceptableMethods(s, offered)
+		err = &NoAcceptableMethodsError{offered}
+	}
+	conn.writeStatus(http.StatusProxyAuthRequired, http.Header{"Proxy-Authenticate": {`Basic realm="socks5"`}})
+	return &OpError{Version5, "", conn.RemoteAddr(), "\"http authentication\"", err}
+}
+
+// proxyBasicAuth return the Basic credentials of the Proxy-Authorization
+// header of r.
+func proxyBasicAuth(r *http.Request) (username, password string, ok bool) {
+	auth := r.Header.Get("Proxy-Authorization")
+	if auth == "" {
+		return "", "", false
+	}
+	// BasicAuth parses the Authorization header only.
+	return (&http.Request{Header: http.Header{"Authorization": {auth}}}).BasicAuth()
+}
@@ -0,0 +1,107 @@
+package socks5
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestServer_HTTPConnect(t *testing.T) {
+	store := NewMemeryStore(sha256.New(), "secret")
+	store.Set("alice", "123456")
+	users := make(chan string, 4)
+	srv := &Server{
+		HTTPConnect:    true,
+		Authenticators: map[METHOD]Authenticator{USERNAME_PASSWORD: UserPwdAuth{store}},
+		Rules: RuleSetFunc(func(s *Session, req *Request) bool {
+			users <- s.Username
+			return req.Address.Port != 1
+		}),
+		ErrorLog: log.New(io.Discard, "", 0),
+	}
+	addr := serveTest(t, srv)
+	echo := echoTest(t)
+
+	for _, protocol := range []Protocol{ProtocolHTTP, ProtocolSOCKS5} {
+		client := &Client{ProxyAddr: addr, Protocol: protocol, Username: "alice", Password: "123456"}
+		conn, err := client.Dial("tcp", echo)
+		if err != nil {
+			t.Fatalf("%s: %v", protocol, err)
+		}
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		conn.Write([]byte("ping"))
+		b, err := ReadNBytes(conn, 4)
+		if err != nil || string(b) != "ping" {
+			t.Errorf("%s: echo %q, %v", protocol, b, err)
+		}
+		conn.Close()
+		if user := <-users; user != "alice" {
+			t.Errorf("%s: user %q", protocol, user)
+		}
+	}
+
+	tests := []struct {
+		name     string
+		password string
+		dest     string
+		status   int
+	}{
+		{"no credentials", "", echo, http.StatusProxyAuthRequired},
+		{"wrong password", "654321", echo, http.StatusProxyAuthRequired},
+		{"denied", "123456", "127.0.0.1:1", http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		client := &Client{ProxyAddr: addr, Protocol: ProtocolHTTP, Password: tt.password}
+		if tt.password != "" {
+			client.Username = "alice"
+		}
+		_, err := client.Dial("tcp", tt.dest)
+		var status *HTTPStatusError
+		if !errors.As(err, &status) || status.StatusCode != tt.status {
+			t.Errorf("%s: %v, want status %d", tt.name, err, tt.status)
+		}
+	}
+}
+
+func TestServer_HTTPConnectErrors(t *testing.T) {
+	srv := &Server{
+		HTTPConnect: true,
+		Router: RouterFunc(func(s *Session, dest *Address) []Route {
+			return []Route{{Name: "upstream", Dialer: failDialer{}}}
+		}),
+		ErrorLog: log.New(io.Discard, "", 0),
+	}
+	addr := serveTest(t, srv)
+	_, err := (&Client{ProxyAddr: addr, Protocol: ProtocolHTTP}).Dial("tcp", echoTest(t))
+	var status *HTTPStatusError
+	if !errors.As(err, &status) || status.StatusCode != http.StatusBadGateway {
+		t.Errorf("dial error: %v", err)
+	}
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	conn.Write([]byte("GET http://example.com/ HTTP/1.1\r\nHost: example.com\r\n\r\n"))
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusMethodNotAllowed || resp.Header.Get("Allow") != "CONNECT" {
+		t.Errorf("GET: %s, Allow %q", resp.Status, resp.Header.Get("Allow"))
+	}
+
+	_, err = (&Client{ProxyAddr: serveTest(t, &Server{ErrorLog: log.New(io.Discard, "", 0)}), Protocol: ProtocolHTTP}).Dial("tcp", echoTest(t))
+	if err == nil {
+		t.Error("HTTP served without HTTPConnect")
+	}
+}
@@ -0,0 +1,129 @@
+package socks5
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+)
+
+// RelayInterceptor inspects the data relayed by CONNECT and BIND
+// sessions, such as to record traffic, sniff protocols or scan for data
+// leaks, without reimplementing the relay; see Server.Interceptors.
+type RelayInterceptor interface {
+	// Intercept return the stream the relay copies from leg from of s:
+	// up to the destination for ClientLeg, down to the client for
+	// RemoteLeg. It wraps r to observe or rewrite the data, such as with
+	// io.TeeReader, a Read error ending the relay, or return r itself to
+	// leave the leg alone. It is called when the relay starts, readers
+	// are read on the goroutines of the relay.
+	Intercept(s *Session, from Leg, r io.Reader) io.Reader
+}
+
+// RelayInterceptorFunc is an adapter to allow the use of ordinary
+// functions as RelayInterceptor.
+type RelayInterceptorFunc func(s *Session, from Leg, r io.Reader) io.Reader
+
+// Intercept calls f(s, from, r).
+func (f RelayInterceptorFunc) Intercept(s *Session, from Leg, r io.Reader) io.Reader {
+	return f(s, from, r)
+}
+
+// interceptLegs apply Interceptors to both legs of s.
+func (srv *Server) interceptLegs(s *Session, client, remote net.Conn) (net.Conn, net.Conn) {
+	if len(srv.Interceptors) == 0 {
+		return client, remote
+	}
+	return srv.intercept(s, ClientLeg, client), srv.intercept(s, RemoteLeg, remote)
+}
+
+// intercept return conn reading from the stream of Interceptors, or
+// conn itself if none wrapped it.
+func (srv *Server) intercept(s *Session, leg Leg, conn net.Conn) net.Conn {
+	var r io.Reader = conn
+	for _, i := range srv.Interceptors {
+		r = i.Intercept(s, leg, r)
+	}
+	if r == io.Reader(conn) {
+		return conn
+	}
+	return WrapConn(conn, r, nil)
+}
+
+// SniffSNI is a RelayInterceptor setting the MetaSNI metadata of the
+// sessions whose client starts a TLS handshake to the server name of
+// its ClientHello, for logs and accounting. It delays no byte: the
+// ClientHello is relayed as it is read.
+var SniffSNI RelayInterceptor = RelayInterceptorFunc(func(s *Session, from Leg, r io.Reader) io.Reader {
+	if from != ClientLeg {
+		return r
+	}
+	return &sniReader{r: r, s: s}
+})
+
+// maxTLSRecord is the size of the largest TLS plaintext record, header
+// included.
+const maxTLSRecord = 5 + 16384
+
+// sniReader copies the first TLS record read from r, until it parsed the
+// ClientHello it carries.
+type sniReader struct {
+	r      io.Reader
+	s      *Session
+	record []byte
+	done   bool
+}
+
+func (r *sniReader) Read(b []byte) (int, error) {
+	n, err := r.r.Read(b)
+	if !r.done && n > 0 {
+		r.sniff(b[:n])
+	}
+	return n, err
+}
+
+func (r *sniReader) sniff(b []byte) {
+	r.record = append(r.record, b...)
+	if r.record[0] != 0x16 {
+		// not a TLS handshake
+		r.done, r.record = true, nil
+		return
+	}
+	if len(r.record) < 5 {
+		return
+	}
+	size := 5 + (int(r.record[3])<<8 | int(r.record[4]))
+	if size > maxTLSRecord {
+		r.done, r.record = true, nil
+		return
+	}
+	if len(r.record) < size {
+		return
+	}
+	if name := serverName(r.record[:size]); name != "" {
+		r.s.Set(MetaSNI, name)
+	}
+	r.done, r.record = true, nil
+}
+
+// errSniffed ends the handshake serverName runs once it read the
+// ClientHello.
+var errSniffed = errors.New("client hello read")
+
+// serverName return the server name of the ClientHello in the TLS
+// record, "" if none.
+func serverName(record []byte) string {
+	var name string
+	conn := rwConn{struct {
+		io.Reader
+		io.Writer
+	}{bytes.NewReader(record), io.Discard}}
+	tls.Server(conn, &tls.Config{
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			name = hello.ServerName
+			return nil, errSniffed
+		},
+	}).Handshake()
+	return name
+}
@@ -0,0 +1,140 @@
+package socks5
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// syncBuffer is a bytes.Buffer safe for concurrent use.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+// errLeak is the failure of leakReader.
+var errLeak = errors.New("data leak")
+
+// leakReader fails reads of data containing "secret".
+type leakReader struct {
+	io.Reader
+}
+
+func (r leakReader) Read(b []byte) (int, error) {
+	n, err := r.Reader.Read(b)
+	if bytes.Contains(b[:n], []byte("secret")) {
+		return 0, errLeak
+	}
+	return n, err
+}
+
+func TestServer_Interceptors(t *testing.T) {
+	var up, down syncBuffer
+	record := RelayInterceptorFunc(func(s *Session, from Leg, r io.Reader) io.Reader {
+		if from == ClientLeg {
+			return io.TeeReader(r, &up)
+		}
+		return io.TeeReader(r, &down)
+	})
+	dlp := RelayInterceptorFunc(func(s *Session, from Leg, r io.Reader) io.Reader {
+		if from == ClientLeg {
+			return leakReader{r}
+		}
+		return r
+	})
+	srv := &Server{Interceptors: []RelayInterceptor{record, dlp}, ErrorLog: log.New(io.Discard, "", 0)}
+	addr := serveTest(t, srv)
+	echo := echoTest(t)
+
+	conn, err := (&Client{ProxyAddr: addr}).Dial("tcp", echo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.Write([]byte("ping"))
+	if b, err := ReadNBytes(conn, 4); err != nil || string(b) != "ping" {
+		t.Fatalf("echo %q, %v", b, err)
+	}
+	conn.Write([]byte("the secret"))
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if b, err := io.ReadAll(conn); len(b) != 0 || err != nil {
+		t.Errorf("leaked %q, %v", b, err)
+	}
+	if up.String() != "pingthe secret" || down.String() != "ping" {
+		t.Errorf("recorded up %q, down %q", up.String(), down.String())
+	}
+}
+
+func TestSniffSNI(t *testing.T) {
+	sni := make(chan string, 1)
+	srv := &Server{
+		Interceptors: []RelayInterceptor{SniffSNI},
+		Hooks: Hooks{OnClose: func(s *Session) {
+			sni <- s.GetString(MetaSNI)
+		}},
+	}
+	addr := serveTest(t, srv)
+	ts := httptest.NewTLSServer(nil)
+	defer ts.Close()
+
+	conn, err := (&Client{ProxyAddr: addr}).Dial("tcp", ts.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	tlsConn := tls.Client(conn, &tls.Config{ServerName: "www.example.test", InsecureSkipVerify: true})
+	if err := tlsConn.Handshake(); err != nil {
+		t.Fatal(err)
+	}
+	tlsConn.Close()
+	if name := <-sni; name != "www.example.test" {
+		t.Errorf("sni %q", name)
+	}
+
+	conn, err = (&Client{ProxyAddr: addr}).Dial("tcp", ts.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Write([]byte("GET / HTTP/1.0\r\n\r\n"))
+	io.Copy(io.Discard, conn)
+	conn.Close()
+	if name := <-sni; name != "" {
+		t.Errorf("sni of plain text %q", name)
+	}
+}
+
+func TestServerName(t *testing.T) {
+	client, server := net.Pipe()
+	hello := make(chan []byte)
+	go func() {
+		b := make([]byte, maxTLSRecord)
+		n, _ := server.Read(b)
+		server.Close()
+		hello <- b[:n]
+	}()
+	tls.Client(client, &tls.Config{ServerName: "example.test"}).Handshake()
+	if name := serverName(<-hello); name != "example.test" {
+		t.Errorf("server name %q", name)
+	}
+	if name := serverName([]byte{0x16, 3, 1, 0, 1, 1}); name != "" {
+		t.Errorf("server name of truncated hello %q", name)
+	}
+}
@@ -0,0 +1,89 @@
+//go:build go1.18
+// +build go1.18
+
+package parser
+
+import (
+	"bytes"
+	"testing"
+)
+
+func FuzzReadRequest(f *testing.F) {
+	f.Add([]byte{5, 1, 0, IPv4, 127, 0, 0, 1, 0, 80})
+	f.Add([]byte{5, 1, 0, Domain, 11, 'e', 'x', 'a', 'm', 'p', 'l', 'e', '.', 'c', 'o', 'm', 1, 187})
+	f.Add([]byte{5, 3, 0, IPv6, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1, 0, 53})
+	f.Fuzz(func(t *testing.T, b []byte) {
+		req, err := ReadRequest(bytes.NewReader(b))
+		if err != nil {
+			return
+		}
+		switch req.Address.Type {
+		case IPv4:
+			if len(req.Address.Host) != 4 {
+				t.Fatalf("IPv4 address of %d bytes", len(req.Address.Host))
+			}
+		case IPv6:
+			if len(req.Address.Host) != 16 {
+				t.Fatalf("IPv6 address of %d bytes", len(req.Address.Host))
+			}
+		case Domain:
+			if len(req.Address.Host) == 0 || len(req.Address.Host) > 255 {
+				t.Fatalf("domain of %d bytes", len(req.Address.Host))
+			}
+		default:
+			t.Fatalf("address type %#x accepted", req.Address.Type)
+		}
+	})
+}
+
+func FuzzReadMethods(f *testing.F) {
+	f.Add([]byte{1, 0})
+	f.Add([]byte{2, 0, 2})
+	f.Fuzz(func(t *testing.T, b []byte) {
+		methods, err := ReadMethods(bytes.NewReader(b))
+		if err == nil && len(methods) != int(b[0]) {
+			t.Fatalf("%d methods, NMETHODS %d", len(methods), b[0])
+		}
+	})
+}
+
+func FuzzReadSocks4Request(f *testing.F) {
+	f.Add([]byte("\x00\x50\x7f\x00\x00\x01user\x00"))
+	f.Add([]byte("\x00\x50\x00\x00\x00\x01\x00example.com\x00"))
+	f.Fuzz(func(t *testing.T, b []byte) {
+		req, err := ReadSocks4Request(bytes.NewReader(b))
+		if err != nil {
+			return
+		}
+		if len(req.UserID) > MaxSocks4Field || len(req.Address.Host) > MaxSocks4Field {
+			t.Fatalf("field over the limit: %+v", req)
+		}
+	})
+}
+
+func FuzzParseUDPHeader(f *testing.F) {
+	f.Add([]byte{0, 0, 0, IPv4, 10, 0, 0, 1, 0, 53, 'h', 'i'})
+	f.Add([]byte{0, 0, 0, Domain, 1, 'a', 0, 53})
+	f.Fuzz(func(t *testing.T, b []byte) {
+		h, err := ParseUDPHeader(b)
+		if err != nil {
+			return
+		}
+		if len(h.Data) > len(b) {
+			t.Fatalf("data of %d bytes in a %d bytes datagram", len(h.Data), len(b))
+		}
+	})
+}
+
+func FuzzReadUserPass(f *testing.F) {
+	f.Add([]byte("\x01\x05admin\x06123456"))
+	f.Fuzz(func(t *testing.T, b []byte) {
+		u, err := ReadUserPass(bytes.NewReader(b))
+		if err != nil {
+			return
+		}
+		if len(u.Username) > 255 || len(u.Password) > 255 {
+			t.Fatalf("field over 255 bytes: %+v", u)
+		}
+	})
+}
@@ -0,0 +1,248 @@
+// Package parser parses the socks wire formats: method selection,
+// requests and replies of socks4(a) and socks5 (RFC 1928), UDP request
+// headers and Username/Password authentication (RFC 1929).
+//
+// Parsers never allocate more than the protocol field limits allow, and
+// reject malformed input with errors instead of guessing, so they are
+// safe on untrusted peers.
+package parser
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Address types of socks5.
+const (
+	IPv4   byte = 0x01
+	Domain byte = 0x03
+	IPv6   byte = 0x04
+)
+
+// MaxSocks4Field is the longest USERID or HOSTNAME accepted in socks4
+// requests, which have no length prefix.
+const MaxSocks4Field = 255
+
+var (
+	// ErrEmptyDomain is returned for zero length domain names.
+	ErrEmptyDomain = errors.New("empty domain name")
+	// ErrFieldTooLong is returned for socks4 fields over MaxSocks4Field.
+	ErrFieldTooLong = errors.New("field too long")
+	// ErrShortDatagram is returned for UDP datagrams shorter than a header.
+	ErrShortDatagram = errors.New("udp datagram too short")
+)
+
+// AddressTypeError is returned for unknown socks5 address types.
+type AddressTypeError struct {
+	Type byte
+}
+
+func (e *AddressTypeError) Error() string {
+	return fmt.Sprintf("unknown address type %#x", e.Type)
+}
+
+// Address is a destination or bound address. Host is an IP address of
+// 4 or 16 bytes, or a domain name.
+type Address struct {
+	Type byte
+	Host []byte
+	Port uint16
+}
+
+// readN read exactly n bytes.
+func readN(r io.Reader, n int) ([]byte, error) {
+	b := make([]byte, n)
+	_, err := io.ReadFull(r, b)
+	if err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// ReadMethods read NMETHODS and METHODS of a socks5 method selection,
+// the version having been read by the caller.
+func ReadMethods(r io.Reader) ([]byte, error) {
+	n, err := readN(r, 1)
+	if err != nil {
+		return nil, err
+	}
+	return readN(r, int(n[0]))
+}
+
+// ReadAddress read a socks5 ATYP, ADDR and PORT.
+func ReadAddress(r io.Reader) (*Address, error) {
+	atyp, err := readN(r, 1)
+	if err != nil {
+		return nil, err
+	}
+	addr := &Address{Type: atyp[0]}
+
+	var n int
+	switch addr.Type {
+	case IPv4:
+		n = 4
+	case IPv6:
+		n = 16
+	case Domain:
+		l, err := readN(r, 1)
+		if err != nil {
+			return nil, err
+		}
+		if l[0] == 0 {
+			return nil, ErrEmptyDomain
+		}
+		n = int(l[0])
+	default:
+		return nil, &AddressTypeError{addr.Type}
+	}
+
+	b, err := readN(r, n+2)
+	if err != nil {
+		return nil, err
+	}
+	addr.Host = b[:n:n]
+	addr.Port = binary.BigEndian.Uint16(b[n:])
+	return addr, nil
+}
+
+// Request is a socks5 request, or the reply of the server.
+type Request struct {
+	Version byte
+	// Command is CMD in requests, REP in replies.
+	Command byte
+	Rsv     byte
+	Address *Address
+}
+
+// ReadRequest read a socks5 request, or reply, including the version.
+// The version is not checked.
+func ReadRequest(r io.Reader) (*Request, error) {
+	b, err := readN(r, 3)
+	if err != nil {
+		return nil, err
+	}
+	addr, err := ReadAddress(r)
+	if err != nil {
+		return nil, err
+	}
+	return &Request{Version: b[0], Command: b[1], Rsv: b[2], Address: addr}, nil
+}
+
+// Socks4Request is the part of a socks4 request following VN and CD.
+type Socks4Request struct {
+	Address *Address
+	UserID  []byte
+}
+
+// ReadSocks4Request read DSTPORT, DSTIP, USERID and, for socks4a, the
+// HOSTNAME of a socks4 request. Variable fields are limited to
+// MaxSocks4Field bytes.
+func ReadSocks4Request(r io.Reader) (*Socks4Request, error) {
+	b, err := readN(r, 6)
+	if err != nil {
+		return nil, err
+	}
+	addr := &Address{Type: IPv4, Host: b[2:6:6], Port: binary.BigEndian.Uint16(b)}
+	userID, err := readNULL(r, MaxSocks4Field)
+	if err != nil {
+		return nil, err
+	}
+
+	// socks4a: DSTIP is 0.0.0.x with x non-zero, the host name follows.
+	ip := addr.Host
+	if ip[0] == 0 && ip[1] == 0 && ip[2] == 0 && ip[3] != 0 {
+		host, err := readNULL(r, MaxSocks4Field)
+		if err != nil {
+			return nil, err
+		}
+		if len(host) == 0 {
+			return nil, ErrEmptyDomain
+		}
+		addr.Type, addr.Host = Domain, host
+	}
+	return &Socks4Request{Address: addr, UserID: userID}, nil
+}
+
+// readNULL read a NULL terminated field of at most max bytes, excluding
+// the NULL.
+func readNULL(r io.Reader, max int) ([]byte, error) {
+	var field bytes.Buffer
+	b := make([]byte, 1)
+	for {
+		_, err := io.ReadFull(r, b)
+		if err != nil {
+			return nil, err
+		}
+		if b[0] == 0 {
+			return field.Bytes(), nil
+		}
+		if field.Len() == max {
+			return nil, ErrFieldTooLong
+		}
+		field.WriteByte(b[0])
+	}
+}
+
+// UDPHeader is the header of datagrams relayed by socks5 UDP
+// associations.
+type UDPHeader struct {
+	Rsv     uint16
+	Frag    byte
+	Address *Address
+	// Data shares memory with the parsed datagram.
+	Data []byte
+}
+
+// ParseUDPHeader parse a datagram of an UDP association.
+func ParseUDPHeader(b []byte) (*UDPHeader, error) {
+	if len(b) < 4 {
+		return nil, ErrShortDatagram
+	}
+	r := bytes.NewReader(b[3:])
+	addr, err := ReadAddress(r)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return nil, ErrShortDatagram
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &UDPHeader{
+		Rsv:     binary.BigEndian.Uint16(b),
+		Frag:    b[2],
+		Address: addr,
+		Data:    b[len(b)-r.Len():],
+	}, nil
+}
+
+// UserPass is an Username/Password authentication request.
+type UserPass struct {
+	Version  byte
+	Username []byte
+	Password []byte
+}
+
+// ReadUserPass read an Username/Password authentication request.
+// The version is not checked.
+func ReadUserPass(r io.Reader) (*UserPass, error) {
+	b, err := readN(r, 2)
+	if err != nil {
+		return nil, err
+	}
+	u := &UserPass{Version: b[0]}
+	u.Username, err = readN(r, int(b[1]))
+	if err != nil {
+		return nil, err
+	}
+	l, err := readN(r, 1)
+	if err != nil {
+		return nil, err
+	}
+	u.Password, err = readN(r, int(l[0]))
+	if err != nil {
+		return nil, err
+	}
+	return u, nil
+}
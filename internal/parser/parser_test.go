@@ -0,0 +1,96 @@
+package parser
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"testing"
+)
+
+func TestReadAddress(t *testing.T) {
+	tests := []struct {
+		in   []byte
+		addr string
+		err  error
+	}{
+		{[]byte{IPv4, 127, 0, 0, 1, 0, 80}, "1 7f000001 80", nil},
+		{append([]byte{IPv6}, append(make([]byte, 16), 1, 0)...), "4 00000000000000000000000000000000 256", nil},
+		{[]byte{Domain, 3, 'a', '.', 'b', 0, 53}, "3 612e62 53", nil},
+		{[]byte{Domain, 0, 0, 53}, "", ErrEmptyDomain},
+		{[]byte{Domain, 4, 'a'}, "", io.ErrUnexpectedEOF},
+		{[]byte{IPv4, 127, 0}, "", io.ErrUnexpectedEOF},
+		{[]byte{}, "", io.EOF},
+	}
+	for _, test := range tests {
+		addr, err := ReadAddress(bytes.NewReader(test.in))
+		if err != test.err {
+			t.Errorf("%x: error %v, expected %v", test.in, err, test.err)
+			continue
+		}
+		if err == nil {
+			got := fmt.Sprintf("%d %x %d", addr.Type, addr.Host, addr.Port)
+			if got != test.addr {
+				t.Errorf("%x: got %s", test.in, got)
+			}
+		}
+	}
+
+	var atype *AddressTypeError
+	_, err := ReadAddress(bytes.NewReader([]byte{0x02, 0, 0}))
+	if !errors.As(err, &atype) || atype.Type != 0x02 {
+		t.Errorf("unknown address type: %v", err)
+	}
+}
+
+func TestReadSocks4Request(t *testing.T) {
+	req, err := ReadSocks4Request(bytes.NewReader([]byte("\x00\x50\x00\x00\x00\x01user\x00example.com\x00")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if req.Address.Type != Domain || string(req.Address.Host) != "example.com" || req.Address.Port != 80 || string(req.UserID) != "user" {
+		t.Errorf("socks4a request: %+v %+v", req, req.Address)
+	}
+
+	req, err = ReadSocks4Request(bytes.NewReader([]byte("\x00\x50\x7f\x00\x00\x01\x00")))
+	if err != nil || req.Address.Type != IPv4 || len(req.UserID) != 0 {
+		t.Errorf("socks4 request: %+v, %v", req, err)
+	}
+
+	long := append([]byte("\x00\x50\x7f\x00\x00\x01"), bytes.Repeat([]byte{'a'}, MaxSocks4Field+1)...)
+	_, err = ReadSocks4Request(bytes.NewReader(long))
+	if err != ErrFieldTooLong {
+		t.Errorf("long user id: %v", err)
+	}
+	_, err = ReadSocks4Request(bytes.NewReader([]byte("\x00\x50\x00\x00\x00\x01\x00\x00")))
+	if err != ErrEmptyDomain {
+		t.Errorf("empty host name: %v", err)
+	}
+}
+
+func TestParseUDPHeader(t *testing.T) {
+	h, err := ParseUDPHeader([]byte{0, 0, 1, IPv4, 10, 0, 0, 1, 0, 53, 'h', 'i'})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h.Frag != 1 || h.Address.Port != 53 || string(h.Data) != "hi" {
+		t.Errorf("header: %+v", h)
+	}
+	for _, b := range [][]byte{{0, 0, 0}, {0, 0, 0, IPv4, 10, 0}, {0, 0, 0, Domain, 9, 'a'}} {
+		_, err := ParseUDPHeader(b)
+		if err != ErrShortDatagram {
+			t.Errorf("%x: %v", b, err)
+		}
+	}
+}
+
+func TestReadUserPass(t *testing.T) {
+	u, err := ReadUserPass(bytes.NewReader([]byte("\x01\x05admin\x06123456")))
+	if err != nil || u.Version != 1 || string(u.Username) != "admin" || string(u.Password) != "123456" {
+		t.Errorf("got %+v, %v", u, err)
+	}
+	_, err = ReadUserPass(bytes.NewReader([]byte("\x01\x05adm")))
+	if err != io.ErrUnexpectedEOF {
+		t.Errorf("truncated: %v", err)
+	}
+}
@@ -0,0 +1,228 @@
+package socks5
+
+import (
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultLatencyBounds are the default histogram bucket upper bounds of
+// LatencyStats.
+var DefaultLatencyBounds = []time.Duration{
+	time.Millisecond, 2 * time.Millisecond, 5 * time.Millisecond,
+	10 * time.Millisecond, 20 * time.Millisecond, 50 * time.Millisecond,
+	100 * time.Millisecond, 200 * time.Millisecond, 500 * time.Millisecond,
+	time.Second, 2 * time.Second, 5 * time.Second, 10 * time.Second,
+}
+
+// Histogram counts durations in buckets. It is safe for concurrent use.
+type Histogram struct {
+	// accessed atomically. Keep them 64-bit aligned.
+	count uint64
+	sum   uint64
+
+	bounds []time.Duration
+	// counts[i] counts durations in (bounds[i-1], bounds[i]], the last
+	// one those over the last bound.
+	counts []uint64
+}
+
+// NewHistogram create a histogram with the bucket upper bounds bounds,
+// in increasing order, and an implicit last bucket for larger durations.
+func NewHistogram(bounds []time.Duration) *Histogram {
+	return &Histogram{bounds: bounds, counts: make([]uint64, len(bounds)+1)}
+}
+
+// Observe add d to the histogram.
+func (h *Histogram) Observe(d time.Duration) {
+	i := 0
+	for i < len(h.bounds) && d > h.bounds[i] {
+		i++
+	}
+	atomic.AddUint64(&h.counts[i], 1)
+	atomic.AddUint64(&h.count, 1)
+	atomic.AddUint64(&h.sum, uint64(d))
+}
+
+// Snapshot return the current state of the histogram.
+func (h *Histogram) Snapshot() HistogramSnapshot {
+	s := HistogramSnapshot{
+		Bounds: h.bounds,
+		Counts: make([]uint64, len(h.counts)),
+		Count:  atomic.LoadUint64(&h.count),
+		Sum:    time.Duration(atomic.LoadUint64(&h.sum)),
+	}
+	for i := range h.counts {
+		s.Counts[i] = atomic.LoadUint64(&h.counts[i])
+	}
+	return s
+}
+
+// HistogramSnapshot is the state of a Histogram.
+type HistogramSnapshot struct {
+	// Bounds are the bucket upper bounds.
+	Bounds []time.Duration
+	// Counts are the observations per bucket, not cumulative. It has one
+	// more element than Bounds, for observations over the last bound.
+	Counts []uint64
+	// Count is the number of observations.
+	Count uint64
+	// Sum is the sum of observations.
+	Sum time.Duration
+}
+
+// LatencyStats records latency histograms of CONNECT destinations,
+// grouped in buckets such as domains or networks, to spot slow upstream
+// networks: the dial latency, and the time to first byte, from the
+// first byte sent to the destination, or from the connection if the
+// destination speaks first, to the first byte it sends.
+//
+// Measuring the time to first byte wraps the destination leg, see
+// PooledTransport. The zero value is ready to use, see Server.Latency;
+// set PrometheusMetrics.Latency to export the histograms.
+type LatencyStats struct {
+	// Bucket map destinations to their bucket. If nil,
+	// DestinationBucket is used.
+	Bucket func(dest *Address) string
+
+	// Bounds are the histogram bucket upper bounds. If nil,
+	// DefaultLatencyBounds is used.
+	Bounds []time.Duration
+
+	// MaxBuckets caps the number of destination buckets, the
+	// destinations of further buckets are recorded in the "other" bucket.
+	// Zero means 1000.
+	MaxBuckets int
+
+	mu      sync.Mutex
+	buckets map[string]*Latency
+}
+
+// Latency are the histograms of one destination bucket.
+type Latency struct {
+	Dial *Histogram
+	TTFB *Histogram
+}
+
+// LatencySnapshot is the state of a Latency.
+type LatencySnapshot struct {
+	Dial HistogramSnapshot
+	TTFB HistogramSnapshot
+}
+
+// latency return the histograms of the bucket of dest.
+func (l *LatencyStats) latency(dest *Address) *Latency {
+	bucket := DestinationBucket
+	if l.Bucket != nil {
+		bucket = l.Bucket
+	}
+	key := bucket(dest)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.buckets == nil {
+		l.buckets = make(map[string]*Latency)
+	}
+	lat, ok := l.buckets[key]
+	if ok {
+		return lat
+	}
+	max := l.MaxBuckets
+	if max == 0 {
+		max = 1000
+	}
+	if len(l.buckets) >= max {
+		key = "other"
+		if lat, ok = l.buckets[key]; ok {
+			return lat
+		}
+	}
+	bounds := l.Bounds
+	if bounds == nil {
+		bounds = DefaultLatencyBounds
+	}
+	lat = &Latency{NewHistogram(bounds), NewHistogram(bounds)}
+	l.buckets[key] = lat
+	return lat
+}
+
+// Snapshot return the histograms of every destination bucket.
+func (l *LatencyStats) Snapshot() map[string]LatencySnapshot {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	snap := make(map[string]LatencySnapshot, len(l.buckets))
+	for key, lat := range l.buckets {
+		snap[key] = LatencySnapshot{lat.Dial.Snapshot(), lat.TTFB.Snapshot()}
+	}
+	return snap
+}
+
+// DestinationBucket return the bucket of dest: the last two labels of
+// domain names, such as example.com for cdn.example.com, the /24 network
+// of IPv4 addresses and the /48 network of IPv6 addresses.
+//
+// It does not know public suffixes: all the names under a suffix of two
+// labels, such as bbc.co.uk and gov.co.uk, share the bucket co.uk. Set
+// LatencyStats.Bucket to a function using a public suffix list, such as
+// golang.org/x/net/publicsuffix, to bucket them apart.
+func DestinationBucket(dest *Address) string {
+	switch dest.ATYPE {
+	case DOMAINNAME:
+		name := strings.ToLower(strings.TrimSuffix(string(dest.Addr), "."))
+		labels := strings.Split(name, ".")
+		if len(labels) > 2 {
+			labels = labels[len(labels)-2:]
+		}
+		return strings.Join(labels, ".")
+	case IPV4_ADDRESS:
+		return (&net.IPNet{IP: dest.Addr.Mask(net.CIDRMask(24, 32)), Mask: net.CIDRMask(24, 32)}).String()
+	}
+	return (&net.IPNet{IP: dest.Addr.Mask(net.CIDRMask(48, 128)), Mask: net.CIDRMask(48, 128)}).String()
+}
+
+// ttfbConn measures the time to first byte of a destination connection.
+type ttfbConn struct {
+	// start is the time of the connection, then of the first write, in
+	// nanoseconds since the Unix epoch. It is zero once measured.
+	// Accessed atomically, keep it 64-bit aligned.
+	start   int64
+	written int32
+
+	net.Conn
+	ttfb *Histogram
+}
+
+// timeFirstByte wrap remote, the connection to the destination of s, to
+// measure its time to first byte if needed.
+func (srv *Server) timeFirstByte(s *Session, remote net.Conn) net.Conn {
+	if srv.Latency == nil {
+		return remote
+	}
+	return &ttfbConn{start: time.Now().UnixNano(), Conn: remote, ttfb: srv.Latency.latency(s.Request.Address).TTFB}
+}
+
+func (c *ttfbConn) Write(b []byte) (int, error) {
+	if len(b) > 0 && atomic.CompareAndSwapInt32(&c.written, 0, 1) {
+		if start := atomic.LoadInt64(&c.start); start != 0 {
+			atomic.CompareAndSwapInt64(&c.start, start, time.Now().UnixNano())
+		}
+	}
+	return c.Conn.Write(b)
+}
+
+// CloseWrite half-close the measured connection.
+func (c *ttfbConn) CloseWrite() error {
+	return closeWrite(c.Conn)
+}
+
+func (c *ttfbConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		if start := atomic.SwapInt64(&c.start, 0); start != 0 {
+			c.ttfb.Observe(time.Duration(time.Now().UnixNano() - start))
+		}
+	}
+	return n, err
+}
@@ -0,0 +1,69 @@
+package socks5
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDestinationBucket(t *testing.T) {
+	for _, tt := range []struct {
+		addr     string
+		expected string
+	}{
+		{"cdn.Example.com.:443", "example.com"},
+		{"localhost:80", "localhost"},
+		{"www.bbc.co.uk:443", "co.uk"},
+		{"192.0.2.77:80", "192.0.2.0/24"},
+		{"[2001:db8:1:2::1]:80", "2001:db8:1::/48"},
+	} {
+		dest, err := ParseAddress(tt.addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if b := DestinationBucket(dest); b != tt.expected {
+			t.Errorf("%s: bucket %s, expected %s", tt.addr, b, tt.expected)
+		}
+	}
+}
+
+func TestHistogram(t *testing.T) {
+	h := NewHistogram([]time.Duration{time.Millisecond, time.Second})
+	h.Observe(time.Millisecond)
+	h.Observe(10 * time.Millisecond)
+	h.Observe(time.Minute)
+	s := h.Snapshot()
+	if s.Count != 3 || s.Sum != time.Minute+11*time.Millisecond {
+		t.Errorf("count %d, sum %v", s.Count, s.Sum)
+	}
+	if len(s.Counts) != 3 || s.Counts[0] != 1 || s.Counts[1] != 1 || s.Counts[2] != 1 {
+		t.Errorf("counts %v", s.Counts)
+	}
+}
+
+func TestServer_Latency(t *testing.T) {
+	stats := &LatencyStats{}
+	addr := serveTest(t, &Server{Latency: stats})
+	dest, _ := ParseAddress(echoTest(t))
+	conn, reply := connectTest(t, addr, dest)
+	if reply[1] != SUCCESSED {
+		t.Fatalf("reply %#x", reply[1])
+	}
+	conn.Write([]byte("ping"))
+	if _, err := ReadNBytes(conn, 4); err != nil {
+		t.Fatal(err)
+	}
+
+	lat, ok := stats.Snapshot()["127.0.0.0/24"]
+	if !ok {
+		t.Fatalf("no bucket for %s: %v", dest, stats.Snapshot())
+	}
+	if lat.Dial.Count != 1 || lat.TTFB.Count != 1 {
+		t.Errorf("dial %d, ttfb %d observations", lat.Dial.Count, lat.TTFB.Count)
+	}
+
+	waitMetrics(t, &PrometheusMetrics{Latency: stats},
+		`socks5_destination_dial_duration_seconds_count{dest="127.0.0.0/24"} 1`,
+		`socks5_destination_ttfb_seconds_bucket{dest="127.0.0.0/24",le="+Inf"} 1`,
+		`socks5_destination_ttfb_seconds_count{dest="127.0.0.0/24"} 1`,
+	)
+}
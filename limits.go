@@ -0,0 +1,386 @@
+package socks5
+
+import (
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	errUDPAssociationLimit = errors.New("too many UDP associations")
+	errConnectionLimit     = errors.New("too many connections")
+)
+
+// LimitKind names a limit of the server.
+type LimitKind string
+
+const (
+	// LimitSessionBytes is the bytes a CONNECT session transfers.
+	LimitSessionBytes LimitKind = "session_bytes"
+	// LimitSessionDuration is the lifetime of a session.
+	LimitSessionDuration LimitKind = "session_duration"
+	// LimitConnections is the number of sessions being served.
+	LimitConnections LimitKind = "connections"
+	// LimitConnectionsPerIP is the number of sessions of a client IP.
+	LimitConnectionsPerIP LimitKind = "connections_per_ip"
+	// LimitIdleTimeout is the time a session relays no byte.
+	LimitIdleTimeout LimitKind = "idle_timeout"
+	// LimitUDPAssociations is the number of active UDP associations.
+	LimitUDPAssociations LimitKind = "udp_associations"
+	// LimitBandwidth is the rate of a direction of a session, reported
+	// the first time the direction is shaped by Server.RateLimit, or goes
+	// over SoftLimits.Bandwidth: Value is the bytes read over the rate,
+	// Threshold the rate in bytes per second.
+	LimitBandwidth LimitKind = "bandwidth"
+	// LimitLockout is the failed authentication attempts banning the
+	// client IP or user name of a session, see Server.Lockout.
+	LimitLockout LimitKind = "lockout"
+)
+
+// SoftLimits are warning thresholds: crossing one only emits a
+// Hooks.OnLimit event, so operators get an early signal before the hard
+// limit enforces. Zero disables a threshold.
+type SoftLimits struct {
+	// SessionBytes warns of CONNECT sessions transferring more bytes,
+	// see Server.MaxSessionBytes.
+	SessionBytes int64
+	// SessionDuration warns of sessions living longer, see
+	// Server.MaxSessionDuration.
+	SessionDuration time.Duration
+	// Connections warns when the server serves more sessions.
+	Connections int
+	// ConnectionsPerIP warns when a client IP has more sessions, see
+	// Server.MaxConnectionsPerIP.
+	ConnectionsPerIP int
+	// IdleTimeout warns of sessions relaying no byte for longer, once per
+	// idle period, see Server.IdleTimeout.
+	IdleTimeout time.Duration
+	// Bandwidth warns of CONNECT and BIND sessions relaying faster in a
+	// direction, once per direction. As with RateLimiter, a session may
+	// burst one second of traffic before it warns.
+	Bandwidth Bandwidth
+	// UDPAssociations warns when the server relays more UDP associations,
+	// see Server.MaxUDPAssociations.
+	UDPAssociations int
+}
+
+// LimitEvent reports a limit crossed by a session or by the server.
+type LimitEvent struct {
+	Kind LimitKind
+	// Hard is set when the limit is enforced, unset for soft thresholds.
+	Hard bool
+	// Session is the session crossing a session limit, or the session
+	// whose arrival crossed a server limit.
+	Session *Session
+	// Value is the measured value and Threshold the crossed threshold.
+	// Durations are in nanoseconds.
+	Value     int64
+	Threshold int64
+}
+
+func (srv *Server) onLimit(e LimitEvent) {
+	if srv.Hooks.OnLimit != nil {
+		srv.Hooks.OnLimit(e)
+	}
+}
+
+// gauge is a server count warning once every time it goes over its soft
+// threshold.
+type gauge struct {
+	mu     sync.Mutex
+	n      int64
+	warned bool
+}
+
+// add delta to g and return its new value, crossed is set if it went
+// over soft for the first time since it was last under it.
+func (g *gauge) add(delta, soft int64) (n int64, crossed bool) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.n += delta
+	if soft <= 0 || g.n <= soft {
+		g.warned = false
+		return g.n, false
+	}
+	crossed = !g.warned
+	g.warned = true
+	return g.n, crossed
+}
+
+// countConnection count s in the sessions being served, ok is false if
+// it is over MaxConnections or MaxConnectionsPerIP and was not counted.
+// Otherwise done must be called when the session ends.
+func (srv *Server) countConnection(s *Session) (done func(), ok bool) {
+	soft := int64(srv.SoftLimits.Connections)
+	n, crossed := srv.connections.add(1, soft)
+	if max := int64(srv.MaxConnections); max > 0 && n > max {
+		srv.connections.add(-1, soft)
+		srv.onLimit(LimitEvent{LimitConnections, true, s, n, max})
+		return nil, false
+	}
+	if crossed {
+		srv.onLimit(LimitEvent{LimitConnections, false, s, n, soft})
+	}
+	ip, ok := srv.countIP(s)
+	if !ok {
+		srv.connections.add(-1, soft)
+		return nil, false
+	}
+	return func() {
+		srv.connections.add(-1, soft)
+		srv.uncountIP(ip)
+	}, true
+}
+
+// countIP count s in the sessions of its client IP if
+// MaxConnectionsPerIP or its soft threshold is set, ok is false if it is
+// over the limit.
+func (srv *Server) countIP(s *Session) (ip string, ok bool) {
+	max, soft := srv.MaxConnectionsPerIP, srv.SoftLimits.ConnectionsPerIP
+	clientIP := s.ClientIP()
+	if (max <= 0 && soft <= 0) || clientIP == nil {
+		return "", true
+	}
+	ip = clientIP.String()
+	srv.ipMu.Lock()
+	n := srv.ipConnections[ip] + 1
+	over := max > 0 && n > max
+	if !over {
+		if srv.ipConnections == nil {
+			srv.ipConnections = make(map[string]int)
+		}
+		srv.ipConnections[ip] = n
+	}
+	srv.ipMu.Unlock()
+	if over {
+		srv.onLimit(LimitEvent{LimitConnectionsPerIP, true, s, int64(n), int64(max)})
+		return "", false
+	}
+	if soft > 0 && n == soft+1 {
+		srv.onLimit(LimitEvent{LimitConnectionsPerIP, false, s, int64(n), int64(soft)})
+	}
+	return ip, true
+}
+
+func (srv *Server) uncountIP(ip string) {
+	if ip == "" {
+		return
+	}
+	srv.ipMu.Lock()
+	defer srv.ipMu.Unlock()
+	if srv.ipConnections[ip] <= 1 {
+		delete(srv.ipConnections, ip)
+	} else {
+		srv.ipConnections[ip]--
+	}
+}
+
+// maxRefusals caps the connections over the limits whose request is read
+// at once with RefuseOverLimit, further ones are closed: each costs a
+// handshake, authentication included.
+const maxRefusals = 16
+
+// refuseOverLimit reply CONNECTION_REFUSED to the request of s, over the
+// connection limits, if RefuseOverLimit is set and fewer than maxRefusals
+// are being refused.
+func (srv *Server) refuseOverLimit(s *Session, client net.Conn) {
+	if !srv.RefuseOverLimit {
+		return
+	}
+	if atomic.AddInt32(&srv.refusing, 1) > maxRefusals {
+		atomic.AddInt32(&srv.refusing, -1)
+		return
+	}
+	defer atomic.AddInt32(&srv.refusing, -1)
+	req, err := srv.handShake(s, client)
+	if err == nil {
+		if s.encapsulated != nil {
+			client = s.encapsulated
+		}
+		srv.refuse(client, req, CONNECTION_REFUSED, "\"connection limit\"", errConnectionLimit)
+	}
+}
+
+// countUDPAssociation count the UDP association of s, ok is false if it
+// is over MaxUDPAssociations and was not counted. Otherwise done must be
+// called when the association ends.
+func (srv *Server) countUDPAssociation(s *Session) (done func(), ok bool) {
+	soft := int64(srv.SoftLimits.UDPAssociations)
+	n, crossed := srv.udpAssociations.add(1, soft)
+	if max := int64(srv.MaxUDPAssociations); max > 0 && n > max {
+		srv.udpAssociations.add(-1, soft)
+		srv.onLimit(LimitEvent{LimitUDPAssociations, true, s, n, max})
+		return nil, false
+	}
+	if crossed {
+		srv.onLimit(LimitEvent{LimitUDPAssociations, false, s, n, soft})
+	}
+	return func() { srv.udpAssociations.add(-1, soft) }, true
+}
+
+// maxDuration return the lifetime limit of s, zero means unlimited.
+func (srv *Server) maxDuration(s *Session) time.Duration {
+	d := s.MaxDuration
+	if d == 0 {
+		d = srv.MaxSessionDuration
+	}
+	if d < 0 {
+		return 0
+	}
+	return d
+}
+
+// limitDuration close conns when s outlives its lifetime limit, until
+// the returned stop function is called.
+func (srv *Server) limitDuration(s *Session, conns ...io.Closer) (stop func()) {
+	var timers []*time.Timer
+	if soft := srv.SoftLimits.SessionDuration; soft > 0 {
+		timers = append(timers, time.AfterFunc(soft-time.Since(s.start), func() {
+			srv.onLimit(LimitEvent{LimitSessionDuration, false, s, int64(time.Since(s.start)), int64(soft)})
+		}))
+	}
+	if d := srv.maxDuration(s); d > 0 {
+		timers = append(timers, time.AfterFunc(d-time.Since(s.start), func() {
+			s.setCloseReason(CloseExpired)
+			srv.onLimit(LimitEvent{LimitSessionDuration, true, s, int64(time.Since(s.start)), int64(d)})
+			if srv.Hooks.OnSessionExpired != nil {
+				srv.Hooks.OnSessionExpired(s)
+			}
+			for _, c := range conns {
+				c.Close()
+			}
+		}))
+	}
+	return func() {
+		for _, t := range timers {
+			t.Stop()
+		}
+	}
+}
+
+// idleTimeout return the idle timeout of s, zero means no timeout.
+func (srv *Server) idleTimeout(s *Session) time.Duration {
+	d := s.IdleTimeout
+	if d == 0 {
+		d = srv.IdleTimeout
+	}
+	if d < 0 {
+		return 0
+	}
+	return d
+}
+
+// limitIdle close conns when s relays no byte for its idle timeout, and
+// warns when it relays no byte for the soft one, until the returned stop
+// function is called.
+func (srv *Server) limitIdle(s *Session, conns ...io.Closer) (stop func()) {
+	d, soft := srv.idleTimeout(s), srv.SoftLimits.IdleTimeout
+	if d <= 0 && soft <= 0 {
+		return func() {}
+	}
+	var mu sync.Mutex
+	var t *time.Timer
+	stopped := false
+	// warned is the last activity of the idle period warned of, the
+	// session warns again once it was active since.
+	warned := int64(-1)
+	// next return the wait until the next check of the session idle for
+	// idle: its timeout, its warning, or once warned, its next activity.
+	next := func(idle time.Duration) time.Duration {
+		wait := time.Duration(-1)
+		if d > 0 {
+			wait = d - idle
+		}
+		if soft > 0 {
+			w := soft - idle
+			if warned == atomic.LoadInt64(&s.lastActive) {
+				w = soft
+			}
+			if wait < 0 || w < wait {
+				wait = w
+			}
+		}
+		return wait
+	}
+	var check func()
+	check = func() {
+		mu.Lock()
+		defer mu.Unlock()
+		if stopped {
+			return
+		}
+		active, idle := atomic.LoadInt64(&s.lastActive), s.Idle()
+		if soft > 0 && idle >= soft && warned != active {
+			warned = active
+			srv.onLimit(LimitEvent{LimitIdleTimeout, false, s, int64(idle), int64(soft)})
+		}
+		if d <= 0 || idle < d {
+			t = time.AfterFunc(next(idle), check)
+			return
+		}
+		s.setCloseReason(CloseIdle)
+		srv.onLimit(LimitEvent{LimitIdleTimeout, true, s, int64(s.Idle()), int64(d)})
+		for _, c := range conns {
+			c.Close()
+		}
+	}
+	mu.Lock()
+	t = time.AfterFunc(next(s.Idle()), check)
+	mu.Unlock()
+	return func() {
+		mu.Lock()
+		defer mu.Unlock()
+		stopped = true
+		t.Stop()
+	}
+}
+
+// maxBytes return the transfer limit of s, zero means unlimited.
+func (srv *Server) maxBytes(s *Session) uint64 {
+	n := s.MaxBytes
+	if n == 0 {
+		n = srv.MaxSessionBytes
+	}
+	if n < 0 {
+		return 0
+	}
+	return uint64(n)
+}
+
+// byteLimit warns once a session transferred more than soft bytes in
+// both directions, and closes its legs once it transferred more than max
+// bytes. Zero disables either threshold.
+type byteLimit struct {
+	srv   *Server
+	s     *Session
+	soft  uint64
+	max   uint64
+	conns []net.Conn
+	warn  sync.Once
+	once  sync.Once
+}
+
+func (l *byteLimit) check() {
+	n := l.s.BytesUp() + l.s.BytesDown()
+	if l.soft > 0 && n > l.soft {
+		l.warn.Do(func() {
+			l.srv.onLimit(LimitEvent{LimitSessionBytes, false, l.s, int64(n), int64(l.soft)})
+		})
+	}
+	if l.max == 0 || n <= l.max {
+		return
+	}
+	l.once.Do(func() {
+		l.s.setCloseReason(CloseByteLimit)
+		l.srv.onLimit(LimitEvent{LimitSessionBytes, true, l.s, int64(n), int64(l.max)})
+		if l.srv.Hooks.OnByteLimit != nil {
+			l.srv.Hooks.OnByteLimit(l.s)
+		}
+		for _, c := range l.conns {
+			c.Close()
+		}
+	})
+}
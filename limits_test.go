@@ -0,0 +1,296 @@
+package socks5
+
+import (
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestServer_MaxSessionDuration(t *testing.T) {
+	expired := make(chan *Session, 1)
+	srv := &Server{
+		MaxSessionDuration: time.Hour,
+		Router: RouterFunc(func(s *Session, dest *Address) []Route {
+			s.MaxDuration = 100 * time.Millisecond
+			return []Route{DirectRoute}
+		}),
+		Hooks: Hooks{OnSessionExpired: func(s *Session) { expired <- s }},
+	}
+	client := &Client{ProxyAddr: serveTest(t, srv)}
+	conn, err := client.Dial("tcp", echoTest(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	_, err = io.Copy(io.Discard, conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-expired:
+	default:
+		t.Error("OnSessionExpired not called")
+	}
+}
+
+func TestServer_MaxSessionBytes(t *testing.T) {
+	limited := make(chan *Session, 1)
+	srv := &Server{
+		MaxSessionBytes: 1024,
+		Hooks:           Hooks{OnByteLimit: func(s *Session) { limited <- s }},
+	}
+	client := &Client{ProxyAddr: serveTest(t, srv)}
+	conn, err := client.Dial("tcp", echoTest(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	go conn.Write(make([]byte, 4096))
+	n, _ := io.Copy(io.Discard, conn)
+	if n >= 4096 {
+		t.Errorf("relayed %d bytes", n)
+	}
+	select {
+	case s := <-limited:
+		if s.BytesUp()+s.BytesDown() <= 1024 {
+			t.Errorf("limit reached at %d bytes", s.BytesUp()+s.BytesDown())
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("OnByteLimit not called")
+	}
+}
+
+// udpHold is a Transporter keeping UDP associations until release is
+// closed.
+type udpHold struct {
+	Transporter
+	release chan struct{}
+}
+
+func (h udpHold) TransportUDP(conn *net.UDPConn) error {
+	<-h.release
+	return nil
+}
+
+func TestServer_SoftLimits(t *testing.T) {
+	events := make(chan LimitEvent, 10)
+	hold := udpHold{DefaultTransporter, make(chan struct{})}
+	defer close(hold.release)
+	srv := &Server{
+		Transporter:        hold,
+		MaxUDPAssociations: 1,
+		SoftLimits:         SoftLimits{SessionBytes: 100, Connections: 1},
+		Hooks:              Hooks{OnLimit: func(e LimitEvent) { events <- e }},
+	}
+	addr := serveTest(t, srv)
+	client := &Client{ProxyAddr: addr}
+	conn, err := client.Dial("tcp", echoTest(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	conn.Write(make([]byte, 200))
+	if _, err := ReadNBytes(conn, 200); err != nil {
+		t.Fatal(err)
+	}
+	if e := <-events; e.Kind != LimitSessionBytes || e.Hard || e.Threshold != 100 {
+		t.Errorf("session bytes event: %+v", e)
+	}
+
+	// A second session crosses the soft connections threshold, a third
+	// one does not warn again but is over the hard UDP associations limit.
+	unspecified := &Address{net.IPv4zero.To4(), IPV4_ADDRESS, 0}
+	if _, reply := requestTest(t, addr, UDP_ASSOCIATE, unspecified); reply[1] != SUCCESSED {
+		t.Fatalf("reply %#x", reply[1])
+	}
+	if e := <-events; e.Kind != LimitConnections || e.Hard || e.Value != 2 {
+		t.Errorf("connections event: %+v", e)
+	}
+	if _, reply := requestTest(t, addr, UDP_ASSOCIATE, unspecified); reply[1] != CONNECTION_NOT_ALLOW_BY_RULESET {
+		t.Errorf("reply %#x over the UDP associations limit", reply[1])
+	}
+	if e := <-events; e.Kind != LimitUDPAssociations || !e.Hard || e.Value != 2 || e.Threshold != 1 {
+		t.Errorf("UDP associations event: %+v", e)
+	}
+}
+
+// limitEventTest return the next event of kind in events.
+func limitEventTest(t *testing.T, events <-chan LimitEvent, kind LimitKind) LimitEvent {
+	t.Helper()
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case e := <-events:
+			if e.Kind == kind {
+				return e
+			}
+		case <-timeout:
+			t.Fatalf("no %s event", kind)
+		}
+	}
+}
+
+func TestServer_SoftLimitsPerSession(t *testing.T) {
+	events := make(chan LimitEvent, 10)
+	srv := &Server{
+		SoftLimits: SoftLimits{ConnectionsPerIP: 1, IdleTimeout: 100 * time.Millisecond},
+		Hooks:      Hooks{OnLimit: func(e LimitEvent) { events <- e }},
+	}
+	addr := serveTest(t, srv)
+	echo := echoTest(t)
+	client := &Client{ProxyAddr: addr}
+	var conns []net.Conn
+	for i := 0; i < 2; i++ {
+		conn, err := client.Dial("tcp", echo)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		conns = append(conns, conn)
+	}
+	if e := limitEventTest(t, events, LimitConnectionsPerIP); e.Hard || e.Value != 2 || e.Threshold != 1 {
+		t.Errorf("connections per IP event: %+v", e)
+	}
+
+	// sessions warn once per idle period, and are not closed.
+	if e := limitEventTest(t, events, LimitIdleTimeout); e.Hard || e.Threshold != int64(100*time.Millisecond) {
+		t.Errorf("idle timeout event: %+v", e)
+	}
+	conn := conns[0]
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	time.Sleep(200 * time.Millisecond)
+	for len(events) > 0 {
+		<-events
+	}
+	conn.Write([]byte("ping"))
+	if _, err := ReadNBytes(conn, 4); err != nil {
+		t.Fatal(err)
+	}
+	if e := limitEventTest(t, events, LimitIdleTimeout); e.Hard {
+		t.Errorf("idle timeout event after activity: %+v", e)
+	}
+}
+
+func TestServer_MaxConnections(t *testing.T) {
+	events := make(chan LimitEvent, 10)
+	closed := make(chan *Session, 10)
+	srv := &Server{
+		MaxConnections: 1,
+		Hooks: Hooks{
+			OnLimit: func(e LimitEvent) { events <- e },
+			OnClose: func(s *Session) { closed <- s },
+		},
+	}
+	addr := serveTest(t, srv)
+	echo := echoTest(t)
+	client := &Client{ProxyAddr: addr}
+	conn, err := client.Dial("tcp", echo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Dial("tcp", echo); err == nil {
+		t.Error("connection over MaxConnections served")
+	}
+	if e := <-events; e.Kind != LimitConnections || !e.Hard || e.Value != 2 || e.Threshold != 1 {
+		t.Errorf("connections event: %+v", e)
+	}
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Error("OnClose not called for the refused session")
+	}
+
+	// the slot is free again once the first session ends.
+	conn.Close()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		conn, err := client.Dial("tcp", echo)
+		if err == nil {
+			conn.Close()
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal(err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestServer_MaxConnectionsPerIP(t *testing.T) {
+	events := make(chan LimitEvent, 10)
+	srv := &Server{
+		MaxConnectionsPerIP: 1,
+		RefuseOverLimit:     true,
+		Hooks:               Hooks{OnLimit: func(e LimitEvent) { events <- e }},
+	}
+	addr := serveTest(t, srv)
+	echo, err := ParseAddress(echoTest(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, reply := requestTest(t, addr, CONNECT, echo)
+	defer conn.Close()
+	if reply[1] != SUCCESSED {
+		t.Fatalf("reply %#x", reply[1])
+	}
+	if _, reply := requestTest(t, addr, CONNECT, echo); reply[1] != CONNECTION_REFUSED {
+		t.Errorf("reply %#x over MaxConnectionsPerIP", reply[1])
+	}
+	if e := <-events; e.Kind != LimitConnectionsPerIP || !e.Hard || e.Value != 2 || e.Threshold != 1 {
+		t.Errorf("connections per IP event: %+v", e)
+	}
+
+	// over maxRefusals, connections are closed without handshake.
+	atomic.StoreInt32(&srv.refusing, maxRefusals)
+	raw, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer raw.Close()
+	raw.Write([]byte{Version5, 1, NO_AUTHENTICATION_REQUIRED})
+	closedTest(t, raw)
+}
+
+func TestServer_IdleTimeout(t *testing.T) {
+	events := make(chan LimitEvent, 10)
+	metrics := &PrometheusMetrics{}
+	srv := &Server{
+		IdleTimeout: 200 * time.Millisecond,
+		Metrics:     metrics,
+		Hooks:       Hooks{OnLimit: func(e LimitEvent) { events <- e }},
+	}
+	addr := serveTest(t, srv)
+	conn, err := (&Client{ProxyAddr: addr}).Dial("tcp", echoTest(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	// an active session outlives the timeout.
+	for i := 0; i < 4; i++ {
+		conn.Write([]byte("ping"))
+		if _, err := ReadNBytes(conn, 4); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	start := time.Now()
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("read %v from an idle session", err)
+	}
+	if d := time.Since(start); d > 2*time.Second {
+		t.Errorf("idle session closed after %v", d)
+	}
+	if e := <-events; e.Kind != LimitIdleTimeout || !e.Hard || e.Threshold != int64(200*time.Millisecond) {
+		t.Errorf("idle timeout event: %+v", e)
+	}
+	waitMetrics(t, metrics, `socks5_sessions_closed_total{reason="idle"} 1`)
+}
@@ -0,0 +1,365 @@
+package socks5
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// errLockedOut is the failure of an authentication attempt of a banned
+// client IP or user name.
+var errLockedOut = errors.New("too many failed authentication attempts")
+
+// Lockout protects credentials against brute force: it bans client IPs
+// and user names for a while after MaxFailures failed authentication
+// attempts within Window, and slows down the attempts of client IPs
+// which failed recently. Set Server.Lockout to it. Several servers may
+// share a Lockout.
+//
+// Attempts of banned client IPs or user names fail without checking
+// the credentials. The Username/Password authenticators of the package
+// check user names before validating the credentials, other
+// authenticators are checked once they succeeded.
+//
+// Lockout is an http.Handler listing the active bans as JSON, and
+// lifting the ban of the ip or user parameter on DELETE requests:
+//
+//	lockout := &socks5.Lockout{}
+//	srv := &socks5.Server{Lockout: lockout}
+//	http.Handle("/debug/socks5/bans", lockout)
+type Lockout struct {
+	// MaxFailures is the number of failed attempts within Window which
+	// bans a client IP or user name. Zero means 5.
+	MaxFailures int
+	// Window is the period failed attempts are counted over. Zero means
+	// 10 minutes.
+	Window time.Duration
+	// BanDuration is the duration of a first ban, each further ban of
+	// the same client IP or user name doubles it, up to MaxBan. Zero
+	// means a minute.
+	BanDuration time.Duration
+	// MaxBan caps the duration of bans. Zero means an hour.
+	MaxBan time.Duration
+	// Backoff delays the attempts of client IPs which failed within
+	// Window by Backoff, doubled for each further failure, up to
+	// MaxBackoff. Zero disables the delay.
+	Backoff time.Duration
+	// MaxBackoff caps the delay of attempts. Zero means 10 seconds.
+	MaxBackoff time.Duration
+	// MaxEntries caps the number of client IPs and user names whose
+	// failed attempts are counted, such as against clients spraying user
+	// names, further ones are not counted until entries expire. Zero
+	// means 65536.
+	MaxEntries int
+
+	// OnBan is optionally called when a client IP or user name is banned.
+	OnBan func(b Ban)
+
+	mu      sync.Mutex
+	entries map[lockoutKey]*lockoutEntry
+	sweep   time.Time
+}
+
+// Ban is the ban of a client IP or of a user name.
+type Ban struct {
+	// IP is the banned client IP, nil for the ban of a user name.
+	IP net.IP `json:"ip,omitempty"`
+	// Username is the banned user name, empty for the ban of a client IP.
+	Username string    `json:"username,omitempty"`
+	Until    time.Time `json:"until"`
+}
+
+type lockoutKey struct {
+	ip   string
+	user string
+}
+
+type lockoutEntry struct {
+	failures int
+	// first is the time of the first failure counted.
+	first time.Time
+	// bans is the number of bans, until the end of the last one.
+	bans  int
+	until time.Time
+}
+
+func ipKey(ip net.IP) lockoutKey {
+	return lockoutKey{ip: string(ip.To16())}
+}
+
+func userKey(username string) lockoutKey {
+	return lockoutKey{user: username}
+}
+
+func (l *Lockout) window() time.Duration {
+	if l.Window <= 0 {
+		return 10 * time.Minute
+	}
+	return l.Window
+}
+
+// Banned report whether the client IP or the user name is banned. An
+// empty user name is never banned.
+func (l *Lockout) Banned(ip net.IP, username string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	if ip != nil && l.bannedLocked(ipKey(ip), now) {
+		return true
+	}
+	return username != "" && l.bannedLocked(userKey(username), now)
+}
+
+func (l *Lockout) bannedLocked(key lockoutKey, now time.Time) bool {
+	e, ok := l.entries[key]
+	return ok && now.Before(e.until)
+}
+
+// Bans return the active bans, client IPs first.
+func (l *Lockout) Bans() []Ban {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	var bans []Ban
+	for key, e := range l.entries {
+		if !now.Before(e.until) {
+			continue
+		}
+		b := Ban{Username: key.user, Until: e.until}
+		if key.ip != "" {
+			b.IP = net.IP(key.ip)
+		}
+		bans = append(bans, b)
+	}
+	sort.Slice(bans, func(i, j int) bool {
+		if (bans[i].IP == nil) != (bans[j].IP == nil) {
+			return bans[i].IP != nil
+		}
+		if bans[i].IP != nil {
+			return bans[i].IP.String() < bans[j].IP.String()
+		}
+		return bans[i].Username < bans[j].Username
+	})
+	return bans
+}
+
+// Unban lift the ban of the client IP or the user name of b, and forget
+// their failed attempts. It return whether there was a ban.
+func (l *Lockout) Unban(b Ban) bool {
+	key := userKey(b.Username)
+	if b.IP != nil {
+		key = ipKey(b.IP)
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	e, ok := l.entries[key]
+	delete(l.entries, key)
+	return ok && time.Now().Before(e.until)
+}
+
+// fail count a failed attempt of the client IP as username, which may
+// be empty, ban them once they reach MaxFailures and return the bans.
+func (l *Lockout) fail(ip net.IP, username string) []Ban {
+	var bans []Ban
+	l.mu.Lock()
+	now := time.Now()
+	l.sweepLocked(now)
+	if ip != nil {
+		if until, ok := l.failLocked(ipKey(ip), now); ok {
+			bans = append(bans, Ban{IP: ip, Until: until})
+		}
+	}
+	if username != "" {
+		if until, ok := l.failLocked(userKey(username), now); ok {
+			bans = append(bans, Ban{Username: username, Until: until})
+		}
+	}
+	l.mu.Unlock()
+	if l.OnBan != nil {
+		for _, b := range bans {
+			l.OnBan(b)
+		}
+	}
+	return bans
+}
+
+// failLocked count a failure of key, and return the end of the ban it
+// caused if any. Failures of new keys are not counted over MaxEntries.
+func (l *Lockout) failLocked(key lockoutKey, now time.Time) (time.Time, bool) {
+	if l.entries == nil {
+		l.entries = make(map[lockoutKey]*lockoutEntry)
+	}
+	e, ok := l.entries[key]
+	if !ok {
+		max := l.MaxEntries
+		if max <= 0 {
+			max = 65536
+		}
+		if len(l.entries) >= max {
+			return time.Time{}, false
+		}
+		e = &lockoutEntry{}
+		l.entries[key] = e
+	}
+	if e.failures == 0 || now.Sub(e.first) >= l.window() {
+		e.failures, e.first = 0, now
+	}
+	e.failures++
+	if e.failures < l.maxFailures() {
+		return time.Time{}, false
+	}
+	d, maxBan := l.BanDuration, l.MaxBan
+	if d <= 0 {
+		d = time.Minute
+	}
+	if maxBan <= 0 {
+		maxBan = time.Hour
+	}
+	for i := 0; i < e.bans && d < maxBan; i++ {
+		d *= 2
+	}
+	if d > maxBan {
+		d = maxBan
+	}
+	e.bans++
+	e.failures = 0
+	e.until = now.Add(d)
+	return e.until, true
+}
+
+func (l *Lockout) maxFailures() int {
+	if l.MaxFailures <= 0 {
+		return 5
+	}
+	return l.MaxFailures
+}
+
+// succeed forget the failed attempts of username.
+func (l *Lockout) succeed(username string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if e, ok := l.entries[userKey(username)]; ok {
+		e.failures = 0
+	}
+}
+
+// delay return the delay of the next attempt of the client IP.
+func (l *Lockout) delay(ip net.IP) time.Duration {
+	if l.Backoff <= 0 || ip == nil {
+		return 0
+	}
+	l.mu.Lock()
+	e, ok := l.entries[ipKey(ip)]
+	failures := 0
+	if ok && time.Since(e.first) < l.window() {
+		failures = e.failures
+	}
+	l.mu.Unlock()
+	if failures == 0 {
+		return 0
+	}
+	max := l.MaxBackoff
+	if max <= 0 {
+		max = 10 * time.Second
+	}
+	d := l.Backoff
+	for i := 1; i < failures && d < max; i++ {
+		d *= 2
+	}
+	if d > max {
+		d = max
+	}
+	return d
+}
+
+// sweepLocked forget the entries without failures in Window nor ban of
+// the last MaxBan, at most once per Window.
+func (l *Lockout) sweepLocked(now time.Time) {
+	if now.Before(l.sweep) {
+		return
+	}
+	l.sweep = now.Add(l.window())
+	maxBan := l.MaxBan
+	if maxBan <= 0 {
+		maxBan = time.Hour
+	}
+	for key, e := range l.entries {
+		if now.Sub(e.first) >= l.window() && now.Sub(e.until) >= maxBan {
+			delete(l.entries, key)
+		}
+	}
+}
+
+// ServeHTTP write the active bans as JSON, or lift the ban of the ip or
+// user parameter on DELETE requests.
+func (l *Lockout) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		w.Header().Set("Content-Type", "application/json")
+		bans := l.Bans()
+		if bans == nil {
+			bans = []Ban{}
+		}
+		json.NewEncoder(w).Encode(bans)
+	case http.MethodDelete:
+		b := Ban{Username: r.URL.Query().Get("user")}
+		if ip := r.URL.Query().Get("ip"); ip != "" {
+			if b.IP = net.ParseIP(ip); b.IP == nil {
+				http.Error(w, "invalid ip", http.StatusBadRequest)
+				return
+			}
+		} else if b.Username == "" {
+			http.Error(w, "missing ip or user", http.StatusBadRequest)
+			return
+		}
+		if !l.Unban(b) {
+			http.Error(w, "not banned", http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.Header().Set("Allow", "GET, DELETE")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// checkLockout return errLockedOut if the client IP of s or username is
+// banned by the Lockout of the server.
+func (srv *Server) checkLockout(s *Session, username string) error {
+	if srv.Lockout != nil && srv.Lockout.Banned(s.ClientIP(), username) {
+		return errLockedOut
+	}
+	return nil
+}
+
+// lockoutDelay wait the backoff of the client IP of s, or until s is
+// cancelled.
+func (srv *Server) lockoutDelay(s *Session) {
+	if srv.Lockout == nil {
+		return
+	}
+	d := srv.Lockout.delay(s.ClientIP())
+	if d <= 0 {
+		return
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+	case <-s.Context().Done():
+	}
+}
+
+// checkUser return errLockedOut if the session of ctx may not
+// authenticate as username, before its credentials are validated.
+func checkUser(ctx context.Context, username string) error {
+	if s := SessionFromContext(ctx); s != nil && s.checkUser != nil {
+		return s.checkUser(username)
+	}
+	return nil
+}
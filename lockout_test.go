@@ -0,0 +1,127 @@
+package socks5
+
+import (
+	"crypto/sha256"
+	"io"
+	"log"
+	"net"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestServer_Lockout(t *testing.T) {
+	store := NewMemeryStore(sha256.New(), "")
+	store.Set("alice", "a")
+	store.Set("bob", "b")
+	banned := make(chan Ban, 2)
+	lockout := &Lockout{MaxFailures: 2, OnBan: func(b Ban) { banned <- b }}
+	events := make(chan LimitEvent, 2)
+	srv := &Server{
+		Authenticators: map[METHOD]Authenticator{USERNAME_PASSWORD: UserPwdAuth{store}},
+		MethodPriority: []METHOD{USERNAME_PASSWORD},
+		Lockout:        lockout,
+		Hooks:          Hooks{OnLimit: func(e LimitEvent) { events <- e }},
+		ErrorLog:       log.New(io.Discard, "", 0),
+	}
+	addr := serveTest(t, srv)
+	echo := echoTest(t)
+	dial := func(username, password string) error {
+		conn, err := (&Client{ProxyAddr: addr, Username: username, Password: password}).Dial("tcp", echo)
+		if err == nil {
+			conn.Close()
+		}
+		return err
+	}
+
+	for i := 0; i < 2; i++ {
+		if dial("bob", "guess") == nil {
+			t.Fatal("wrong password accepted")
+		}
+	}
+	for i := 0; i < 2; i++ {
+		select {
+		case <-banned:
+		case <-time.After(5 * time.Second):
+			t.Fatal("not banned")
+		}
+	}
+	for i := 0; i < 2; i++ {
+		if e := <-events; e.Kind != LimitLockout || !e.Hard || e.Value != 2 || e.Threshold != 2 {
+			t.Errorf("lockout event %+v", e)
+		}
+	}
+	if bans := lockout.Bans(); len(bans) != 2 || !bans[0].IP.Equal(net.IPv4(127, 0, 0, 1)) || bans[1].Username != "bob" {
+		t.Fatalf("bans %+v", bans)
+	}
+	// the client IP is banned, even with valid credentials.
+	if dial("alice", "a") == nil {
+		t.Error("banned client IP accepted")
+	}
+	if !lockout.Unban(Ban{IP: net.IPv4(127, 0, 0, 1)}) {
+		t.Error("client IP was not banned")
+	}
+	if err := dial("alice", "a"); err != nil {
+		t.Errorf("unbanned client IP: %v", err)
+	}
+	if dial("bob", "b") == nil {
+		t.Error("banned user name accepted")
+	}
+
+	w := httptest.NewRecorder()
+	lockout.ServeHTTP(w, httptest.NewRequest("DELETE", "/?user=bob", nil))
+	if w.Code != 204 {
+		t.Errorf("unban: status %d", w.Code)
+	}
+	if err := dial("bob", "b"); err != nil {
+		t.Errorf("unbanned user name: %v", err)
+	}
+	w = httptest.NewRecorder()
+	lockout.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	if strings.TrimSpace(w.Body.String()) != "[]" {
+		t.Errorf("bans %s", w.Body.String())
+	}
+}
+
+func TestLockout_Backoff(t *testing.T) {
+	l := &Lockout{MaxFailures: 3, BanDuration: time.Minute, MaxBan: 3 * time.Minute, Backoff: time.Second, MaxBackoff: 3 * time.Second}
+	ip := net.IPv4(192, 0, 2, 1)
+	for i, expected := range []time.Duration{time.Second, 2 * time.Second} {
+		l.fail(ip, "")
+		if d := l.delay(ip); d != expected {
+			t.Errorf("delay after %d failures: %s, expected %s", i+1, d, expected)
+		}
+	}
+	// each ban doubles the previous one, up to MaxBan.
+	for _, expected := range []time.Duration{time.Minute, 2 * time.Minute, 3 * time.Minute} {
+		for i := 0; i < 3; i++ {
+			l.fail(nil, "carol")
+		}
+		bans := l.Bans()
+		if len(bans) != 1 || bans[0].Username != "carol" {
+			t.Fatalf("bans %+v", bans)
+		}
+		if d := time.Until(bans[0].Until); d <= expected-time.Second || d > expected {
+			t.Errorf("ban of %s, expected %s", d, expected)
+		}
+	}
+	if !l.Banned(nil, "carol") || l.Banned(ip, "") {
+		t.Error("Banned")
+	}
+}
+
+func TestLockout_MaxEntries(t *testing.T) {
+	l := &Lockout{MaxFailures: 1, MaxEntries: 2}
+	ip := net.IPv4(192, 0, 2, 1)
+	l.fail(nil, "alice")
+	l.fail(nil, "bob")
+	// the failures of further user names and client IPs are not counted.
+	l.fail(ip, "carol")
+	if l.Banned(ip, "carol") || len(l.entries) != 2 {
+		t.Errorf("%d entries, bans %+v", len(l.entries), l.Bans())
+	}
+	if !l.Banned(nil, "alice") {
+		t.Error("counted user name not banned")
+	}
+}
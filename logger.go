@@ -0,0 +1,105 @@
+package socks5
+
+import (
+	"time"
+)
+
+// Logger is a structured logger, see Server.Logger. keyvals alternate
+// keys, strings, and values, as in "session", 1, "error", err. SlogLogger
+// adapts a *slog.Logger, and the zaplog module a *zap.Logger.
+type Logger interface {
+	Debug(msg string, keyvals ...interface{})
+	Info(msg string, keyvals ...interface{})
+	Warn(msg string, keyvals ...interface{})
+	Error(msg string, keyvals ...interface{})
+}
+
+// Levels of the events of a session logged to Server.Logger.
+const (
+	levelDebug = iota
+	levelInfo
+	levelWarn
+	levelError
+)
+
+// Stages of a session at which logError logs its failure.
+const (
+	stageHandshake = "handshake"
+	stageRequest   = "request"
+	stageEstablish = "establish"
+	stageRelay     = "relay"
+)
+
+// stageLevels are the levels the failures of stages are logged at:
+// failed handshakes and relays are usually the doing of clients and
+// peers, denied requests are expected, failures to connect are not.
+var stageLevels = map[string]int{
+	stageHandshake: levelWarn,
+	stageRequest:   levelInfo,
+	stageEstablish: levelError,
+	stageRelay:     levelWarn,
+}
+
+// logError log err, the failure of session s at stage, with the session
+// tags. Without Logger, it is printed to ErrorLog.
+func (srv *Server) logError(s *Session, stage string, err error) {
+	if srv.Logger == nil {
+		if tags := s.Tags(); len(tags) > 0 {
+			srv.logf()("%v [%s]", err, formatTags(tags))
+			return
+		}
+		srv.logf()("%v", err)
+		return
+	}
+	keyvals := []interface{}{"stage", stage}
+	if s.failure != "" {
+		keyvals = append(keyvals, "reason", s.failure)
+	}
+	srv.log(s, stageLevels[stage], stage+" failed", append(keyvals, "error", err)...)
+}
+
+// log log msg at level to Logger, if any, with the fields of s first.
+func (srv *Server) log(s *Session, level int, msg string, keyvals ...interface{}) {
+	l := srv.Logger
+	if l == nil {
+		return
+	}
+	tags := s.Tags()
+	fields := make([]interface{}, 0, 4+2*len(tags)+len(keyvals))
+	fields = append(fields, "session", s.ID)
+	if s.ClientAddr != nil {
+		fields = append(fields, "client", s.ClientAddr.String())
+	}
+	for _, t := range tags {
+		fields = append(fields, t.Key, t.Value)
+	}
+	fields = append(fields, keyvals...)
+	switch level {
+	case levelDebug:
+		l.Debug(msg, fields...)
+	case levelInfo:
+		l.Info(msg, fields...)
+	case levelWarn:
+		l.Warn(msg, fields...)
+	default:
+		l.Error(msg, fields...)
+	}
+}
+
+// logClosed log why the server closed s, if it did.
+func (srv *Server) logClosed(s *Session) {
+	if reason := s.CloseReason(); reason != "" {
+		srv.log(s, levelInfo, "session closed", "reason", reason, "duration", time.Since(s.start),
+			"bytes_up", s.BytesUp(), "bytes_down", s.BytesDown())
+	}
+}
+
+// logAuthFailure log the failed authentication of s with method.
+func (srv *Server) logAuthFailure(s *Session, method METHOD, err error) {
+	srv.log(s, levelWarn, "authentication failed", "method", methodString(method), "error", err)
+}
+
+// logDialError log the failed attempt of s to connect through a route.
+func (srv *Server) logDialError(s *Session, e *DialError, latency time.Duration) {
+	srv.log(s, levelDebug, "dial failed", "route", e.Route, "dest", e.Dest.String(), "class", e.Class.String(), "latency", latency, "error", e.Err)
+}
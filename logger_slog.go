@@ -0,0 +1,15 @@
+//go:build go1.21
+// +build go1.21
+
+package socks5
+
+import "log/slog"
+
+// SlogLogger return l as a Logger, slog.Default() if l is nil. Fields
+// are passed to l as its key-value args.
+func SlogLogger(l *slog.Logger) Logger {
+	if l == nil {
+		return slog.Default()
+	}
+	return l
+}
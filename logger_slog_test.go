@@ -0,0 +1,23 @@
+//go:build go1.21
+// +build go1.21
+
+package socks5
+
+import (
+	"bytes"
+	"log/slog"
+	"strings"
+	"testing"
+)
+
+func TestSlogLogger(t *testing.T) {
+	var b bytes.Buffer
+	l := SlogLogger(slog.New(slog.NewTextHandler(&b, &slog.HandlerOptions{Level: slog.LevelDebug})))
+	l.Warn("handshake failed", "session", uint64(7), "reason", FailureVersion)
+	if !strings.Contains(b.String(), `level=WARN msg="handshake failed" session=7 reason=version`) {
+		t.Errorf("slog: %s", b.String())
+	}
+	if SlogLogger(nil) == nil {
+		t.Error("nil slog logger")
+	}
+}
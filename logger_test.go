@@ -0,0 +1,86 @@
+package socks5
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// recordLogger is a Logger recording entries as "level msg k=v ...".
+type recordLogger struct {
+	mu      sync.Mutex
+	entries []string
+}
+
+func (l *recordLogger) record(level, msg string, keyvals []interface{}) {
+	entry := level + " " + msg
+	for i := 0; i+1 < len(keyvals); i += 2 {
+		entry += fmt.Sprintf(" %v=%v", keyvals[i], keyvals[i+1])
+	}
+	l.mu.Lock()
+	l.entries = append(l.entries, entry)
+	l.mu.Unlock()
+}
+
+func (l *recordLogger) Debug(msg string, keyvals ...interface{}) { l.record("DEBUG", msg, keyvals) }
+func (l *recordLogger) Info(msg string, keyvals ...interface{})  { l.record("INFO", msg, keyvals) }
+func (l *recordLogger) Warn(msg string, keyvals ...interface{})  { l.record("WARN", msg, keyvals) }
+func (l *recordLogger) Error(msg string, keyvals ...interface{}) { l.record("ERROR", msg, keyvals) }
+
+// wait until n entries are recorded and return them.
+func (l *recordLogger) wait(t *testing.T, n int) []string {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		l.mu.Lock()
+		entries := append([]string(nil), l.entries...)
+		l.mu.Unlock()
+		if len(entries) >= n {
+			return entries
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("entries %q", entries)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestServer_Logger(t *testing.T) {
+	logger := &recordLogger{}
+	srv := &Server{
+		Router: RouterFunc(func(s *Session, dest *Address) []Route {
+			s.Tag("team", "video")
+			return []Route{{Name: "upstream", Dialer: failDialer{}}}
+		}),
+		Logger: logger,
+	}
+	addr := serveTest(t, srv)
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Write([]byte{0x06})
+	entries := logger.wait(t, 1)
+	conn.Close()
+	want := fmt.Sprintf(" client=%s stage=handshake reason=version error=", conn.LocalAddr())
+	if !strings.HasPrefix(entries[0], "WARN handshake failed session=") || !strings.Contains(entries[0], want) || !strings.Contains(entries[0], "version: 6") {
+		t.Errorf("bad version: %s", entries[0])
+	}
+
+	connectTest(t, addr, &Address{net.IPv4(127, 0, 0, 1).To4(), IPV4_ADDRESS, 80})
+	entries = logger.wait(t, 3)
+	if !strings.HasPrefix(entries[1], "DEBUG dial failed session=") {
+		t.Errorf("dial: %s", entries[1])
+	}
+	for _, field := range []string{" team=video ", " route=upstream ", " dest=127.0.0.1:80 ", " class=", " error=upstream down"} {
+		if !strings.Contains(entries[1], field) {
+			t.Errorf("dial: %s, missing %q", entries[1], field)
+		}
+	}
+	if !strings.HasPrefix(entries[2], "ERROR establish failed session=") || !strings.Contains(entries[2], " stage=establish ") {
+		t.Errorf("establish: %s", entries[2])
+	}
+}
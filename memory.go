@@ -0,0 +1,173 @@
+package socks5
+
+import (
+	"errors"
+	"math"
+	"os"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// MemoryLimit configures load shedding under memory pressure, so the
+// server degrades predictably instead of being killed for running out
+// of memory. While the memory usage is over Threshold the server closes
+// the connections it accepts right away, and optionally closes its most
+// idle sessions. See Server.MemoryLimit.
+type MemoryLimit struct {
+	// Threshold is the memory usage in bytes past which the server sheds
+	// load. If zero, it is 90% of the cgroup memory limit of the process,
+	// and shedding is disabled if there is no such limit.
+	Threshold uint64
+
+	// Usage return the memory usage in bytes. If nil, ProcessMemory is
+	// used.
+	Usage func() uint64
+
+	// Interval is the interval between memory checks. Zero means one
+	// second.
+	Interval time.Duration
+
+	// CloseIdle is the number of sessions closed at every check while
+	// the usage is over Threshold, the most idle first. Zero closes no
+	// session. Tracking idleness counts the relayed bytes, see
+	// PooledTransport.
+	CloseIdle int
+}
+
+// ProcessMemory return the memory obtained by the Go runtime from the
+// system and not released to it.
+func ProcessMemory() uint64 {
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+	return m.Sys - m.HeapReleased
+}
+
+// CgroupMemory return the memory usage and limit of the cgroup of the
+// process, read from the cgroup v2 or v1 files under /sys/fs/cgroup as
+// mounted in containers. limit is zero if the cgroup is unlimited.
+func CgroupMemory() (usage, limit uint64, err error) {
+	for _, files := range [][2]string{
+		{"/sys/fs/cgroup/memory.current", "/sys/fs/cgroup/memory.max"},
+		{"/sys/fs/cgroup/memory/memory.usage_in_bytes", "/sys/fs/cgroup/memory/memory.limit_in_bytes"},
+	} {
+		usage, err = readUint(files[0])
+		if err != nil {
+			continue
+		}
+		limit, err = readUint(files[1])
+		// cgroup v1 reports no limit as a huge value.
+		if err != nil || limit >= math.MaxInt64/2 {
+			limit = 0
+		}
+		return usage, limit, nil
+	}
+	return 0, 0, errors.New("no cgroup memory accounting")
+}
+
+// readUint read the unsigned integer in file.
+func readUint(file string) (uint64, error) {
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseUint(strings.TrimSpace(string(b)), 10, 64)
+}
+
+// threshold return the usage over which to shed load, zero if unknown.
+func (ml *MemoryLimit) threshold() uint64 {
+	if ml.Threshold != 0 {
+		return ml.Threshold
+	}
+	_, limit, err := CgroupMemory()
+	if err != nil {
+		return 0
+	}
+	return limit / 10 * 9
+}
+
+func (ml *MemoryLimit) usage() uint64 {
+	if ml.Usage != nil {
+		return ml.Usage()
+	}
+	return ProcessMemory()
+}
+
+// overMemory report whether the server sheds load.
+func (srv *Server) overMemory() bool {
+	return atomic.LoadInt32(&srv.shedding) != 0
+}
+
+// monitorMemory check the memory usage every MemoryLimit.Interval until
+// stop is closed.
+func (srv *Server) monitorMemory(stop <-chan struct{}) {
+	ml := srv.MemoryLimit
+	interval := ml.Interval
+	if interval <= 0 {
+		interval = time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			srv.checkMemory(ml)
+		case <-stop:
+			return
+		}
+	}
+}
+
+// checkMemory start or stop shedding load according to the memory
+// usage, and close idle sessions while shedding.
+func (srv *Server) checkMemory(ml *MemoryLimit) {
+	threshold := ml.threshold()
+	if threshold == 0 {
+		return
+	}
+	usage := ml.usage()
+	var over int32
+	if usage > threshold {
+		over = 1
+	}
+	if atomic.SwapInt32(&srv.shedding, over) != over {
+		srv.onMemoryPressure(usage, over == 1)
+	}
+	if over == 1 && ml.CloseIdle > 0 {
+		srv.closeIdle(ml.CloseIdle)
+	}
+}
+
+// closeIdle close the n most idle sessions.
+func (srv *Server) closeIdle(n int) {
+	sessions := srv.Sessions()
+	idle := make([]time.Duration, len(sessions))
+	for i, s := range sessions {
+		idle[i] = s.Idle()
+	}
+	sort.Sort(byIdle{sessions, idle})
+	if n > len(sessions) {
+		n = len(sessions)
+	}
+	for _, s := range sessions[:n] {
+		s.setCloseReason(CloseShed)
+		srv.onSessionShed(s)
+		s.Close()
+	}
+}
+
+// byIdle sort sessions from the most idle.
+type byIdle struct {
+	sessions []*Session
+	idle     []time.Duration
+}
+
+func (b byIdle) Len() int           { return len(b.sessions) }
+func (b byIdle) Less(i, j int) bool { return b.idle[i] > b.idle[j] }
+func (b byIdle) Swap(i, j int) {
+	b.sessions[i], b.sessions[j] = b.sessions[j], b.sessions[i]
+	b.idle[i], b.idle[j] = b.idle[j], b.idle[i]
+}
@@ -0,0 +1,64 @@
+package socks5
+
+import (
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestServer_MemoryLimit(t *testing.T) {
+	var usage uint64
+	pressure := make(chan bool, 2)
+	shed := make(chan *Session, 1)
+	srv := &Server{
+		MemoryLimit: &MemoryLimit{
+			Threshold: 100,
+			Usage:     func() uint64 { return atomic.LoadUint64(&usage) },
+			Interval:  10 * time.Millisecond,
+			CloseIdle: 1,
+		},
+		Hooks: Hooks{
+			OnMemoryPressure: func(usage uint64, over bool) { pressure <- over },
+			OnSessionShed: func(s *Session) {
+				select {
+				case shed <- s:
+				default:
+				}
+			},
+		},
+	}
+	addr := serveTest(t, srv)
+	dest, _ := ParseAddress(echoTest(t))
+	idle, _ := connectTest(t, addr, dest)
+	busy, _ := connectTest(t, addr, dest)
+	busy.Write([]byte("ping"))
+	ReadNBytes(busy, 4)
+
+	atomic.StoreUint64(&usage, 200)
+	if over := <-pressure; !over {
+		t.Fatal("no memory pressure event")
+	}
+	if s := <-shed; s.ClientAddr.String() != idle.LocalAddr().String() {
+		t.Errorf("shed %s, expected the idle session %s", s.ClientAddr, idle.LocalAddr())
+	}
+	if _, err := idle.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("idle session not closed: %v", err)
+	}
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("connection accepted under memory pressure: %v", err)
+	}
+
+	atomic.StoreUint64(&usage, 50)
+	if over := <-pressure; over {
+		t.Fatal("no memory relief event")
+	}
+}
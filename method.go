@@ -0,0 +1,237 @@
+package socks5
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+)
+
+// NoAcceptableMethodsError is returned by the server when none of the
+// methods offered by the client is acceptable.
+type NoAcceptableMethodsError struct {
+	// Offered are the methods offered by the client, in order.
+	Offered []METHOD
+}
+
+func (e *NoAcceptableMethodsError) Error() string {
+	return "no acceptable method among offered " + methodList(e.Offered)
+}
+
+// InvalidMethodsError is returned by servers with StrictMethods set when
+// the method selection message of the client is malformed.
+type InvalidMethodsError struct {
+	// Offered are the methods offered by the client, as sent.
+	Offered []METHOD
+	// Reason describes the violation.
+	Reason string
+}
+
+func (e *InvalidMethodsError) Error() string {
+	return "invalid methods " + methodList(e.Offered) + ": " + e.Reason
+}
+
+// methodList format methods with their names.
+func methodList(methods []METHOD) string {
+	names := make([]string, len(methods))
+	for i, m := range methods {
+		names[i] = methodString(m)
+	}
+	return "[" + strings.Join(names, " ") + "]"
+}
+
+// methodString return the name of m, or its hexadecimal value if it is
+// unknown.
+func methodString(m METHOD) string {
+	if str, ok := method2Str[m]; ok {
+		return str
+	}
+	return fmt.Sprintf("%#x", m)
+}
+
+// methodSelect select the method to authenticate the client among the
+// offered methods, send it to the client, then run its sub-negotiation.
+func (srv *Server) methodSelect(s *Session, methods []METHOD, client net.Conn) error {
+	s.Methods = methods
+	srv.onMethods(s, methods)
+	if srv.StrictMethods {
+		if reason := checkMethods(methods); reason != "" {
+			return srv.rejectMethods(s, client, &InvalidMethodsError{methods, reason})
+		}
+	}
+
+	methods = uniqueMethods(methods)
+	m := srv.selectMethod(client.RemoteAddr(), methods)
+	if m == NO_ACCEPTABLE_METHODS {
+		return srv.rejectMethods(s, client, &NoAcceptableMethodsError{methods})
+	}
+	_, err := client.Write([]byte{Version5, m})
+	if err != nil {
+		return err
+	}
+
+	s.Method = m
+	if m == NO_AUTHENTICATION_REQUIRED {
+		return nil
+	}
+	defer srv.limitAuth(s, client)()
+	return srv.authenticate(s, m, client, client)
+}
+
+// authenticate run the sub-negotiation of method m with the client, over
+// in and out.
+func (srv *Server) authenticate(s *Session, m METHOD, in io.Reader, out io.Writer) error {
+	var err error
+	srv.lockoutDelay(s)
+	if srv.Lockout != nil {
+		s.checkUser = func(username string) error { return srv.checkLockout(s, username) }
+	}
+	start := time.Now()
+	a, _ := srv.authenticator(m)
+	if sa, ok := a.(SessionAuthenticator); ok {
+		err = sa.AuthenticateSession(s, in, out)
+	} else if ca, ok := a.(ContextAuthenticator); ok {
+		err = ca.AuthenticateContext(s.Context(), in, out)
+	} else {
+		err = a.Authenticate(in, out)
+	}
+	if err == nil {
+		// authenticators which did not check the user name.
+		if err = srv.checkLockout(s, s.Username); err != nil {
+			s.authUser, s.Username = s.Username, ""
+		}
+	}
+	srv.auditAuth(s, m, time.Since(start), err)
+	if err != nil {
+		srv.authFailure(s, m, err)
+		return err
+	}
+	if srv.Lockout != nil {
+		srv.Lockout.succeed(s.Username)
+	}
+	s.user.Store(s.Username)
+	srv.onAuthSuccess(s)
+	return nil
+}
+
+// authFailure report the failure of the client to authenticate with m.
+func (srv *Server) authFailure(s *Session, m METHOD, err error) {
+	if srv.Lockout != nil && !errors.Is(err, errLockedOut) {
+		max := int64(srv.Lockout.maxFailures())
+		for range srv.Lockout.fail(s.ClientIP(), s.authUser) {
+			srv.onLimit(LimitEvent{LimitLockout, true, s, max, max})
+		}
+	}
+	srv.authFailed(s, m)
+	srv.logAuthFailure(s, m, err)
+	srv.onAuthFailure(s, m, err)
+}
+
+// rejectMethods reply NO_ACCEPTABLE_METHODS to the client and return err
+// as the failure of the method selection.
+func (srv *Server) rejectMethods(s *Session, client net.Conn, err error) error {
+	s.failure = FailureMethods
+	_, werr := client.Write([]byte{Version5, NO_ACCEPTABLE_METHODS})
+	if werr != nil {
+		return werr
+	}
+	srv.onNoAcceptableMethods(s, s.Methods)
+	srv.rejectDelay(s)
+	return &OpError{Version5, "", client.RemoteAddr(), "\"method selection\"", err}
+}
+
+// checkMethods return why methods is not a valid METHODS field, empty if
+// it is valid: it must list at least one method, each at most once, and
+// NO_ACCEPTABLE_METHODS is not a method.
+func checkMethods(methods []METHOD) string {
+	if len(methods) == 0 {
+		return "no method offered"
+	}
+	var seen [256]bool
+	for _, m := range methods {
+		if m == NO_ACCEPTABLE_METHODS {
+			return "NO_ACCEPTABLE_METHODS offered"
+		}
+		if seen[m] {
+			return "duplicate method " + methodString(m)
+		}
+		seen[m] = true
+	}
+	return ""
+}
+
+// uniqueMethods return methods without NO_ACCEPTABLE_METHODS and
+// repeated methods, in order of first occurrence.
+func uniqueMethods(methods []METHOD) []METHOD {
+	var seen [256]bool
+	unique := make([]METHOD, 0, len(methods))
+	for _, m := range methods {
+		if !seen[m] && m != NO_ACCEPTABLE_METHODS {
+			unique = append(unique, m)
+		}
+		seen[m] = true
+	}
+	return unique
+}
+
+// rejectDelay wait NoAcceptableMethodsDelay, or until s is cancelled.
+func (srv *Server) rejectDelay(s *Session) {
+	if srv.NoAcceptableMethodsDelay <= 0 {
+		return
+	}
+	t := time.NewTimer(srv.NoAcceptableMethodsDelay)
+	defer t.Stop()
+	select {
+	case <-t.C:
+	case <-s.Context().Done():
+	}
+}
+
+// selectMethod return the method chosen among methods offered by the
+// client at clientAddr, NO_ACCEPTABLE_METHODS if there is none.
+func (srv *Server) selectMethod(clientAddr net.Addr, methods []METHOD) METHOD {
+	if srv.MethodSelector != nil {
+		m := srv.MethodSelector(clientAddr, methods)
+		if !offered(m, methods) || !srv.supportsMethod(m, true) {
+			return NO_ACCEPTABLE_METHODS
+		}
+		return m
+	}
+	if srv.MethodPriority != nil {
+		for _, m := range srv.MethodPriority {
+			if offered(m, methods) && srv.supportsMethod(m, false) {
+				return m
+			}
+		}
+		return NO_ACCEPTABLE_METHODS
+	}
+	for _, m := range methods {
+		if srv.supportsMethod(m, false) {
+			return m
+		}
+	}
+	return NO_ACCEPTABLE_METHODS
+}
+
+// supportsMethod report whether the server can authenticate clients with
+// m. NO_AUTHENTICATION_REQUIRED is supported if explicit is set, when it
+// was chosen by MethodSelector, or if IsAllowNoAuthRequired.
+func (srv *Server) supportsMethod(m METHOD, explicit bool) bool {
+	if m == NO_AUTHENTICATION_REQUIRED {
+		return explicit || srv.IsAllowNoAuthRequired()
+	}
+	_, ok := srv.authenticator(m)
+	return ok && m != NO_ACCEPTABLE_METHODS
+}
+
+// offered report whether m is one of methods.
+func offered(m METHOD, methods []METHOD) bool {
+	for _, o := range methods {
+		if o == m {
+			return true
+		}
+	}
+	return false
+}
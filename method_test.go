@@ -0,0 +1,172 @@
+package socks5
+
+import (
+	"io"
+	"log"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// methodTest send the method selection message offering methods to the
+// server at addr and return the selected method.
+func methodTest(t *testing.T, addr string, methods ...METHOD) METHOD {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	conn.Write(append([]byte{Version5, byte(len(methods))}, methods...))
+	reply, err := ReadNBytes(conn, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return reply[1]
+}
+
+func TestServer_MethodSelector(t *testing.T) {
+	serve := func(selector func(net.Addr, []byte) byte) string {
+		return serveTest(t, &Server{
+			Authenticators: map[METHOD]Authenticator{
+				NO_AUTHENTICATION_REQUIRED: NoAuth{},
+				USERNAME_PASSWORD:          UserPwdAuth{NewMemeryStore(nil, "")},
+			},
+			MethodSelector: selector,
+			ErrorLog:       log.New(io.Discard, "", 0),
+		})
+	}
+
+	// Loopback clients must use Username/Password.
+	addr := serve(func(clientAddr net.Addr, offered []byte) byte {
+		if clientAddr.(*net.TCPAddr).IP.IsLoopback() {
+			return USERNAME_PASSWORD
+		}
+		return NO_AUTHENTICATION_REQUIRED
+	})
+
+	if m := methodTest(t, addr, NO_AUTHENTICATION_REQUIRED, USERNAME_PASSWORD); m != USERNAME_PASSWORD {
+		t.Errorf("selected %#x, expected Username/Password", m)
+	}
+	if m := methodTest(t, addr, NO_AUTHENTICATION_REQUIRED); m != NO_ACCEPTABLE_METHODS {
+		t.Errorf("selected %#x for a method the client did not offer", m)
+	}
+
+	addr = serve(func(clientAddr net.Addr, offered []byte) byte { return GSSAPI })
+	if m := methodTest(t, addr, GSSAPI); m != NO_ACCEPTABLE_METHODS {
+		t.Errorf("selected %#x without authenticator", m)
+	}
+
+	addr = serve(nil)
+	if m := methodTest(t, addr, USERNAME_PASSWORD, NO_AUTHENTICATION_REQUIRED); m != USERNAME_PASSWORD {
+		t.Errorf("default selection %#x, expected the first supported method", m)
+	}
+}
+
+func TestServer_MethodPriority(t *testing.T) {
+	addr := serveTest(t, &Server{
+		Authenticators: map[METHOD]Authenticator{
+			NO_AUTHENTICATION_REQUIRED: NoAuth{},
+			USERNAME_PASSWORD:          UserPwdAuth{NewMemeryStore(nil, "")},
+			GSSAPI:                     GSSAPIAuth{},
+		},
+		MethodPriority: []METHOD{GSSAPI, USERNAME_PASSWORD},
+		ErrorLog:       log.New(io.Discard, "", 0),
+	})
+
+	for _, c := range []struct {
+		offered  []METHOD
+		expected METHOD
+	}{
+		{[]METHOD{NO_AUTHENTICATION_REQUIRED, USERNAME_PASSWORD, GSSAPI}, GSSAPI},
+		{[]METHOD{NO_AUTHENTICATION_REQUIRED, USERNAME_PASSWORD}, USERNAME_PASSWORD},
+		// supported, but not in the priority list.
+		{[]METHOD{NO_AUTHENTICATION_REQUIRED}, NO_ACCEPTABLE_METHODS},
+	} {
+		if m := methodTest(t, addr, c.offered...); m != c.expected {
+			t.Errorf("offered %s: selected %s, expected %s", methodList(c.offered), methodString(m), methodString(c.expected))
+		}
+	}
+}
+
+func TestServer_NoAcceptableMethods(t *testing.T) {
+	logs := make(chan string, 1)
+	offered := make(chan []METHOD, 1)
+	srv := &Server{
+		Authenticators:           map[METHOD]Authenticator{USERNAME_PASSWORD: UserPwdAuth{NewMemeryStore(nil, "")}},
+		NoAcceptableMethodsDelay: 200 * time.Millisecond,
+		Hooks: Hooks{OnNoAcceptableMethods: func(s *Session, methods []METHOD) {
+			offered <- methods
+		}},
+		ErrorLog: log.New(writerFunc(func(b []byte) (int, error) {
+			logs <- string(b)
+			return len(b), nil
+		}), "", 0),
+	}
+	addr := serveTest(t, srv)
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	conn.Write([]byte{Version5, 2, NO_AUTHENTICATION_REQUIRED, 0x80})
+	reply, err := ReadNBytes(conn, 2)
+	if err != nil || reply[1] != NO_ACCEPTABLE_METHODS {
+		t.Fatalf("reply %x, %v", reply, err)
+	}
+	start := time.Now()
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("connection not closed: %v", err)
+	}
+	if d := time.Since(start); d < 150*time.Millisecond {
+		t.Errorf("closed after %v, expected the configured delay", d)
+	}
+
+	if m := <-offered; len(m) != 2 || m[0] != NO_AUTHENTICATION_REQUIRED || m[1] != 0x80 {
+		t.Errorf("hook offered methods: %x", m)
+	}
+	msg := <-logs
+	if !strings.Contains(msg, "127.0.0.1") || !strings.Contains(msg, "[NO_AUTHENTICATION_REQUIRED 0x80]") {
+		t.Errorf("log: %s", msg)
+	}
+}
+
+func TestServer_StrictMethods(t *testing.T) {
+	tests := []struct {
+		name            string
+		offered         []METHOD
+		lenient, strict METHOD
+	}{
+		{"valid", []METHOD{USERNAME_PASSWORD, NO_AUTHENTICATION_REQUIRED}, NO_AUTHENTICATION_REQUIRED, NO_AUTHENTICATION_REQUIRED},
+		{"duplicate", []METHOD{NO_AUTHENTICATION_REQUIRED, NO_AUTHENTICATION_REQUIRED}, NO_AUTHENTICATION_REQUIRED, NO_ACCEPTABLE_METHODS},
+		{"no acceptable methods offered", []METHOD{NO_ACCEPTABLE_METHODS, NO_AUTHENTICATION_REQUIRED}, NO_AUTHENTICATION_REQUIRED, NO_ACCEPTABLE_METHODS},
+		{"unknown", []METHOD{0x80, NO_AUTHENTICATION_REQUIRED}, NO_AUTHENTICATION_REQUIRED, NO_AUTHENTICATION_REQUIRED},
+		{"empty", nil, NO_ACCEPTABLE_METHODS, NO_ACCEPTABLE_METHODS},
+	}
+	for _, strict := range []bool{false, true} {
+		offered := make(chan []METHOD, 1)
+		addr := serveTest(t, &Server{
+			StrictMethods: strict,
+			Hooks: Hooks{OnMethods: func(s *Session, methods []METHOD) {
+				offered <- methods
+			}},
+			ErrorLog: log.New(io.Discard, "", 0),
+		})
+		for _, tt := range tests {
+			expected := tt.lenient
+			if strict {
+				expected = tt.strict
+			}
+			if m := methodTest(t, addr, tt.offered...); m != expected {
+				t.Errorf("%s (strict %v): selected %#x, expected %#x", tt.name, strict, m, expected)
+			}
+			if m := <-offered; string(m) != string(tt.offered) {
+				t.Errorf("%s: hook offered %x", tt.name, m)
+			}
+		}
+	}
+}
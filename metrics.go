@@ -0,0 +1,532 @@
+package socks5
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Handshake failure reasons reported to Metrics.HandshakeFailed.
+const (
+	// FailureVersion is an unsupported protocol version, including socks4
+	// when Server.DisableSocks4 is set.
+	FailureVersion = "version"
+	// FailureTLS is a failed TLS handshake, see Server.ServeTLS.
+	FailureTLS = "tls"
+	// FailureMethods means no method offered by the client is acceptable,
+	// or the methods are invalid, see Server.StrictMethods.
+	FailureMethods = "methods"
+	// FailureAuth is a failed authentication sub-negotiation.
+	FailureAuth = "auth"
+	// FailureRequest is a malformed or unsupported request, or an I/O
+	// error before the request was read.
+	FailureRequest = "request"
+	// FailureDenied is a request denied by Server.Rules or Server.Policy.
+	FailureDenied = "denied"
+	// FailureTimeout is a handshake which outlived Server.HandshakeTimeout
+	// or Server.AuthTimeout.
+	FailureTimeout = "timeout"
+	// FailureSlow is a client which sent its handshake slower than
+	// Server.HandshakeReadTimeout allows.
+	FailureSlow = "slow"
+	// FailureOversized is a handshake larger than Server.MaxHandshakeBytes.
+	FailureOversized = "oversized"
+)
+
+// UDP datagram drop reasons reported to Metrics.UDPDropped.
+const (
+	// UDPDropMalformed is a client datagram without a valid UDP request
+	// header.
+	UDPDropMalformed = "malformed"
+	// UDPDropFragment is a fragment of a client datagram, dropped unless
+	// Server.UDPReassembly is set, or abandoned by the reassembly.
+	UDPDropFragment = "fragment"
+	// UDPDropUnresolved is a destination which failed to resolve, or
+	// without address of Server.AddressFamily.
+	UDPDropUnresolved = "unresolved"
+	// UDPDropTableFull is a new destination over Server.MaxUDPPeers.
+	UDPDropTableFull = "table_full"
+	// UDPDropUnknownSource is a datagram from neither the client nor a
+	// destination of the NAT table, see Server.UDPPeerTimeout.
+	UDPDropUnknownSource = "unknown_source"
+	// UDPDropSend is a datagram the relay failed to send.
+	UDPDropSend = "send"
+	// UDPDropDenied is a datagram to a destination denied by Server.Rules
+	// or Server.Policy.
+	UDPDropDenied = "denied"
+)
+
+// Metrics receives the events of a server to export metrics, see
+// Server.Metrics and PrometheusMetrics. Its methods are called on the
+// goroutines of sessions, concurrently, and should return quickly.
+type Metrics interface {
+	// SessionStarted is called when the server accepts a connection.
+	SessionStarted(s *Session)
+
+	// SessionEnded is called when the connection of s is closed, its
+	// bytes are counted in s.BytesUp and s.BytesDown, and s.CloseReason
+	// tells whether the server closed it.
+	SessionEnded(s *Session)
+
+	// HandshakeFailed is called when s failed before its relay started,
+	// reason is one of the Failure constants.
+	HandshakeFailed(s *Session, reason string)
+
+	// AuthFailed is called when the client failed to authenticate with
+	// method.
+	AuthFailed(s *Session, method METHOD)
+
+	// Dialed is called after each attempt to connect to the destination
+	// of s through route, err is nil if it succeeded.
+	Dialed(s *Session, route string, latency time.Duration, err error)
+
+	// UDPDatagram is called for each datagram relayed by an UDP
+	// association, up from the client to the destination, of size bytes
+	// of payload.
+	UDPDatagram(s *Session, up bool, size int)
+
+	// UDPDropped is called for each datagram an UDP association drops,
+	// reason is one of the UDPDrop constants.
+	UDPDropped(s *Session, reason string)
+
+	// PortsExhausted is called when the UDP ASSOCIATE or BIND request of
+	// s failed because all the ports of Server.RelayPorts are in use.
+	PortsExhausted(s *Session)
+}
+
+func (srv *Server) sessionStarted(s *Session) {
+	if srv.Metrics != nil {
+		srv.Metrics.SessionStarted(s)
+	}
+}
+
+func (srv *Server) sessionEnded(s *Session) {
+	if srv.Metrics != nil {
+		srv.Metrics.SessionEnded(s)
+	}
+}
+
+// handshakeFailed report the failure of s, FailureRequest if the failure
+// was not classified where it occurred.
+func (srv *Server) handshakeFailed(s *Session) {
+	if srv.Metrics == nil {
+		return
+	}
+	reason := s.failure
+	if reason == "" {
+		reason = FailureRequest
+	}
+	srv.Metrics.HandshakeFailed(s, reason)
+}
+
+func (srv *Server) authFailed(s *Session, method METHOD) {
+	s.failure = FailureAuth
+	if srv.Metrics != nil {
+		srv.Metrics.AuthFailed(s, method)
+	}
+}
+
+func (srv *Server) portsExhausted(s *Session) {
+	if srv.Metrics != nil {
+		srv.Metrics.PortsExhausted(s)
+	}
+}
+
+func (srv *Server) dialed(s *Session, route string, latency time.Duration, err error) {
+	if srv.Metrics != nil {
+		srv.Metrics.Dialed(s, route, latency, err)
+	}
+}
+
+// PrometheusMetrics is a Metrics exporting the metrics of servers in the
+// Prometheus text format, it is an http.Handler to scrape:
+//
+//	metrics := &socks5.PrometheusMetrics{}
+//	srv := &socks5.Server{Metrics: metrics}
+//	http.Handle("/metrics", metrics)
+//
+// It exports
+//
+//	socks5_sessions_active                                gauge
+//	socks5_sessions_total                                 counter
+//	socks5_sessions_closed_total{reason}                  counter, closed by the server
+//	socks5_handshake_failures_total{reason}               counter
+//	socks5_auth_failures_total{method}                    counter
+//	socks5_bytes_relayed_total{direction}                 counter, up or down
+//	socks5_udp_datagrams_total{direction}                 counter, up or down
+//	socks5_udp_dropped_total{reason}                      counter
+//	socks5_relay_ports_exhausted_total{command}           counter, see Server.RelayPorts
+//	socks5_dial_failures_total{route}                     counter
+//	socks5_dial_duration_seconds{route}                   histogram of successful dials
+//
+// and, if Latency is set, the histograms of its destination buckets
+//
+//	socks5_destination_dial_duration_seconds{dest}        histogram of successful dials
+//	socks5_destination_ttfb_seconds{dest}                 histogram of times to first byte
+//
+// and, for the tag keys of TagLabels,
+//
+//	socks5_tagged_sessions_total{tags...}                 counter, ended sessions
+//	socks5_tagged_bytes_relayed_total{tags...,direction}  counter, up or down
+//
+// The bytes relayed by active sessions are included as they go. Several
+// servers may share a PrometheusMetrics.
+type PrometheusMetrics struct {
+	// accessed atomically. Keep them 64-bit aligned.
+	sessions   uint64
+	udpUp      uint64
+	udpDown    uint64
+	closedUp   uint64
+	closedDown uint64
+
+	// Bounds are the bucket upper bounds of dial latency histograms. If
+	// nil, DefaultLatencyBounds is used.
+	Bounds []time.Duration
+
+	// Latency optionally exports the histograms of a LatencyStats, the
+	// Server.Latency of the servers, by destination bucket. The number of
+	// series is bounded by its MaxBuckets.
+	Latency *LatencyStats
+
+	// TagLabels are the keys of the session tags exported as labels of
+	// the tagged series, such as "team", which must be valid Prometheus
+	// label names. Other tags are not exported, sessions without a tag
+	// have it empty. The first 100 combinations of values get their own
+	// series, further ones are counted with all values "other".
+	TagLabels []string
+
+	mu           sync.Mutex
+	active       map[*Session]struct{}
+	handshake    map[string]uint64
+	closed       map[string]uint64
+	auth         map[METHOD]uint64
+	udpDropped   map[string]uint64
+	exhausted    map[string]uint64
+	dialFailures map[string]uint64
+	dials        map[string]*Histogram
+	// tagged are the counters of the tagged series of ended sessions,
+	// by their formatted labels.
+	tagged map[string]*taggedCounters
+}
+
+// taggedCounters are the counters of a combination of TagLabels values.
+type taggedCounters struct {
+	sessions, up, down uint64
+}
+
+// maxMetricsRoutes caps the routes with their own series, further routes
+// are counted as "other".
+const maxMetricsRoutes = 100
+
+// SessionStarted implements Metrics.
+func (m *PrometheusMetrics) SessionStarted(s *Session) {
+	atomic.AddUint64(&m.sessions, 1)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.active == nil {
+		m.active = make(map[*Session]struct{})
+	}
+	m.active[s] = struct{}{}
+}
+
+// SessionEnded implements Metrics.
+func (m *PrometheusMetrics) SessionEnded(s *Session) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.active, s)
+	// under mu, so the bytes of s are counted either as active or closed.
+	atomic.AddUint64(&m.closedUp, s.BytesUp())
+	atomic.AddUint64(&m.closedDown, s.BytesDown())
+	if len(m.TagLabels) > 0 {
+		if m.tagged == nil {
+			m.tagged = make(map[string]*taggedCounters)
+		}
+		c := m.taggedCounter(m.tagged, s)
+		c.sessions++
+		c.up += s.BytesUp()
+		c.down += s.BytesDown()
+	}
+	if reason := s.CloseReason(); reason != "" {
+		if m.closed == nil {
+			m.closed = make(map[string]uint64)
+		}
+		m.closed[reason]++
+	}
+}
+
+// taggedCounter return the counters of the TagLabels values of s in
+// tagged, adding them if needed.
+func (m *PrometheusMetrics) taggedCounter(tagged map[string]*taggedCounters, s *Session) *taggedCounters {
+	values := make([]string, len(m.TagLabels))
+	for i, key := range m.TagLabels {
+		values[i] = s.TagValue(key)
+	}
+	labels := m.tagLabels(values)
+	c, ok := tagged[labels]
+	if !ok {
+		if len(tagged) >= maxMetricsRoutes {
+			for i := range values {
+				values[i] = "other"
+			}
+			labels = m.tagLabels(values)
+			c, ok = tagged[labels]
+		}
+		if !ok {
+			c = &taggedCounters{}
+			tagged[labels] = c
+		}
+	}
+	return c
+}
+
+// tagLabels format the TagLabels with values as Prometheus labels.
+func (m *PrometheusMetrics) tagLabels(values []string) string {
+	labels := make([]string, len(values))
+	for i, v := range values {
+		labels[i] = m.TagLabels[i] + "=\"" + escapeLabel(v) + "\""
+	}
+	return strings.Join(labels, ",")
+}
+
+// HandshakeFailed implements Metrics.
+func (m *PrometheusMetrics) HandshakeFailed(s *Session, reason string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.handshake == nil {
+		m.handshake = make(map[string]uint64)
+	}
+	m.handshake[reason]++
+}
+
+// AuthFailed implements Metrics.
+func (m *PrometheusMetrics) AuthFailed(s *Session, method METHOD) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.auth == nil {
+		m.auth = make(map[METHOD]uint64)
+	}
+	m.auth[method]++
+}
+
+// Dialed implements Metrics.
+func (m *PrometheusMetrics) Dialed(s *Session, route string, latency time.Duration, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.dials == nil {
+		m.dials = make(map[string]*Histogram)
+		m.dialFailures = make(map[string]uint64)
+	}
+	h, ok := m.dials[route]
+	if !ok {
+		if len(m.dials) >= maxMetricsRoutes {
+			route = "other"
+			h, ok = m.dials[route]
+		}
+		if !ok {
+			bounds := m.Bounds
+			if bounds == nil {
+				bounds = DefaultLatencyBounds
+			}
+			h = NewHistogram(bounds)
+			m.dials[route] = h
+		}
+	}
+	if err != nil {
+		m.dialFailures[route]++
+		return
+	}
+	h.Observe(latency)
+}
+
+// UDPDatagram implements Metrics.
+func (m *PrometheusMetrics) UDPDatagram(s *Session, up bool, size int) {
+	if up {
+		atomic.AddUint64(&m.udpUp, 1)
+	} else {
+		atomic.AddUint64(&m.udpDown, 1)
+	}
+}
+
+// UDPDropped implements Metrics.
+func (m *PrometheusMetrics) UDPDropped(s *Session, reason string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.udpDropped == nil {
+		m.udpDropped = make(map[string]uint64)
+	}
+	m.udpDropped[reason]++
+}
+
+// PortsExhausted implements Metrics.
+func (m *PrometheusMetrics) PortsExhausted(s *Session) {
+	command := ""
+	if s.Request != nil {
+		command = cmdName(s.Request.CMD)
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.exhausted == nil {
+		m.exhausted = make(map[string]uint64)
+	}
+	m.exhausted[command]++
+}
+
+// ServeHTTP write the metrics in the Prometheus text format.
+func (m *PrometheusMetrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	b := bufio.NewWriter(w)
+	m.writeTo(b)
+	b.Flush()
+}
+
+func (m *PrometheusMetrics) writeTo(w *bufio.Writer) {
+	m.mu.Lock()
+	active := len(m.active)
+	up, down := atomic.LoadUint64(&m.closedUp), atomic.LoadUint64(&m.closedDown)
+	tagged := make(map[string]*taggedCounters, len(m.tagged))
+	for labels, c := range m.tagged {
+		copied := *c
+		tagged[labels] = &copied
+	}
+	for s := range m.active {
+		up += s.BytesUp()
+		down += s.BytesDown()
+		if len(m.TagLabels) > 0 {
+			c := m.taggedCounter(tagged, s)
+			c.up += s.BytesUp()
+			c.down += s.BytesDown()
+		}
+	}
+	handshake := copyCounters(m.handshake)
+	closed := copyCounters(m.closed)
+	auth := make(map[string]uint64, len(m.auth))
+	for method, n := range m.auth {
+		auth[methodString(method)] = n
+	}
+	udpDropped := copyCounters(m.udpDropped)
+	exhausted := copyCounters(m.exhausted)
+	dialFailures := copyCounters(m.dialFailures)
+	dials := make(map[string]HistogramSnapshot, len(m.dials))
+	for route, h := range m.dials {
+		dials[route] = h.Snapshot()
+	}
+	m.mu.Unlock()
+
+	writeMetric(w, "socks5_sessions_active", "gauge", "Sessions being served.")
+	fmt.Fprintf(w, "socks5_sessions_active %d\n", active)
+	writeMetric(w, "socks5_sessions_total", "counter", "Sessions accepted.")
+	fmt.Fprintf(w, "socks5_sessions_total %d\n", atomic.LoadUint64(&m.sessions))
+	writeMetric(w, "socks5_sessions_closed_total", "counter", "Sessions closed by the server, by reason.")
+	writeCounters(w, "socks5_sessions_closed_total", "reason", closed)
+	writeMetric(w, "socks5_handshake_failures_total", "counter", "Sessions failed before their relay, by reason.")
+	writeCounters(w, "socks5_handshake_failures_total", "reason", handshake)
+	writeMetric(w, "socks5_auth_failures_total", "counter", "Failed authentications, by method.")
+	writeCounters(w, "socks5_auth_failures_total", "method", auth)
+	writeMetric(w, "socks5_bytes_relayed_total", "counter", "Bytes relayed, up from clients to destinations and down.")
+	fmt.Fprintf(w, "socks5_bytes_relayed_total{direction=\"up\"} %d\n", up)
+	fmt.Fprintf(w, "socks5_bytes_relayed_total{direction=\"down\"} %d\n", down)
+	writeMetric(w, "socks5_udp_datagrams_total", "counter", "UDP datagrams relayed, up from clients to destinations and down.")
+	fmt.Fprintf(w, "socks5_udp_datagrams_total{direction=\"up\"} %d\n", atomic.LoadUint64(&m.udpUp))
+	fmt.Fprintf(w, "socks5_udp_datagrams_total{direction=\"down\"} %d\n", atomic.LoadUint64(&m.udpDown))
+	writeMetric(w, "socks5_udp_dropped_total", "counter", "UDP datagrams dropped, by reason.")
+	writeCounters(w, "socks5_udp_dropped_total", "reason", udpDropped)
+	writeMetric(w, "socks5_relay_ports_exhausted_total", "counter", "Requests failed because all the relay ports were in use, by command.")
+	writeCounters(w, "socks5_relay_ports_exhausted_total", "command", exhausted)
+	writeMetric(w, "socks5_dial_failures_total", "counter", "Failed connections to destinations, by route.")
+	writeCounters(w, "socks5_dial_failures_total", "route", dialFailures)
+	writeMetric(w, "socks5_dial_duration_seconds", "histogram", "Latency of successful connections to destinations, by route.")
+	for _, route := range sortedKeys(dials) {
+		writeHistogram(w, "socks5_dial_duration_seconds", "route", route, dials[route])
+	}
+	if m.Latency != nil {
+		latency := m.Latency.Snapshot()
+		dests := make([]string, 0, len(latency))
+		for dest := range latency {
+			dests = append(dests, dest)
+		}
+		sort.Strings(dests)
+		writeMetric(w, "socks5_destination_dial_duration_seconds", "histogram", "Latency of successful connections to destinations, by destination bucket.")
+		for _, dest := range dests {
+			writeHistogram(w, "socks5_destination_dial_duration_seconds", "dest", dest, latency[dest].Dial)
+		}
+		writeMetric(w, "socks5_destination_ttfb_seconds", "histogram", "Time to the first byte sent by destinations, by destination bucket.")
+		for _, dest := range dests {
+			writeHistogram(w, "socks5_destination_ttfb_seconds", "dest", dest, latency[dest].TTFB)
+		}
+	}
+	if len(m.TagLabels) == 0 {
+		return
+	}
+	labels := make([]string, 0, len(tagged))
+	for l := range tagged {
+		labels = append(labels, l)
+	}
+	sort.Strings(labels)
+	writeMetric(w, "socks5_tagged_sessions_total", "counter", "Sessions ended, by tags.")
+	for _, l := range labels {
+		fmt.Fprintf(w, "socks5_tagged_sessions_total{%s} %d\n", l, tagged[l].sessions)
+	}
+	writeMetric(w, "socks5_tagged_bytes_relayed_total", "counter", "Bytes relayed, up from clients to destinations and down, by tags.")
+	for _, l := range labels {
+		fmt.Fprintf(w, "socks5_tagged_bytes_relayed_total{%s,direction=\"up\"} %d\n", l, tagged[l].up)
+		fmt.Fprintf(w, "socks5_tagged_bytes_relayed_total{%s,direction=\"down\"} %d\n", l, tagged[l].down)
+	}
+}
+
+func copyCounters(counters map[string]uint64) map[string]uint64 {
+	c := make(map[string]uint64, len(counters))
+	for k, v := range counters {
+		c[k] = v
+	}
+	return c
+}
+
+func writeMetric(w *bufio.Writer, name, kind, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+func writeCounters(w *bufio.Writer, name, label string, counters map[string]uint64) {
+	keys := make([]string, 0, len(counters))
+	for k := range counters {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		fmt.Fprintf(w, "%s{%s=\"%s\"} %d\n", name, label, escapeLabel(k), counters[k])
+	}
+}
+
+// writeHistogram write the series of the histogram h of the metric name
+// with label=value.
+func writeHistogram(w *bufio.Writer, name, label, value string, h HistogramSnapshot) {
+	l := label + "=\"" + escapeLabel(value) + "\""
+	var cumulative uint64
+	for i, bound := range h.Bounds {
+		cumulative += h.Counts[i]
+		fmt.Fprintf(w, "%s_bucket{%s,le=\"%g\"} %d\n", name, l, bound.Seconds(), cumulative)
+	}
+	fmt.Fprintf(w, "%s_bucket{%s,le=\"+Inf\"} %d\n", name, l, h.Count)
+	fmt.Fprintf(w, "%s_sum{%s} %g\n", name, l, h.Sum.Seconds())
+	fmt.Fprintf(w, "%s_count{%s} %d\n", name, l, h.Count)
+}
+
+func sortedKeys(m map[string]HistogramSnapshot) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// escapeLabel escape a label value of the Prometheus text format.
+func escapeLabel(v string) string {
+	return labelEscaper.Replace(v)
+}
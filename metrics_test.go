@@ -0,0 +1,153 @@
+package socks5
+
+import (
+	"crypto/sha256"
+	"io"
+	"log"
+	"net"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// waitMetrics wait until the exposition of m contains all lines.
+func waitMetrics(t *testing.T, m *PrometheusMetrics, lines ...string) string {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		w := httptest.NewRecorder()
+		m.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+		body := w.Body.String()
+		missing := ""
+		for _, line := range lines {
+			if !strings.Contains(body, line+"\n") {
+				missing = line
+				break
+			}
+		}
+		if missing == "" {
+			return body
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("missing %q in\n%s", missing, body)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestPrometheusMetrics(t *testing.T) {
+	store := NewMemeryStore(sha256.New(), "")
+	store.Set("alice", "a")
+	metrics := &PrometheusMetrics{}
+	srv := &Server{
+		Authenticators: map[METHOD]Authenticator{
+			NO_AUTHENTICATION_REQUIRED: NoAuth{},
+			USERNAME_PASSWORD:          UserPwdAuth{store},
+		},
+		MethodPriority: []METHOD{USERNAME_PASSWORD, NO_AUTHENTICATION_REQUIRED},
+		Rules:          DenyList(&Match{Ports: []PortRange{{9, 9}}}),
+		Metrics:        metrics,
+		ErrorLog:       log.New(io.Discard, "", 0),
+	}
+	addr := serveTest(t, srv)
+	echo := echoTest(t)
+
+	conn, err := (&Client{ProxyAddr: addr, Username: "alice", Password: "a"}).Dial("tcp", echo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Write([]byte("ping"))
+	ReadNBytes(conn, 4)
+	waitMetrics(t, metrics,
+		"socks5_sessions_active 1",
+		`socks5_bytes_relayed_total{direction="up"} 4`,
+		`socks5_bytes_relayed_total{direction="down"} 4`,
+	)
+	conn.Close()
+
+	if _, err := (&Client{ProxyAddr: addr, Username: "alice", Password: "b"}).Dial("tcp", echo); err == nil {
+		t.Error("bad password accepted")
+	}
+	if _, err := (&Client{ProxyAddr: addr}).Dial("tcp", "127.0.0.1:9"); err == nil {
+		t.Error("denied destination connected")
+	}
+	raw, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw.Write([]byte{Version5, 1, GSSAPI})
+	if reply, err := ReadNBytes(raw, 2); err != nil || reply[1] != NO_ACCEPTABLE_METHODS {
+		t.Errorf("GSSAPI only: %v, %v", reply, err)
+	}
+	raw.Close()
+
+	body := waitMetrics(t, metrics,
+		"socks5_sessions_active 0",
+		"socks5_sessions_total 4",
+		`socks5_handshake_failures_total{reason="auth"} 1`,
+		`socks5_handshake_failures_total{reason="denied"} 1`,
+		`socks5_handshake_failures_total{reason="methods"} 1`,
+		`socks5_auth_failures_total{method="USERNAME_PASSWORD"} 1`,
+		`socks5_bytes_relayed_total{direction="up"} 4`,
+		`socks5_dial_duration_seconds_bucket{route="direct",le="+Inf"} 1`,
+		`socks5_dial_duration_seconds_count{route="direct"} 1`,
+	)
+	if !strings.Contains(body, "# TYPE socks5_dial_duration_seconds histogram\n") {
+		t.Errorf("histogram type missing in\n%s", body)
+	}
+}
+
+func TestPrometheusMetrics_TagLabels(t *testing.T) {
+	metrics := &PrometheusMetrics{TagLabels: []string{"team"}}
+	srv := &Server{
+		Metrics: metrics,
+		Hooks: Hooks{OnRequest: func(s *Session, req *Request) {
+			s.Tag("team", "video")
+			s.Tag("user", "alice")
+		}},
+	}
+	addr := serveTest(t, srv)
+	echo := echoTest(t)
+
+	conn, err := (&Client{ProxyAddr: addr}).Dial("tcp", echo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Write([]byte("ping"))
+	ReadNBytes(conn, 4)
+	waitMetrics(t, metrics,
+		`socks5_tagged_bytes_relayed_total{team="video",direction="up"} 4`,
+	)
+	conn.Close()
+	body := waitMetrics(t, metrics,
+		`socks5_tagged_sessions_total{team="video"} 1`,
+		`socks5_tagged_bytes_relayed_total{team="video",direction="up"} 4`,
+		`socks5_tagged_bytes_relayed_total{team="video",direction="down"} 4`,
+	)
+	if strings.Contains(body, "alice") {
+		t.Errorf("tag not in TagLabels exported:\n%s", body)
+	}
+}
+
+func TestPrometheusMetrics_UDP(t *testing.T) {
+	echo := udpEchoTest(t)
+	metrics := &PrometheusMetrics{}
+	client := &Client{ProxyAddr: serveTest(t, &Server{Metrics: metrics})}
+	conn, err := client.DialUDP(echo.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	b := make([]byte, 16)
+	for i := 0; i < 2; i++ {
+		conn.Write([]byte("ping"))
+		if _, err := conn.Read(b); err != nil {
+			t.Fatal(err)
+		}
+	}
+	waitMetrics(t, metrics,
+		`socks5_udp_datagrams_total{direction="up"} 2`,
+		`socks5_udp_datagrams_total{direction="down"} 2`,
+	)
+}
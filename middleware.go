@@ -0,0 +1,59 @@
+package socks5
+
+import (
+	"context"
+	"net"
+)
+
+// ConnHandler serves a connection accepted by a server. It owns conn and
+// closes it once served.
+type ConnHandler interface {
+	ServeConn(ctx context.Context, conn net.Conn)
+}
+
+// ConnHandlerFunc is a function used as a ConnHandler.
+type ConnHandlerFunc func(ctx context.Context, conn net.Conn)
+
+// ServeConn call f(ctx, conn).
+func (f ConnHandlerFunc) ServeConn(ctx context.Context, conn net.Conn) {
+	f(ctx, conn)
+}
+
+// Middleware wraps the handling of connections before the handshake,
+// such as to filter clients, parse a PROXY protocol header or unwrap TLS:
+// the handler it returns may inspect and wrap conn or the context before
+// calling next, or close conn instead of calling next to drop it.
+//
+//	srv.Middleware = []socks5.Middleware{
+//		func(next socks5.ConnHandler) socks5.ConnHandler {
+//			return socks5.ConnHandlerFunc(func(ctx context.Context, conn net.Conn) {
+//				log.Printf("accepted %s", conn.RemoteAddr())
+//				next.ServeConn(ctx, conn)
+//			})
+//		},
+//	}
+type Middleware func(next ConnHandler) ConnHandler
+
+// handler return the handler of connections with Middleware applied.
+func (srv *Server) handler() ConnHandler {
+	var h ConnHandler = ConnHandlerFunc(srv.serveConn)
+	for i := len(srv.Middleware) - 1; i >= 0; i-- {
+		h = srv.Middleware[i](h)
+	}
+	return h
+}
+
+// AllowClients is a Middleware closing the connections of clients out of
+// networks before the handshake, cheaper than denying their requests
+// with Rules.
+func AllowClients(networks ...*net.IPNet) Middleware {
+	return func(next ConnHandler) ConnHandler {
+		return ConnHandlerFunc(func(ctx context.Context, conn net.Conn) {
+			if ip := addrIP(conn.RemoteAddr()); ip == nil || !inNetworks(ip, networks) {
+				conn.Close()
+				return
+			}
+			next.ServeConn(ctx, conn)
+		})
+	}
+}
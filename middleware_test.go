@@ -0,0 +1,100 @@
+package socks5
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+)
+
+type middlewareKey struct{}
+
+func TestServer_Middleware(t *testing.T) {
+	var mu sync.Mutex
+	var order []string
+	record := func(name string) Middleware {
+		return func(next ConnHandler) ConnHandler {
+			return ConnHandlerFunc(func(ctx context.Context, conn net.Conn) {
+				mu.Lock()
+				order = append(order, name)
+				mu.Unlock()
+				next.ServeConn(context.WithValue(ctx, middlewareKey{}, name), conn)
+			})
+		}
+	}
+	var seen string
+	srv := &Server{
+		Middleware: []Middleware{record("outer"), record("inner")},
+		Hooks: Hooks{
+			OnMethods: func(s *Session, offered []METHOD) {
+				mu.Lock()
+				seen, _ = s.Context().Value(middlewareKey{}).(string)
+				mu.Unlock()
+			},
+		},
+	}
+	addr := serveTest(t, srv)
+	conn, err := (&Client{ProxyAddr: addr}).Dial("tcp", echoTest(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	mu.Lock()
+	defer mu.Unlock()
+	if len(order) != 2 || order[0] != "outer" || order[1] != "inner" || seen != "inner" {
+		t.Errorf("order %v, context %q", order, seen)
+	}
+}
+
+func TestAllowClients(t *testing.T) {
+	networks, err := ParseNetworks("10.0.0.0/8")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := serveTest(t, &Server{Middleware: []Middleware{AllowClients(networks...)}})
+	if _, err := (&Client{ProxyAddr: addr}).Dial("tcp", echoTest(t)); err == nil {
+		t.Error("client out of networks served")
+	}
+
+	networks, _ = ParseNetworks("127.0.0.0/8")
+	addr = serveTest(t, &Server{Middleware: []Middleware{AllowClients(networks...)}})
+	conn, err := (&Client{ProxyAddr: addr}).Dial("tcp", echoTest(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+}
+
+// udpClientConn is a conn of a client over QUIC, its address a UDP one.
+type udpClientConn struct {
+	net.Conn
+}
+
+func (c udpClientConn) RemoteAddr() net.Addr {
+	addr := c.Conn.RemoteAddr().(*net.TCPAddr)
+	return &net.UDPAddr{IP: addr.IP, Port: addr.Port}
+}
+
+func TestAllowClients_UDPAddr(t *testing.T) {
+	networks, _ := ParseNetworks("127.0.0.0/8")
+	overUDP := func(next ConnHandler) ConnHandler {
+		return ConnHandlerFunc(func(ctx context.Context, conn net.Conn) {
+			next.ServeConn(ctx, udpClientConn{conn})
+		})
+	}
+	addr := serveTest(t, &Server{Middleware: []Middleware{overUDP, AllowClients(networks...)}})
+	conn, err := (&Client{ProxyAddr: addr}).Dial("tcp", echoTest(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+
+	srv := &Server{MaxConnectionsPerIP: 1}
+	s := &Session{ClientAddr: &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1}}
+	if _, ok := srv.countIP(s); !ok {
+		t.Fatal("first client refused")
+	}
+	if _, ok := srv.countIP(s); ok {
+		t.Error("client over UDP not capped")
+	}
+}
@@ -0,0 +1,130 @@
+package socks5
+
+import (
+	"context"
+	"io"
+	"net"
+	"time"
+)
+
+// ServerNegotiator runs the server side of a socks5 handshake, method
+// selection, authentication sub-negotiation and request, on any
+// io.ReadWriter. It lets other transports embed the socks5 handshake
+// without the rest of Server: the caller serves the request and sends
+// the reply with Reply.
+type ServerNegotiator struct {
+	// Authenticators are the supported methods, as Server.Authenticators.
+	Authenticators map[METHOD]Authenticator
+
+	// MethodSelector overrides the method selection, as
+	// Server.MethodSelector. clientAddr is nil unless rw is a net.Conn.
+	MethodSelector func(clientAddr net.Addr, offered []byte) (chosen byte)
+
+	// MethodPriority orders the supported methods by preference, as
+	// Server.MethodPriority.
+	MethodPriority []METHOD
+
+	// StrictMethods rejects malformed METHODS fields, as
+	// Server.StrictMethods.
+	StrictMethods bool
+}
+
+// Negotiate read the handshake of a socks5 client from rw up to its
+// request, which is returned in the Request field of the session. The
+// failures the protocol reports, such as no acceptable method or an
+// unsupported address type, are replied to the client. Methods such as
+// GSSAPI protect the rest of the session, see Protected.
+func (n *ServerNegotiator) Negotiate(ctx context.Context, rw io.ReadWriter) (*Session, error) {
+	srv := &Server{
+		Authenticators: n.Authenticators,
+		MethodSelector: n.MethodSelector,
+		MethodPriority: n.MethodPriority,
+		StrictMethods:  n.StrictMethods,
+	}
+	conn := netConn(rw)
+	s := newSession(ctx, conn)
+	version, err := checkVersion(conn)
+	if err != nil {
+		return nil, &OpError{Version5, "read", conn.RemoteAddr(), "\"check version\"", err}
+	}
+	if version != Version5 {
+		return nil, &OpError{Version5, "", conn.RemoteAddr(), "\"check version\"", &VersionError{version}}
+	}
+	err = srv.authentication(s, conn)
+	if err != nil {
+		return nil, err
+	}
+	if s.encapsulate != nil {
+		conn = s.encapsulate(conn)
+		s.encapsulated = conn
+	}
+	s.Request, err = srv.readSocks5Request(conn)
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Protected return the stream of s negotiated on rw, which the reply and
+// the relayed data go through: rw protected by the authentication
+// method of s, such as GSSAPI, or rw.
+func (n *ServerNegotiator) Protected(s *Session, rw io.ReadWriter) io.ReadWriter {
+	if s.encapsulated != nil {
+		return s.encapsulated
+	}
+	return rw
+}
+
+// Reply send the reply to the request with code rep and the bound
+// address bnd. A nil bnd is sent as 0.0.0.0:0.
+func (n *ServerNegotiator) Reply(w io.Writer, rep REP, bnd *Address) error {
+	if bnd == nil {
+		bnd = &Address{net.IPv4zero.To4(), IPV4_ADDRESS, 0}
+	}
+	return WriteReply(w, &Reply{VER: Version5, REP: rep, Address: bnd})
+}
+
+// ClientNegotiator runs the client side of a socks5 handshake, method
+// selection, authentication sub-negotiation, request and reply, on any
+// io.ReadWriter.
+type ClientNegotiator struct {
+	// Username and Password are the credentials of the Username/Password
+	// method, which is offered if Username is not empty.
+	Username string
+	Password string
+}
+
+// Negotiate send the request cmd for dest on rw and return the bound
+// address of the reply. Failure replies are returned as *REPError.
+// After a successful CONNECT, rw carries the relayed stream.
+func (n *ClientNegotiator) Negotiate(rw io.ReadWriter, cmd CMD, dest *Address) (*Address, error) {
+	c := &Client{Username: n.Username, Password: n.Password}
+	conn := netConn(rw)
+	err := c.negotiate(conn)
+	if err != nil {
+		return nil, err
+	}
+	return c.request(conn, cmd, dest)
+}
+
+// netConn return rw as a net.Conn, the negotiation code works on
+// connections.
+func netConn(rw io.ReadWriter) net.Conn {
+	if conn, ok := rw.(net.Conn); ok {
+		return conn
+	}
+	return rwConn{rw}
+}
+
+// rwConn is an io.ReadWriter seen as a net.Conn without addresses or
+// deadlines.
+type rwConn struct {
+	io.ReadWriter
+}
+
+func (rwConn) Close() error                       { return nil }
+func (rwConn) LocalAddr() net.Addr                { return nil }
+func (rwConn) RemoteAddr() net.Addr               { return nil }
+func (rwConn) SetDeadline(t time.Time) error      { return nil }
+func (rwConn) SetReadDeadline(t time.Time) error  { return nil }
+func (rwConn) SetWriteDeadline(t time.Time) error { return nil }
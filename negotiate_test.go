@@ -0,0 +1,71 @@
+package socks5
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"io"
+	"net"
+	"testing"
+)
+
+// rwPipe return two connected io.ReadWriters which are not net.Conn.
+func rwPipe() (io.ReadWriter, io.ReadWriter) {
+	r1, w1 := io.Pipe()
+	r2, w2 := io.Pipe()
+	return struct {
+		io.Reader
+		io.Writer
+	}{r1, w2}, struct {
+		io.Reader
+		io.Writer
+	}{r2, w1}
+}
+
+func TestNegotiators(t *testing.T) {
+	store := NewMemeryStore(sha256.New(), "secret")
+	store.Set("admin", "123456")
+	server := &ServerNegotiator{Authenticators: map[METHOD]Authenticator{USERNAME_PASSWORD: UserPwdAuth{store}}}
+	bnd := &Address{net.IPv4(10, 0, 0, 1).To4(), IPV4_ADDRESS, 1080}
+	dest := &Address{[]byte("example.org"), DOMAINNAME, 443}
+
+	crw, srw := rwPipe()
+	done := make(chan error, 1)
+	go func() {
+		s, err := server.Negotiate(context.Background(), srw)
+		if err != nil {
+			done <- err
+			return
+		}
+		if s.Username != "admin" || s.Request.CMD != CONNECT || s.Request.Address.String() != "example.org:443" {
+			done <- errors.New("unexpected session " + s.Username + " " + s.Request.Address.String())
+			return
+		}
+		done <- server.Reply(srw, SUCCESSED, bnd)
+	}()
+
+	client := &ClientNegotiator{Username: "admin", Password: "123456"}
+	addr, err := client.Negotiate(crw, CONNECT, dest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if addr.String() != "10.0.0.1:1080" {
+		t.Errorf("bound address %s", addr)
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	crw, srw = rwPipe()
+	go func() {
+		_, err := server.Negotiate(context.Background(), srw)
+		done <- err
+	}()
+	client.Password = "bad"
+	if _, err := client.Negotiate(crw, CONNECT, dest); !errors.Is(err, errAuthFailed) {
+		t.Errorf("bad password: %v", err)
+	}
+	if err := <-done; err == nil {
+		t.Error("server accepted a bad password")
+	}
+}
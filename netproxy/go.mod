@@ -0,0 +1,10 @@
+module github.com/haochen233/socks5/netproxy
+
+go 1.24.0
+
+require (
+	github.com/haochen233/socks5 v0.0.0
+	golang.org/x/net v0.42.0
+)
+
+replace github.com/haochen233/socks5 => ../
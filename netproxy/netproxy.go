@@ -0,0 +1,35 @@
+// Package netproxy registers the proxy URLs of socks5.FromURL with
+// golang.org/x/net/proxy, so that proxy.FromURL and
+// proxy.FromEnvironment return socks5 clients. It is a module of its own
+// so that the socks5 package keeps no dependencies.
+//
+//	netproxy.Register("socks4a", "socks5s", "wss")
+//	d, err := proxy.FromURL(u, proxy.Direct)
+//
+// proxy.FromURL handles the socks5 and socks5h schemes itself, before
+// the registered ones: registering them has no effect there.
+package netproxy
+
+import (
+	"net/url"
+
+	"github.com/haochen233/socks5"
+	"golang.org/x/net/proxy"
+)
+
+// FromURL return the socks5.Client configured by u, connecting through
+// forward, as socks5.FromURL. It fits proxy.RegisterDialerType.
+func FromURL(u *url.URL, forward proxy.Dialer) (proxy.Dialer, error) {
+	c, err := socks5.FromURL(u, forward)
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Register register FromURL for schemes with proxy.RegisterDialerType.
+func Register(schemes ...string) {
+	for _, scheme := range schemes {
+		proxy.RegisterDialerType(scheme, FromURL)
+	}
+}
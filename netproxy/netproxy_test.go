@@ -0,0 +1,58 @@
+package netproxy
+
+import (
+	"io"
+	"net"
+	"net/url"
+	"testing"
+
+	"github.com/haochen233/socks5"
+	"golang.org/x/net/proxy"
+)
+
+func TestRegister(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &socks5.Server{}
+	go srv.Serve(ln)
+	defer srv.Close()
+	echo, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+	go func() {
+		for {
+			conn, err := echo.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	Register("socks4a")
+	u, _ := url.Parse("socks4a://" + ln.Addr().String())
+	d, err := proxy.FromURL(u, proxy.Direct)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c, ok := d.(*socks5.Client); !ok || c.Protocol != socks5.ProtocolSOCKS4 {
+		t.Fatalf("dialer %#v", d)
+	}
+	conn, err := d.Dial("tcp", echo.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.Write([]byte("ping"))
+	b := make([]byte, 4)
+	if _, err := io.ReadFull(conn, b); err != nil || string(b) != "ping" {
+		t.Errorf("echo %q, %v", b, err)
+	}
+}
@@ -0,0 +1,12 @@
+module github.com/haochen233/socks5/passhash
+
+go 1.26.0
+
+require (
+	github.com/haochen233/socks5 v0.0.0
+	golang.org/x/crypto v0.57.0
+)
+
+require golang.org/x/sys v0.48.0 // indirect
+
+replace github.com/haochen233/socks5 => ../
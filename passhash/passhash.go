@@ -0,0 +1,219 @@
+// Package passhash implements socks5.PasswordHasher with scrypt, bcrypt
+// and argon2id, the recommended password hashing algorithms. It is a
+// module of its own so that the socks5 package keeps no dependencies.
+//
+// The hashers salt each password with random bytes and compare hashes in
+// constant time. Hashes embed their parameters, so raising the costs does
+// not invalidate the hashes stored before:
+//
+//	store := socks5.NewHashedMemoryStore(passhash.Argon2id{})
+//	store.Set("admin", "123456")
+package passhash
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"math/bits"
+	"strings"
+
+	"github.com/haochen233/socks5"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/crypto/scrypt"
+)
+
+var (
+	_ socks5.PasswordHasher = Scrypt{}
+	_ socks5.PasswordHasher = Bcrypt{}
+	_ socks5.PasswordHasher = Argon2id{}
+)
+
+// Scrypt hashes passwords with scrypt (RFC 7914). Hashes have the form
+// "$scrypt$ln=<log2 N>,r=<r>,p=<p>$<salt>$<key>", with unpadded base64
+// salt and key.
+type Scrypt struct {
+	// N is the CPU/memory cost, a power of two. Zero means 32768.
+	N int
+	// R is the block size. Zero means 8.
+	R int
+	// P is the parallelization. Zero means 1.
+	P int
+}
+
+const (
+	scryptPrefix  = "$scrypt$"
+	scryptSaltLen = 16
+	scryptKeyLen  = 32
+)
+
+func (h Scrypt) params() (n, r, p int) {
+	n, r, p = h.N, h.R, h.P
+	if n == 0 {
+		n = 1 << 15
+	}
+	if r == 0 {
+		r = 8
+	}
+	if p == 0 {
+		p = 1
+	}
+	return n, r, p
+}
+
+// Hash return the scrypt hash of password with a new random salt.
+func (h Scrypt) Hash(password string) (string, error) {
+	n, r, p := h.params()
+	salt := make([]byte, scryptSaltLen)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	key, err := scrypt.Key([]byte(password), salt, n, r, p, scryptKeyLen)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%sln=%d,r=%d,p=%d$%s$%s", scryptPrefix, bits.TrailingZeros(uint(n)), r, p,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+// Compare derive the key of password with the salt and parameters of
+// hash, and compare it with the key of hash in constant time.
+func (h Scrypt) Compare(hash, password string) error {
+	if !strings.HasPrefix(hash, scryptPrefix) {
+		return fmt.Errorf("not a scrypt hash")
+	}
+	fields := strings.Split(hash[len(scryptPrefix):], "$")
+	if len(fields) != 3 {
+		return fmt.Errorf("malformed scrypt hash")
+	}
+	var ln, r, p int
+	if _, err := fmt.Sscanf(fields[0], "ln=%d,r=%d,p=%d", &ln, &r, &p); err != nil || ln <= 0 || ln >= 31 {
+		return fmt.Errorf("malformed scrypt parameters %q", fields[0])
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(fields[1])
+	if err != nil {
+		return fmt.Errorf("malformed scrypt salt: %w", err)
+	}
+	want, err := base64.RawStdEncoding.DecodeString(fields[2])
+	if err != nil || len(want) == 0 {
+		return fmt.Errorf("malformed scrypt key")
+	}
+	key, err := scrypt.Key([]byte(password), salt, 1<<uint(ln), r, p, len(want))
+	if err != nil {
+		return err
+	}
+	if subtle.ConstantTimeCompare(key, want) != 1 {
+		return socks5.ErrPasswordMismatch
+	}
+	return nil
+}
+
+// Bcrypt hashes passwords with bcrypt. Hashes have the modular crypt form
+// "$2a$<cost>$<salt and hash>". bcrypt only hashes the first 72 bytes of
+// passwords, Hash fails with longer passwords.
+type Bcrypt struct {
+	// Cost is the log2 of the number of rounds, from 4 to 31. Zero means
+	// bcrypt.DefaultCost.
+	Cost int
+}
+
+// Hash return the bcrypt hash of password with a new random salt.
+func (h Bcrypt) Hash(password string) (string, error) {
+	cost := h.Cost
+	if cost == 0 {
+		cost = bcrypt.DefaultCost
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), cost)
+	return string(hash), err
+}
+
+// Compare compare the bcrypt hash of password with hash, with the salt and
+// cost of hash.
+func (h Bcrypt) Compare(hash, password string) error {
+	err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
+	if errors.Is(err, bcrypt.ErrMismatchedHashAndPassword) {
+		return socks5.ErrPasswordMismatch
+	}
+	return err
+}
+
+// Argon2id hashes passwords with argon2id (RFC 9106). Hashes have the PHC
+// form "$argon2id$v=19$m=<memory>,t=<time>,p=<threads>$<salt>$<key>",
+// with unpadded base64 salt and key. The zero value uses the second
+// recommended option of RFC 9106, 64 MiB and 3 passes.
+type Argon2id struct {
+	// Time is the number of passes over the memory. Zero means 3.
+	Time uint32
+	// Memory is the memory size in KiB. Zero means 64 MiB.
+	Memory uint32
+	// Threads is the number of lanes. Zero means 4.
+	Threads uint8
+}
+
+const (
+	argon2idPrefix  = "$argon2id$"
+	argon2idSaltLen = 16
+	argon2idKeyLen  = 32
+)
+
+func (h Argon2id) params() (time, memory uint32, threads uint8) {
+	time, memory, threads = h.Time, h.Memory, h.Threads
+	if time == 0 {
+		time = 3
+	}
+	if memory == 0 {
+		memory = 64 * 1024
+	}
+	if threads == 0 {
+		threads = 4
+	}
+	return time, memory, threads
+}
+
+// Hash return the argon2id hash of password with a new random salt.
+func (h Argon2id) Hash(password string) (string, error) {
+	time, memory, threads := h.params()
+	salt := make([]byte, argon2idSaltLen)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	key := argon2.IDKey([]byte(password), salt, time, memory, threads, argon2idKeyLen)
+	return fmt.Sprintf("%sv=%d$m=%d,t=%d,p=%d$%s$%s", argon2idPrefix, argon2.Version, memory, time, threads,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+// Compare derive the key of password with the salt and parameters of
+// hash, and compare it with the key of hash in constant time.
+func (h Argon2id) Compare(hash, password string) error {
+	if !strings.HasPrefix(hash, argon2idPrefix) {
+		return fmt.Errorf("not an argon2id hash")
+	}
+	fields := strings.Split(hash[len(argon2idPrefix):], "$")
+	if len(fields) != 4 {
+		return fmt.Errorf("malformed argon2id hash")
+	}
+	var version int
+	if _, err := fmt.Sscanf(fields[0], "v=%d", &version); err != nil || version != argon2.Version {
+		return fmt.Errorf("unsupported argon2id version %q", fields[0])
+	}
+	var time, memory uint32
+	var threads uint8
+	if _, err := fmt.Sscanf(fields[1], "m=%d,t=%d,p=%d", &memory, &time, &threads); err != nil || time == 0 || threads == 0 {
+		return fmt.Errorf("malformed argon2id parameters %q", fields[1])
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(fields[2])
+	if err != nil {
+		return fmt.Errorf("malformed argon2id salt: %w", err)
+	}
+	want, err := base64.RawStdEncoding.DecodeString(fields[3])
+	if err != nil || len(want) == 0 {
+		return fmt.Errorf("malformed argon2id key")
+	}
+	key := argon2.IDKey([]byte(password), salt, time, memory, threads, uint32(len(want)))
+	if subtle.ConstantTimeCompare(key, want) != 1 {
+		return socks5.ErrPasswordMismatch
+	}
+	return nil
+}
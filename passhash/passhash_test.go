@@ -0,0 +1,72 @@
+package passhash
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/haochen233/socks5"
+)
+
+func TestHashers(t *testing.T) {
+	for _, h := range []socks5.PasswordHasher{
+		Scrypt{N: 1024},
+		Bcrypt{Cost: 4},
+		Argon2id{Time: 1, Memory: 64, Threads: 1},
+	} {
+		hash, err := h.Hash("123456")
+		if err != nil {
+			t.Fatalf("%T: %v", h, err)
+		}
+		if err := h.Compare(hash, "123456"); err != nil {
+			t.Errorf("%T: %v", h, err)
+		}
+		if err := h.Compare(hash, "654321"); err != socks5.ErrPasswordMismatch {
+			t.Errorf("%T wrong password: %v", h, err)
+		}
+		if other, _ := h.Hash("123456"); other == hash {
+			t.Errorf("%T: same salt", h)
+		}
+		if err := h.Compare("$1$abc", "123456"); err == nil || err == socks5.ErrPasswordMismatch {
+			t.Errorf("%T malformed hash: %v", h, err)
+		}
+	}
+}
+
+func TestArgon2id_Parameters(t *testing.T) {
+	hash, err := Argon2id{Time: 2, Memory: 128, Threads: 2}.Hash("123456")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(hash, "$argon2id$v=19$m=128,t=2,p=2$") {
+		t.Errorf("hash %q", hash)
+	}
+	// compared with the parameters of the hash, not of the hasher
+	if err := (Argon2id{}).Compare(hash, "123456"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestScrypt_Parameters(t *testing.T) {
+	hash, err := Scrypt{N: 1024, R: 4, P: 2}.Hash("123456")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(hash, "$scrypt$ln=10,r=4,p=2$") {
+		t.Errorf("hash %q", hash)
+	}
+	// compared with the parameters of the hash, not of the hasher
+	if err := (Scrypt{}).Compare(hash, "123456"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestMemoryStore(t *testing.T) {
+	store := socks5.NewHashedMemoryStore(Argon2id{Time: 1, Memory: 64, Threads: 1})
+	store.Set("admin", "123456")
+	if err := store.Validate("admin", "123456"); err != nil {
+		t.Error(err)
+	}
+	if err := store.Validate("admin", "654321"); err == nil {
+		t.Error("wrong password validated")
+	}
+}
@@ -0,0 +1,65 @@
+package socks5
+
+import (
+	"errors"
+	"net"
+)
+
+// errPolicyDenied is returned when the policy of the server denies a
+// request.
+var errPolicyDenied = errors.New("request denied by policy")
+
+// Decision is the verdict of a Policy on a request.
+type Decision struct {
+	// Deny refuses the request with CONNECTION_NOT_ALLOW_BY_RULESET.
+	Deny bool
+
+	// Dest rewrites the destination of the request if not nil.
+	Dest *Address
+
+	// Routes are the candidate routes of the request, overriding
+	// Server.Router if not empty.
+	Routes []Route
+}
+
+// Policy decides on requests with more logic than a RuleSet: it may deny
+// a request, rewrite its destination or choose its routes. It lets
+// operators plug policies in without rebuilding the server, such as
+// scripts evaluated by an embedded interpreter.
+type Policy interface {
+	// Decide return the decision on req. s carries the client address
+	// and the authenticated user, resolver is the resolver of the server
+	// for policies depending on the addresses of names. An error fails
+	// the request with GENERAL_SOCKS_SERVER_FAILURE.
+	Decide(s *Session, req *Request, resolver NameResolver) (Decision, error)
+}
+
+// PolicyFunc is an adapter to allow the use of ordinary functions as Policy.
+type PolicyFunc func(s *Session, req *Request, resolver NameResolver) (Decision, error)
+
+// Decide calls f(s, req, resolver).
+func (f PolicyFunc) Decide(s *Session, req *Request, resolver NameResolver) (Decision, error) {
+	return f(s, req, resolver)
+}
+
+// decide apply the decision of the policy on req, and reply the refusal
+// to the client if it is denied or the policy failed.
+func (srv *Server) decide(s *Session, client net.Conn, req *Request) error {
+	policy := srv.policy()
+	if policy == nil {
+		return nil
+	}
+	const step = "\"process request policy\""
+	d, err := policy.Decide(s, req, srv.resolver())
+	if err != nil {
+		return srv.refuse(client, req, GENERAL_SOCKS_SERVER_FAILURE, step, err)
+	}
+	if d.Deny {
+		return srv.refuse(client, req, CONNECTION_NOT_ALLOW_BY_RULESET, step, errPolicyDenied)
+	}
+	if d.Dest != nil {
+		req.Address = d.Dest
+	}
+	s.routes = d.Routes
+	return nil
+}
@@ -0,0 +1,65 @@
+package socks5
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestServer_Policy(t *testing.T) {
+	echo := echoTest(t)
+	echoAddr, _ := ParseAddress(echo)
+	var routed string
+	srv := &Server{
+		Policy: PolicyFunc(func(s *Session, req *Request, resolver NameResolver) (Decision, error) {
+			switch string(req.Address.Addr) {
+			case "denied.test":
+				return Decision{Deny: true}, nil
+			case "broken.test":
+				return Decision{}, errors.New("broken policy")
+			case "echo.test":
+				ips, err := resolver.Resolve(context.Background(), "localhost")
+				if err != nil || len(ips) == 0 {
+					return Decision{}, err
+				}
+				route := Route{Name: "policy", Dialer: dialContextFunc(func(ctx context.Context, network, address string) (net.Conn, error) {
+					routed = address
+					return (&net.Dialer{}).DialContext(ctx, network, address)
+				})}
+				return Decision{Dest: echoAddr, Routes: []Route{route}}, nil
+			}
+			return Decision{}, nil
+		}),
+		ErrorLog: log.New(io.Discard, "", 0),
+	}
+	addr := serveTest(t, srv)
+	client := &Client{ProxyAddr: addr}
+
+	_, err := client.Dial("tcp", "denied.test:80")
+	var rep *REPError
+	if !errors.As(err, &rep) || rep.REP != CONNECTION_NOT_ALLOW_BY_RULESET {
+		t.Errorf("denied: %v", err)
+	}
+	_, err = client.Dial("tcp", "broken.test:80")
+	if !errors.As(err, &rep) || rep.REP != GENERAL_SOCKS_SERVER_FAILURE {
+		t.Errorf("broken: %v", err)
+	}
+
+	conn, err := client.Dial("tcp", "echo.test:80")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	conn.Write([]byte("ping"))
+	if b, err := ReadNBytes(conn, 4); err != nil || string(b) != "ping" {
+		t.Errorf("rewritten: %q, %v", b, err)
+	}
+	if routed != echo {
+		t.Errorf("routed to %q", routed)
+	}
+}
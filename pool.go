@@ -0,0 +1,405 @@
+package socks5
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// errPoolExpired is a warm connection idle longer than IdleTimeout.
+var errPoolExpired = errors.New("pooled connection expired")
+
+// ConnPool is a Dialer keeping warm connections to the destinations it
+// dials frequently, such as the sites of a crawler, so that their
+// requests skip the dial latency. Set it as Server.Dialer, or as the
+// Dialer of routes:
+//
+//	pool := &socks5.ConnPool{}
+//	defer pool.Close()
+//	srv := &socks5.Server{Dialer: pool}
+//	http.Handle("/debug/socks5/pool", pool)
+//
+// Connections are never reused: a relay ends with its connection, as the
+// state of the protocol spoken over it is unknown. The pool dials ahead
+// of requests instead, and hands out connections which carried nothing
+// but the greeting of destinations speaking first, which is read first.
+// Warm connections closed by their destination are discarded. Not every
+// destination tolerates idle connections, pooling is limited to Ports.
+type ConnPool struct {
+	// Dialer dials the connections. If nil, a net.Dialer is used.
+	Dialer Dialer
+
+	// Ports are the destination ports pooled. If nil, 80 and 443 are,
+	// whose clients speak first and servers tolerate idle connections.
+	Ports []PortRange
+
+	// MinDials is the number of dials to a destination within Window
+	// from which the pool keeps warm connections to it. Zero means 3.
+	MinDials int
+	// Window is the period dials are counted over, destinations not
+	// dialed for that long are forgotten. Zero means a minute.
+	Window time.Duration
+
+	// MaxIdle is the number of warm connections kept per destination.
+	// Zero means 2.
+	MaxIdle int
+	// IdleTimeout closes the warm connections unused for that long,
+	// before their destination does. Zero means 30 seconds.
+	IdleTimeout time.Duration
+	// MaxDestinations caps the number of destinations tracked. Zero
+	// means 256.
+	MaxDestinations int
+	// DialTimeout bounds the dials ahead of requests. Zero means 10
+	// seconds.
+	DialTimeout time.Duration
+
+	mu     sync.Mutex
+	dests  map[string]*poolDest
+	sweep  time.Time
+	closed bool
+	stats  PoolStats
+}
+
+// PoolStats are the counters of a ConnPool.
+type PoolStats struct {
+	// Hits are the dials served by warm connections.
+	Hits uint64 `json:"hits"`
+	// Misses are the dials to pooled ports served by new connections.
+	Misses uint64 `json:"misses"`
+	// Dials are the connections dialed ahead of requests, DialErrors
+	// the dials which failed.
+	Dials      uint64 `json:"dials"`
+	DialErrors uint64 `json:"dial_errors"`
+	// Expired are the warm connections closed unused after IdleTimeout.
+	Expired uint64 `json:"expired"`
+	// Closed are the warm connections closed by their destination.
+	Closed uint64 `json:"closed"`
+	// Idle is the number of warm connections.
+	Idle int `json:"idle"`
+	// Destinations is the number of destinations tracked.
+	Destinations int `json:"destinations"`
+}
+
+// poolDest is a destination dialed through the pool.
+type poolDest struct {
+	network, addr string
+	// recent are the times of the last MinDials dials, oldest first.
+	recent  []time.Time
+	idle    []*idleConn
+	dialing int
+}
+
+// idleConn is a warm connection, watched by a goroutine reading its
+// greeting or its closing until it is taken.
+type idleConn struct {
+	net.Conn
+	added time.Time
+	// taken is set, under the lock of the pool, once the connection is
+	// no longer idle.
+	taken bool
+	// done is closed when the watch ends, with greeting and err read.
+	done     chan struct{}
+	greeting []byte
+	err      error
+}
+
+func (p *ConnPool) dialer() Dialer {
+	if p.Dialer == nil {
+		return &net.Dialer{}
+	}
+	return p.Dialer
+}
+
+func (p *ConnPool) window() time.Duration {
+	if p.Window <= 0 {
+		return time.Minute
+	}
+	return p.Window
+}
+
+func (p *ConnPool) idleTimeout() time.Duration {
+	if p.IdleTimeout <= 0 {
+		return 30 * time.Second
+	}
+	return p.IdleTimeout
+}
+
+// pooled report whether the pool keeps connections to address.
+func (p *ConnPool) pooled(network, address string) bool {
+	if network != "tcp" && network != "tcp4" && network != "tcp6" {
+		return false
+	}
+	_, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return false
+	}
+	n, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return false
+	}
+	if p.Ports == nil {
+		return n == 80 || n == 443
+	}
+	return inPortRanges(uint16(n), p.Ports)
+}
+
+// DialContext return a warm connection to address if any, or dial it.
+func (p *ConnPool) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	if !p.pooled(network, address) {
+		return p.dialer().DialContext(ctx, network, address)
+	}
+	p.mu.Lock()
+	d := p.record(network, address, time.Now())
+	for d != nil && len(d.idle) > 0 {
+		c := d.idle[len(d.idle)-1]
+		d.idle = d.idle[:len(d.idle)-1]
+		c.taken = true
+		p.mu.Unlock()
+		conn, err := c.take(p.idleTimeout())
+		p.mu.Lock()
+		if err == nil {
+			p.stats.Hits++
+			p.refill(d)
+			p.mu.Unlock()
+			return conn, nil
+		}
+		c.Close()
+		p.countClosed(err)
+	}
+	p.stats.Misses++
+	if d != nil {
+		p.refill(d)
+	}
+	p.mu.Unlock()
+	return p.dialer().DialContext(ctx, network, address)
+}
+
+// record count a dial to address and return its destination, nil if
+// MaxDestinations are tracked already or the pool is closed.
+func (p *ConnPool) record(network, address string, now time.Time) *poolDest {
+	if p.closed {
+		return nil
+	}
+	p.sweepLocked(now)
+	key := network + " " + address
+	d, ok := p.dests[key]
+	if !ok {
+		max := p.MaxDestinations
+		if max <= 0 {
+			max = 256
+		}
+		if len(p.dests) >= max {
+			return nil
+		}
+		if p.dests == nil {
+			p.dests = make(map[string]*poolDest)
+		}
+		d = &poolDest{network: network, addr: address}
+		p.dests[key] = d
+	}
+	d.recent = append(d.recent, now)
+	if min := p.minDials(); len(d.recent) > min {
+		d.recent = d.recent[len(d.recent)-min:]
+	}
+	return d
+}
+
+func (p *ConnPool) minDials() int {
+	if p.MinDials <= 0 {
+		return 3
+	}
+	return p.MinDials
+}
+
+// refill dial ahead the missing warm connections of d, if it is dialed
+// frequently.
+func (p *ConnPool) refill(d *poolDest) {
+	if p.closed || len(d.recent) < p.minDials() || time.Since(d.recent[0]) > p.window() {
+		return
+	}
+	max := p.MaxIdle
+	if max <= 0 {
+		max = 2
+	}
+	for len(d.idle)+d.dialing < max {
+		d.dialing++
+		go p.prefill(d)
+	}
+}
+
+// prefill dial a warm connection of d.
+func (p *ConnPool) prefill(d *poolDest) {
+	timeout := p.DialTimeout
+	if timeout <= 0 {
+		timeout = 10 * time.Second
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	conn, err := p.dialer().DialContext(ctx, d.network, d.addr)
+	cancel()
+
+	p.mu.Lock()
+	d.dialing--
+	if err != nil {
+		p.stats.DialErrors++
+		p.mu.Unlock()
+		return
+	}
+	p.stats.Dials++
+	if p.closed || p.dests[d.network+" "+d.addr] != d {
+		p.mu.Unlock()
+		conn.Close()
+		return
+	}
+	c := &idleConn{Conn: conn, added: time.Now(), done: make(chan struct{})}
+	// the deadline is set before take may set its own.
+	c.SetReadDeadline(c.added.Add(p.idleTimeout()))
+	d.idle = append(d.idle, c)
+	p.mu.Unlock()
+	go p.watch(d, c)
+}
+
+// watch read the greeting of c, and discard c if its destination closes
+// it or it expires first.
+func (p *ConnPool) watch(d *poolDest, c *idleConn) {
+	buf := make([]byte, 4096)
+	n, err := c.Read(buf)
+	c.greeting = buf[:n]
+	if n == 0 {
+		c.err = err
+	}
+
+	p.mu.Lock()
+	discard := !c.taken && c.err != nil
+	if discard {
+		c.taken = true
+		for i, idle := range d.idle {
+			if idle == c {
+				d.idle = append(d.idle[:i], d.idle[i+1:]...)
+				break
+			}
+		}
+		if isTimeout(err) {
+			err = errPoolExpired
+		}
+		p.countClosed(err)
+	}
+	p.mu.Unlock()
+	close(c.done)
+	if discard {
+		c.Close()
+	}
+}
+
+// take end the watch of c and return it, reading its greeting first.
+func (c *idleConn) take(idleTimeout time.Duration) (net.Conn, error) {
+	c.SetReadDeadline(time.Unix(1, 0))
+	<-c.done
+	if c.err != nil && !isTimeout(c.err) {
+		return nil, c.err
+	}
+	if time.Since(c.added) >= idleTimeout {
+		return nil, errPoolExpired
+	}
+	c.SetReadDeadline(time.Time{})
+	if len(c.greeting) > 0 {
+		return &greetedConn{Conn: c.Conn, greeting: c.greeting}, nil
+	}
+	return c.Conn, nil
+}
+
+// countClosed count a warm connection discarded with err.
+func (p *ConnPool) countClosed(err error) {
+	if err == errPoolExpired {
+		p.stats.Expired++
+	} else {
+		p.stats.Closed++
+	}
+}
+
+// sweepLocked forget the destinations not dialed within Window, at most
+// once per Window.
+func (p *ConnPool) sweepLocked(now time.Time) {
+	if now.Before(p.sweep) {
+		return
+	}
+	p.sweep = now.Add(p.window())
+	for key, d := range p.dests {
+		if now.Sub(d.recent[len(d.recent)-1]) > p.window() {
+			p.dropLocked(key, d)
+		}
+	}
+}
+
+// dropLocked forget d and close its warm connections.
+func (p *ConnPool) dropLocked(key string, d *poolDest) {
+	for _, c := range d.idle {
+		c.taken = true
+		c.Close()
+	}
+	d.idle = nil
+	delete(p.dests, key)
+}
+
+// Close close the warm connections, the pool dials without them from
+// then on.
+func (p *ConnPool) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.closed = true
+	for key, d := range p.dests {
+		p.dropLocked(key, d)
+	}
+	return nil
+}
+
+// Stats return the counters of the pool.
+func (p *ConnPool) Stats() PoolStats {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	stats := p.stats
+	stats.Destinations = len(p.dests)
+	for _, d := range p.dests {
+		stats.Idle += len(d.idle)
+	}
+	return stats
+}
+
+// ServeHTTP write the Stats as JSON.
+func (p *ConnPool) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(p.Stats())
+}
+
+// greetedConn is a warm connection whose destination spoke first,
+// reading its greeting first.
+type greetedConn struct {
+	net.Conn
+	greeting []byte
+}
+
+// CloseWrite half-close the warm connection.
+func (c *greetedConn) CloseWrite() error {
+	return closeWrite(c.Conn)
+}
+
+func (c *greetedConn) Read(b []byte) (int, error) {
+	if len(c.greeting) > 0 {
+		n := copy(b, c.greeting)
+		c.greeting = c.greeting[n:]
+		return n, nil
+	}
+	return c.Conn.Read(b)
+}
+
+// isTimeout report whether err is a timeout.
+func isTimeout(err error) bool {
+	var ne net.Error
+	return errors.As(err, &ne) && ne.Timeout()
+}
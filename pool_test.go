@@ -0,0 +1,156 @@
+package socks5
+
+import (
+	"context"
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// poolTest serve connections with handle on a local listener, and
+// return its address, port and the number of connections accepted.
+func poolTest(t *testing.T, handle func(net.Conn)) (string, uint16, *int32) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	accepted := new(int32)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			atomic.AddInt32(accepted, 1)
+			go handle(conn)
+		}
+	}()
+	return ln.Addr().String(), uint16(ln.Addr().(*net.TCPAddr).Port), accepted
+}
+
+// waitPool wait until cond holds for the stats of p.
+func waitPool(t *testing.T, p *ConnPool, cond func(PoolStats) bool) {
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond(p.Stats()) {
+		if time.Now().After(deadline) {
+			t.Fatalf("pool stats %+v", p.Stats())
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestConnPool(t *testing.T) {
+	addr, port, accepted := poolTest(t, func(conn net.Conn) {
+		defer conn.Close()
+		conn.Write([]byte("hello\n"))
+		io.Copy(conn, conn)
+	})
+	pool := &ConnPool{Ports: []PortRange{{port, port}}, MinDials: 2}
+	defer pool.Close()
+	ctx := context.Background()
+
+	for i := 0; i < 2; i++ {
+		conn, err := pool.DialContext(ctx, "tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.Close()
+	}
+	waitPool(t, pool, func(s PoolStats) bool { return s.Idle == 2 })
+
+	conn, err := pool.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.Write([]byte("ping"))
+	if b, err := ReadNBytes(conn, 10); err != nil || string(b) != "hello\nping" {
+		t.Errorf("warm connection read %q, %v", b, err)
+	}
+	waitPool(t, pool, func(s PoolStats) bool { return s.Idle == 2 })
+	stats := pool.Stats()
+	if stats.Hits != 1 || stats.Misses != 2 || stats.Dials != 3 || stats.Destinations != 1 {
+		t.Errorf("stats %+v", stats)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for atomic.LoadInt32(accepted) != 5 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if n := atomic.LoadInt32(accepted); n != 5 {
+		t.Errorf("%d connections accepted, want 5", n)
+	}
+
+	pool.Close()
+	if stats := pool.Stats(); stats.Idle != 0 || stats.Destinations != 0 {
+		t.Errorf("closed pool stats %+v", stats)
+	}
+	if conn, err := pool.DialContext(ctx, "tcp", addr); err != nil {
+		t.Error(err)
+	} else {
+		conn.Close()
+	}
+}
+
+func TestConnPool_TakeFresh(t *testing.T) {
+	addr, port, _ := poolTest(t, func(conn net.Conn) {
+		defer conn.Close()
+		io.Copy(conn, conn)
+	})
+	pool := &ConnPool{Ports: []PortRange{{port, port}}, MinDials: 1, MaxIdle: 1, IdleTimeout: time.Minute}
+	defer pool.Close()
+
+	// connections taken as soon as they are pooled are not delayed by
+	// their watch.
+	for i := 0; i < 20; i++ {
+		start := time.Now()
+		conn, err := pool.DialContext(context.Background(), "tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.Close()
+		if d := time.Since(start); d > 2*time.Second {
+			t.Fatalf("dial %d took %v", i, d)
+		}
+	}
+}
+
+func TestConnPool_Discard(t *testing.T) {
+	addr, port, _ := poolTest(t, func(conn net.Conn) { conn.Close() })
+	pool := &ConnPool{Ports: []PortRange{{port, port}}, MinDials: 1}
+	defer pool.Close()
+	conn, err := pool.DialContext(context.Background(), "tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	waitPool(t, pool, func(s PoolStats) bool { return s.Closed == 2 && s.Idle == 0 })
+
+	addr, port, _ = poolTest(t, func(conn net.Conn) {
+		defer conn.Close()
+		io.Copy(io.Discard, conn)
+	})
+	pool = &ConnPool{Ports: []PortRange{{port, port}}, MinDials: 1, IdleTimeout: 20 * time.Millisecond}
+	defer pool.Close()
+	if conn, err = pool.DialContext(context.Background(), "tcp", addr); err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	waitPool(t, pool, func(s PoolStats) bool { return s.Expired >= 2 })
+}
+
+func TestConnPool_Ports(t *testing.T) {
+	addr, _, _ := poolTest(t, func(conn net.Conn) { conn.Close() })
+	pool := &ConnPool{MinDials: 1}
+	defer pool.Close()
+	conn, err := pool.DialContext(context.Background(), "tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	if stats := pool.Stats(); stats != (PoolStats{}) {
+		t.Errorf("unpooled port stats %+v", stats)
+	}
+}
@@ -0,0 +1,121 @@
+package socks5
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// ErrPortsExhausted is returned when all the ports of Server.RelayPorts
+// are in use.
+var ErrPortsExhausted = errors.New("socks5 relay port range exhausted")
+
+// PortRange is an inclusive range of ports. The zero value lets the
+// system choose any ephemeral port.
+type PortRange struct {
+	Min uint16
+	Max uint16
+}
+
+// ParsePortRange parse a range in the form "min-max", or a single port.
+func ParsePortRange(s string) (PortRange, error) {
+	lo, hi := s, s
+	if i := strings.IndexByte(s, '-'); i >= 0 {
+		lo, hi = s[:i], s[i+1:]
+	}
+	min, err := strconv.ParseUint(strings.TrimSpace(lo), 10, 16)
+	if err != nil {
+		return PortRange{}, fmt.Errorf("invalid port range %q", s)
+	}
+	max, err := strconv.ParseUint(strings.TrimSpace(hi), 10, 16)
+	if err != nil || min == 0 || max < min {
+		return PortRange{}, fmt.Errorf("invalid port range %q", s)
+	}
+	return PortRange{uint16(min), uint16(max)}, nil
+}
+
+func (r PortRange) String() string {
+	return strconv.Itoa(int(r.Min)) + "-" + strconv.Itoa(int(r.Max))
+}
+
+// each call try with the ports of r, starting from a random one, until
+// try does not fail with EADDRINUSE. It returns the last error of try, or
+// ErrPortsExhausted if all ports are in use. The zero range calls try
+// with port 0.
+func (r PortRange) each(try func(port int) error) error {
+	if r.Min == 0 && r.Max == 0 {
+		return try(0)
+	}
+	n := int(r.Max) - int(r.Min) + 1
+	start := rand.Intn(n)
+	for i := 0; i < n; i++ {
+		err := try(int(r.Min) + (start+i)%n)
+		if !errors.Is(err, syscall.EADDRINUSE) {
+			return err
+		}
+	}
+	return ErrPortsExhausted
+}
+
+// relayIP return the IP address to bind the relay sockets of client to.
+func (srv *Server) relayIP(client net.Conn) net.IP {
+	if srv.RelayAddr != nil {
+		return srv.RelayAddr
+	}
+	if addr, ok := client.LocalAddr().(*net.TCPAddr); ok {
+		return addr.IP
+	}
+	return nil
+}
+
+// relayAddress return the address of the relay socket bound to addr
+// reported to client: its local address if addr is unspecified.
+func (srv *Server) relayAddress(client net.Conn, addr *net.UDPAddr) *Address {
+	ip := addr.IP
+	if ip == nil || ip.IsUnspecified() {
+		if local, ok := client.LocalAddr().(*net.TCPAddr); ok {
+			ip = local.IP
+		} else {
+			ip = srv.localAddress(client).Addr
+		}
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return &Address{ip4, IPV4_ADDRESS, uint16(addr.Port)}
+	}
+	return &Address{ip, IPV6_ADDRESS, uint16(addr.Port)}
+}
+
+// listenUDP open an UDP relay socket for s on ip, with a port of
+// RelayPorts.
+func (srv *Server) listenUDP(s *Session, ip net.IP) (*net.UDPConn, error) {
+	var conn *net.UDPConn
+	err := srv.RelayPorts.each(func(port int) error {
+		var err error
+		conn, err = net.ListenUDP("udp", &net.UDPAddr{IP: ip, Port: port})
+		return err
+	})
+	if err == ErrPortsExhausted {
+		srv.portsExhausted(s)
+		srv.onPortsExhausted(s)
+	}
+	return conn, err
+}
+
+// listenTCP open a BIND listener for s on ip, with a port of RelayPorts.
+func (srv *Server) listenTCP(s *Session, ip net.IP) (*net.TCPListener, error) {
+	var ln *net.TCPListener
+	err := srv.RelayPorts.each(func(port int) error {
+		var err error
+		ln, err = net.ListenTCP("tcp", &net.TCPAddr{IP: ip, Port: port})
+		return err
+	})
+	if err == ErrPortsExhausted {
+		srv.portsExhausted(s)
+		srv.onPortsExhausted(s)
+	}
+	return ln, err
+}
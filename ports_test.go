@@ -0,0 +1,73 @@
+package socks5
+
+import (
+	"io"
+	"log"
+	"net"
+	"testing"
+)
+
+func TestParsePortRange(t *testing.T) {
+	for in, expected := range map[string]PortRange{
+		"40000-40100": {40000, 40100},
+		"5000":        {5000, 5000},
+	} {
+		r, err := ParsePortRange(in)
+		if err != nil || r != expected {
+			t.Errorf("%s: %v, %v", in, r, err)
+		}
+	}
+	for _, in := range []string{"", "0", "10-5", "1-70000", "a-b"} {
+		if _, err := ParsePortRange(in); err == nil {
+			t.Errorf("%s: expected error", in)
+		}
+	}
+}
+
+// udpNop is a Transporter ending UDP associations right away.
+type udpNop struct {
+	Transporter
+}
+
+func (udpNop) TransportUDP(conn *net.UDPConn) error {
+	return nil
+}
+
+func TestServer_RelayPorts(t *testing.T) {
+	blocker, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer blocker.Close()
+	port := uint16(blocker.LocalAddr().(*net.UDPAddr).Port)
+
+	exhausted := make(chan struct{}, 1)
+	metrics := &PrometheusMetrics{}
+	srv := &Server{
+		Metrics:     metrics,
+		Transporter: udpNop{DefaultTransporter},
+		RelayPorts:  PortRange{port, port},
+		Hooks: Hooks{OnPortsExhausted: func(s *Session) {
+			exhausted <- struct{}{}
+		}},
+		ErrorLog: log.New(io.Discard, "", 0),
+	}
+	addr := serveTest(t, srv)
+	unspecified := &Address{net.IPv4zero.To4(), IPV4_ADDRESS, 0}
+
+	_, reply := requestTest(t, addr, UDP_ASSOCIATE, unspecified)
+	if reply[1] != GENERAL_SOCKS_SERVER_FAILURE {
+		t.Errorf("reply %#x with the range exhausted", reply[1])
+	}
+	<-exhausted
+	waitMetrics(t, metrics, `socks5_relay_ports_exhausted_total{command="UDP_ASSOCIATE"} 1`)
+
+	blocker.Close()
+	_, reply = requestTest(t, addr, UDP_ASSOCIATE, unspecified)
+	if reply[1] != SUCCESSED {
+		t.Fatalf("reply %#x", reply[1])
+	}
+	if bnd := uint16(reply[8])<<8 | uint16(reply[9]); bnd != port {
+		t.Errorf("relay port %d, expected %d", bnd, port)
+	}
+}
@@ -83,10 +83,10 @@ type REPError struct {
 }
 
 func (r *REPError) Error() string {
-	if _, ok := cmd2Str[r.REP]; !ok {
+	if _, ok := rep2Str[r.REP]; !ok {
 		return fmt.Sprintf("unknown rep:%#x", r.REP)
 	}
-	return fmt.Sprintf("don't support this rep:%s", rep2Str[r.REP])
+	return fmt.Sprintf("server reply:%s", rep2Str[r.REP])
 }
 
 // REP is one of a filed in Socks5 Reply
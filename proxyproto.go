@@ -0,0 +1,171 @@
+package socks5
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// proxyHeaderTimeout limits the time to read a PROXY protocol header.
+const proxyHeaderTimeout = 10 * time.Second
+
+// proxyV2Signature starts the headers of the PROXY protocol version 2.
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// ProxyProtocol is a Middleware reading the PROXY protocol header, version
+// 1 or 2, which TCP load balancers such as HAProxy or AWS NLB send before
+// the stream of the client: the session gets the address of the client
+// as ClientAddr, so Rules, per IP limits and logs see the real client.
+//
+// Connections from trusted networks, the load balancers, must start with
+// a header, they are closed otherwise. Connections from other networks
+// are served as is. If trusted is empty, all connections must start with
+// a header.
+//
+//	srv.Middleware = []socks5.Middleware{socks5.ProxyProtocol(balancers...)}
+func ProxyProtocol(trusted ...*net.IPNet) Middleware {
+	return func(next ConnHandler) ConnHandler {
+		return ConnHandlerFunc(func(ctx context.Context, conn net.Conn) {
+			if len(trusted) > 0 {
+				if ip := addrIP(conn.RemoteAddr()); ip == nil || !inNetworks(ip, trusted) {
+					next.ServeConn(ctx, conn)
+					return
+				}
+			}
+			conn.SetReadDeadline(time.Now().Add(proxyHeaderTimeout))
+			client, err := readProxyHeader(conn)
+			conn.SetReadDeadline(time.Time{})
+			if err != nil {
+				conn.Close()
+				return
+			}
+			if client != nil {
+				conn = &proxiedConn{conn, client}
+			}
+			next.ServeConn(ctx, conn)
+		})
+	}
+}
+
+// proxiedConn is a connection of a load balancer on behalf of a client.
+type proxiedConn struct {
+	net.Conn
+	client net.Addr
+}
+
+// RemoteAddr return the address of the client.
+func (c *proxiedConn) RemoteAddr() net.Addr {
+	return c.client
+}
+
+// CloseWrite half-close the connection of the load balancer.
+func (c *proxiedConn) CloseWrite() error {
+	return closeWrite(c.Conn)
+}
+
+// errProxyHeader is a missing or malformed PROXY protocol header.
+var errProxyHeader = errors.New("invalid PROXY protocol header")
+
+// readProxyHeader read a PROXY protocol header from r and return the
+// source address it carries, nil for headers of the load balancer itself,
+// such as health checks, or of unknown protocols.
+func readProxyHeader(r io.Reader) (*net.TCPAddr, error) {
+	first, err := ReadNBytes(r, 1)
+	if err != nil {
+		return nil, err
+	}
+	switch first[0] {
+	case 'P':
+		return readProxyV1(r)
+	case proxyV2Signature[0]:
+		return readProxyV2(r)
+	}
+	return nil, errProxyHeader
+}
+
+// readProxyV1 read the rest of a text header after its first byte:
+//
+//	PROXY TCP4 192.0.2.1 198.51.100.1 56324 1080\r\n
+func readProxyV1(r io.Reader) (*net.TCPAddr, error) {
+	// a v1 header is at most 107 bytes long
+	line := make([]byte, 0, 107)
+	line = append(line, 'P')
+	b := make([]byte, 1)
+	for !bytes.HasSuffix(line, []byte("\r\n")) {
+		if len(line) == cap(line) {
+			return nil, errProxyHeader
+		}
+		if _, err := io.ReadFull(r, b); err != nil {
+			return nil, err
+		}
+		line = append(line, b[0])
+	}
+	fields := strings.Fields(string(line))
+	if len(fields) < 2 || fields[0] != "PROXY" {
+		return nil, errProxyHeader
+	}
+	switch fields[1] {
+	case "UNKNOWN":
+		return nil, nil
+	case "TCP4", "TCP6":
+	default:
+		return nil, errProxyHeader
+	}
+	if len(fields) != 6 {
+		return nil, errProxyHeader
+	}
+	ip := net.ParseIP(fields[2])
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if ip == nil || err != nil || (ip.To4() != nil) != (fields[1] == "TCP4") {
+		return nil, errProxyHeader
+	}
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+// readProxyV2 read the rest of a binary header after its first byte.
+func readProxyV2(r io.Reader) (*net.TCPAddr, error) {
+	head, err := ReadNBytes(r, len(proxyV2Signature)-1+4)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(head[:len(proxyV2Signature)-1], proxyV2Signature[1:]) {
+		return nil, errProxyHeader
+	}
+	head = head[len(proxyV2Signature)-1:]
+	verCmd, family := head[0], head[1]
+	if verCmd>>4 != 2 {
+		return nil, fmt.Errorf("unsupported PROXY protocol version %d", verCmd>>4)
+	}
+	addrs, err := ReadNBytes(r, int(binary.BigEndian.Uint16(head[2:])))
+	if err != nil {
+		return nil, err
+	}
+	switch verCmd & 0xf {
+	case 0: // LOCAL
+		return nil, nil
+	case 1: // PROXY
+	default:
+		return nil, errProxyHeader
+	}
+	// addresses are followed by TLVs, which are skipped
+	switch family {
+	case 0x11: // TCP over IPv4
+		if len(addrs) < 12 {
+			return nil, errProxyHeader
+		}
+		return &net.TCPAddr{IP: net.IP(addrs[:4]), Port: int(binary.BigEndian.Uint16(addrs[8:]))}, nil
+	case 0x21: // TCP over IPv6
+		if len(addrs) < 36 {
+			return nil, errProxyHeader
+		}
+		return &net.TCPAddr{IP: net.IP(addrs[:16]), Port: int(binary.BigEndian.Uint16(addrs[32:]))}, nil
+	}
+	return nil, nil
+}
@@ -0,0 +1,103 @@
+package socks5
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"sync"
+	"testing"
+)
+
+// proxyHeaderDialer dials like a load balancer, sending header first.
+type proxyHeaderDialer []byte
+
+func (h proxyHeaderDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	conn, err := (&net.Dialer{}).DialContext(ctx, network, addr)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := conn.Write(h); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+func TestProxyProtocol(t *testing.T) {
+	v2 := append([]byte(nil), proxyV2Signature...)
+	v2 = append(v2, 0x21, 0x11, 0, 12+4)
+	v2 = append(v2, 192, 0, 2, 7, 127, 0, 0, 1, 0xdb, 0xe4, 0x04, 0x38)
+	v2 = append(v2, 0x04, 0, 1, 'x') // a TLV, skipped
+	v6 := append([]byte(nil), proxyV2Signature...)
+	v6 = append(v6, 0x21, 0x21, 0, 36)
+	v6 = append(v6, net.ParseIP("2001:db8::7")...)
+	v6 = append(v6, make([]byte, 16)...)
+	v6 = append(v6, 0xdb, 0xe4, 0x04, 0x38)
+
+	loopback, _ := ParseNetworks("127.0.0.0/8")
+	other, _ := ParseNetworks("10.0.0.0/8")
+	tests := []struct {
+		name    string
+		trusted []*net.IPNet
+		header  []byte
+		client  string // empty if the session is refused
+	}{
+		{"v1", loopback, []byte("PROXY TCP4 192.0.2.7 127.0.0.1 56292 1080\r\n"), "192.0.2.7:56292"},
+		{"v1 tcp6", nil, []byte("PROXY TCP6 2001:db8::7 ::1 56292 1080\r\n"), "[2001:db8::7]:56292"},
+		{"v1 unknown", loopback, []byte("PROXY UNKNOWN\r\n"), "127.0.0.1"},
+		{"v2", loopback, v2, "192.0.2.7:56292"},
+		{"v2 tcp6", loopback, v6, "[2001:db8::7]:56292"},
+		{"v2 local", loopback, append(append([]byte(nil), proxyV2Signature...), 0x20, 0, 0, 0), "127.0.0.1"},
+		{"untrusted", other, nil, "127.0.0.1"},
+		{"missing", loopback, nil, ""},
+		{"malformed", nil, []byte("PROXY TCP4 192.0.2.7\r\n"), ""},
+		{"bad family", nil, []byte("PROXY TCP6 192.0.2.7 127.0.0.1 56292 1080\r\n"), ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var mu sync.Mutex
+			var client net.Addr
+			srv := &Server{
+				Middleware: []Middleware{ProxyProtocol(tt.trusted...)},
+				Hooks: Hooks{OnMethods: func(s *Session, offered []METHOD) {
+					mu.Lock()
+					client = s.ClientAddr
+					mu.Unlock()
+				}},
+			}
+			addr := serveTest(t, srv)
+			conn, err := (&Client{ProxyAddr: addr, Dialer: proxyHeaderDialer(tt.header)}).Dial("tcp", echoTest(t))
+			if tt.client == "" {
+				if err == nil {
+					conn.Close()
+					t.Fatal("session served")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			conn.Close()
+			mu.Lock()
+			defer mu.Unlock()
+			got, _ := client.(*net.TCPAddr)
+			if got == nil || (got.String() != tt.client && got.IP.String() != tt.client) {
+				t.Errorf("client %v, want %s", client, tt.client)
+			}
+		})
+	}
+}
+
+func TestReadProxyHeader_Exact(t *testing.T) {
+	r := bytes.NewReader([]byte("PROXY TCP4 192.0.2.7 127.0.0.1 56292 1080\r\n\x05\x01\x00"))
+	if _, err := readProxyHeader(r); err != nil {
+		t.Fatal(err)
+	}
+	if r.Len() != 3 {
+		t.Errorf("%d bytes left after the header, want 3", r.Len())
+	}
+	long := append([]byte("PROXY TCP4 "), bytes.Repeat([]byte("1"), 120)...)
+	if _, err := readProxyHeader(bytes.NewReader(long)); err != errProxyHeader {
+		t.Errorf("long header: %v", err)
+	}
+}
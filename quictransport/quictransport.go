@@ -0,0 +1,275 @@
+// Package quictransport carries socks over QUIC: each QUIC stream is a
+// socks session, so the sessions of a client share one connection, which
+// survives changes of the client address, such as mobile users moving
+// between networks, and a lost packet only stalls its own stream. It is a
+// module of its own so that the socks5 package keeps no dependencies.
+//
+// The server accepts the streams of a Listener:
+//
+//	ln, err := quictransport.Listen(":1080", tlsConfig, nil)
+//	...
+//	srv.Serve(ln)
+//
+// and clients open them with a Dialer:
+//
+//	client := &socks5.Client{ProxyAddr: "proxy.example:1080", Dialer: &quictransport.Dialer{}}
+package quictransport
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"sync"
+
+	"github.com/haochen233/socks5"
+	"github.com/quic-go/quic-go"
+)
+
+// NextProto is the ALPN protocol of socks over QUIC, used when the TLS
+// configurations of Listen and Dialer set none.
+const NextProto = "socks5"
+
+// Listener is a net.Listener accepting the streams of the QUIC
+// connections of a quic.Listener.
+type Listener struct {
+	ln      *quic.Listener
+	streams chan net.Conn
+	ctx     context.Context
+	cancel  context.CancelFunc
+	// err is why accepting connections stopped
+	errOnce sync.Once
+	err     error
+}
+
+// Listen listens for QUIC connections on the UDP address addr.
+func Listen(addr string, tlsConfig *tls.Config, config *quic.Config) (*Listener, error) {
+	ln, err := quic.ListenAddr(addr, withNextProto(tlsConfig), config)
+	if err != nil {
+		return nil, err
+	}
+	return NewListener(ln), nil
+}
+
+// NewListener return a Listener accepting the streams of the connections
+// of ln, which it closes with it.
+func NewListener(ln *quic.Listener) *Listener {
+	ctx, cancel := context.WithCancel(context.Background())
+	l := &Listener{ln: ln, streams: make(chan net.Conn), ctx: ctx, cancel: cancel}
+	go l.acceptConns()
+	return l
+}
+
+// acceptConns accept the connections of ln, and their streams.
+func (l *Listener) acceptConns() {
+	for {
+		conn, err := l.ln.Accept(l.ctx)
+		if err != nil {
+			l.stop(err)
+			return
+		}
+		go l.acceptStreams(conn)
+	}
+}
+
+func (l *Listener) acceptStreams(conn *quic.Conn) {
+	for {
+		stream, err := conn.AcceptStream(l.ctx)
+		if err != nil {
+			return
+		}
+		select {
+		case l.streams <- &streamConn{stream, conn}:
+		case <-l.ctx.Done():
+			stream.CancelRead(0)
+			stream.Close()
+			return
+		}
+	}
+}
+
+func (l *Listener) stop(err error) {
+	l.errOnce.Do(func() {
+		l.err = err
+		l.cancel()
+	})
+}
+
+// Accept wait for the next stream.
+func (l *Listener) Accept() (net.Conn, error) {
+	select {
+	case stream := <-l.streams:
+		return stream, nil
+	case <-l.ctx.Done():
+		return nil, l.err
+	}
+}
+
+// Close stop accepting connections and close them.
+func (l *Listener) Close() error {
+	l.stop(net.ErrClosed)
+	return l.ln.Close()
+}
+
+// Addr return the UDP address of the listener.
+func (l *Listener) Addr() net.Addr {
+	return l.ln.Addr()
+}
+
+// streamConn is a QUIC stream as a net.Conn.
+type streamConn struct {
+	*quic.Stream
+	conn *quic.Conn
+}
+
+func (c *streamConn) LocalAddr() net.Addr  { return c.conn.LocalAddr() }
+func (c *streamConn) RemoteAddr() net.Addr { return c.conn.RemoteAddr() }
+
+// CloseWrite close the send side of the stream, the peer reads the end
+// of the stream.
+func (c *streamConn) CloseWrite() error {
+	return c.Stream.Close()
+}
+
+// Close close both sides of the stream.
+func (c *streamConn) Close() error {
+	c.Stream.CancelRead(0)
+	return c.Stream.Close()
+}
+
+// Dialer is a socks5.Dialer opening streams of QUIC connections, one
+// connection per address, reconnected when it closes. Its zero value is
+// usable and verifies the server with the system roots.
+type Dialer struct {
+	// TLSConfig configures the TLS of connections. ServerName defaults
+	// to the host dialed, and NextProtos to NextProto.
+	TLSConfig *tls.Config
+
+	// Config configures the QUIC connections, such as their keep-alive.
+	Config *quic.Config
+
+	mu    sync.Mutex
+	conns map[string]*quic.Conn
+	dials map[string]*dial
+}
+
+var _ socks5.Dialer = (*Dialer)(nil)
+
+// DialContext open a stream of the connection to address.
+func (d *Dialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	switch network {
+	case "tcp", "tcp4", "tcp6", "udp", "udp4", "udp6":
+	default:
+		return nil, errors.New("quictransport: unsupported network " + network)
+	}
+	conn, err := d.conn(ctx, address)
+	if err != nil {
+		return nil, err
+	}
+	stream, err := conn.OpenStreamSync(ctx)
+	if err != nil && conn.Context().Err() != nil {
+		// the connection closed since it was last used, dial it again.
+		d.forget(address, conn)
+		if conn, err = d.conn(ctx, address); err != nil {
+			return nil, err
+		}
+		stream, err = conn.OpenStreamSync(ctx)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &streamConn{stream, conn}, nil
+}
+
+// conn return the connection to address, dialing it if needed. Concurrent
+// calls share the dial of an address, and dials of other addresses do not
+// wait for it.
+func (d *Dialer) conn(ctx context.Context, address string) (*quic.Conn, error) {
+	d.mu.Lock()
+	if conn, ok := d.conns[address]; ok && conn.Context().Err() == nil {
+		d.mu.Unlock()
+		return conn, nil
+	}
+	if dl, ok := d.dials[address]; ok {
+		d.mu.Unlock()
+		select {
+		case <-dl.done:
+			return dl.conn, dl.err
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	dl := &dial{done: make(chan struct{})}
+	if d.dials == nil {
+		d.dials = make(map[string]*dial)
+	}
+	d.dials[address] = dl
+	d.mu.Unlock()
+
+	dl.conn, dl.err = d.dial(ctx, address)
+	d.mu.Lock()
+	delete(d.dials, address)
+	if dl.err == nil {
+		if d.conns == nil {
+			d.conns = make(map[string]*quic.Conn)
+		}
+		d.conns[address] = dl.conn
+	}
+	d.mu.Unlock()
+	close(dl.done)
+	return dl.conn, dl.err
+}
+
+// dial is a dial in progress, done closed when conn and err are set.
+type dial struct {
+	done chan struct{}
+	conn *quic.Conn
+	err  error
+}
+
+// dial dial a new connection to address.
+func (d *Dialer) dial(ctx context.Context, address string) (*quic.Conn, error) {
+	config := withNextProto(d.TLSConfig)
+	if config.ServerName == "" {
+		host, _, err := net.SplitHostPort(address)
+		if err != nil {
+			return nil, err
+		}
+		config.ServerName = host
+	}
+	return quic.DialAddr(ctx, address, config, d.Config)
+}
+
+func (d *Dialer) forget(address string, conn *quic.Conn) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.conns[address] == conn {
+		delete(d.conns, address)
+	}
+}
+
+// Close close the connections of the dialer.
+func (d *Dialer) Close() error {
+	d.mu.Lock()
+	conns := d.conns
+	d.conns = nil
+	d.mu.Unlock()
+	for _, conn := range conns {
+		conn.CloseWithError(0, "")
+	}
+	return nil
+}
+
+// withNextProto return a copy of config, NextProtos defaulting to
+// NextProto.
+func withNextProto(config *tls.Config) *tls.Config {
+	if config == nil {
+		config = &tls.Config{}
+	} else {
+		config = config.Clone()
+	}
+	if len(config.NextProtos) == 0 {
+		config.NextProtos = []string{NextProto}
+	}
+	return config
+}
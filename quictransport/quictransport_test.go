@@ -0,0 +1,120 @@
+package quictransport
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"net"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/haochen233/socks5"
+)
+
+func echoServer(t *testing.T) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+// quicServer serve srv over QUIC and return the listener and the roots
+// verifying it.
+func quicServer(t *testing.T, srv *socks5.Server) (*Listener, *x509.CertPool) {
+	ts := httptest.NewUnstartedServer(nil)
+	ts.StartTLS()
+	cert := ts.TLS.Certificates[0]
+	roots := x509.NewCertPool()
+	roots.AddCert(ts.Certificate())
+	ts.Close()
+
+	ln, err := Listen("127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.Serve(ln)
+	t.Cleanup(func() { ln.Close() })
+	return ln, roots
+}
+
+func TestQUIC(t *testing.T) {
+	ln, roots := quicServer(t, &socks5.Server{})
+	dialer := &Dialer{TLSConfig: &tls.Config{ServerName: "example.com", RootCAs: roots}}
+	defer dialer.Close()
+	client := &socks5.Client{ProxyAddr: ln.Addr().String(), Dialer: dialer}
+	echo := echoServer(t)
+	for _, msg := range []string{"ping", "pong"} {
+		conn, err := client.Dial("tcp", echo)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.Write([]byte(msg))
+		b := make([]byte, len(msg))
+		if _, err := io.ReadFull(conn, b); err != nil || string(b) != msg {
+			t.Errorf("echo %q, %v", b, err)
+		}
+		conn.Close()
+	}
+	dialer.mu.Lock()
+	if len(dialer.conns) != 1 {
+		t.Errorf("%d connections, want the streams of one", len(dialer.conns))
+	}
+	dialer.mu.Unlock()
+}
+
+func TestDialer_SlowAddress(t *testing.T) {
+	ln, roots := quicServer(t, &socks5.Server{})
+	silent, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer silent.Close()
+
+	dialer := &Dialer{TLSConfig: &tls.Config{ServerName: "example.com", RootCAs: roots}}
+	defer dialer.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	slow := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			_, err := dialer.DialContext(ctx, "tcp", silent.LocalAddr().String())
+			slow <- err
+		}()
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	fast, cancelFast := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFast()
+	conn, err := dialer.DialContext(fast, "tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("dial waited for another address: %v", err)
+	}
+	conn.Close()
+	select {
+	case err := <-slow:
+		t.Fatalf("dial of the silent address returned %v", err)
+	default:
+	}
+	cancel()
+	for i := 0; i < 2; i++ {
+		if err := <-slow; err == nil {
+			t.Error("dial of the silent address succeeded")
+		}
+	}
+}
@@ -0,0 +1,331 @@
+package socks5
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+)
+
+// Bandwidth is a rate in bytes per second for each direction, up from
+// clients to destinations and down. Zero is unlimited.
+type Bandwidth struct {
+	Up   int64
+	Down int64
+}
+
+// RateLimiter shapes the traffic relayed by CONNECT and BIND sessions
+// with token buckets: one shared by all sessions, one per client IP and
+// one per authenticated user, for each direction independently. Set
+// Server.RateLimit to it. Its limits may be set at any time and apply to
+// active sessions. Several servers may share a RateLimiter.
+//
+// The buckets of a rate hold one second of traffic, so a session may
+// burst that much before it is shaped.
+type RateLimiter struct {
+	mu      sync.Mutex
+	global  Bandwidth
+	perIP   Bandwidth
+	perUser Bandwidth
+	// users are the overrides of perUser
+	users map[string]Bandwidth
+
+	globalBuckets *sharedBuckets
+	ips           map[string]*sharedBuckets
+	userBuckets   map[string]*sharedBuckets
+}
+
+// sharedBuckets are the buckets of both directions of a key, shared by
+// refs sessions.
+type sharedBuckets struct {
+	refs     int
+	up, down tokenBucket
+}
+
+func (b *sharedBuckets) set(bw Bandwidth) {
+	b.up.setRate(bw.Up)
+	b.down.setRate(bw.Down)
+}
+
+// SetGlobal set the bandwidth of all sessions together.
+func (r *RateLimiter) SetGlobal(bw Bandwidth) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.global = bw
+	if r.globalBuckets != nil {
+		r.globalBuckets.set(bw)
+	}
+}
+
+// SetPerIP set the bandwidth of the sessions of each client IP.
+func (r *RateLimiter) SetPerIP(bw Bandwidth) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.perIP = bw
+	for _, b := range r.ips {
+		b.set(bw)
+	}
+}
+
+// SetPerUser set the bandwidth of the sessions of each authenticated
+// user without a bandwidth of its own.
+func (r *RateLimiter) SetPerUser(bw Bandwidth) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.perUser = bw
+	for username, b := range r.userBuckets {
+		if _, ok := r.users[username]; !ok {
+			b.set(bw)
+		}
+	}
+}
+
+// SetUser set the bandwidth of the sessions of username, overriding the
+// one set by SetPerUser.
+func (r *RateLimiter) SetUser(username string, bw Bandwidth) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.users == nil {
+		r.users = make(map[string]Bandwidth)
+	}
+	r.users[username] = bw
+	if b, ok := r.userBuckets[username]; ok {
+		b.set(bw)
+	}
+}
+
+// DelUser delete the bandwidth of username, its sessions are limited by
+// the one set by SetPerUser again.
+func (r *RateLimiter) DelUser(username string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.users, username)
+	if b, ok := r.userBuckets[username]; ok {
+		b.set(r.perUser)
+	}
+}
+
+// acquire return the buckets limiting s, until release is called.
+func (r *RateLimiter) acquire(s *Session) (buckets []*sharedBuckets, release func()) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.globalBuckets == nil {
+		r.globalBuckets = newSharedBuckets(r.global)
+	}
+	buckets = append(buckets, r.globalBuckets)
+
+	var ip string
+	if clientIP := s.ClientIP(); clientIP != nil {
+		ip = clientIP.String()
+		if r.ips == nil {
+			r.ips = make(map[string]*sharedBuckets)
+		}
+		buckets = append(buckets, refBuckets(r.ips, ip, r.perIP))
+	}
+	username := s.Username
+	if username != "" {
+		if r.userBuckets == nil {
+			r.userBuckets = make(map[string]*sharedBuckets)
+		}
+		bw, ok := r.users[username]
+		if !ok {
+			bw = r.perUser
+		}
+		buckets = append(buckets, refBuckets(r.userBuckets, username, bw))
+	}
+	return buckets, func() {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		if ip != "" {
+			unrefBuckets(r.ips, ip)
+		}
+		if username != "" {
+			unrefBuckets(r.userBuckets, username)
+		}
+	}
+}
+
+func newSharedBuckets(bw Bandwidth) *sharedBuckets {
+	b := &sharedBuckets{}
+	b.set(bw)
+	return b
+}
+
+// refBuckets return the buckets of key in m, created with bw if missing.
+func refBuckets(m map[string]*sharedBuckets, key string, bw Bandwidth) *sharedBuckets {
+	b, ok := m[key]
+	if !ok {
+		b = newSharedBuckets(bw)
+		m[key] = b
+	}
+	b.refs++
+	return b
+}
+
+// unrefBuckets release the buckets of key in m, deleted when unused.
+func unrefBuckets(m map[string]*sharedBuckets, key string) {
+	if b := m[key]; b != nil {
+		b.refs--
+		if b.refs == 0 {
+			delete(m, key)
+		}
+	}
+}
+
+// tokenBucket holds up to one second of tokens at rate, in bytes.
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+// setRate change the rate of b, zero for unlimited.
+func (b *tokenBucket) setRate(rate int64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.last.IsZero() {
+		b.tokens = float64(rate)
+	}
+	b.refill(time.Now())
+	b.rate = float64(rate)
+	if b.tokens > b.rate {
+		b.tokens = b.rate
+	}
+}
+
+func (b *tokenBucket) refill(now time.Time) {
+	if !b.last.IsZero() {
+		b.tokens += b.rate * now.Sub(b.last).Seconds()
+		if b.tokens > b.rate {
+			b.tokens = b.rate
+		}
+	}
+	b.last = now
+}
+
+// burst return the tokens b holds when full, zero if unlimited.
+func (b *tokenBucket) burst() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return int(b.rate)
+}
+
+// take n tokens and return the time to wait until they are available.
+func (b *tokenBucket) take(n int) time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.rate <= 0 {
+		return 0
+	}
+	b.refill(time.Now())
+	b.tokens -= float64(n)
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// minRateRead is the least a rate limited read may read, so that very
+// low rates are still shaped by waits rather than by tiny reads.
+const minRateRead = 512
+
+// rateConn shapes the bytes read from its conn by buckets. shaped is
+// called the first time a read waits, with the bytes over the rate and
+// the rate of the bucket waited for. soft only measures the reads, warn
+// is called the first time they go over its rate.
+type rateConn struct {
+	net.Conn
+	ctx     context.Context
+	buckets []*tokenBucket
+	shaped  func(over, rate int64)
+	soft    *tokenBucket
+	warn    func(over, rate int64)
+}
+
+func (c *rateConn) Read(b []byte) (int, error) {
+	// read at most the smallest burst, so the wait is at most a second.
+	for _, bucket := range c.buckets {
+		if burst := bucket.burst(); burst > 0 {
+			if burst < minRateRead {
+				burst = minRateRead
+			}
+			if len(b) > burst {
+				b = b[:burst]
+			}
+		}
+	}
+	n, err := c.Conn.Read(b)
+	if n > 0 && c.warn != nil {
+		if wait := c.soft.take(n); wait > 0 {
+			rate := int64(c.soft.burst())
+			c.warn(int64(wait.Seconds()*float64(rate)), rate)
+			c.warn = nil
+		}
+	}
+	if n > 0 {
+		var wait time.Duration
+		var limiting *tokenBucket
+		for _, bucket := range c.buckets {
+			if d := bucket.take(n); d > wait {
+				wait, limiting = d, bucket
+			}
+		}
+		if wait > 0 && c.shaped != nil {
+			rate := int64(limiting.burst())
+			c.shaped(int64(wait.Seconds()*float64(rate)), rate)
+			c.shaped = nil
+		}
+		if wait > 0 {
+			t := time.NewTimer(wait)
+			select {
+			case <-t.C:
+			case <-c.ctx.Done():
+				t.Stop()
+			}
+		}
+	}
+	return n, err
+}
+
+// CloseWrite half-close the shaped connection.
+func (c *rateConn) CloseWrite() error {
+	return closeWrite(c.Conn)
+}
+
+// limitRate wrap both legs of s to shape them by RateLimit if it is set,
+// and to warn of the soft bandwidth, until release is called.
+func (srv *Server) limitRate(s *Session, client, remote net.Conn) (net.Conn, net.Conn, func()) {
+	limiter, soft := srv.rateLimiter(), srv.SoftLimits.Bandwidth
+	if limiter == nil && soft.Up <= 0 && soft.Down <= 0 {
+		return client, remote, func() {}
+	}
+	var up, down []*tokenBucket
+	release := func() {}
+	if limiter != nil {
+		var shared []*sharedBuckets
+		shared, release = limiter.acquire(s)
+		up = make([]*tokenBucket, len(shared))
+		down = make([]*tokenBucket, len(shared))
+		for i, b := range shared {
+			up[i], down[i] = &b.up, &b.down
+		}
+	}
+	shaped := func(over, rate int64) {
+		srv.onLimit(LimitEvent{LimitBandwidth, true, s, over, rate})
+	}
+	warn := func(over, rate int64) {
+		srv.onLimit(LimitEvent{LimitBandwidth, false, s, over, rate})
+	}
+	clientLeg := &rateConn{Conn: client, ctx: s.Context(), buckets: up, shaped: shaped}
+	remoteLeg := &rateConn{Conn: remote, ctx: s.Context(), buckets: down, shaped: shaped}
+	if soft.Up > 0 {
+		clientLeg.soft, clientLeg.warn = &tokenBucket{}, warn
+		clientLeg.soft.setRate(soft.Up)
+	}
+	if soft.Down > 0 {
+		remoteLeg.soft, remoteLeg.warn = &tokenBucket{}, warn
+		remoteLeg.soft.setRate(soft.Down)
+	}
+	return clientLeg, remoteLeg, release
+}
@@ -0,0 +1,105 @@
+package socks5
+
+import (
+	"crypto/sha256"
+	"io"
+	"testing"
+	"time"
+)
+
+func TestTokenBucket(t *testing.T) {
+	b := &tokenBucket{}
+	b.setRate(1000)
+	if d := b.take(1000); d != 0 {
+		t.Errorf("burst waits %v", d)
+	}
+	if d := b.take(500); d < 400*time.Millisecond || d > 500*time.Millisecond {
+		t.Errorf("wait %v, want about 500ms", d)
+	}
+	b.setRate(0)
+	if d := b.take(1 << 20); d != 0 {
+		t.Errorf("unlimited waits %v", d)
+	}
+}
+
+// relayTest relay n bytes through client to an echo server and return
+// the time it took.
+func relayTest(t *testing.T, client *Client, echo string, n int) time.Duration {
+	conn, err := client.Dial("tcp", echo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	start := time.Now()
+	go conn.Write(make([]byte, n))
+	if _, err := io.ReadFull(conn, make([]byte, n)); err != nil {
+		t.Fatal(err)
+	}
+	return time.Since(start)
+}
+
+func TestServer_RateLimit(t *testing.T) {
+	const rate = 64 << 10
+	store := NewMemeryStore(sha256.New(), "")
+	store.Set("alice", "a")
+	store.Set("bob", "b")
+	limiter := &RateLimiter{}
+	limiter.SetPerUser(Bandwidth{Down: rate})
+	events := make(chan LimitEvent, 10)
+	srv := &Server{
+		Authenticators: map[METHOD]Authenticator{USERNAME_PASSWORD: UserPwdAuth{store}},
+		RateLimit:      limiter,
+		Hooks:          Hooks{OnLimit: func(e LimitEvent) { events <- e }},
+	}
+	addr := serveTest(t, srv)
+	echo := echoTest(t)
+
+	// one second of burst, then one second shaped.
+	alice := &Client{ProxyAddr: addr, Username: "alice", Password: "a"}
+	if d := relayTest(t, alice, echo, 2*rate); d < 800*time.Millisecond {
+		t.Errorf("limited relay took %v", d)
+	}
+	if e := <-events; e.Kind != LimitBandwidth || !e.Hard || e.Value <= 0 || e.Threshold != rate {
+		t.Errorf("bandwidth event %+v", e)
+	}
+
+	limiter.SetUser("bob", Bandwidth{})
+	bob := &Client{ProxyAddr: addr, Username: "bob", Password: "b"}
+	if d := relayTest(t, bob, echo, 4*rate); d > 800*time.Millisecond {
+		t.Errorf("unlimited relay took %v", d)
+	}
+
+	limiter.SetGlobal(Bandwidth{Up: rate})
+	if d := relayTest(t, bob, echo, 2*rate); d < 800*time.Millisecond {
+		t.Errorf("globally limited relay took %v", d)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		limiter.mu.Lock()
+		users, ips := len(limiter.userBuckets), len(limiter.ips)
+		limiter.mu.Unlock()
+		if users == 0 && ips == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("buckets of closed sessions kept: %d users, %d ips", users, ips)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestServer_SoftBandwidth(t *testing.T) {
+	const rate = 64 << 10
+	events := make(chan LimitEvent, 10)
+	srv := &Server{
+		SoftLimits: SoftLimits{Bandwidth: Bandwidth{Down: rate}},
+		Hooks:      Hooks{OnLimit: func(e LimitEvent) { events <- e }},
+	}
+	client := &Client{ProxyAddr: serveTest(t, srv)}
+	if d := relayTest(t, client, echoTest(t), 4*rate); d > 800*time.Millisecond {
+		t.Errorf("relay over the soft bandwidth took %v", d)
+	}
+	if e := limitEventTest(t, events, LimitBandwidth); e.Hard || e.Value <= 0 || e.Threshold != rate {
+		t.Errorf("bandwidth event %+v", e)
+	}
+}
@@ -0,0 +1,125 @@
+// Package redisstore implements a socks5.UserPwdStore keeping password
+// hashes in Redis, so that several servers behind a load balancer share
+// their users. It is built on github.com/redis/go-redis, and is a module
+// of its own so that the socks5 package keeps no dependencies.
+//
+//	client := redis.NewClient(&redis.Options{Addr: "127.0.0.1:6379"})
+//	store := redisstore.New(client, passhash.Argon2id{})
+//	srv := &socks5.Server{Authenticators: map[socks5.METHOD]socks5.Authenticator{
+//		socks5.USERNAME_PASSWORD: socks5.UserPwdAuth{UserPwdStore: store},
+//	}}
+package redisstore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/haochen233/socks5"
+	"github.com/redis/go-redis/v9"
+)
+
+var _ socks5.ContextUserPwdStore = (*Store)(nil)
+
+// errNoHasher is returned by stores without Hasher.
+var errNoHasher = errors.New("redisstore: no password hasher")
+
+// Store is a socks5.ContextUserPwdStore keeping password hashes in Redis.
+// The hash of the password of user is the string value of the key
+// Prefix+user.
+type Store struct {
+	// Client is the Redis client, such as a *redis.Client, or a
+	// *redis.ClusterClient for Redis Cluster. Its options set the
+	// address, authentication, database, TLS and connection pool.
+	Client redis.UniversalClient
+
+	// Prefix is prepended to user names to make keys. Empty means
+	// "socks5:user:".
+	Prefix string
+
+	// Hasher hashes and compares the passwords, such as passhash.Scrypt.
+	// It must be set.
+	Hasher socks5.PasswordHasher
+}
+
+// New return a Store of the users in client, hashed with hasher.
+func New(client redis.UniversalClient, hasher socks5.PasswordHasher) *Store {
+	return &Store{Client: client, Hasher: hasher}
+}
+
+func (s *Store) prefix() string {
+	if s.Prefix == "" {
+		return "socks5:user:"
+	}
+	return s.Prefix
+}
+
+func (s *Store) hash(password string) (string, error) {
+	if s.Hasher == nil {
+		return "", errNoHasher
+	}
+	return s.Hasher.Hash(password)
+}
+
+// Set the password of username.
+func (s *Store) Set(username string, password string) error {
+	hashed, err := s.hash(password)
+	if err != nil {
+		return err
+	}
+	return s.Client.Set(context.Background(), s.prefix()+username, hashed, 0).Err()
+}
+
+// Load set the passwords of users at once with MSET, such as to import
+// an existing store.
+func (s *Store) Load(users map[string]string) error {
+	if len(users) == 0 {
+		return nil
+	}
+	pairs := make([]interface{}, 0, 2*len(users))
+	for username, password := range users {
+		hashed, err := s.hash(password)
+		if err != nil {
+			return err
+		}
+		pairs = append(pairs, s.prefix()+username, hashed)
+	}
+	return s.Client.MSet(context.Background(), pairs...).Err()
+}
+
+// Del delete by username.
+func (s *Store) Del(username string) error {
+	n, err := s.Client.Del(context.Background(), s.prefix()+username).Result()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return socks5.NewUserNotExist(username)
+	}
+	return nil
+}
+
+// Validate validate username and password.
+func (s *Store) Validate(username string, password string) error {
+	return s.ValidateContext(context.Background(), username, password)
+}
+
+// ValidateContext validate username and password, the query to Redis is
+// abandoned when ctx is done.
+func (s *Store) ValidateContext(ctx context.Context, username string, password string) error {
+	hashed, err := s.Client.Get(ctx, s.prefix()+username).Result()
+	if err == redis.Nil {
+		return socks5.NewUserNotExist(username)
+	}
+	if err != nil {
+		return err
+	}
+	if s.Hasher == nil {
+		return errNoHasher
+	}
+	err = s.Hasher.Compare(hashed, password)
+	if err == socks5.ErrPasswordMismatch {
+		return fmt.Errorf("user %s has bad password", username)
+	}
+	return err
+}
@@ -0,0 +1,74 @@
+package redisstore
+
+import (
+	"context"
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/haochen233/socks5"
+	"github.com/redis/go-redis/v9"
+)
+
+func TestStore(t *testing.T) {
+	mr := miniredis.RunT(t)
+	mr.RequireAuth("redispass")
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr(), Password: "redispass", DB: 1})
+	defer client.Close()
+	store := New(client, socks5.HMACHasher{Key: []byte("secret")})
+	store.Prefix = "proxy:"
+
+	if err := store.Set("admin", "123456"); err != nil {
+		t.Fatal(err)
+	}
+	mr.Select(1)
+	if !mr.Exists("proxy:admin") {
+		t.Errorf("keys %v", mr.Keys())
+	}
+	unprefixed := New(client, store.Hasher)
+	if _, ok := unprefixed.Validate("admin", "123456").(socks5.UserNotExist); !ok {
+		t.Error("key not prefixed")
+	}
+	if err := store.Load(map[string]string{"alice": "a", "bob": "b"}); err != nil {
+		t.Fatal(err)
+	}
+	for user, password := range map[string]string{"admin": "123456", "alice": "a", "bob": "b"} {
+		if err := store.ValidateContext(context.Background(), user, password); err != nil {
+			t.Errorf("%s: %v", user, err)
+		}
+	}
+	if err := store.Validate("admin", "a"); err == nil {
+		t.Error("wrong password validated")
+	}
+	if err := store.Del("alice"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := store.Del("alice").(socks5.UserNotExist); !ok {
+		t.Error("deleted user deleted again")
+	}
+	if _, ok := store.Validate("alice", "a").(socks5.UserNotExist); !ok {
+		t.Error("deleted user validated")
+	}
+
+	wrong := redis.NewClient(&redis.Options{Addr: mr.Addr(), Password: "wrong"})
+	defer wrong.Close()
+	if err := New(wrong, store.Hasher).Validate("admin", "123456"); err == nil {
+		t.Error("wrong Redis password accepted")
+	}
+	if err := New(client, nil).Set("carol", "c"); err == nil {
+		t.Error("set without hasher")
+	}
+}
+
+func TestStore_Context(t *testing.T) {
+	mr := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	defer client.Close()
+	store := New(client, socks5.HMACHasher{Key: []byte("secret")})
+	store.Set("admin", "123456")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := store.ValidateContext(ctx, "admin", "123456"); err == nil {
+		t.Error("validated with a cancelled context")
+	}
+}
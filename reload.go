@@ -0,0 +1,136 @@
+package socks5
+
+import (
+	"os"
+	"os/signal"
+)
+
+// Config is the configuration Reload replaces while the server runs.
+// Each field overrides the Server field of the same name, or the store
+// of Username/Password authentication for Store, nil fields included:
+// a Config is the whole configuration, not a change of it.
+type Config struct {
+	// Rules decides which requests are served, nil allows all requests.
+	Rules RuleSet
+
+	// Store validates Username/Password credentials, as SetStore. If
+	// nil, the Authenticators of the server are used.
+	Store UserPwdStore
+
+	// RateLimit shapes the traffic of sessions, nil is unlimited.
+	RateLimit *RateLimiter
+
+	// Router selects the routes to destinations, such as upstream
+	// proxies, nil dials them directly.
+	Router Router
+
+	// Policy decides requests and their routes before Router, nil defers
+	// to Rules and Router.
+	Policy Policy
+}
+
+// swappedConfig is the configuration set while the server runs. rules
+// is set if Rules overrides Server.Rules, and all if every field
+// overrides the Server fields, since Reload was called.
+type swappedConfig struct {
+	Config
+	rules bool
+	all   bool
+}
+
+// Reload atomically replace the rules, credential store, rate limits and
+// routing of the server while it runs, such as after editing its
+// configuration file, without dropping sessions: requests read from then
+// on use cfg, sessions already relaying keep their settings, including
+// their rate limits and routes. Fields of cfg left nil clear the
+// settings of the server, such as its Router, a nil Store restores the
+// Authenticators: use SetRules and SetStore to change one setting only.
+func (srv *Server) Reload(cfg Config) {
+	srv.reload(func(c *swappedConfig) {
+		c.Config, c.rules, c.all = cfg, true, true
+	})
+}
+
+// ReloadOnSignal call Reload with the configuration returned by load each
+// time the process receives one of sigs, SIGHUP by default, until stop
+// is called. If load fails, the error is logged to ErrorLog and the
+// configuration is kept.
+//
+//	stop := srv.ReloadOnSignal(func() (socks5.Config, error) {
+//		return loadConfig("/etc/socks5.json")
+//	})
+//	defer stop()
+func (srv *Server) ReloadOnSignal(load func() (Config, error), sigs ...os.Signal) (stop func()) {
+	if len(sigs) == 0 {
+		sigs = reloadSignals
+	}
+	if len(sigs) == 0 {
+		// Notify would relay all the signals.
+		return func() {}
+	}
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, sigs...)
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-ch:
+				cfg, err := load()
+				if err != nil {
+					srv.logf()("socks5: reload: %v", err)
+					continue
+				}
+				srv.Reload(cfg)
+			case <-done:
+				return
+			}
+		}
+	}()
+	return func() {
+		signal.Stop(ch)
+		close(done)
+	}
+}
+
+// reload replace the swapped configuration by a copy changed by set.
+func (srv *Server) reload(set func(c *swappedConfig)) {
+	srv.reloadMu.Lock()
+	defer srv.reloadMu.Unlock()
+	c := &swappedConfig{}
+	if old := srv.swapped(); old != nil {
+		*c = *old
+	}
+	set(c)
+	srv.reloaded.Store(c)
+}
+
+// swapped return the configuration set while the server runs, nil if
+// none.
+func (srv *Server) swapped() *swappedConfig {
+	c, _ := srv.reloaded.Load().(*swappedConfig)
+	return c
+}
+
+// rateLimiter return the current RateLimiter of the server.
+func (srv *Server) rateLimiter() *RateLimiter {
+	if c := srv.swapped(); c != nil && c.all {
+		return c.RateLimit
+	}
+	return srv.RateLimit
+}
+
+// router return the current Router of the server.
+func (srv *Server) router() Router {
+	if c := srv.swapped(); c != nil && c.all {
+		return c.Router
+	}
+	return srv.Router
+}
+
+// policy return the current Policy of the server.
+func (srv *Server) policy() Policy {
+	if c := srv.swapped(); c != nil && c.all {
+		return c.Policy
+	}
+	return srv.Policy
+}
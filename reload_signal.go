@@ -0,0 +1,12 @@
+//go:build !windows
+// +build !windows
+
+package socks5
+
+import (
+	"os"
+	"syscall"
+)
+
+// reloadSignals are the default signals of ReloadOnSignal.
+var reloadSignals = []os.Signal{syscall.SIGHUP}
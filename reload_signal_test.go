@@ -0,0 +1,48 @@
+//go:build !windows
+// +build !windows
+
+package socks5
+
+import (
+	"errors"
+	"io"
+	"log"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestServer_ReloadOnSignal(t *testing.T) {
+	srv := &Server{ErrorLog: log.New(io.Discard, "", 0)}
+	loaded := make(chan struct{}, 2)
+	fail := true
+	stop := srv.ReloadOnSignal(func() (Config, error) {
+		defer func() { loaded <- struct{}{} }()
+		if fail {
+			fail = false
+			return Config{}, errors.New("invalid configuration")
+		}
+		return Config{Rules: RuleSetFunc(func(s *Session, req *Request) bool { return false })}, nil
+	}, syscall.SIGUSR1)
+	defer stop()
+
+	for i := 0; i < 2; i++ {
+		syscall.Kill(syscall.Getpid(), syscall.SIGUSR1)
+		select {
+		case <-loaded:
+		case <-time.After(5 * time.Second):
+			t.Fatal("configuration not loaded on signal")
+		}
+		if i == 0 && srv.swapped() != nil {
+			t.Error("failed load reloaded the server")
+		}
+	}
+	// Reload follows load.
+	deadline := time.Now().Add(5 * time.Second)
+	for srv.swapped() == nil && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if rules := srv.ruleSet(); rules == nil || rules.Allow(&Session{}, &Request{}) {
+		t.Error("rules not reloaded")
+	}
+}
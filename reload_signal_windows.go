@@ -0,0 +1,7 @@
+package socks5
+
+import "os"
+
+// reloadSignals are the default signals of ReloadOnSignal. The platform
+// has no SIGHUP, pass the signals to ReloadOnSignal.
+var reloadSignals []os.Signal
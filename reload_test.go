@@ -0,0 +1,79 @@
+package socks5
+
+import (
+	"io"
+	"log"
+	"testing"
+	"time"
+)
+
+func TestServer_Reload(t *testing.T) {
+	srv := &Server{ErrorLog: log.New(io.Discard, "", 0)}
+	addr := serveTest(t, srv)
+	echo := echoTest(t)
+	client := &Client{ProxyAddr: addr}
+	conn, err := client.Dial("tcp", echo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	routed := make(chan string, 1)
+	srv.Reload(Config{
+		Rules: RuleSetFunc(func(s *Session, req *Request) bool { return req.Address.Port != 1 }),
+		Router: RouterFunc(func(s *Session, dest *Address) []Route {
+			routed <- dest.String()
+			return []Route{{Name: "upstream", Dialer: failDialer{}}}
+		}),
+	})
+	if _, err := client.Dial("tcp", "127.0.0.1:1"); err == nil {
+		t.Error("request allowed by the reloaded rules")
+	}
+	if _, err := client.Dial("tcp", echo); err == nil {
+		t.Error("request not routed by the reloaded router")
+	}
+	if dest := <-routed; dest != echo {
+		t.Errorf("routed %s, want %s", dest, echo)
+	}
+
+	// the session relaying before the reload keeps its route.
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	conn.Write([]byte("ping"))
+	if b, err := ReadNBytes(conn, 4); err != nil || string(b) != "ping" {
+		t.Errorf("echo: %q, %v", b, err)
+	}
+
+	// SetRules keeps the rest of the reloaded configuration.
+	srv.SetRules(nil)
+	if _, err := client.Dial("tcp", "127.0.0.1:1"); err == nil {
+		t.Error("request not routed by the reloaded router after SetRules")
+	}
+	<-routed
+
+	srv.Reload(Config{})
+	conn2, err := client.Dial("tcp", echo)
+	if err != nil {
+		t.Fatalf("dial after reload: %v", err)
+	}
+	conn2.Close()
+}
+
+func TestServer_ReloadPartial(t *testing.T) {
+	srv := &Server{
+		Router:   RouterFunc(func(s *Session, dest *Address) []Route { return []Route{{Name: "upstream", Dialer: failDialer{}}} }),
+		ErrorLog: log.New(io.Discard, "", 0),
+	}
+	client := &Client{ProxyAddr: serveTest(t, srv)}
+	echo := echoTest(t)
+	if _, err := client.Dial("tcp", echo); err == nil {
+		t.Fatal("request not routed by Router")
+	}
+
+	// the Router left nil by the Config is cleared.
+	srv.Reload(Config{Rules: RuleSetFunc(func(s *Session, req *Request) bool { return true })})
+	conn, err := client.Dial("tcp", echo)
+	if err != nil {
+		t.Fatalf("dial after partial reload: %v", err)
+	}
+	conn.Close()
+}
@@ -0,0 +1,74 @@
+package socks5
+
+import (
+	"context"
+	"io"
+	"net"
+	"time"
+)
+
+// Replay send the client bytes of t to conn, a connection to a socks
+// server, to reproduce a recorded negotiation. Before each client event,
+// it waits for as many server bytes as were recorded before it, so the
+// server sees the same sequence of reads. It returns the trace of the
+// replayed negotiation, which can be decoded and compared with t; the
+// trace is returned even when the server closed the connection early.
+//
+// To replay against a Server in process, serve a loopback listener: with
+// the synchronous net.Pipe, the replay blocks if the server does not read
+// all the bytes a client event carries.
+func Replay(ctx context.Context, conn net.Conn, t *Trace) (*Trace, error) {
+	replayed := &Trace{SessionID: t.SessionID, Start: time.Now()}
+	if addr := conn.LocalAddr(); addr != nil {
+		replayed.Client = addr.String()
+	}
+	stop := interruptOnDone(ctx, conn)
+
+	err := replay(conn, t, replayed)
+	if ctxErr := stop(); ctxErr != nil {
+		err = ctxErr
+	}
+	if err == io.EOF {
+		err = nil
+	}
+	return replayed, err
+}
+
+func replay(conn net.Conn, t, replayed *Trace) error {
+	record := func(dir TraceDir, b []byte) {
+		replayed.Events = append(replayed.Events, TraceEvent{time.Since(replayed.Start), dir, b})
+	}
+	// read the server bytes recorded before the next client event.
+	pending := 0
+	read := func() error {
+		for pending > 0 {
+			b := make([]byte, pending)
+			n, err := conn.Read(b)
+			if n > 0 {
+				record(TraceServer, b[:n])
+				pending -= n
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	for _, e := range t.Events {
+		if e.Dir == TraceServer {
+			pending += len(e.Data)
+			continue
+		}
+		err := read()
+		if err != nil {
+			return err
+		}
+		_, err = conn.Write(e.Data)
+		if err != nil {
+			return err
+		}
+		record(TraceClient, e.Data)
+	}
+	return read()
+}
@@ -0,0 +1,74 @@
+package socks5
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReplay(t *testing.T) {
+	trace, err := ReadTrace(strings.NewReader(`# session 7 client 10.0.0.1:4000 start 2026-01-02T15:04:05Z
+1ms C 05
+1ms C 0100
+2ms S 0500
+3ms C 050100020000
+4ms S 05080001000000000000
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client, err := net.Dial("tcp", serveTest(t, &Server{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	replayed, err := Replay(ctx, client, trace)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stream := func(t *Trace, dir TraceDir) []byte {
+		var b []byte
+		for _, e := range t.Events {
+			if e.Dir == dir {
+				b = append(b, e.Data...)
+			}
+		}
+		return b
+	}
+	if !bytes.Equal(stream(replayed, TraceClient), stream(trace, TraceClient)) {
+		t.Errorf("client: replayed %x, recorded %x", stream(replayed, TraceClient), stream(trace, TraceClient))
+	}
+	// BND.ADDR of the reply differs.
+	if server := stream(replayed, TraceServer); len(server) != 12 || !bytes.Equal(server[:5], []byte{5, 0, 5, 8, 0}) {
+		t.Errorf("server: replayed %x", server)
+	}
+	// the client bytes were sent after the method reply, as recorded.
+	if len(replayed.Events) != 5 || replayed.Events[2].Dir != TraceServer {
+		t.Errorf("events: %+v", replayed.Events)
+	}
+}
+
+func TestReplay_Cancel(t *testing.T) {
+	trace := &Trace{Events: []TraceEvent{
+		{Dir: TraceClient, Data: []byte{5, 1, 0}},
+		{Dir: TraceServer, Data: []byte{5, 0}},
+	}}
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	go server.Read(make([]byte, 3))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err := Replay(ctx, client, trace)
+	if err != context.DeadlineExceeded {
+		t.Errorf("replay of a silent server: %v", err)
+	}
+}
@@ -1,5 +1,7 @@
 package socks5
 
+import "io"
+
 // Reply a reply formed as follows:
 //    +----+-----+-------+------+----------+----------+
 //    |VER | REP |  RSV  | ATYP | BND.ADDR | BND.PORT |
@@ -12,3 +14,35 @@ type Reply struct {
 	RSV uint8
 	*Address
 }
+
+// WriteReply write the socks4 or socks5 reply r to out, according to r.VER.
+// The socks4 reply address must be IPv4.
+func WriteReply(out io.Writer, r *Reply) error {
+	var reply []byte
+	var err error
+
+	if r.VER == Version4 {
+		if r.Address.ATYPE != IPV4_ADDRESS {
+			return errErrorATPE
+		}
+		addr, err := r.Address.Bytes(r.VER)
+		if err != nil {
+			return err
+		}
+		reply = append(reply, 0, r.REP)
+		// Remove NULL at the end. Please see Address.Bytes() Method.
+		reply = append(reply, addr[:len(addr)-1]...)
+	} else if r.VER == Version5 {
+		addr, err := r.Address.Bytes(r.VER)
+		if err != nil {
+			return err
+		}
+		reply = append(reply, r.VER, r.REP, r.RSV)
+		reply = append(reply, addr...)
+	} else {
+		return &VersionError{r.VER}
+	}
+
+	_, err = out.Write(reply)
+	return err
+}
@@ -0,0 +1,186 @@
+package socks5
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+)
+
+// NameResolver resolves the domain name destinations of client requests.
+type NameResolver interface {
+	// Resolve return the IP addresses of fqdn. Failures should be
+	// reported as *net.DNSError so the server replies the proper code.
+	// ctx carries the Session being served, see SessionFromContext.
+	Resolve(ctx context.Context, fqdn string) ([]net.IP, error)
+}
+
+// NameResolverFunc is an adapter to allow the use of ordinary functions
+// as NameResolver.
+type NameResolverFunc func(ctx context.Context, fqdn string) ([]net.IP, error)
+
+// Resolve calls f(ctx, fqdn).
+func (f NameResolverFunc) Resolve(ctx context.Context, fqdn string) ([]net.IP, error) {
+	return f(ctx, fqdn)
+}
+
+// NetResolver adapts r to NameResolver, such as a net.Resolver querying
+// a given DNS server through its Dial function.
+func NetResolver(r *net.Resolver) NameResolver {
+	return netResolver{r}
+}
+
+// NewDoTResolver return a NameResolver querying the DNS over TLS server
+// at addr, such as "1.1.1.1:853" (RFC 7858). config may be nil if the
+// certificate of the server is valid for the host of addr. It relies on
+// the pure Go resolver, which is not available on Windows before Go 1.19.
+func NewDoTResolver(addr string, config *tls.Config) NameResolver {
+	if config == nil {
+		host, _, _ := net.SplitHostPort(addr)
+		config = &tls.Config{ServerName: host}
+	}
+	return netResolver{&net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			// a stream connection makes the resolver frame the queries
+			// with their length, as DNS over TCP and TLS do.
+			d := &tls.Dialer{Config: config}
+			return d.DialContext(ctx, "tcp", addr)
+		},
+	}}
+}
+
+// BlocklistResolver fails the resolution of blocked domain names with
+// NXDOMAIN, so the server replies HOST_UNREACHABLE as for nonexistent
+// names, and resolves the other names with Next.
+type BlocklistResolver struct {
+	// Domains are the blocked domain names, "example.com",
+	// ".example.com" and "*.example.com" all block example.com itself
+	// and any name under it.
+	Domains []string
+
+	// Blocked reports whether fqdn is blocked, in addition to Domains,
+	// such as to query a blocklist service.
+	Blocked func(ctx context.Context, fqdn string) bool
+
+	// Next resolves names which are not blocked.
+	// If nil, net.DefaultResolver is used.
+	Next NameResolver
+}
+
+// Resolve fail with NXDOMAIN if fqdn is blocked, else resolve it with Next.
+func (b *BlocklistResolver) Resolve(ctx context.Context, fqdn string) ([]net.IP, error) {
+	if matchDomains(fqdn, b.Domains) || b.Blocked != nil && b.Blocked(ctx, fqdn) {
+		return nil, &net.DNSError{Err: "no such host", Name: fqdn, IsNotFound: true}
+	}
+	if b.Next == nil {
+		return netResolver{net.DefaultResolver}.Resolve(ctx, fqdn)
+	}
+	return b.Next.Resolve(ctx, fqdn)
+}
+
+// netResolver adapts net.Resolver to NameResolver.
+type netResolver struct {
+	*net.Resolver
+}
+
+func (r netResolver) Resolve(ctx context.Context, fqdn string) ([]net.IP, error) {
+	addrs, err := r.LookupIPAddr(ctx, fqdn)
+	if err != nil {
+		return nil, err
+	}
+	ips := make([]net.IP, 0, len(addrs))
+	for _, addr := range addrs {
+		ips = append(ips, addr.IP)
+	}
+	return ips, nil
+}
+
+// IdentityResolver selects the NameResolver by the identity of the client,
+// so clients resolving the same name can be steered to different backends
+// (split-horizon DNS). The resolver is chosen in the following order:
+// the authenticated user, the user's groups, the client's network,
+// and finally Default.
+type IdentityResolver struct {
+	// Users maps authenticated user names to resolvers.
+	Users map[string]NameResolver
+
+	// Groups maps group names to resolvers, GroupsOf report the groups
+	// of a user. Groups are tried in the order returned by GroupsOf.
+	Groups   map[string]NameResolver
+	GroupsOf func(username string) []string
+
+	// Networks maps client networks to resolvers, the first match wins.
+	Networks []NetworkResolver
+
+	// Default resolves for other clients.
+	// If nil, net.DefaultResolver is used.
+	Default NameResolver
+}
+
+// NetworkResolver is the resolver of clients in Net.
+type NetworkResolver struct {
+	Net      *net.IPNet
+	Resolver NameResolver
+}
+
+// Resolve fqdn with the resolver selected for the session in ctx.
+func (r *IdentityResolver) Resolve(ctx context.Context, fqdn string) ([]net.IP, error) {
+	return r.selectResolver(SessionFromContext(ctx)).Resolve(ctx, fqdn)
+}
+
+func (r *IdentityResolver) selectResolver(s *Session) NameResolver {
+	if s != nil {
+		if s.Username != "" {
+			if resolver, ok := r.Users[s.Username]; ok {
+				return resolver
+			}
+			if r.GroupsOf != nil {
+				for _, group := range r.GroupsOf(s.Username) {
+					if resolver, ok := r.Groups[group]; ok {
+						return resolver
+					}
+				}
+			}
+		}
+		if ip := s.ClientIP(); ip != nil {
+			for _, n := range r.Networks {
+				if n.Net.Contains(ip) {
+					return n.Resolver
+				}
+			}
+		}
+	}
+	if r.Default == nil {
+		return netResolver{net.DefaultResolver}
+	}
+	return r.Default
+}
+
+type sessionKey struct{}
+
+// SessionFromContext return the Session stored in ctx by the server,
+// or nil if there is none.
+func SessionFromContext(ctx context.Context) *Session {
+	s, _ := ctx.Value(sessionKey{}).(*Session)
+	return s
+}
+
+// ContextWithSession return a copy of ctx carrying s.
+func ContextWithSession(ctx context.Context, s *Session) context.Context {
+	return context.WithValue(ctx, sessionKey{}, s)
+}
+
+func (srv *Server) resolver() NameResolver {
+	if srv.Resolver == nil {
+		return netResolver{net.DefaultResolver}
+	}
+	return srv.Resolver
+}
+
+// resolve return the IP addresses of dest using r.
+func resolve(ctx context.Context, r NameResolver, dest *Address) ([]net.IP, error) {
+	if dest.ATYPE != DOMAINNAME {
+		return []net.IP{dest.Addr}, nil
+	}
+	return r.Resolve(ctx, string(dest.Addr))
+}
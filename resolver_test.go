@@ -0,0 +1,130 @@
+package socks5
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestIdentityResolver(t *testing.T) {
+	_, office, _ := net.ParseCIDR("10.1.0.0/16")
+	r := &IdentityResolver{
+		Users:    map[string]NameResolver{"alice": staticResolver{"wiki": {net.IPv4(10, 0, 0, 1)}}},
+		Groups:   map[string]NameResolver{"staff": staticResolver{"wiki": {net.IPv4(10, 0, 0, 2)}}},
+		GroupsOf: func(username string) []string { return []string{"staff"} },
+		Networks: []NetworkResolver{{office, staticResolver{"wiki": {net.IPv4(10, 0, 0, 3)}}}},
+		Default:  staticResolver{"wiki": {net.IPv4(10, 0, 0, 4)}},
+	}
+
+	tests := []struct {
+		session *Session
+		want    net.IP
+	}{
+		{&Session{Username: "alice", ClientAddr: &net.TCPAddr{IP: net.IPv4(10, 1, 0, 1)}}, net.IPv4(10, 0, 0, 1)},
+		{&Session{Username: "bob", ClientAddr: &net.TCPAddr{IP: net.IPv4(10, 1, 0, 1)}}, net.IPv4(10, 0, 0, 2)},
+		{&Session{ClientAddr: &net.TCPAddr{IP: net.IPv4(10, 1, 0, 1)}}, net.IPv4(10, 0, 0, 3)},
+		{&Session{ClientAddr: &net.TCPAddr{IP: net.IPv4(192, 168, 0, 1)}}, net.IPv4(10, 0, 0, 4)},
+	}
+	for i, test := range tests {
+		ips, err := r.Resolve(ContextWithSession(context.Background(), test.session), "wiki")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !ips[0].Equal(test.want) {
+			t.Errorf("case %d: got %s, want %s", i, ips[0], test.want)
+		}
+	}
+}
+
+func TestBlocklistResolver(t *testing.T) {
+	next := NameResolverFunc(func(ctx context.Context, fqdn string) ([]net.IP, error) {
+		return []net.IP{net.IPv4(127, 0, 0, 1)}, nil
+	})
+	r := &BlocklistResolver{
+		Domains: []string{"ads.example"},
+		Blocked: func(ctx context.Context, fqdn string) bool { return fqdn == "malware.test" },
+		Next:    next,
+	}
+	for fqdn, blocked := range map[string]bool{
+		"ads.example":     true,
+		"cdn.ads.example": true,
+		"malware.test":    true,
+		"example.com":     false,
+	} {
+		ips, err := r.Resolve(context.Background(), fqdn)
+		var dnsErr *net.DNSError
+		if blocked != (errors.As(err, &dnsErr) && dnsErr.IsNotFound) {
+			t.Errorf("%s: %v, %v", fqdn, ips, err)
+		}
+	}
+
+	srv := &Server{Resolver: r, ErrorLog: log.New(io.Discard, "", 0)}
+	client := &Client{ProxyAddr: serveTest(t, srv)}
+	var rep *REPError
+	if _, err := client.Dial("tcp", "ads.example:80"); !errors.As(err, &rep) || rep.REP != HOST_UNREACHABLE {
+		t.Errorf("blocked destination: %v", err)
+	}
+}
+
+func TestDoTResolver(t *testing.T) {
+	ts := httptest.NewUnstartedServer(nil)
+	ts.StartTLS()
+	config := ts.TLS.Clone()
+	pool := x509.NewCertPool()
+	pool.AddCert(ts.Certificate())
+	ts.Close()
+
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	h := &dohTestHandler{}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				for {
+					query, err := readDNSStream(conn)
+					if err != nil {
+						return
+					}
+					w := httptest.NewRecorder()
+					h.ServeHTTP(w, httptest.NewRequest("POST", "/", bytes.NewReader(query)))
+					resp := w.Body.Bytes()
+					copy(resp, query[:2]) // ID
+					conn.Write(append([]byte{byte(len(resp) >> 8), byte(len(resp))}, resp...))
+				}
+			}()
+		}
+	}()
+
+	r := NewDoTResolver(ln.Addr().String(), &tls.Config{RootCAs: pool, ServerName: "example.com"})
+	ips, err := r.Resolve(context.Background(), "example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ips) != 1 || !ips[0].Equal(net.IPv4(93, 184, 216, 34)) {
+		t.Errorf("ips %v", ips)
+	}
+}
+
+// readDNSStream read a DNS message framed with its length.
+func readDNSStream(r io.Reader) ([]byte, error) {
+	n, err := ReadNBytes(r, 2)
+	if err != nil {
+		return nil, err
+	}
+	return ReadNBytes(r, int(n[0])<<8|int(n[1]))
+}
@@ -0,0 +1,212 @@
+package socks5
+
+import (
+	"context"
+	"net"
+	"strings"
+	"time"
+)
+
+// Dialer connects to outbound addresses. *net.Dialer implements Dialer.
+type Dialer interface {
+	DialContext(ctx context.Context, network, address string) (net.Conn, error)
+}
+
+// Route is one way for the server to reach destinations.
+type Route struct {
+	// Name identifies the route, it is recorded in the session Metadata
+	// as MetaRoute and in DialError.
+	Name string
+
+	// Dialer connects to the destination, such as through an upstream
+	// proxy or a specific interface. If nil, Server.Dialer is used.
+	Dialer Dialer
+
+	// Resolver resolves domain name destinations of the route.
+	// If nil, Server.Resolver is used.
+	Resolver NameResolver
+
+	// RemoteDNS passes domain name destinations to Dialer as "host:port"
+	// instead of resolving them with Resolver, such as for upstream
+	// proxies which then request the name itself and resolve it on their
+	// side. A nil Dialer resolves them with the system resolver.
+	RemoteDNS bool
+
+	// Transporter relays data of sessions using the route, such as a
+	// recording or throttling relay. If nil, Server.Transporter is used.
+	Transporter Transporter
+}
+
+// DirectRoute connects to destinations directly.
+var DirectRoute = Route{Name: "direct"}
+
+// Router selects the routes to reach the destination of a request.
+type Router interface {
+	// Route return the candidate routes for dest in order of preference.
+	// The server uses the first one, and on failure falls back to the
+	// next ones within Server.DialRetries.
+	Route(s *Session, dest *Address) []Route
+}
+
+// RouterFunc is an adapter to allow the use of ordinary functions as Router.
+type RouterFunc func(s *Session, dest *Address) []Route
+
+// Route calls f(s, dest).
+func (f RouterFunc) Route(s *Session, dest *Address) []Route {
+	return f(s, dest)
+}
+
+// routes return the candidate routes of dest, limited by retry budget.
+func (srv *Server) routes(s *Session, dest *Address) []Route {
+	routes := s.routes
+	if router := srv.router(); len(routes) == 0 && router != nil {
+		routes = router.Route(s, dest)
+	}
+	if len(routes) == 0 {
+		return []Route{DirectRoute}
+	}
+	if n := srv.DialRetries + 1; len(routes) > n && srv.DialRetries >= 0 {
+		routes = routes[:n]
+	}
+	return routes
+}
+
+func (srv *Server) routeResolver(r Route) NameResolver {
+	if r.Resolver == nil {
+		return srv.resolver()
+	}
+	return r.Resolver
+}
+
+// routeDialer return the Dialer of r, the one of the server if it has
+// none.
+func (srv *Server) routeDialer(r Route) Dialer {
+	if r.Dialer != nil {
+		return r.Dialer
+	}
+	if srv.Dialer != nil {
+		return srv.Dialer
+	}
+	return &localDialer{srv.LocalIPs, srv.KeepAlive}
+}
+
+// localDialer dials from the first of ips of the family of the
+// destination.
+type localDialer struct {
+	ips       []net.IP
+	keepAlive time.Duration
+}
+
+func (d *localDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	dialer := &net.Dialer{KeepAlive: d.keepAlive}
+	if len(d.ips) > 0 {
+		// domain names are dialed from the first address.
+		ip := d.ips[0]
+		if host, _, err := net.SplitHostPort(address); err == nil {
+			if dest := net.ParseIP(host); dest != nil {
+				ip = nil
+				for _, local := range d.ips {
+					if (local.To4() != nil) == (dest.To4() != nil) {
+						ip = local
+						break
+					}
+				}
+			}
+		}
+		if ip != nil {
+			dialer.LocalAddr = &net.TCPAddr{IP: ip}
+		}
+	}
+	return dialer.DialContext(ctx, network, address)
+}
+
+// DomainRoute sends destinations under domain suffixes through Route.
+type DomainRoute struct {
+	// Suffixes are the matched domain suffixes. "corp.internal",
+	// ".corp.internal" and "*.corp.internal" all match corp.internal
+	// itself and any name under it.
+	Suffixes []string
+
+	Route
+}
+
+// SplitTunnel is a Router which sends domain name destinations matching
+// one of Domains through its route, and everything else through Default.
+// Domains are matched in order, the first match wins. Matched domains
+// never fall back to Default, so internal names don't leak outside.
+type SplitTunnel struct {
+	Domains []DomainRoute
+
+	// Default is the route of other destinations.
+	// If Default has no name, DirectRoute is used.
+	Default Route
+}
+
+// Route implements Router.
+func (t *SplitTunnel) Route(s *Session, dest *Address) []Route {
+	if dest.ATYPE == DOMAINNAME {
+		name := canonicalHost(string(dest.Addr))
+		for _, d := range t.Domains {
+			for _, suffix := range d.Suffixes {
+				if matchDomainSuffix(name, suffix) {
+					return []Route{d.Route}
+				}
+			}
+		}
+	}
+	if t.Default.Name == "" {
+		return []Route{DirectRoute}
+	}
+	return []Route{t.Default}
+}
+
+// RuleRoute sends the requests allowed by Rules through Routes.
+type RuleRoute struct {
+	// Rules selects the requests, such as a Match.
+	Rules RuleSet
+
+	// Routes are the routes of the selected requests, in order of
+	// preference.
+	Routes []Route
+}
+
+// RuleRouter is a Router selecting routes per request with rule sets,
+// such as to chain the requests of some users or destinations through
+// upstream proxies:
+//
+//	srv.Router = &socks5.RuleRouter{Rules: []socks5.RuleRoute{{
+//		Rules:  &socks5.Match{Users: []string{"crawler"}},
+//		Routes: []socks5.Route{socks5.UpstreamRoute("exit", exit)},
+//	}}}
+//
+// Rules are evaluated in order, the first match wins. The rules see the
+// request with the destination being dialed, which differs from the one
+// sent by the client if it was rewritten by Server.Policy.
+type RuleRouter struct {
+	Rules []RuleRoute
+
+	// Default are the routes of unmatched requests.
+	// If empty, DirectRoute is used.
+	Default []Route
+}
+
+// Route implements Router.
+func (r *RuleRouter) Route(s *Session, dest *Address) []Route {
+	req := &Request{VER: Version5, CMD: CONNECT, Address: dest}
+	if s.Request != nil {
+		req.VER, req.CMD = s.Request.VER, s.Request.CMD
+	}
+	for _, rule := range r.Rules {
+		if rule.Rules.Allow(s, req) {
+			return rule.Routes
+		}
+	}
+	return r.Default
+}
+
+// matchDomainSuffix report whether name is suffix or a subdomain of it.
+func matchDomainSuffix(name, suffix string) bool {
+	suffix = strings.TrimPrefix(suffix, "*")
+	suffix = canonicalHost(strings.TrimPrefix(suffix, "."))
+	return name == suffix || strings.HasSuffix(name, "."+suffix)
+}
@@ -0,0 +1,197 @@
+package socks5
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+)
+
+type failDialer struct{}
+
+func (failDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	return nil, errors.New("upstream down")
+}
+
+func TestServer_DialRetries(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+	dest := &Address{net.IPv4(127, 0, 0, 1).To4(), IPV4_ADDRESS, uint16(ln.Addr().(*net.TCPAddr).Port)}
+
+	for _, retries := range []int{0, 1} {
+		var failed []string
+		srv := &Server{
+			Router: RouterFunc(func(s *Session, dest *Address) []Route {
+				return []Route{{Name: "upstream", Dialer: failDialer{}}, DirectRoute}
+			}),
+			DialRetries: retries,
+			Hooks: Hooks{
+				OnDialError: func(s *Session, e *DialError) { failed = append(failed, e.Route) },
+			},
+		}
+		addr := serveTest(t, srv)
+
+		_, reply := connectTest(t, addr, dest)
+		want := GENERAL_SOCKS_SERVER_FAILURE
+		if retries > 0 {
+			want = SUCCESSED
+		}
+		if reply[1] != want {
+			t.Errorf("retries %d: reply %#x, want %#x", retries, reply[1], want)
+		}
+		if len(failed) != 1 || failed[0] != "upstream" {
+			t.Errorf("retries %d: failed routes %v, want [upstream]", retries, failed)
+		}
+	}
+}
+
+func TestSplitTunnel(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+
+	vpn := Route{
+		Name:     "vpn",
+		Resolver: staticResolver{"git.corp.internal": {net.IPv4(127, 0, 0, 1)}},
+	}
+	tunnel := &SplitTunnel{
+		Domains: []DomainRoute{{Suffixes: []string{"*.corp.internal"}, Route: vpn}},
+	}
+
+	tests := []struct {
+		host  string
+		route string
+	}{
+		{"git.corp.internal", "vpn"},
+		{"CORP.internal.", "vpn"},
+		{"notcorp.internal", "direct"},
+		{"example.com", "direct"},
+	}
+	for _, test := range tests {
+		routes := tunnel.Route(nil, &Address{[]byte(test.host), DOMAINNAME, 80})
+		if len(routes) != 1 || routes[0].Name != test.route {
+			t.Errorf("%s: routes %v, want %s", test.host, routes, test.route)
+		}
+	}
+
+	srv := &Server{Router: tunnel}
+	s := &Session{}
+	dest := &Address{[]byte("git.corp.internal"), DOMAINNAME, uint16(ln.Addr().(*net.TCPAddr).Port)}
+	conn, err := srv.dialTCP(s, dest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	if s.GetString(MetaRoute) != "vpn" {
+		t.Errorf("route: %s, want vpn", s.GetString(MetaRoute))
+	}
+}
+
+type countingTransporter struct {
+	Transporter
+	n int32
+}
+
+func (c *countingTransporter) TransportTCP(client net.Conn, remote net.Conn) error {
+	atomic.AddInt32(&c.n, 1)
+	return c.Transporter.TransportTCP(client, remote)
+}
+
+func TestRoute_Transporter(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		conn.Close()
+	}()
+
+	relay := &countingTransporter{Transporter: DefaultTransporter}
+	srv := &Server{
+		Router: RouterFunc(func(s *Session, dest *Address) []Route {
+			return []Route{{Name: "recorded", Transporter: relay}}
+		}),
+	}
+	addr := serveTest(t, srv)
+	dest, _ := ParseAddress(ln.Addr().String())
+	conn, reply := connectTest(t, addr, dest)
+	if reply[1] != SUCCESSED {
+		t.Fatalf("reply: %#x", reply[1])
+	}
+	// remote closed at once, the session ends after the relay
+	io.Copy(io.Discard, conn)
+	if atomic.LoadInt32(&relay.n) != 1 {
+		t.Errorf("route transporter called %d times, want 1", relay.n)
+	}
+}
+
+func TestServer_RemoteDNS(t *testing.T) {
+	echo := echoTest(t)
+	addresses := make(chan string, 1)
+	dialer := dialContextFunc(func(ctx context.Context, network, address string) (net.Conn, error) {
+		addresses <- address
+		return net.Dial(network, echo)
+	})
+	for _, c := range []struct {
+		name   string
+		srv    *Server
+		remote bool
+	}{
+		{"route", &Server{Router: RouterFunc(func(s *Session, dest *Address) []Route {
+			return []Route{{Name: "upstream", Dialer: dialer, RemoteDNS: true}}
+		})}, true},
+		{"server", &Server{RemoteDNS: true, Router: RouterFunc(func(s *Session, dest *Address) []Route {
+			return []Route{{Name: "upstream", Dialer: dialer}}
+		})}, true},
+		{"local", &Server{
+			Resolver: &HostsResolver{Hosts: map[string][]net.IP{"upstream.test": {net.IPv4(192, 0, 2, 1)}}},
+			Router: RouterFunc(func(s *Session, dest *Address) []Route {
+				return []Route{{Name: "upstream", Dialer: dialer}}
+			}),
+		}, false},
+	} {
+		client := &Client{ProxyAddr: serveTest(t, c.srv)}
+		conn, err := client.Dial("tcp", "upstream.test:80")
+		if err != nil {
+			t.Fatalf("%s: %v", c.name, err)
+		}
+		conn.Close()
+		want := "192.0.2.1:80"
+		if c.remote {
+			want = "upstream.test:80"
+		}
+		if address := <-addresses; address != want {
+			t.Errorf("%s: dialed %s, want %s", c.name, address, want)
+		}
+	}
+}
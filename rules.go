@@ -0,0 +1,106 @@
+package socks5
+
+import (
+	"errors"
+	"net"
+)
+
+// errRequestDenied is returned when the rules of the server deny a request.
+var errRequestDenied = errors.New("request denied by rules")
+
+// RuleSet decides which requests the server serves. It is consulted once
+// the request has been read, s carries the client address and the
+// authenticated user. It is consulted again for each new destination of
+// an UDP association, with an UDP_ASSOCIATE request to it.
+type RuleSet interface {
+	Allow(s *Session, req *Request) bool
+}
+
+// RuleSetFunc is an adapter to allow the use of ordinary functions as RuleSet.
+type RuleSetFunc func(s *Session, req *Request) bool
+
+// Allow calls f(s, req).
+func (f RuleSetFunc) Allow(s *Session, req *Request) bool {
+	return f(s, req)
+}
+
+// SetRules replace the rules of the server while it runs: requests read
+// from then on are checked against rules, sessions already relaying are
+// not affected. It overrides the Rules field, nil allows all requests.
+func (srv *Server) SetRules(rules RuleSet) {
+	srv.reload(func(c *swappedConfig) {
+		c.Rules, c.rules = rules, true
+	})
+}
+
+// SetStore replace the credential store of Username/Password
+// authentication while the server runs, such as to switch to a new
+// backend, without dropping sessions. Clients authenticating from then
+// on are validated by store. It overrides the store of the UserPwdAuth
+// of Authenticators, and enables Username/Password if there is none.
+// Other Username/Password authenticators, such as FuncAuth, have no
+// store to replace: they are kept, and store is not used.
+func (srv *Server) SetStore(store UserPwdStore) {
+	srv.reload(func(c *swappedConfig) {
+		c.Store = store
+	})
+}
+
+// Store return the credential store of Username/Password authentication
+// in use: the one set by SetStore or Reload, or the one of the
+// UserPwdAuth of Authenticators. It is nil if there is none.
+func (srv *Server) Store() UserPwdStore {
+	a, _ := srv.authenticator(USERNAME_PASSWORD)
+	switch a := a.(type) {
+	case UserPwdAuth:
+		return a.UserPwdStore
+	case *UserPwdAuth:
+		return a.UserPwdStore
+	}
+	return nil
+}
+
+// ruleSet return the current rules of the server.
+func (srv *Server) ruleSet() RuleSet {
+	if c := srv.swapped(); c != nil && c.rules {
+		return c.Rules
+	}
+	return srv.Rules
+}
+
+// authenticator return the authenticator of m, with the store set by
+// SetStore for a Username/Password UserPwdAuth.
+func (srv *Server) authenticator(m METHOD) (Authenticator, bool) {
+	a, ok := srv.Authenticators[m]
+	if c := srv.swapped(); c != nil && m == USERNAME_PASSWORD && c.Store != nil {
+		switch a.(type) {
+		case nil, UserPwdAuth, *UserPwdAuth:
+			return UserPwdAuth{c.Store}, true
+		}
+	}
+	return a, ok
+}
+
+// allow check req against the rules, and reply the refusal to the
+// client if it is denied.
+func (srv *Server) allow(s *Session, client net.Conn, req *Request) error {
+	rules := srv.ruleSet()
+	if rules == nil || rules.Allow(s, req) {
+		return nil
+	}
+	return srv.refuse(client, req, CONNECTION_NOT_ALLOW_BY_RULESET, "\"process request rules\"", errRequestDenied)
+}
+
+// refuse reply rep to req, REJECT for socks4, and return the OpError of
+// step failing with err.
+func (srv *Server) refuse(client net.Conn, req *Request, rep REP, step string, err error) error {
+	reply := &Reply{VER: req.VER, REP: rep, Address: srv.localAddress(client)}
+	if req.VER == Version4 {
+		reply.REP = REJECT
+		reply.Address = &Address{net.IPv4zero, IPV4_ADDRESS, 0}
+	}
+	if werr := srv.sendReply(client, reply); werr != nil {
+		return &OpError{req.VER, "write", client.RemoteAddr(), step, werr}
+	}
+	return &OpError{req.VER, "", client.RemoteAddr(), step, err}
+}
@@ -0,0 +1,91 @@
+package socks5
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"testing"
+)
+
+func TestServer_SetStore(t *testing.T) {
+	old := NewMemeryStore(sha256.New(), "secret")
+	old.Set("admin", "123456")
+	srv := &Server{
+		Authenticators: map[METHOD]Authenticator{USERNAME_PASSWORD: UserPwdAuth{old}},
+		ErrorLog:       log.New(io.Discard, "", 0),
+	}
+	addr := serveTest(t, srv)
+	echo := echoTest(t)
+	client := &Client{ProxyAddr: addr, Username: "admin", Password: "123456"}
+	established, err := client.Dial("tcp", echo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer established.Close()
+
+	rotated := NewMemeryStore(sha256.New(), "secret")
+	rotated.Set("admin", "654321")
+	srv.SetStore(rotated)
+	if srv.Store() != rotated {
+		t.Error("Store is not the store set")
+	}
+	if _, err := client.Dial("tcp", echo); !errors.Is(err, errAuthFailed) {
+		t.Errorf("old password: %v", err)
+	}
+	client.Password = "654321"
+	conn, err := client.Dial("tcp", echo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+
+	established.Write([]byte("ping"))
+	if b, err := ReadNBytes(established, 4); err != nil || string(b) != "ping" {
+		t.Errorf("established session: %q, %v", b, err)
+	}
+}
+
+func TestServer_SetStoreFuncAuth(t *testing.T) {
+	srv := &Server{
+		Authenticators: map[METHOD]Authenticator{USERNAME_PASSWORD: FuncAuth(func(ctx context.Context, username, password string, clientAddr net.Addr) error {
+			if username != "admin" || password != "123456" {
+				return errAuthFailed
+			}
+			return nil
+		})},
+		ErrorLog: log.New(io.Discard, "", 0),
+	}
+	client := &Client{ProxyAddr: serveTest(t, srv), Username: "admin", Password: "123456"}
+
+	// the store does not replace the function.
+	srv.SetStore(NewMemeryStore(sha256.New(), ""))
+	conn, err := client.Dial("tcp", echoTest(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+}
+
+func TestServer_SetRules(t *testing.T) {
+	srv := &Server{ErrorLog: log.New(io.Discard, "", 0)}
+	client := &Client{ProxyAddr: serveTest(t, srv)}
+	echo := echoTest(t)
+
+	srv.SetRules(RuleSetFunc(func(s *Session, req *Request) bool {
+		return req.CMD != CONNECT
+	}))
+	var rep *REPError
+	if _, err := client.Dial("tcp", echo); !errors.As(err, &rep) || rep.REP != CONNECTION_NOT_ALLOW_BY_RULESET {
+		t.Errorf("denied request: %v", err)
+	}
+
+	srv.SetRules(nil)
+	conn, err := client.Dial("tcp", echo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+}
@@ -1,12 +1,18 @@
 package socks5
 
 import (
+	"context"
+	"crypto/tls"
 	"errors"
 	"io"
 	"log"
 	"net"
 	"strconv"
+	"sync"
+	"sync/atomic"
 	"time"
+
+	"github.com/haochen233/socks5/internal/parser"
 )
 
 // checkVersion check version is 4 or 5.
@@ -34,12 +40,65 @@ type Server struct {
 	ReadTimeout  time.Duration
 	WriteTimeout time.Duration
 
+	// HandshakeTimeout limits the time from the connection of a client
+	// to its request being read, TLS handshake and authentication
+	// included, so that clients which never send their method selection
+	// or request do not hold the connection, refused ones of
+	// RefuseOverLimit too. Zero means no limit.
+	HandshakeTimeout time.Duration
+
+	// AuthTimeout limits the authentication sub-negotiation, within
+	// HandshakeTimeout. Zero means no limit but HandshakeTimeout.
+	AuthTimeout time.Duration
+
+	// HandshakeReadTimeout limits the wait for each read of the
+	// handshake after the TLS one, closing clients which trickle their
+	// handshake to hold connections (slowloris). Zero means no limit.
+	HandshakeReadTimeout time.Duration
+
+	// MaxHandshakeBytes caps the bytes read from a client before its
+	// request, after the TLS handshake, closing clients which send
+	// endless handshakes. Socks handshakes take about a kilobyte, HTTP
+	// CONNECT requests and GSSAPI tokens more. Zero means no limit.
+	MaxHandshakeBytes int
+
+	// DialTimeout limits each attempt to connect to a destination
+	// through a route, name resolution included, before the next route
+	// is tried. Zero means no limit but the one of the dialer.
+	DialTimeout time.Duration
+
 	// method mapping to the authenticator
 	// if nil server provide NO_AUTHENTICATION_REQUIRED method by default
 	Authenticators map[METHOD]Authenticator
 
-	// The server select method to use policy
-	//MethodSelector
+	// MethodSelector optionally overrides the method selection per
+	// connection, such as to require GSSAPI from some networks. It
+	// receives the methods offered by the client and returns the chosen
+	// one, or NO_ACCEPTABLE_METHODS to reject the client. A chosen method
+	// the client did not offer, or which is neither
+	// NO_AUTHENTICATION_REQUIRED nor in Authenticators, rejects the
+	// client. If nil, the first offered method the server supports is
+	// chosen.
+	MethodSelector func(clientAddr net.Addr, offered []byte) (chosen byte)
+
+	// MethodPriority optionally orders the supported methods by
+	// preference: the first one offered by the client is chosen, whatever
+	// the order of the client, and methods missing from it are never
+	// chosen. If nil, the first offered method the server supports is
+	// chosen. MethodSelector takes precedence. Serve listeners with
+	// distinct Servers to give them distinct priorities.
+	MethodPriority []METHOD
+
+	// NoAcceptableMethodsDelay delays closing the connection of clients
+	// rejected with NO_ACCEPTABLE_METHODS, slowing down clients probing
+	// the server. Zero closes it right after the reply.
+	NoAcceptableMethodsDelay time.Duration
+
+	// StrictMethods rejects method selection messages offering no method,
+	// the same method twice or NO_ACCEPTABLE_METHODS, replying
+	// NO_ACCEPTABLE_METHODS. By default such messages are accepted,
+	// repeated methods and NO_ACCEPTABLE_METHODS being ignored.
+	StrictMethods bool
 
 	// Server transmit data between client and dest server.
 	// if nil, DefaultTransport is used.
@@ -51,169 +110,666 @@ type Server struct {
 	// If nil, logging is done via log package's standard logger.
 	ErrorLog *log.Logger
 
+	// Logger optionally logs the events of sessions with structured
+	// fields, such as failed handshakes with their reason, failed
+	// authentications and each failed dial. If not nil, failures are
+	// logged to it instead of ErrorLog.
+	Logger Logger
+
 	// DisableSocks4, disable socks4 server, default enable socks4 compatible.
+	// Socks4 and socks4a clients are served on the same listener, CONNECT
+	// and BIND only, if the server accepts clients without authentication,
+	// see IsAllowNoAuthRequired and MethodSelector.
 	DisableSocks4 bool
 
+	// HTTPConnect serves HTTP proxy clients on the same listener: their
+	// CONNECT requests are served as socks5 CONNECT requests, by the same
+	// authenticators, rules and relay. The credentials of their Basic
+	// Proxy-Authorization header are checked by the Username/Password
+	// authenticator. Other HTTP methods are refused.
+	HTTPConnect bool
+
+	// Resolver resolves domain name destinations.
+	// If nil, net.DefaultResolver is used.
+	Resolver NameResolver
+
+	// RemoteDNS passes domain name destinations of CONNECT requests to
+	// the Dialer of their route instead of resolving them, as with
+	// Route.RemoteDNS for every route.
+	RemoteDNS bool
+
+	// Rules optionally decides which requests the server serves, denied
+	// requests are replied CONNECTION_NOT_ALLOW_BY_RULESET. SetRules
+	// replaces it while the server runs. The destinations of UDP
+	// associations are checked too, as UDP_ASSOCIATE requests to them,
+	// and denied datagrams dropped.
+	Rules RuleSet
+
+	// Policy optionally decides on the requests allowed by Rules, and may
+	// rewrite their destination or choose their routes, such as a script
+	// loaded at run time. It may deny the destinations of UDP
+	// associations as Rules does.
+	Policy Policy
+
+	// Router selects the routes to reach CONNECT destinations.
+	// If nil, the server connects to destinations directly.
+	Router Router
+
+	// DialRetries is the number of alternate routes tried after the
+	// preferred route failed to connect, zero means no retry.
+	// A negative value tries all routes returned by Router.
+	DialRetries int
+
+	// DialErrorReply optionally chooses the reply code to a CONNECT
+	// request which failed with e, instead of e.REP, the code mapped by
+	// ClassifyDialError, such as to hide the reason of failures from
+	// clients with GENERAL_SOCKS_SERVER_FAILURE. It is called for each
+	// failed route, hooks and logs see the code it returns.
+	DialErrorReply func(e *DialError) REP
+
+	// Dialer connects to the destinations of routes without a Dialer of
+	// their own, such as DirectRoute, for instance to set socket options.
+	// If nil, the server dials with a net.Dialer configured by LocalIPs
+	// and KeepAlive.
+	Dialer Dialer
+
+	// LocalIPs are the source addresses of the outbound connections of
+	// the default Dialer, for multi-homed hosts: connections use the first
+	// one of the family of their destination. If none matches, the system
+	// chooses.
+	LocalIPs []net.IP
+
+	// KeepAlive is the TCP keep-alive period of the outbound connections
+	// of the default Dialer. Zero uses the default of net.Dialer,
+	// negative disables keep-alives.
+	KeepAlive time.Duration
+
+	// AddressFamily orders or restricts the resolved addresses of
+	// destinations by IP family, for CONNECT and UDP ASSOCIATE. Domain
+	// names passed to dialers with RemoteDNS are not affected.
+	AddressFamily AddressFamily
+
+	// RaceDelay enables racing connections to the resolved addresses of a
+	// destination, in the order of AddressFamily: an attempt is started
+	// every RaceDelay until one succeeds, or as soon as the previous one
+	// failed. Zero tries the addresses in turn, see also FallbackDelay.
+	RaceDelay time.Duration
+
+	// FallbackDelay enables Happy Eyeballs (RFC 8305) for destinations
+	// resolving to IPv6 and IPv4 addresses: their families are
+	// interleaved, from the first one in the order of AddressFamily, and
+	// raced, the first address getting a head start of FallbackDelay
+	// over the other family, so a broken IPv6 path costs FallbackDelay
+	// rather than a connection timeout. Further attempts start every
+	// RaceDelay, or FallbackDelay if zero. Zero disables it.
+	FallbackDelay time.Duration
+
+	// Hijacker optionally takes over connections after their request
+	// has been read.
+	Hijacker Hijacker
+
+	// Interceptors inspect the data relayed by CONNECT and BIND sessions,
+	// each wrapping the streams returned by the previous one. Intercepted
+	// legs are not relayed zero-copy, see PooledTransport.
+	Interceptors []RelayInterceptor
+
+	// Hooks are callbacks invoked on connection events.
+	Hooks Hooks
+
+	// UsageInterval is the interval of Hooks.OnUsage events,
+	// zero disables them.
+	UsageInterval time.Duration
+
+	// RateLimit optionally shapes the bandwidth of CONNECT and BIND
+	// sessions, globally, per client IP and per user.
+	RateLimit *RateLimiter
+
+	// Metrics optionally receives the events of sessions to export
+	// metrics, see PrometheusMetrics. It counts the relayed bytes, see
+	// PooledTransport.
+	Metrics Metrics
+
+	// Stats optionally accounts the traffic of sessions, see ConnStats.
+	// It counts the relayed bytes, see PooledTransport.
+	Stats *ConnStats
+
+	// Lockout optionally bans client IPs and user names after failed
+	// authentication attempts, see Lockout.
+	Lockout *Lockout
+
+	// AuthAuditor optionally records each authentication attempt, see
+	// AuthLog.
+	AuthAuditor AuthAuditor
+
+	// AccessLog optionally writes a record of each session once it ends,
+	// see AccessLog. It counts the relayed bytes, see PooledTransport.
+	AccessLog *AccessLog
+
+	// MeasureWriteStalls enables Session.WriteStall, the time the relay
+	// spent blocked writing to each leg, see PooledTransport for its cost.
+	MeasureWriteStalls bool
+
+	// WriteStallThreshold is the duration past which a blocked write is
+	// reported to Hooks.OnWriteStall. Zero means 100ms.
+	WriteStallThreshold time.Duration
+
+	// RelayAddr is the IP address the UDP relay sockets of UDP ASSOCIATE
+	// and the listeners of BIND bind to. If nil, they bind to the address
+	// the client connected to.
+	RelayAddr net.IP
+
+	// AllowBind optionally restricts BIND requests by the expected peer
+	// address dest, denied requests are replied
+	// CONNECTION_NOT_ALLOW_BY_RULESET. If nil, all are allowed.
+	AllowBind func(s *Session, dest *Address) bool
+
+	// BindTimeout limits the wait for the peer of a BIND request, zero
+	// means two minutes.
+	BindTimeout time.Duration
+
+	// UDPOffload controls GSO/GRO on UDP relay sockets.
+	// The zero value enables them when the kernel supports them.
+	UDPOffload UDPOffload
+
+	// UDPPeerTimeout evicts a destination from the NAT table of an UDP
+	// association once it exchanged no datagram for that long, its
+	// datagrams are dropped until the client sends to it again. Zero
+	// means two minutes.
+	UDPPeerTimeout time.Duration
+
+	// UDPFiltering decides which sources may send datagrams to the client
+	// of an UDP association, the zero value only the destinations it sent
+	// to.
+	UDPFiltering UDPFiltering
+
+	// MaxUDPPeers caps the destinations in the NAT table of an UDP
+	// association, datagrams to further destinations are dropped. Zero
+	// means 4096.
+	MaxUDPPeers int
+
+	// UDPReassembly reassembles fragmented client datagrams, whose
+	// fragments must arrive in order within 5 seconds, instead of
+	// dropping them. Metrics.UDPDropped reports dropped datagrams.
+	UDPReassembly bool
+
+	// MaxSessionDuration caps the lifetime of sessions, counted from
+	// accept, after which the server closes them. Zero means no limit.
+	// Session.MaxDuration overrides it per session.
+	MaxSessionDuration time.Duration
+
+	// IdleTimeout closes sessions relaying no byte in either direction
+	// for that long, with the UDP associations idle as long. Zero means
+	// no timeout. Session.IdleTimeout overrides it per session. It counts
+	// the relayed bytes, see PooledTransport.
+	IdleTimeout time.Duration
+
+	// MaxSessionBytes caps the bytes a CONNECT session transfers in both
+	// directions, the server closes sessions going over it. Zero means
+	// no limit. Session.MaxBytes overrides it per session. It counts the
+	// relayed bytes, see PooledTransport.
+	MaxSessionBytes int64
+
+	// MaxUDPAssociations caps the number of UDP associations the server
+	// relays at once, further UDP ASSOCIATE requests are rejected with
+	// CONNECTION_NOT_ALLOW_BY_RULESET. Zero means no limit.
+	MaxUDPAssociations int
+
+	// MaxConnections caps the number of sessions the server serves at
+	// once, and MaxConnectionsPerIP the number of sessions of each client
+	// IP. Further connections are closed before the handshake, see
+	// RefuseOverLimit. Zero means no limit.
+	MaxConnections      int
+	MaxConnectionsPerIP int
+
+	// RefuseOverLimit makes the server refuse connections over
+	// MaxConnections or MaxConnectionsPerIP gracefully: it reads their
+	// request and replies CONNECTION_REFUSED before closing them, so
+	// clients report why. It costs a handshake per refused connection,
+	// authentication included: a few are refused at once, further ones
+	// are closed.
+	RefuseOverLimit bool
+
+	// SoftLimits are warning thresholds of the limits, reported by
+	// Hooks.OnLimit.
+	SoftLimits SoftLimits
+
+	// RelayPorts restricts the ports of UDP ASSOCIATE relay sockets and
+	// BIND listeners, so firewalls can be opened narrowly. When all its
+	// ports are in use, requests fail with GENERAL_SOCKS_SERVER_FAILURE
+	// and Metrics.PortsExhausted and Hooks.OnPortsExhausted are called.
+	// The zero value uses any ephemeral port.
+	RelayPorts PortRange
+
+	// Latency optionally records the dial latency and the time to first
+	// byte of CONNECT destinations, see LatencyStats.
+	Latency *LatencyStats
+
+	// MemoryLimit optionally sheds load under memory pressure, see
+	// MemoryLimit. It is monitored while the server serves a listener.
+	MemoryLimit *MemoryLimit
+
+	// BaseContext optionally returns the base context of the connections
+	// accepted on l by Serve. Cancelling it ends their negotiations and
+	// relays. If nil, context.Background() is used.
+	BaseContext func(l net.Listener) context.Context
+
+	// ConnContext optionally derives the context of a connection accepted
+	// by Serve from ctx, such as to limit its lifetime with a deadline.
+	ConnContext func(ctx context.Context, c net.Conn) context.Context
+
+	// TLSConfig optionally configures ServeTLS and ListenAndServeTLS,
+	// such as to verify client certificates with ClientAuth and
+	// ClientCAs. The state of the connection is in Session.TLS.
+	TLSConfig *tls.Config
+
+	// Middleware optionally wraps the handling of each connection before
+	// the handshake, the first one outermost, see Middleware.
+	Middleware []Middleware
+
+	// Tracer optionally receives the bytes of session negotiations,
+	// see Trace.
+	Tracer Tracer
+
 	// Generate by Server.Addr field. For Server internal use only.
 	addr *Address
+
+	// sessions being served
+	sessions sessionSet
+	// *swappedConfig set by Reload, SetRules and SetStore
+	reloadMu sync.Mutex
+	reloaded atomic.Value
+
+	// counts of the soft and hard limits
+	connections     gauge
+	udpAssociations gauge
+	// ipConnections are the sessions of each client IP, if
+	// MaxConnectionsPerIP is set
+	ipMu          sync.Mutex
+	ipConnections map[string]int
+	// refusing is the number of connections being refused by
+	// RefuseOverLimit, accessed atomically
+	refusing int32
+	// shedding is 1 while the memory usage is over MemoryLimit,
+	// accessed atomically
+	shedding int32
+
+	// listeners being served and connections accepted from them, see
+	// Shutdown. serving and inShutdown are accessed atomically.
+	mu         sync.Mutex
+	listeners  map[*net.Listener]struct{}
+	serving    int32
+	inShutdown int32
 }
 
 // ListenAndServe listens on the TCP network address srv.Addr and then
-// calls serve to handle requests on incoming connections.
+// calls Serve to handle requests on incoming connections. To listen on
+// another network, see ListenAndServeNetwork.
 //
 // If srv.Addr is blank, ":1080" is used.
 func (srv *Server) ListenAndServe() error {
-	if srv.addr == nil {
-		srv.addr = new(Address)
-	}
 	addr := srv.Addr
 	if addr == "" {
 		addr = "0.0.0.0:1080"
 	}
+	return srv.ListenAndServeNetwork("tcp", addr)
+}
 
-	host, port, err := net.SplitHostPort(addr)
-	if err != nil {
-		return err
+// ListenAndServeNetwork listens on the address addr of network, as
+// net.Listen does, such as "tcp6" or "unix", and then calls Serve to
+// handle requests on incoming connections. srv.Addr is not used.
+func (srv *Server) ListenAndServeNetwork(network, addr string) error {
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+		address, err := ParseAddress(addr)
+		if err != nil {
+			return err
+		}
+		srv.addr = address
 	}
 
-	ip := net.ParseIP(host)
-	if ip == nil {
-		srv.addr.ATYPE = DOMAINNAME
-		srv.addr.Addr = []byte(host)
-	} else if ip.To4() != nil {
-		srv.addr.ATYPE = IPV4_ADDRESS
-		srv.addr.Addr = ip.To4()
-	} else if ip.To16() != nil {
-		srv.addr.ATYPE = IPV6_ADDRESS
-		srv.addr.Addr = ip.To16()
-	}
-	atoi, err := strconv.Atoi(port)
-	if err != nil {
-		return err
+	if srv.shuttingDown() {
+		return ErrServerClosed
 	}
-	srv.addr.Port = uint16(atoi)
-
-	ln, err := net.Listen("tcp", addr)
+	ln, err := net.Listen(network, addr)
 	if err != nil {
 		return err
 	}
-	return srv.serve(ln)
+	return srv.Serve(ln)
 }
 
-// serve accepts incoming connections on the Listener l, creating a
+// Serve accepts incoming connections on the Listener l, creating a
 // new service goroutine for each. The service goroutine select client
 // list methods and reply client. Then process authentication and reply
 // to them. At then end of handshake, read socks request from client and
 // establish a connection to the target.
-func (srv *Server) serve(l net.Listener) error {
+//
+// Serve always returns a non-nil error and closes l. After Shutdown, the
+// returned error is ErrServerClosed.
+func (srv *Server) Serve(l net.Listener) error {
+	l = &onceCloseListener{Listener: l}
+	defer l.Close()
+	if !srv.trackListener(&l, true) {
+		return ErrServerClosed
+	}
+	defer srv.trackListener(&l, false)
+	baseCtx := context.Background()
+	if srv.BaseContext != nil {
+		baseCtx = srv.BaseContext(l)
+	}
+	if srv.MemoryLimit != nil {
+		stop := make(chan struct{})
+		defer close(stop)
+		go srv.monitorMemory(stop)
+	}
 	for {
 		client, err := l.Accept()
 		if err != nil {
+			if srv.shuttingDown() {
+				return ErrServerClosed
+			}
 			return err
 		}
-		go srv.serveconn(client)
+		if srv.overMemory() {
+			client.Close()
+			continue
+		}
+		ctx := baseCtx
+		if srv.ConnContext != nil {
+			ctx = srv.ConnContext(ctx, client)
+		}
+		atomic.AddInt32(&srv.serving, 1)
+		go func() {
+			defer atomic.AddInt32(&srv.serving, -1)
+			srv.ServeConn(ctx, client)
+		}()
+	}
+}
+
+// ServeConn serves the socks protocol on conn, a connection the caller has
+// already accepted, such as from a custom listener, an SSH channel or a
+// QUIC stream. ServeConn blocks until the session ends and closes conn,
+// unless conn was taken over by Hijacker. Cancelling ctx closes conn and
+// ends the session. Server.Middleware is applied to conn first.
+func (srv *Server) ServeConn(ctx context.Context, conn net.Conn) {
+	if len(srv.Middleware) > 0 {
+		srv.handler().ServeConn(ctx, conn)
+		return
 	}
+	srv.serveConn(ctx, conn)
 }
 
-func (srv *Server) serveconn(client net.Conn) {
+// serveConn serves the socks protocol on conn, after Middleware.
+func (srv *Server) serveConn(ctx context.Context, conn net.Conn) {
+	hijacked := false
+	defer func() {
+		if !hijacked {
+			conn.Close()
+		}
+	}()
+	// ends are the cleanups of the session, run in reverse order when
+	// serveConn returns, or by Session.Release for hijacked sessions.
+	var ends []func()
+	var endOnce sync.Once
+	end := func() {
+		endOnce.Do(func() {
+			for i := len(ends) - 1; i >= 0; i-- {
+				ends[i]()
+			}
+		})
+	}
+	defer func() {
+		if !hijacked {
+			end()
+		}
+	}()
+	ctx, cancel := context.WithCancel(ctx)
+	ends = append(ends, cancel)
+	stop := make(chan struct{})
+	watched := make(chan struct{})
+	go func(conn net.Conn) {
+		defer close(watched)
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-stop:
+		}
+	}(conn)
+	// Stop watching before cancel, which must not close hijacked conns.
+	defer func() {
+		close(stop)
+		<-watched
+	}()
+
+	s := newSession(ctx, conn)
+	s.cancel = cancel
+	srv.sessions.add(s)
+	ends = append(ends, func() { srv.sessions.remove(s) })
+	// refused sessions end too.
+	ends = append(ends, func() { srv.onClose(s) })
+	// the limits also bound the handshakes of refused connections.
+	handshake, clearLimits := srv.limitHandshake(s, conn)
+	done, ok := srv.countConnection(s)
+	if !ok {
+		srv.refuseOverLimit(s, handshake)
+		return
+	}
+	ends = append(ends, done, srv.trackStats(s))
+	srv.sessionStarted(s)
+	ends = append(ends,
+		func() { srv.sessionEnded(s) },
+		func() { srv.logClosed(s) },
+		func() { srv.logAccess(s) },
+		func() {
+			if s.udpDone != nil {
+				s.udpDone()
+			}
+		})
+	if err := srv.tlsHandshake(s, conn); err != nil {
+		srv.handshakeLimited(s, err)
+		srv.handshakeFailed(s)
+		srv.logError(s, stageHandshake, err)
+		srv.onHandshake(s, err)
+		return
+	}
+	negotiation, endTrace := srv.trace(s, handshake)
+	defer endTrace()
 	// handshake
-	request, err := srv.handShake(client)
+	request, err := srv.handShake(s, negotiation)
 	if err != nil {
-		srv.logf()(err.Error())
-		client.Close()
+		srv.handshakeLimited(s, err)
+		srv.handshakeFailed(s)
+		srv.logError(s, stageHandshake, err)
+		srv.onHandshake(s, err)
+		return
+	}
+	clearLimits()
+	s.Request = request
+	srv.onHandshake(s, nil)
+	if s.encapsulated != nil {
+		// the method protects the rest of the session, or it is an HTTP
+		// CONNECT session.
+		conn, negotiation = s.encapsulated, s.encapsulated
+	}
+	if err := srv.allow(s, negotiation, request); err != nil {
+		s.failure = FailureDenied
+		srv.handshakeFailed(s)
+		srv.logError(s, stageRequest, err)
+		return
+	}
+	if err := srv.decide(s, negotiation, request); err != nil {
+		s.failure = FailureDenied
+		srv.handshakeFailed(s)
+		srv.logError(s, stageRequest, err)
 		return
 	}
+	srv.onRequest(s, request)
+	if s.Context().Err() != nil {
+		// closed by OnRequest
+		return
+	}
+	if srv.Hijacker != nil {
+		endTrace()
+		// the hijacker may release the session before Hijack returns.
+		atomic.AddInt32(&srv.serving, 1)
+		s.release = func() {
+			end()
+			atomic.AddInt32(&srv.serving, -1)
+		}
+		if srv.Hijacker.Hijack(s, conn, request) {
+			hijacked = true
+			return
+		}
+		s.release = nil
+		atomic.AddInt32(&srv.serving, -1)
+	}
 	// establish connection to remote
-	remote, err := srv.establish(client, request)
+	remote, err := srv.establish(s, negotiation, request)
+	endTrace()
 	if err != nil {
-		srv.logf()(err.Error())
-		client.Close()
+		srv.logError(s, stageEstablish, err)
 		return
 	}
+	defer remote.Close()
+	stopLimit := srv.limitDuration(s, conn, remote)
+	defer stopLimit()
+	stopIdle := srv.limitIdle(s, conn, remote)
+	defer stopIdle()
+	srv.statsRelay(s)
+	srv.onRelayStart(s)
 	// transport data
-	if request.CMD == CONNECT {
-		err = srv.transport().TransportTCP(client, remote)
+	if request.CMD == CONNECT || request.CMD == BIND {
+		client, remote := srv.countLegs(s, conn, srv.timeFirstByte(s, remote))
+		client, remote = srv.wrapLegs(s, client, remote)
+		client, remote = srv.interceptLegs(s, client, remote)
+		client, remote, releaseRate := srv.limitRate(s, client, remote)
+		defer releaseRate()
+		stopUsage := srv.reportUsage(s)
+		err = srv.transport(s).TransportTCP(client, remote)
+		stopUsage()
 		if err != nil {
-			srv.logf()(err.Error())
+			srv.logError(s, stageRelay, err)
 		}
 	} else if request.CMD == UDP_ASSOCIATE {
-		udpServer := remote.(*net.UDPConn)
-		err = srv.transport().TransportUDP(udpServer)
+		relay := remote.(*net.UDPConn)
+		go watchAssociation(conn, relay)
+		err = srv.transportUDP(s, relay)
 		if err != nil {
-			srv.logf()(err.Error())
+			srv.logError(s, stageRelay, err)
 		}
 	}
 }
 
-func (srv *Server) transport() Transporter {
+// localAddress return the address the server reports in replies.
+// It is a copy of the address the server listens on, or the local
+// address of client if the server was not started by ListenAndServe or
+// ListenAndServeNetwork on a TCP network.
+func (srv *Server) localAddress(client net.Conn) *Address {
+	if srv.addr != nil {
+		addr := *srv.addr
+		return &addr
+	}
+	if client.LocalAddr() != nil {
+		addr, err := ParseAddress(client.LocalAddr().String())
+		if err == nil {
+			return addr
+		}
+	}
+	return &Address{net.IPv4zero, IPV4_ADDRESS, 0}
+}
+
+// transport return the Transporter of s, the one of its route if any.
+func (srv *Server) transport(s *Session) Transporter {
+	if s.route.Transporter != nil {
+		return s.route.Transporter
+	}
 	if srv.Transporter == nil {
 		return DefaultTransporter
 	}
 	return srv.Transporter
 }
 
-var errDisableSocks4 = errors.New("socks4 server has been disabled")
+var (
+	errDisableSocks4 = errors.New("socks4 server has been disabled")
+	errSocks4Auth    = errors.New("socks4 client cannot authenticate")
+)
+
+// rejectSocks4 send a REJECT reply to a socks4 client before its request
+// and return err.
+func (srv *Server) rejectSocks4(client net.Conn, err error) error {
+	address := &Address{net.IPv4zero, IPV4_ADDRESS, 0}
+	addr, werr := address.Bytes(Version4)
+	if werr != nil {
+		return &OpError{Version4, "", client.RemoteAddr(), "\"authentication\"", werr}
+	}
+	_, werr = client.Write(append([]byte{0, REJECT}, addr...))
+	if werr != nil {
+		return &OpError{Version4, "write", client.RemoteAddr(), "\"authentication\"", werr}
+	}
+	return err
+}
 
 // handShake socks protocol handshake process
-func (srv *Server) handShake(client net.Conn) (*Request, error) {
+func (srv *Server) handShake(s *Session, client net.Conn) (*Request, error) {
 	//validate socks version message
 	version, err := checkVersion(client)
 	if err != nil {
+		if v, ok := err.(*VersionError); ok {
+			if srv.HTTPConnect && isHTTPMethodStart(v.VER) {
+				return srv.readHTTPRequest(s, client, v.VER)
+			}
+			s.failure = FailureVersion
+		}
 		return nil, &OpError{Version5, "read", client.RemoteAddr(), "\"check version\"", err}
 	}
 
 	//socks4 protocol process
 	if version == Version4 {
 		if srv.DisableSocks4 {
-			//send server reject reply
-			address := &Address{net.IPv4zero, IPV4_ADDRESS, 0}
-			addr, err := address.Bytes(Version4)
-			if err != nil {
-				return nil, &OpError{Version4, "", client.RemoteAddr(), "\"authentication\"", err}
-			}
-			_, err = client.Write(append([]byte{0, REJECT}, addr...))
-			if err != nil {
-				return nil, &OpError{Version4, "write", client.RemoteAddr(), "\"authentication\"", err}
-			}
-			return nil, errDisableSocks4
+			s.failure = FailureVersion
+			return nil, srv.rejectSocks4(client, errDisableSocks4)
+		}
+		// socks4 has no authentication, serve it only to clients which
+		// may skip it.
+		if srv.selectMethod(client.RemoteAddr(), []METHOD{NO_AUTHENTICATION_REQUIRED}) != NO_AUTHENTICATION_REQUIRED {
+			s.failure = FailureMethods
+			return nil, srv.rejectSocks4(client, errSocks4Auth)
 		}
 
 		//handle socks4 request
-		return srv.readSocks4Request(client)
+		return srv.readSocks4Request(s, client)
 	}
 
 	//socks5 protocol authentication
-	err = srv.authentication(client)
+	err = srv.authentication(s, client)
 	if err != nil {
 		return nil, err
 	}
+	if s.encapsulate != nil {
+		client = s.encapsulate(client)
+		s.encapsulated = client
+	}
 
 	//handle socks5 request
 	return srv.readSocks5Request(client)
 }
 
 // authentication socks5 authentication process
-func (srv *Server) authentication(client net.Conn) error {
-	//get nMethods
-	nMethods, err := ReadNBytes(client, 1)
-	if err != nil {
-		return err
-	}
-
-	//Get methods
-	methods, err := ReadNBytes(client, int(nMethods[0]))
+func (srv *Server) authentication(s *Session, client net.Conn) error {
+	//get nMethods, methods
+	methods, err := parser.ReadMethods(client)
 	if err != nil {
 		return err
 	}
 
-	return srv.MethodSelect(methods, client)
+	return srv.methodSelect(s, methods, client)
 }
 
-// readSocks4Request receive socks4 protocol client request.
-func (srv *Server) readSocks4Request(client net.Conn) (*Request, error) {
+// readSocks4Request receive socks4 protocol client request, its USERID
+// is recorded in s.UserID.
+func (srv *Server) readSocks4Request(s *Session, client net.Conn) (*Request, error) {
 	reply := &Reply{
 		VER:     Version4,
-		Address: srv.addr,
+		Address: srv.localAddress(client),
 	}
 	req := &Request{
 		VER:   Version4,
@@ -225,16 +781,18 @@ func (srv *Server) readSocks4Request(client net.Conn) (*Request, error) {
 		return nil, &OpError{req.VER, "read", client.RemoteAddr(), "\"process request command\"", err}
 	}
 	req.CMD = cmd[0]
-	// DST.PORT, DST.IP
-	addr, rep, err := readAddress(client, req.VER)
+	// DST.PORT, DST.IP, USERID
+	r, err := parser.ReadSocks4Request(client)
 	if err != nil {
-		reply.REP = rep
-		err := srv.sendReply(client, reply)
-		if err != nil {
-			return nil, &OpError{req.VER, "write", client.RemoteAddr(), "\"process request address type\"", err}
+		reply.REP = REJECT
+		werr := srv.sendReply(client, reply)
+		if werr != nil {
+			return nil, &OpError{req.VER, "write", client.RemoteAddr(), "\"process request address type\"", werr}
 		}
+		return nil, &OpError{Version4, "read", client.RemoteAddr(), "\"process request dest address\"", err}
 	}
-	req.Address = addr
+	s.UserID = string(r.UserID)
+	req.Address = &Address{net.IP(r.Address.Host), r.Address.Type, r.Address.Port}
 	return req, nil
 }
 
@@ -242,7 +800,7 @@ func (srv *Server) readSocks4Request(client net.Conn) (*Request, error) {
 func (srv *Server) readSocks5Request(client net.Conn) (*Request, error) {
 	reply := &Reply{
 		VER:     Version5,
-		Address: srv.addr,
+		Address: srv.localAddress(client),
 	}
 	req := &Request{}
 	//VER, CMD, RSV
@@ -254,13 +812,17 @@ func (srv *Server) readSocks5Request(client net.Conn) (*Request, error) {
 	req.CMD = cmd[1]
 	req.RSV = cmd[2]
 	// DST.IP, DST.PORT
-	addr, rep, err := readAddress(client, req.VER)
+	if req.VER != Version5 {
+		return nil, &OpError{Version5, "", client.RemoteAddr(), "\"process request ver\"", &VersionError{req.VER}}
+	}
+	addr, rep, err := readAddress(client, Version5)
 	if err != nil {
 		reply.REP = rep
-		err := srv.sendReply(client, reply)
-		if err != nil {
-			return nil, &OpError{req.VER, "write", client.RemoteAddr(), "\"process request address\"", err}
+		werr := srv.sendReply(client, reply)
+		if werr != nil {
+			return nil, &OpError{req.VER, "write", client.RemoteAddr(), "\"process request address\"", werr}
 		}
+		return nil, err
 	}
 	req.Address = addr
 
@@ -272,7 +834,9 @@ func (srv *Server) readSocks5Request(client net.Conn) (*Request, error) {
 // Otherwise return false.
 func (srv *Server) IsAllowNoAuthRequired() bool {
 	if len(srv.Authenticators) == 0 {
-		return true
+		// a store set by SetStore requires authentication.
+		c := srv.swapped()
+		return c == nil || c.Store == nil
 	}
 	for method := range srv.Authenticators {
 		if method == NO_AUTHENTICATION_REQUIRED {
@@ -282,28 +846,40 @@ func (srv *Server) IsAllowNoAuthRequired() bool {
 	return false
 }
 
-// establish tcp connection to remote host if command is CONNECT or
-// start listen on udp socket when command is UDP_ASSOCIATE.
+// establish tcp connection to remote host if command is CONNECT,
+// accept the connection of the peer if command is BIND, or start listen
+// on udp socket when command is UDP_ASSOCIATE.
 // Finally, send corresponding reply to client.
-func (srv *Server) establish(client net.Conn, req *Request) (dest net.Conn, err error) {
+func (srv *Server) establish(s *Session, client net.Conn, req *Request) (dest net.Conn, err error) {
 	reply := &Reply{
 		VER:     req.VER,
-		Address: srv.addr,
+		Address: srv.localAddress(client),
 	}
 
 	// version4
 	if req.VER == Version4 {
 		switch req.CMD {
 		case CONNECT:
-			dest, err = net.Dial("tcp", req.Address.String())
+			dest, err = srv.dialTCP(s, req.Address)
 			if err != nil {
+				reply.REP = REJECT
+				reply.Address = &Address{net.IPv4zero, IPV4_ADDRESS, 0}
+				if err := srv.sendReply(client, reply); err != nil {
+					return nil, &OpError{req.VER, "write", client.RemoteAddr(), "\"process request reject\"", err}
+				}
 				return nil, err
 			}
 			reply.REP = PERMIT
+			if reply.Address.ATYPE != IPV4_ADDRESS {
+				// socks4 clients take 0.0.0.0 as the address of the server.
+				reply.Address = &Address{net.IPv4zero.To4(), IPV4_ADDRESS, reply.Address.Port}
+			}
 			err = srv.sendReply(client, reply)
 			if err != nil {
 				return nil, &OpError{req.VER, "write", client.RemoteAddr(), "\"process request permit\"", err}
 			}
+		case BIND:
+			return srv.bind(s, client, req)
 		default:
 			reply.REP = REJECT
 			reply.Address = &Address{net.IPv4zero, IPV4_ADDRESS, 0}
@@ -316,29 +892,47 @@ func (srv *Server) establish(client net.Conn, req *Request) (dest net.Conn, err
 	} else if req.VER == Version5 { // version5
 		switch req.CMD {
 		case CONNECT:
-			dest, err = net.Dial("tcp", req.Address.String())
+			dest, err = srv.dialTCP(s, req.Address)
 			if err != nil {
+				reply.REP = err.(*DialError).REP
+				if err := srv.sendReply(client, reply); err != nil {
+					return nil, &OpError{req.VER, "write", client.RemoteAddr(), "\"process request command\"", err}
+				}
 				return nil, err
 			}
 			reply.REP = SUCCESSED
+			reply.Address = srv.boundAddress(client, dest)
 			err = srv.sendReply(client, reply)
 			if err != nil {
 				return nil, &OpError{req.VER, "write", client.RemoteAddr(), "\"process request command\"", err}
 			}
 		case UDP_ASSOCIATE:
-			addr, err := net.ResolveUDPAddr("udp", net.JoinHostPort(srv.addr.Addr.String(), "0"))
+			done, ok := srv.countUDPAssociation(s)
+			if !ok {
+				reply.REP = CONNECTION_NOT_ALLOW_BY_RULESET
+				if err := srv.sendReply(client, reply); err != nil {
+					return nil, &OpError{req.VER, "write", client.RemoteAddr(), "\"process request command\"", err}
+				}
+				return nil, &OpError{req.VER, "", client.RemoteAddr(), "\"process request command\"", errUDPAssociationLimit}
+			}
+			s.udpDone = done
+			relay, err := srv.listenUDP(s, srv.relayIP(client))
 			if err != nil {
-				return nil, err
+				reply.REP = GENERAL_SOCKS_SERVER_FAILURE
+				if err := srv.sendReply(client, reply); err != nil {
+					return nil, &OpError{req.VER, "write", client.RemoteAddr(), "\"process request command\"", err}
+				}
+				return nil, &OpError{req.VER, "", client.RemoteAddr(), "\"process request command\"", err}
 			}
-			dest, err = net.ListenUDP("udp", addr)
+			dest = relay
 			reply.REP = SUCCESSED
-			_, p, err := net.SplitHostPort(dest.LocalAddr().String())
-			port, err := strconv.Atoi(p)
-			reply.Address.Port = uint16(port)
+			reply.Address = srv.relayAddress(client, relay.LocalAddr().(*net.UDPAddr))
 			err = srv.sendReply(client, reply)
 			if err != nil {
 				return nil, &OpError{req.VER, "write", client.RemoteAddr(), "\"process request command\"", err}
 			}
+		case BIND:
+			return srv.bind(s, client, req)
 		default:
 			reply.REP = COMMAND_NOT_SUPPORTED
 			err = srv.sendReply(client, reply)
@@ -358,33 +952,10 @@ var errErrorATPE = errors.New("socks4 server bind address type should be ipv4")
 
 // sendReply The server send socks protocol reply to client
 func (srv *Server) sendReply(out io.Writer, r *Reply) error {
-	var reply []byte
-	var err error
-
-	if r.VER == Version4 {
-		if r.Address.ATYPE != IPV4_ADDRESS {
-			return errErrorATPE
-		}
-		addr, err := r.Address.Bytes(r.VER)
-		if err != nil {
-			return err
-		}
-		reply = append(reply, 0, r.REP)
-		// Remove NULL at the end. Please see Address.Bytes() Method.
-		reply = append(reply, addr[:len(addr)-1]...)
-	} else if r.VER == Version5 {
-		addr, err := r.Address.Bytes(r.VER)
-		if err != nil {
-			return err
-		}
-		reply = append(reply, r.VER, r.REP, r.RSV)
-		reply = append(reply, addr...)
-	} else {
-		return &VersionError{r.VER}
+	if c, ok := out.(*connectConn); ok {
+		return c.writeReply(r.REP)
 	}
-
-	_, err = out.Write(reply)
-	return err
+	return WriteReply(out, r)
 }
 
 //// MethodSelector select authentication method and reply to client.
@@ -396,37 +967,7 @@ func (srv *Server) sendReply(out io.Writer, r *Reply) error {
 // select NO_AUTHENTICATION_REQUIRED method if client provide 0x00 and
 // server provides nothing or provides NO_AUTHENTICATION_REQUIRED.
 func (srv *Server) MethodSelect(methods []CMD, client net.Conn) error {
-	//Select method to authenticate, then send selected method to client.
-	for _, method := range methods {
-		//Preferred to use NO_AUTHENTICATION_REQUIRED method
-		if method == NO_AUTHENTICATION_REQUIRED && srv.IsAllowNoAuthRequired() {
-			reply := []byte{Version5, NO_AUTHENTICATION_REQUIRED}
-			_, err := client.Write(reply)
-			if err != nil {
-				return err
-			}
-			return nil
-		}
-		for m := range srv.Authenticators {
-			//Select the first matched method to authenticate
-			if m == method {
-				reply := []byte{Version5, USERNAME_PASSWORD}
-				_, err := client.Write(reply)
-				if err != nil {
-					return err
-				}
-				return srv.Authenticators[m].Authenticate(client, client)
-			}
-		}
-	}
-
-	//There are no Methods can use
-	reply := []byte{Version5, NO_ACCEPTABLE_METHODS}
-	_, err := client.Write(reply)
-	if err != nil {
-		return err
-	}
-	return &MethodError{methods[0]}
+	return srv.methodSelect(newSession(context.Background(), client), methods, client)
 }
 
 func (srv *Server) logf() func(format string, args ...interface{}) {
@@ -471,3 +1012,8 @@ func (o *OpError) Error() string {
 	str += ":" + o.Err.Error()
 	return str
 }
+
+// Unwrap return the underlying error.
+func (o *OpError) Unwrap() error {
+	return o.Err
+}
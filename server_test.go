@@ -1,9 +1,15 @@
 package socks5
 
 import (
+	"context"
+	"crypto/sha256"
 	"errors"
+	"io"
+	"log"
 	"net"
+	"path/filepath"
 	"testing"
+	"time"
 )
 
 func TestOpError(t *testing.T) {
@@ -22,3 +28,197 @@ func TestOpError(t *testing.T) {
 		t.Errorf("expected: %s\ngot: %s", expected, err.Error())
 	}
 }
+
+// serveTest start srv on a loopback listener and return its address.
+func serveTest(t *testing.T, srv *Server) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := ln.Addr().(*net.TCPAddr).Port
+	srv.addr = &Address{net.IPv4(127, 0, 0, 1).To4(), IPV4_ADDRESS, uint16(port)}
+	go srv.Serve(ln)
+	t.Cleanup(func() { ln.Close() })
+	return ln.Addr().String()
+}
+
+// connectTest dial the socks5 server at addr without authentication,
+// send CONNECT request for dest and return the connection and the reply.
+func connectTest(t *testing.T, addr string, dest *Address) (net.Conn, []byte) {
+	return requestTest(t, addr, CONNECT, dest)
+}
+
+// requestTest is connectTest for the command cmd.
+func requestTest(t *testing.T, addr string, cmd CMD, dest *Address) (net.Conn, []byte) {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	_, err = conn.Write([]byte{Version5, 1, NO_AUTHENTICATION_REQUIRED})
+	if err != nil {
+		t.Fatal(err)
+	}
+	method, err := ReadNBytes(conn, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if method[1] != NO_AUTHENTICATION_REQUIRED {
+		t.Fatalf("selected method: %#x", method[1])
+	}
+
+	b, err := dest.Bytes(Version5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = conn.Write(append([]byte{Version5, cmd, 0}, b...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	reply, err := ReadNBytes(conn, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return conn, reply
+}
+
+func TestServer_ServeConn(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		io.Copy(conn, conn)
+		conn.Close()
+	}()
+
+	srv := &Server{}
+	client, server := net.Pipe()
+	defer client.Close()
+	done := make(chan struct{})
+	go func() {
+		srv.ServeConn(context.Background(), server)
+		close(done)
+	}()
+
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+	dest, _ := ParseAddress(ln.Addr().String())
+	b, _ := dest.Bytes(Version5)
+	client.Write([]byte{Version5, 1, NO_AUTHENTICATION_REQUIRED})
+	ReadNBytes(client, 2)
+	client.Write(append([]byte{Version5, CONNECT, 0}, b...))
+	reply, err := ReadNBytes(client, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reply[1] != SUCCESSED {
+		t.Fatalf("reply: %#x", reply[1])
+	}
+
+	client.Write([]byte("ping"))
+	echo, err := ReadNBytes(client, 4)
+	if err != nil || string(echo) != "ping" {
+		t.Errorf("echo: %q, %v", echo, err)
+	}
+
+	client.Close()
+	<-done
+}
+
+func TestServer_ListenAndServeNetwork(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "socks.sock")
+	srv := &Server{}
+	served := make(chan error, 1)
+	go func() { served <- srv.ListenAndServeNetwork("unix", path) }()
+	defer srv.Close()
+
+	client := &Client{ProxyAddr: path, Dialer: dialContextFunc(func(ctx context.Context, network, address string) (net.Conn, error) {
+		var d net.Dialer
+		return d.DialContext(ctx, "unix", address)
+	})}
+	echo := echoTest(t)
+	var conn net.Conn
+	var err error
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if conn, err = client.Dial("tcp", echo); err == nil {
+			break
+		}
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	conn.Write([]byte("ping"))
+	if b, err := ReadNBytes(conn, 4); err != nil || string(b) != "ping" {
+		t.Errorf("echo: %q, %v", b, err)
+	}
+
+	srv.Close()
+	if err := <-served; err != ErrServerClosed {
+		t.Errorf("served: %v", err)
+	}
+}
+
+func TestServer_ServeConnCancel(t *testing.T) {
+	srv := &Server{}
+	client, server := net.Pipe()
+	defer client.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		srv.ServeConn(ctx, server)
+		close(done)
+	}()
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("ServeConn should return when ctx is cancelled")
+	}
+}
+
+func TestServer_Socks4(t *testing.T) {
+	userIDs := make(chan string, 2)
+	srv := &Server{Rules: RuleSetFunc(func(s *Session, req *Request) bool {
+		userIDs <- s.UserID
+		return true
+	})}
+	_, port, _ := net.SplitHostPort(echoTest(t))
+	client := &Client{ProxyAddr: serveTest(t, srv), Protocol: ProtocolSOCKS4, Username: "admin"}
+	for _, dest := range []string{"127.0.0.1:" + port, "localhost:" + port} {
+		conn, err := client.Dial("tcp", dest)
+		if err != nil {
+			t.Fatalf("%s: %v", dest, err)
+		}
+		conn.Close()
+		if id := <-userIDs; id != "admin" {
+			t.Errorf("%s: user id %q", dest, id)
+		}
+	}
+
+	// socks4 clients cannot authenticate to servers requiring it.
+	store := NewMemeryStore(sha256.New(), "secret")
+	store.Set("admin", "secret")
+	srv = &Server{
+		Authenticators: map[METHOD]Authenticator{USERNAME_PASSWORD: UserPwdAuth{store}},
+		ErrorLog:       log.New(io.Discard, "", 0),
+	}
+	client.ProxyAddr = serveTest(t, srv)
+	if _, err := client.Dial("tcp", "127.0.0.1:"+port); err == nil {
+		t.Error("socks4 served without authentication")
+	}
+	srv = &Server{DisableSocks4: true, ErrorLog: log.New(io.Discard, "", 0)}
+	client.ProxyAddr = serveTest(t, srv)
+	if _, err := client.Dial("tcp", "127.0.0.1:"+port); err == nil {
+		t.Error("socks4 served while disabled")
+	}
+}
@@ -0,0 +1,222 @@
+package socks5
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// sessionID generate Session.ID
+var sessionID uint64
+
+// Session holds the state of one client connection, from accept to close.
+// The server creates a Session per accepted connection and passes it to
+// authenticators and hooks, they may store their own data in its Metadata.
+type Session struct {
+	// ID uniquely identifies the session in the process.
+	ID uint64
+
+	// relayed bytes, time of the last relayed byte in nanoseconds since
+	// the Unix epoch, write stalls per leg in nanoseconds and number of
+	// writes stalled past the threshold, accessed atomically. Keep them
+	// 64-bit aligned.
+	bytesUp     uint64
+	bytesDown   uint64
+	lastActive  int64
+	stallClient int64
+	stallRemote int64
+	stalls      uint64
+
+	// ClientAddr is the client's network address.
+	ClientAddr net.Addr
+
+	// TLS is the state of the TLS connection of the client, such as its
+	// verified certificates, nil if the client did not connect over TLS.
+	TLS *tls.ConnectionState
+
+	// Method is the negotiated socks5 authentication method.
+	Method METHOD
+
+	// Methods are the socks5 methods offered by the client, as sent.
+	Methods []METHOD
+
+	// Username is the authenticated user name, empty if the client
+	// did not authenticate with Username/Password or GSSAPI.
+	Username string
+
+	// UserID is the USERID of socks4 requests, as sent by the client,
+	// which does not authenticate it.
+	UserID string
+
+	// Request is the client request, nil until it has been read.
+	Request *Request
+
+	// Metadata is the key/value store attached to the session.
+	Metadata
+
+	// MaxDuration overrides Server.MaxSessionDuration for the session,
+	// authenticators, routers and hooks may set it before the relay
+	// starts. Zero uses the server value, negative means no limit.
+	MaxDuration time.Duration
+
+	// MaxBytes overrides Server.MaxSessionBytes for the session, such as
+	// per user quotas. Zero uses the server value, negative means no limit.
+	MaxBytes int64
+
+	// IdleTimeout overrides Server.IdleTimeout for the session. Zero uses
+	// the server value, negative means no timeout.
+	IdleTimeout time.Duration
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	start  time.Time
+	// tags set by Tag
+	tagsMu sync.Mutex
+	tags   map[string]string
+	// route used to reach the destination
+	route Route
+	// routes chosen by Server.Policy, overriding Server.Router
+	routes []Route
+	// release ends the session taken over by Server.Hijacker, see Release
+	release     func()
+	releaseOnce sync.Once
+	// udpDone ends the count of the UDP association of the session
+	udpDone func()
+	// encapsulate wraps the client connection after authentication when
+	// the method protects the rest of the session, such as GSSAPI
+	encapsulate func(net.Conn) net.Conn
+	// encapsulated is the wrapped client connection
+	encapsulated net.Conn
+	// failure is the reason of the handshake failure, see Metrics
+	failure string
+	// limited is the failure of a handshake exceeding a limit of
+	// handshakeConn, which overrides failure.
+	limited string
+	// authUser is the user name the client failed to authenticate as.
+	authUser string
+	// checkUser optionally refuses user names before the validation of
+	// their credentials, see Server.Lockout.
+	checkUser func(username string) error
+	// user is the authenticated user name, a string, for other
+	// goroutines, see CloseSessionsFor.
+	user atomic.Value
+
+	// closeReason is why the server closed the session, see CloseReason
+	reasonMu    sync.Mutex
+	closeReason string
+}
+
+// newSession create a session for client connection.
+func newSession(ctx context.Context, client net.Conn) *Session {
+	s := &Session{
+		ID:         atomic.AddUint64(&sessionID, 1),
+		ClientAddr: client.RemoteAddr(),
+		start:      time.Now(),
+	}
+	s.ctx = ContextWithSession(ctx, s)
+	return s
+}
+
+// Context return the context of the session, it carries the session
+// itself and is done when the session is cancelled.
+func (s *Session) Context() context.Context {
+	if s.ctx == nil {
+		return ContextWithSession(context.Background(), s)
+	}
+	return s.ctx
+}
+
+// ClientIP return the IP address of the client, or nil if unknown.
+func (s *Session) ClientIP() net.IP {
+	return addrIP(s.ClientAddr)
+}
+
+// addrIP return the IP address of addr, or nil if unknown. Clients of
+// TCP have a *net.TCPAddr, and those of QUIC a *net.UDPAddr.
+func addrIP(addr net.Addr) net.IP {
+	switch addr := addr.(type) {
+	case *net.TCPAddr:
+		return addr.IP
+	case *net.UDPAddr:
+		return addr.IP
+	case nil:
+		return nil
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return nil
+	}
+	return net.ParseIP(host)
+}
+
+// MetaKey is the key type of Metadata. Packages using Metadata should
+// define their own keys with MetaKey to avoid collisions, such as
+//
+//	const routeKey socks5.MetaKey = "mypkg.route"
+type MetaKey string
+
+// Well-known Metadata keys set by this package.
+const (
+	// MetaUser is set to the user name by Username/Password authentication.
+	MetaUser MetaKey = "user"
+	// MetaRoute is set to the name of route used to reach the destination.
+	MetaRoute MetaKey = "route"
+	// MetaSNI is set to the TLS server name requested by the client, see
+	// SniffSNI.
+	MetaSNI MetaKey = "sni"
+)
+
+// Metadata is a concurrency safe key/value store scoped to a session.
+// The zero value is ready to use.
+type Metadata struct {
+	mu     sync.RWMutex
+	values map[MetaKey]interface{}
+}
+
+// Set the value of key.
+func (m *Metadata) Set(key MetaKey, value interface{}) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.values == nil {
+		m.values = make(map[MetaKey]interface{})
+	}
+	m.values[key] = value
+}
+
+// Get the value of key, ok is false if key is not present.
+func (m *Metadata) Get(key MetaKey) (value interface{}, ok bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	value, ok = m.values[key]
+	return
+}
+
+// GetString get the value of key as string. It returns "" if key is not
+// present or the value is not a string.
+func (m *Metadata) GetString(key MetaKey) string {
+	value, _ := m.Get(key)
+	str, _ := value.(string)
+	return str
+}
+
+// Delete key.
+func (m *Metadata) Delete(key MetaKey) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.values, key)
+}
+
+// Range calls f sequentially for each key and value. If f returns false,
+// range stops the iteration. f must not modify the Metadata.
+func (m *Metadata) Range(f func(key MetaKey, value interface{}) bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	for k, v := range m.values {
+		if !f(k, v) {
+			return
+		}
+	}
+}
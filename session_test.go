@@ -0,0 +1,106 @@
+package socks5
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha256"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestMetadata(t *testing.T) {
+	var m Metadata
+	if _, ok := m.Get(MetaRoute); ok {
+		t.Fatal("zero Metadata should be empty")
+	}
+
+	m.Set(MetaRoute, "upstream-eu")
+	m.Set("count", 1)
+	if got := m.GetString(MetaRoute); got != "upstream-eu" {
+		t.Errorf("get: %s, want: upstream-eu", got)
+	}
+	if got := m.GetString("count"); got != "" {
+		t.Errorf("GetString on non-string value: %q, want empty", got)
+	}
+
+	n := 0
+	m.Range(func(key MetaKey, value interface{}) bool {
+		n++
+		return true
+	})
+	if n != 2 {
+		t.Errorf("range: %d keys, want 2", n)
+	}
+
+	m.Delete(MetaRoute)
+	if _, ok := m.Get(MetaRoute); ok {
+		t.Error("key should be deleted")
+	}
+}
+
+func TestUserPwdAuth_AuthenticateSession(t *testing.T) {
+	store := NewMemeryStore(md5.New(), "secret")
+	store.Set("admin", "123456")
+	auth := UserPwdAuth{store}
+
+	in := bytes.NewBuffer([]byte{0x01, 5})
+	in.WriteString("admin")
+	in.WriteByte(6)
+	in.WriteString("123456")
+	out := &bytes.Buffer{}
+
+	s := &Session{}
+	err := auth.AuthenticateSession(s, in, out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Username != "admin" || s.GetString(MetaUser) != "admin" {
+		t.Errorf("session user: %q, metadata user: %q, want admin", s.Username, s.GetString(MetaUser))
+	}
+	if !bytes.Equal(out.Bytes(), []byte{userPassVersion, 0}) {
+		t.Errorf("reply: %v, want: %v", out.Bytes(), []byte{userPassVersion, 0})
+	}
+}
+
+func TestServer_CloseSessionsFor(t *testing.T) {
+	store := NewMemeryStore(sha256.New(), "")
+	store.Set("alice", "a")
+	store.Set("bob", "b")
+	srv := &Server{
+		Authenticators: map[METHOD]Authenticator{USERNAME_PASSWORD: UserPwdAuth{store}},
+		MethodPriority: []METHOD{USERNAME_PASSWORD},
+	}
+	addr := serveTest(t, srv)
+	echo := echoTest(t)
+	dial := func(user, password string) net.Conn {
+		conn, err := (&Client{ProxyAddr: addr, Username: user, Password: password}).Dial("tcp", echo)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		conn.Write([]byte("ping"))
+		ReadNBytes(conn, 4)
+		return conn
+	}
+	alice := []net.Conn{dial("alice", "a"), dial("alice", "a")}
+	bob := dial("bob", "b")
+
+	if n := srv.CloseSessionsFor("alice"); n != 2 {
+		t.Errorf("closed %d sessions, want 2", n)
+	}
+	for _, conn := range alice {
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+			t.Errorf("closed session read: %v", err)
+		}
+	}
+	bob.Write([]byte("pong"))
+	if b, err := ReadNBytes(bob, 4); err != nil || string(b) != "pong" {
+		t.Errorf("bob echo %q, %v", b, err)
+	}
+	if n := srv.CloseSessionsFor(""); n != 0 {
+		t.Errorf("closed %d anonymous sessions", n)
+	}
+}
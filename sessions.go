@@ -0,0 +1,136 @@
+package socks5
+
+import (
+	"sync"
+	"time"
+)
+
+// sessionSet is the set of sessions being served by a server.
+type sessionSet struct {
+	mu sync.Mutex
+	m  map[*Session]struct{}
+}
+
+func (set *sessionSet) add(s *Session) {
+	set.mu.Lock()
+	defer set.mu.Unlock()
+	if set.m == nil {
+		set.m = make(map[*Session]struct{})
+	}
+	set.m[s] = struct{}{}
+}
+
+func (set *sessionSet) remove(s *Session) {
+	set.mu.Lock()
+	defer set.mu.Unlock()
+	delete(set.m, s)
+}
+
+// Sessions return the sessions being served, in no particular order.
+func (srv *Server) Sessions() []*Session {
+	srv.sessions.mu.Lock()
+	defer srv.sessions.mu.Unlock()
+	list := make([]*Session, 0, len(srv.sessions.m))
+	for s := range srv.sessions.m {
+		list = append(list, s)
+	}
+	return list
+}
+
+// SessionStats return the counters of the sessions being served, from
+// Stats if set. Without it, sessions only have their ID, client, start,
+// bytes and tags: other fields are set by the goroutines of sessions, they
+// are not read.
+func (srv *Server) SessionStats() []ConnStat {
+	if srv.Stats != nil {
+		return srv.Stats.Snapshot().Active
+	}
+	list := []ConnStat{}
+	for _, s := range srv.Sessions() {
+		stat := ConnStat{ID: s.ID, Start: s.start, Duration: time.Since(s.start), BytesUp: s.BytesUp(), BytesDown: s.BytesDown(), Tags: s.tagMap()}
+		if s.ClientAddr != nil {
+			stat.ClientAddr = s.ClientAddr.String()
+		}
+		list = append(list, stat)
+	}
+	return list
+}
+
+// CloseSession close the session of id with CloseKilled as reason, and
+// report whether it was being served.
+func (srv *Server) CloseSession(id uint64) bool {
+	for _, s := range srv.Sessions() {
+		if s.ID == id {
+			s.setCloseReason(CloseKilled)
+			s.Close()
+			return true
+		}
+	}
+	return false
+}
+
+// CloseSessionsFor close the sessions authenticated as username with
+// CloseKilled as reason, and return their number. Remove the user from
+// the credential store first, so that it cannot authenticate new
+// sessions:
+//
+//	store.Del("alice")
+//	srv.CloseSessionsFor("alice")
+func (srv *Server) CloseSessionsFor(username string) int {
+	n := 0
+	for _, s := range srv.Sessions() {
+		if user, _ := s.user.Load().(string); user != "" && user == username {
+			s.setCloseReason(CloseKilled)
+			s.Close()
+			n++
+		}
+	}
+	return n
+}
+
+// Close end the session: the server closes its client connection, which
+// ends its negotiation or relay. Connections taken over by Hijacker are
+// not closed, their hijacker is notified by the end of the session
+// context.
+func (s *Session) Close() {
+	if s.cancel != nil {
+		s.cancel()
+	}
+}
+
+// Reasons the server closes sessions, see Session.CloseReason.
+const (
+	// CloseIdle is a session idle longer than its idle timeout.
+	CloseIdle = "idle"
+	// CloseExpired is a session which outlived its lifetime limit.
+	CloseExpired = "expired"
+	// CloseByteLimit is a session which transferred more than its byte
+	// limit.
+	CloseByteLimit = "byte_limit"
+	// CloseShed is an idle session closed under memory pressure.
+	CloseShed = "shed"
+	// CloseShutdown is a session closed by Server.Close, or by
+	// Server.Shutdown when its context expired.
+	CloseShutdown = "shutdown"
+	// CloseKilled is a session closed by an operator, see
+	// Server.CloseSession and Server.CloseSessionsFor.
+	CloseKilled = "killed"
+)
+
+// CloseReason return why the server closed the session, one of the Close
+// constants, or empty if the client or the destination ended it.
+func (s *Session) CloseReason() string {
+	s.reasonMu.Lock()
+	defer s.reasonMu.Unlock()
+	return s.closeReason
+}
+
+// setCloseReason record reason as why the session is closed, unless an
+// earlier reason was recorded.
+func (s *Session) setCloseReason(reason string) {
+	s.reasonMu.Lock()
+	defer s.reasonMu.Unlock()
+	if s.closeReason == "" {
+		s.closeReason = reason
+	}
+}
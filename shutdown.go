@@ -0,0 +1,118 @@
+package socks5
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ErrServerClosed is returned by the Serve, ListenAndServe and
+// ListenAndServeNetwork methods after a call to Shutdown or Close.
+var ErrServerClosed = errors.New("socks5: Server closed")
+
+// shutdownPollInterval is how often Shutdown checks for the end of the
+// connections being served.
+const shutdownPollInterval = 50 * time.Millisecond
+
+// Shutdown gracefully shuts down the server: it closes all the listeners
+// served by Serve, then waits for the connections accepted from them to
+// end, draining their relays, and for the sessions taken over by Hijacker
+// to be released. If ctx expires first, Shutdown closes the
+// remaining sessions of the server, with the close reason CloseShutdown,
+// and returns the context error. A ctx without deadline waits as long as
+// the sessions last.
+//
+// Once Shutdown has been called, Serve and ListenAndServe return
+// ErrServerClosed.
+func (srv *Server) Shutdown(ctx context.Context) error {
+	atomic.StoreInt32(&srv.inShutdown, 1)
+	err := srv.closeListeners()
+
+	ticker := time.NewTicker(shutdownPollInterval)
+	defer ticker.Stop()
+	for atomic.LoadInt32(&srv.serving) > 0 {
+		select {
+		case <-ctx.Done():
+			srv.closeSessions()
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+	return err
+}
+
+// Close immediately closes all the listeners served by Serve and all the
+// sessions of the server, with the close reason CloseShutdown, without
+// waiting for them to end. Connections taken over by Hijacker are not
+// closed.
+//
+// Once Close has been called, Serve and ListenAndServe return
+// ErrServerClosed.
+func (srv *Server) Close() error {
+	atomic.StoreInt32(&srv.inShutdown, 1)
+	err := srv.closeListeners()
+	srv.closeSessions()
+	return err
+}
+
+// closeListeners close the listeners served by Serve and return the
+// first error.
+func (srv *Server) closeListeners() error {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	var err error
+	for ln := range srv.listeners {
+		if cerr := (*ln).Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// closeSessions close the sessions being served.
+func (srv *Server) closeSessions() {
+	for _, s := range srv.Sessions() {
+		s.setCloseReason(CloseShutdown)
+		s.Close()
+	}
+}
+
+func (srv *Server) shuttingDown() bool {
+	return atomic.LoadInt32(&srv.inShutdown) != 0
+}
+
+// trackListener add or remove ln from the listeners to close on
+// Shutdown. It returns false if ln was not added because the server is
+// shutting down.
+func (srv *Server) trackListener(ln *net.Listener, add bool) bool {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	if !add {
+		delete(srv.listeners, ln)
+		return true
+	}
+	if srv.shuttingDown() {
+		return false
+	}
+	if srv.listeners == nil {
+		srv.listeners = make(map[*net.Listener]struct{})
+	}
+	srv.listeners[ln] = struct{}{}
+	return true
+}
+
+// onceCloseListener wraps a net.Listener, protecting it from multiple
+// Close calls by Serve and Shutdown.
+type onceCloseListener struct {
+	net.Listener
+	once     sync.Once
+	closeErr error
+}
+
+func (oc *onceCloseListener) Close() error {
+	oc.once.Do(func() { oc.closeErr = oc.Listener.Close() })
+	return oc.closeErr
+}
@@ -0,0 +1,130 @@
+package socks5
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestServer_Shutdown(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &Server{}
+	served := make(chan error, 1)
+	go func() { served <- srv.Serve(ln) }()
+	echo := echoTest(t)
+	client := &Client{ProxyAddr: ln.Addr().String()}
+	conn, err := client.Dial("tcp", echo)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Errorf("shutdown with an active session: %v", err)
+	}
+	if err := <-served; err != ErrServerClosed {
+		t.Errorf("serve: %v", err)
+	}
+	if _, err := client.Dial("tcp", echo); err == nil {
+		t.Error("dial after shutdown succeeded")
+	}
+
+	// the active session was closed when the context expired.
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err == nil {
+		t.Error("session not closed")
+	}
+	conn.Close()
+	ctx, cancel = context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		t.Errorf("shutdown: %v", err)
+	}
+	if err := srv.Serve(ln); err != ErrServerClosed {
+		t.Errorf("serve after shutdown: %v", err)
+	}
+}
+
+func TestServer_ShutdownDrain(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &Server{}
+	go srv.Serve(ln)
+	client := &Client{ProxyAddr: ln.Addr().String()}
+	conn, err := client.Dial("tcp", echoTest(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	shutdown := make(chan error, 1)
+	go func() { shutdown <- srv.Shutdown(context.Background()) }()
+
+	// the active session is still relayed until it ends.
+	time.Sleep(2 * shutdownPollInterval)
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	conn.Write([]byte("ping"))
+	if b, err := ReadNBytes(conn, 4); err != nil || string(b) != "ping" {
+		t.Errorf("echo: %q, %v", b, err)
+	}
+	select {
+	case err := <-shutdown:
+		t.Fatalf("shutdown returned with an active session: %v", err)
+	default:
+	}
+	conn.Close()
+	select {
+	case err := <-shutdown:
+		if err != nil {
+			t.Errorf("shutdown: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("shutdown did not return after the session ended")
+	}
+}
+
+func TestServer_Close(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	reasons := make(chan string, 1)
+	srv := &Server{Hooks: Hooks{WrapLeg: func(s *Session, leg Leg, conn net.Conn) net.Conn {
+		if leg == ClientLeg {
+			go func() {
+				<-s.Context().Done()
+				reasons <- s.CloseReason()
+			}()
+		}
+		return conn
+	}}}
+	served := make(chan error, 1)
+	go func() { served <- srv.Serve(ln) }()
+	conn, err := (&Client{ProxyAddr: ln.Addr().String()}).Dial("tcp", echoTest(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	// wait for the relay to start.
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	conn.Write([]byte("ping"))
+	ReadNBytes(conn, 4)
+
+	if err := srv.Close(); err != nil {
+		t.Errorf("close: %v", err)
+	}
+	if err := <-served; err != ErrServerClosed {
+		t.Errorf("serve: %v", err)
+	}
+	if _, err := conn.Read(make([]byte, 1)); err == nil {
+		t.Error("session not closed")
+	}
+	if reason := <-reasons; reason != CloseShutdown {
+		t.Errorf("close reason %q", reason)
+	}
+}
@@ -0,0 +1,56 @@
+package socks5test
+
+import (
+	"context"
+	"net"
+	"sync"
+
+	"github.com/haochen233/socks5"
+)
+
+// Dial is a call recorded by RecordingDialer.
+type Dial struct {
+	Network string
+	Address string
+	// Err is the error returned by the dial, nil on success.
+	Err error
+}
+
+// RecordingDialer is a socks5.Dialer recording its dials, usable as
+// Route.Dialer or Client.Dialer.
+type RecordingDialer struct {
+	// Dialer makes the connections. If nil, net.Dialer is used.
+	Dialer socks5.Dialer
+
+	// Errors scripts failures: dials to an address of Errors fail with
+	// its error without calling Dialer.
+	Errors map[string]error
+
+	mu    sync.Mutex
+	dials []Dial
+}
+
+// DialContext dial address through Dialer, unless Errors fails it.
+func (d *RecordingDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	var c net.Conn
+	err, ok := d.Errors[address]
+	if !ok {
+		dialer := d.Dialer
+		if dialer == nil {
+			dialer = &net.Dialer{}
+		}
+		c, err = dialer.DialContext(ctx, network, address)
+	}
+
+	d.mu.Lock()
+	d.dials = append(d.dials, Dial{network, address, err})
+	d.mu.Unlock()
+	return c, err
+}
+
+// Dials return the dials made so far, in order.
+func (d *RecordingDialer) Dials() []Dial {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return append([]Dial(nil), d.dials...)
+}
@@ -0,0 +1,106 @@
+// Package socks5test provides test doubles for code embedding the socks5
+// package: a scripted UserPwdStore, an in-memory network of target
+// servers, and dialers and resolvers recording their calls, so auth and
+// routing wiring can be unit tested without real sockets.
+//
+// The recorded calls are returned as plain slices of comparable structs,
+// ready for reflect.DeepEqual or assertion libraries.
+package socks5test
+
+import (
+	"context"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"syscall"
+)
+
+// Network is an in-memory network implementing socks5.Dialer. Each
+// address is served by a handler, every dial runs the handler of the
+// address in its own goroutine with one end of a net.Pipe. Dials to
+// addresses without handler fail with ECONNREFUSED, which the server
+// replies as CONNECTION_REFUSED.
+//
+// A socks server is itself a handler, so both the client to proxy and
+// proxy to target legs of a session can be kept in memory:
+//
+//	n := &socks5test.Network{}
+//	n.Handle("10.0.0.1:1080", func(c net.Conn) { srv.ServeConn(ctx, c) })
+//	n.Handle("10.0.0.2:80", socks5test.Echo)
+//	client := &socks5.Client{ProxyAddr: "10.0.0.1:1080", Dialer: n}
+//
+// net.Pipe is synchronous: writes block until the other end reads them.
+type Network struct {
+	mu       sync.Mutex
+	handlers map[string]func(net.Conn)
+	port     int
+}
+
+// Handle registers handler for address, replacing the previous one.
+// A nil handler removes address from the network.
+func (n *Network) Handle(address string, handler func(net.Conn)) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if handler == nil {
+		delete(n.handlers, address)
+		return
+	}
+	if n.handlers == nil {
+		n.handlers = make(map[string]func(net.Conn))
+	}
+	n.handlers[address] = handler
+}
+
+// DialContext connect to the handler of address. The returned
+// connection reports address as its remote address and a 127.0.0.1
+// address with a unique port as its local address, the handler sees
+// them swapped.
+func (n *Network) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, &net.OpError{Op: "dial", Net: network, Err: err}
+	}
+	n.mu.Lock()
+	handler := n.handlers[address]
+	n.port++
+	port := n.port
+	n.mu.Unlock()
+	if handler == nil {
+		return nil, &net.OpError{Op: "dial", Net: network, Err: os.NewSyscallError("connect", syscall.ECONNREFUSED)}
+	}
+
+	local := addr{network, net.JoinHostPort("127.0.0.1", strconv.Itoa(49152+port%16384))}
+	remote := addr{network, address}
+	c1, c2 := net.Pipe()
+	go handler(&conn{c2, remote, local})
+	return &conn{c1, local, remote}, nil
+}
+
+// Echo is a handler writing back everything it reads.
+func Echo(c net.Conn) {
+	defer c.Close()
+	io.Copy(c, c)
+}
+
+// Discard is a handler reading and dropping everything.
+func Discard(c net.Conn) {
+	defer c.Close()
+	io.Copy(io.Discard, c)
+}
+
+// conn is a pipe end with network addresses.
+type conn struct {
+	net.Conn
+	local, remote net.Addr
+}
+
+func (c *conn) LocalAddr() net.Addr  { return c.local }
+func (c *conn) RemoteAddr() net.Addr { return c.remote }
+
+type addr struct {
+	network, address string
+}
+
+func (a addr) Network() string { return a.network }
+func (a addr) String() string  { return a.address }
@@ -0,0 +1,43 @@
+package socks5test
+
+import (
+	"context"
+	"net"
+	"sync"
+)
+
+// Resolver is a socks5.NameResolver answering from a static table and
+// recording the queried names.
+type Resolver struct {
+	// Hosts maps names to their addresses. Names missing from Hosts and
+	// Errors fail with a NXDOMAIN *net.DNSError.
+	Hosts map[string][]net.IP
+
+	// Errors scripts failures, it takes precedence over Hosts.
+	Errors map[string]error
+
+	mu      sync.Mutex
+	queries []string
+}
+
+// Resolve return the addresses of fqdn from Hosts.
+func (r *Resolver) Resolve(ctx context.Context, fqdn string) ([]net.IP, error) {
+	r.mu.Lock()
+	r.queries = append(r.queries, fqdn)
+	r.mu.Unlock()
+
+	if err, ok := r.Errors[fqdn]; ok {
+		return nil, err
+	}
+	if ips, ok := r.Hosts[fqdn]; ok {
+		return ips, nil
+	}
+	return nil, &net.DNSError{Err: "no such host", Name: fqdn, IsNotFound: true}
+}
+
+// Queries return the names resolved so far, in order.
+func (r *Resolver) Queries() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]string(nil), r.queries...)
+}
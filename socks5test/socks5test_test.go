@@ -0,0 +1,108 @@
+package socks5test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"reflect"
+	"testing"
+
+	"github.com/haochen233/socks5"
+)
+
+// inMemory return a client of a password protected server, both wired
+// through n.
+func inMemory(t *testing.T, n *Network, store *Store, resolver *Resolver, dialer *RecordingDialer) *socks5.Client {
+	t.Helper()
+	srv := &socks5.Server{
+		Authenticators: map[socks5.METHOD]socks5.Authenticator{
+			socks5.USERNAME_PASSWORD: socks5.UserPwdAuth{UserPwdStore: store},
+		},
+		Resolver: resolver,
+		Router: socks5.RouterFunc(func(s *socks5.Session, dest *socks5.Address) []socks5.Route {
+			return []socks5.Route{{Name: "test", Dialer: dialer}}
+		}),
+	}
+	n.Handle("10.0.0.1:1080", func(c net.Conn) { srv.ServeConn(context.Background(), c) })
+	return &socks5.Client{ProxyAddr: "10.0.0.1:1080", Username: "alice", Password: "secret", Dialer: n}
+}
+
+func TestInMemorySession(t *testing.T) {
+	n := &Network{}
+	n.Handle("10.0.0.2:7", Echo)
+	store := NewStore("alice", "secret")
+	resolver := &Resolver{Hosts: map[string][]net.IP{"echo.test": {net.IPv4(10, 0, 0, 2)}}}
+	dialer := &RecordingDialer{Dialer: n}
+	client := inMemory(t, n, store, resolver, dialer)
+
+	conn, err := client.Dial("tcp", "echo.test:7")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	msg := []byte("ping")
+	if _, err := conn.Write(msg); err != nil {
+		t.Fatal(err)
+	}
+	got := make([]byte, len(msg))
+	if _, err := io.ReadFull(conn, got); err != nil || string(got) != "ping" {
+		t.Fatalf("echo: %q, %v", got, err)
+	}
+
+	if calls := store.Calls(); !reflect.DeepEqual(calls, []StoreCall{{"Validate", "alice", "secret", nil}}) {
+		t.Errorf("store calls: %+v", calls)
+	}
+	if q := resolver.Queries(); !reflect.DeepEqual(q, []string{"echo.test"}) {
+		t.Errorf("queries: %v", q)
+	}
+	if d := dialer.Dials(); !reflect.DeepEqual(d, []Dial{{"tcp", "10.0.0.2:7", nil}}) {
+		t.Errorf("dials: %+v", d)
+	}
+}
+
+func TestScriptedFailures(t *testing.T) {
+	n := &Network{}
+	store := NewStore("alice", "secret")
+	resolver := &Resolver{Hosts: map[string][]net.IP{"down.test": {net.IPv4(10, 0, 0, 3)}}}
+	dialer := &RecordingDialer{Dialer: n}
+	client := inMemory(t, n, store, resolver, dialer)
+
+	var rep *socks5.REPError
+	_, err := client.Dial("tcp", "down.test:80")
+	if !errors.As(err, &rep) || rep.REP != socks5.CONNECTION_REFUSED {
+		t.Errorf("no target: %v", err)
+	}
+	_, err = client.Dial("tcp", "missing.test:80")
+	if !errors.As(err, &rep) || rep.REP != socks5.HOST_UNREACHABLE {
+		t.Errorf("nxdomain: %v", err)
+	}
+
+	store.Errors = map[string]error{"alice": errors.New("store offline")}
+	if _, err := client.Dial("tcp", "down.test:80"); err == nil {
+		t.Error("dial succeeded with a failing store")
+	}
+	calls := store.Calls()
+	if last := calls[len(calls)-1]; last.Err == nil || last.Err.Error() != "store offline" {
+		t.Errorf("scripted store error: %+v", last)
+	}
+}
+
+func TestStore(t *testing.T) {
+	s := NewStore()
+	s.Set("bob", "pw")
+	if err := s.Validate("bob", "bad"); err == nil {
+		t.Error("bad password accepted")
+	}
+	s.Del("bob")
+	if err := s.Validate("bob", "pw"); err == nil {
+		t.Error("deleted user accepted")
+	}
+	ops := ""
+	for _, c := range s.Calls() {
+		ops += c.Op + " "
+	}
+	if ops != "Set Validate Del Validate " {
+		t.Errorf("calls: %s", ops)
+	}
+}
@@ -0,0 +1,96 @@
+package socks5test
+
+import (
+	"fmt"
+	"sync"
+)
+
+// StoreCall is a call recorded by Store.
+type StoreCall struct {
+	// Op is "Set", "Del" or "Validate".
+	Op       string
+	Username string
+	// Password is empty for Del.
+	Password string
+	// Err is the error returned by the call, nil on success.
+	Err error
+}
+
+// Store is a scripted socks5.UserPwdStore keeping passwords in clear and
+// recording its calls. Use it with socks5.UserPwdAuth.
+type Store struct {
+	// Users maps usernames to their password.
+	Users map[string]string
+
+	// Errors scripts failures: calls for a username of Errors fail with
+	// its error and leave Users unchanged.
+	Errors map[string]error
+
+	mu    sync.Mutex
+	calls []StoreCall
+}
+
+// NewStore return a Store of users, a list of username and password
+// pairs.
+func NewStore(users ...string) *Store {
+	if len(users)%2 != 0 {
+		panic("socks5test: NewStore called with a username without password")
+	}
+	s := &Store{Users: make(map[string]string)}
+	for i := 0; i < len(users); i += 2 {
+		s.Users[users[i]] = users[i+1]
+	}
+	return s
+}
+
+// Set the password of username.
+func (s *Store) Set(username string, password string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	err, ok := s.Errors[username]
+	if !ok {
+		if s.Users == nil {
+			s.Users = make(map[string]string)
+		}
+		s.Users[username] = password
+	}
+	return s.record(StoreCall{"Set", username, password, err})
+}
+
+// Del remove username.
+func (s *Store) Del(username string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	err, ok := s.Errors[username]
+	if !ok {
+		delete(s.Users, username)
+	}
+	return s.record(StoreCall{"Del", username, "", err})
+}
+
+// Validate check password is the one of username.
+func (s *Store) Validate(username string, password string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	err, ok := s.Errors[username]
+	if !ok {
+		if p, exist := s.Users[username]; !exist {
+			err = fmt.Errorf("user %s does not exist", username)
+		} else if p != password {
+			err = fmt.Errorf("user %s has bad password", username)
+		}
+	}
+	return s.record(StoreCall{"Validate", username, password, err})
+}
+
+func (s *Store) record(c StoreCall) error {
+	s.calls = append(s.calls, c)
+	return c.Err
+}
+
+// Calls return the calls made so far, in order.
+func (s *Store) Calls() []StoreCall {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]StoreCall(nil), s.calls...)
+}
@@ -0,0 +1,55 @@
+package socks5
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// stall accumulates the time the relay was blocked writing to a leg.
+type stall struct {
+	srv   *Server
+	s     *Session
+	leg   Leg
+	total *int64
+}
+
+// measuresStalls report whether the server measures write stalls.
+func (srv *Server) measuresStalls() bool {
+	return srv.MeasureWriteStalls || srv.Hooks.OnWriteStall != nil
+}
+
+// stall return the write stall accounting of leg of s, nil if stalls are
+// not measured.
+func (srv *Server) stall(s *Session, leg Leg) *stall {
+	if !srv.measuresStalls() {
+		return nil
+	}
+	total := &s.stallClient
+	if leg == RemoteLeg {
+		total = &s.stallRemote
+	}
+	return &stall{srv, s, leg, total}
+}
+
+func (st *stall) add(d time.Duration) {
+	atomic.AddInt64(st.total, int64(d))
+	threshold := st.srv.WriteStallThreshold
+	if threshold <= 0 {
+		threshold = 100 * time.Millisecond
+	}
+	if d > threshold {
+		atomic.AddUint64(&st.s.stalls, 1)
+		st.srv.onWriteStall(st.s, st.leg, d)
+	}
+}
+
+// WriteStall return the time the relay spent blocked writing to leg of
+// the session so far, waiting for the peer of leg to read: a high
+// ClientLeg stall means a slow client, a high RemoteLeg stall a slow
+// destination. It is zero unless Server.MeasureWriteStalls is set.
+func (s *Session) WriteStall(leg Leg) time.Duration {
+	if leg == RemoteLeg {
+		return time.Duration(atomic.LoadInt64(&s.stallRemote))
+	}
+	return time.Duration(atomic.LoadInt64(&s.stallClient))
+}
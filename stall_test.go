@@ -0,0 +1,81 @@
+package socks5
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestServer_WriteStall(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	const size = 16 << 20
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		conn.Write(make([]byte, size))
+		conn.Close()
+	}()
+
+	type stalled struct {
+		s   *Session
+		leg Leg
+	}
+	stalls := make(chan stalled, 1)
+	stats := &ConnStats{}
+	srv := &Server{
+		WriteStallThreshold: 20 * time.Millisecond,
+		Stats:               stats,
+		Hooks: Hooks{
+			OnWriteStall: func(s *Session, leg Leg, d time.Duration) {
+				select {
+				case stalls <- stalled{s, leg}:
+				default:
+				}
+			},
+		},
+	}
+	addr := serveTest(t, srv)
+	dest, _ := ParseAddress(ln.Addr().String())
+	conn, reply := connectTest(t, addr, dest)
+	if reply[1] != SUCCESSED {
+		t.Fatalf("reply: %#x", reply[1])
+	}
+
+	// a client not reading stalls the writes to the client leg.
+	time.Sleep(200 * time.Millisecond)
+	if _, err := io.Copy(io.Discard, conn); err != nil {
+		t.Fatal(err)
+	}
+	st := <-stalls
+	if st.leg != ClientLeg {
+		t.Errorf("stall on %s", st.leg)
+	}
+	s := st.s
+	if s.WriteStall(ClientLeg) < 20*time.Millisecond {
+		t.Errorf("client leg stall %s", s.WriteStall(ClientLeg))
+	}
+	if s.WriteStall(RemoteLeg) > s.WriteStall(ClientLeg) {
+		t.Errorf("remote leg stall %s", s.WriteStall(RemoteLeg))
+	}
+
+	// the stalls are in the stats of the session once closed.
+	conn.Close()
+	deadline := time.Now().Add(5 * time.Second)
+	for len(stats.Snapshot().Recent) == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	recent := stats.Snapshot().Recent
+	if len(recent) != 1 {
+		t.Fatalf("recent %v", recent)
+	}
+	if stat := recent[0]; stat.WriteStallClient != s.WriteStall(ClientLeg) || stat.WriteStallRemote != s.WriteStall(RemoteLeg) || stat.WriteStalls == 0 {
+		t.Errorf("stat stalls %s %s %d", stat.WriteStallClient, stat.WriteStallRemote, stat.WriteStalls)
+	}
+}
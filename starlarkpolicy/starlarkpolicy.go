@@ -0,0 +1,303 @@
+// Package starlarkpolicy implements socks5.Policy with Starlark scripts,
+// for policies edited and reloaded by operators without rebuilding the
+// server. It is a module of its own so that the socks5 package keeps no
+// dependencies.
+//
+// A script defines a decide function called with each request:
+//
+//	def decide(req):
+//	    if req.user == "guest" and req.port != 443:
+//	        return "deny"
+//	    if req.host.endswith(".corp.internal"):
+//	        return {"route": "vpn"}
+//	    if req.host == "old.example.com":
+//	        return {"host": "new.example.com"}
+//	    return "allow"
+//
+// req has the fields client, the client address "ip:port", user, the
+// authenticated user name or "", command, "CONNECT", "BIND" or
+// "UDP_ASSOCIATE", host, the destination domain name or IP address, and
+// port. decide returns "allow", None or "deny", or a dict with the
+// optional keys action, "allow" or "deny", host and port, rewriting the
+// destination, and route, the name of a route of Policy.Routes or a list
+// of names in order of preference. The builtin resolve(name) returns the
+// IP addresses of name, as strings, using the resolver of the server.
+package starlarkpolicy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+
+	"github.com/haochen233/socks5"
+	"go.starlark.net/starlark"
+	"go.starlark.net/starlarkstruct"
+	"go.starlark.net/syntax"
+)
+
+// DefaultMaxSteps is the default cap on the execution steps of a
+// decision.
+const DefaultMaxSteps = 1000000
+
+// Policy is a socks5.Policy calling the decide function of a Starlark
+// script. It is safe for concurrent use.
+type Policy struct {
+	// Routes are the routes scripts refer to by name.
+	Routes map[string]socks5.Route
+
+	// MaxSteps caps the execution steps of each decision, runaway scripts
+	// fail the request. Zero means DefaultMaxSteps.
+	MaxSteps uint64
+
+	filename string
+	mu       sync.RWMutex
+	decide   starlark.Callable
+}
+
+// Load compile the script src of filename, if src is nil it is read from
+// filename.
+func Load(filename string, src []byte) (*Policy, error) {
+	p := &Policy{filename: filename}
+	if src == nil {
+		var err error
+		if src, err = os.ReadFile(filename); err != nil {
+			return nil, err
+		}
+	}
+	if err := p.load(src); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// Reload read the script file again, such as on SIGHUP. Decisions in
+// progress finish with the old script. On error the old script is kept.
+func (p *Policy) Reload() error {
+	src, err := os.ReadFile(p.filename)
+	if err != nil {
+		return err
+	}
+	return p.load(src)
+}
+
+func (p *Policy) load(src []byte) error {
+	thread := &starlark.Thread{Name: "load " + p.filename}
+	globals, err := starlark.ExecFileOptions(&syntax.FileOptions{}, thread, p.filename, src, builtins)
+	if err != nil {
+		return err
+	}
+	decide, ok := globals["decide"].(starlark.Callable)
+	if !ok {
+		return fmt.Errorf("%s: no decide function", p.filename)
+	}
+	globals.Freeze()
+	p.mu.Lock()
+	p.decide = decide
+	p.mu.Unlock()
+	return nil
+}
+
+// builtins are the predeclared names of scripts.
+var builtins = starlark.StringDict{
+	"resolve": starlark.NewBuiltin("resolve", resolve),
+}
+
+// resolverKey is the thread local holding the socks5.NameResolver, and
+// contextKey the one holding the context of the session.
+const (
+	resolverKey = "resolver"
+	contextKey  = "context"
+)
+
+func resolve(thread *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var name string
+	if err := starlark.UnpackPositionalArgs(fn.Name(), args, kwargs, 1, &name); err != nil {
+		return nil, err
+	}
+	resolver, ok := thread.Local(resolverKey).(socks5.NameResolver)
+	if !ok {
+		return nil, errors.New("resolve: no resolver")
+	}
+	ctx, ok := thread.Local(contextKey).(context.Context)
+	if !ok {
+		ctx = context.Background()
+	}
+	ips, err := resolver.Resolve(ctx, name)
+	if err != nil {
+		var dnsErr *net.DNSError
+		if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+			return starlark.NewList(nil), nil
+		}
+		return nil, err
+	}
+	addrs := make([]starlark.Value, len(ips))
+	for i, ip := range ips {
+		addrs[i] = starlark.String(ip.String())
+	}
+	return starlark.NewList(addrs), nil
+}
+
+// Decide implements socks5.Policy.
+func (p *Policy) Decide(s *socks5.Session, req *socks5.Request, resolver socks5.NameResolver) (socks5.Decision, error) {
+	p.mu.RLock()
+	decide := p.decide
+	p.mu.RUnlock()
+
+	thread := &starlark.Thread{Name: "decide"}
+	thread.SetLocal(resolverKey, resolver)
+	thread.SetLocal(contextKey, s.Context())
+	max := p.MaxSteps
+	if max == 0 {
+		max = DefaultMaxSteps
+	}
+	thread.SetMaxExecutionSteps(max)
+	v, err := starlark.Call(thread, decide, starlark.Tuple{request(s, req)}, nil)
+	if err != nil {
+		return socks5.Decision{}, err
+	}
+	return p.decision(req, v)
+}
+
+// request return the req value of scripts.
+func request(s *socks5.Session, req *socks5.Request) starlark.Value {
+	client := ""
+	if s.ClientAddr != nil {
+		client = s.ClientAddr.String()
+	}
+	host, _, _ := net.SplitHostPort(req.Address.String())
+	return starlarkstruct.FromStringDict(starlark.String("request"), starlark.StringDict{
+		"client":  starlark.String(client),
+		"user":    starlark.String(s.Username),
+		"command": starlark.String(command(req.CMD)),
+		"host":    starlark.String(host),
+		"port":    starlark.MakeInt(int(req.Address.Port)),
+	})
+}
+
+func command(cmd socks5.CMD) string {
+	switch cmd {
+	case socks5.CONNECT:
+		return "CONNECT"
+	case socks5.BIND:
+		return "BIND"
+	case socks5.UDP_ASSOCIATE:
+		return "UDP_ASSOCIATE"
+	}
+	return strconv.Itoa(int(cmd))
+}
+
+// decision convert the value returned by decide.
+func (p *Policy) decision(req *socks5.Request, v starlark.Value) (socks5.Decision, error) {
+	switch v := v.(type) {
+	case starlark.NoneType:
+		return socks5.Decision{}, nil
+	case starlark.String:
+		return action(string(v))
+	case *starlark.Dict:
+		return p.dictDecision(req, v)
+	}
+	return socks5.Decision{}, fmt.Errorf("decide returned %s", v.Type())
+}
+
+func action(a string) (socks5.Decision, error) {
+	switch a {
+	case "allow":
+		return socks5.Decision{}, nil
+	case "deny":
+		return socks5.Decision{Deny: true}, nil
+	}
+	return socks5.Decision{}, fmt.Errorf("unknown action %q", a)
+}
+
+func (p *Policy) dictDecision(req *socks5.Request, dict *starlark.Dict) (socks5.Decision, error) {
+	var d socks5.Decision
+	for _, item := range dict.Items() {
+		key, ok := starlark.AsString(item[0])
+		if !ok {
+			return d, fmt.Errorf("decision key %s is not a string", item[0])
+		}
+		switch key {
+		case "action":
+			a, ok := starlark.AsString(item[1])
+			if !ok {
+				return d, errors.New("decision action is not a string")
+			}
+			ad, err := action(a)
+			if err != nil {
+				return d, err
+			}
+			d.Deny = ad.Deny
+		case "host", "port":
+		case "route":
+			routes, err := p.routes(item[1])
+			if err != nil {
+				return d, err
+			}
+			d.Routes = routes
+		default:
+			return d, fmt.Errorf("unknown decision key %q", key)
+		}
+	}
+	dest, err := rewrite(req.Address, dict)
+	if err != nil {
+		return d, err
+	}
+	d.Dest = dest
+	return d, nil
+}
+
+// rewrite return the destination rewritten by the host and port of dict,
+// nil if it has neither.
+func rewrite(dest *socks5.Address, dict *starlark.Dict) (*socks5.Address, error) {
+	hostValue, hasHost, _ := dict.Get(starlark.String("host"))
+	portValue, hasPort, _ := dict.Get(starlark.String("port"))
+	if !hasHost && !hasPort {
+		return nil, nil
+	}
+	host, port, _ := net.SplitHostPort(dest.String())
+	if hasHost {
+		var ok bool
+		if host, ok = starlark.AsString(hostValue); !ok {
+			return nil, errors.New("decision host is not a string")
+		}
+	}
+	if hasPort {
+		n, err := starlark.AsInt32(portValue)
+		if err != nil || n <= 0 || n > 65535 {
+			return nil, fmt.Errorf("invalid decision port %s", portValue)
+		}
+		port = strconv.Itoa(n)
+	}
+	return socks5.ParseAddress(net.JoinHostPort(host, port))
+}
+
+// routes return the routes named by v, a string or a list of strings.
+func (p *Policy) routes(v starlark.Value) ([]socks5.Route, error) {
+	var names []string
+	if name, ok := starlark.AsString(v); ok {
+		names = []string{name}
+	} else if list, ok := v.(*starlark.List); ok {
+		for i := 0; i < list.Len(); i++ {
+			name, ok := starlark.AsString(list.Index(i))
+			if !ok {
+				return nil, errors.New("decision route is not a string")
+			}
+			names = append(names, name)
+		}
+	} else {
+		return nil, errors.New("decision route is not a string or list")
+	}
+	routes := make([]socks5.Route, len(names))
+	for i, name := range names {
+		r, ok := p.Routes[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown route %q", name)
+		}
+		routes[i] = r
+	}
+	return routes, nil
+}
@@ -0,0 +1,129 @@
+package starlarkpolicy
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/haochen233/socks5"
+	"github.com/haochen233/socks5/socks5test"
+)
+
+const script = `
+def decide(req):
+    if req.user == "guest" and req.port != 443:
+        return "deny"
+    if req.host.endswith(".corp.internal"):
+        return {"route": ["vpn", "backup"]}
+    if req.host == "old.example.com":
+        return {"host": "new.example.com", "port": 8080}
+    if req.host == "pinned.example.com":
+        return {"host": resolve("pinned.example.com")[0]}
+    if req.host == "loop.example.com":
+        for i in range(1000000000):
+            pass
+    return None
+`
+
+func decide(t *testing.T, p *Policy, user, dest string) (socks5.Decision, error) {
+	t.Helper()
+	addr, err := socks5.ParseAddress(dest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &socks5.Session{Username: user, ClientAddr: &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1}}
+	resolver := &socks5test.Resolver{Hosts: map[string][]net.IP{"pinned.example.com": {net.IPv4(192, 0, 2, 1)}}}
+	return p.Decide(s, &socks5.Request{VER: socks5.Version5, CMD: socks5.CONNECT, Address: addr}, resolver)
+}
+
+func TestPolicy(t *testing.T) {
+	p, err := Load("policy.star", []byte(script))
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.Routes = map[string]socks5.Route{"vpn": {Name: "vpn"}, "backup": {Name: "backup"}}
+	p.MaxSteps = 10000
+
+	if d, err := decide(t, p, "guest", "example.com:80"); err != nil || !d.Deny {
+		t.Errorf("guest: %+v, %v", d, err)
+	}
+	if d, err := decide(t, p, "guest", "example.com:443"); err != nil || d.Deny || d.Dest != nil {
+		t.Errorf("guest https: %+v, %v", d, err)
+	}
+	d, err := decide(t, p, "", "git.corp.internal:22")
+	if err != nil || len(d.Routes) != 2 || d.Routes[0].Name != "vpn" || d.Routes[1].Name != "backup" {
+		t.Errorf("corp: %+v, %v", d, err)
+	}
+	if d, err := decide(t, p, "", "old.example.com:80"); err != nil || d.Dest.String() != "new.example.com:8080" {
+		t.Errorf("rewrite: %+v, %v", d, err)
+	}
+	if d, err := decide(t, p, "", "pinned.example.com:80"); err != nil || d.Dest.String() != "192.0.2.1:80" {
+		t.Errorf("resolve: %+v, %v", d, err)
+	}
+	if _, err := decide(t, p, "", "loop.example.com:80"); err == nil {
+		t.Error("runaway script did not fail")
+	}
+}
+
+func TestPolicy_Reload(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "policy.star")
+	os.WriteFile(file, []byte("def decide(req):\n    return 'allow'\n"), 0600)
+	p, err := Load(file, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d, err := decide(t, p, "", "example.com:80"); err != nil || d.Deny {
+		t.Errorf("%+v, %v", d, err)
+	}
+
+	os.WriteFile(file, []byte("def decide(req):\n    return {'action': 'deny'}\n"), 0600)
+	if err := p.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if d, err := decide(t, p, "", "example.com:80"); err != nil || !d.Deny {
+		t.Errorf("reloaded: %+v, %v", d, err)
+	}
+
+	os.WriteFile(file, []byte("decide = 1\n"), 0600)
+	if err := p.Reload(); err == nil {
+		t.Error("script without decide loaded")
+	}
+	if d, _ := decide(t, p, "", "example.com:80"); !d.Deny {
+		t.Error("failed reload replaced the script")
+	}
+	if _, err := decide(t, mustLoad(t, "def decide(req):\n    return 1\n"), "", "example.com:80"); err == nil {
+		t.Error("invalid decision accepted")
+	}
+}
+
+func mustLoad(t *testing.T, src string) *Policy {
+	p, err := Load("test.star", []byte(src))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+type contextResolver struct {
+	ctx context.Context
+}
+
+func (r *contextResolver) Resolve(ctx context.Context, fqdn string) ([]net.IP, error) {
+	r.ctx = ctx
+	return []net.IP{net.IPv4(192, 0, 2, 1)}, nil
+}
+
+func TestPolicy_ResolveContext(t *testing.T) {
+	p := mustLoad(t, "def decide(req):\n    resolve(req.host)\n    return None\n")
+	addr, _ := socks5.ParseAddress("example.com:80")
+	s := &socks5.Session{}
+	resolver := &contextResolver{}
+	if _, err := p.Decide(s, &socks5.Request{VER: socks5.Version5, CMD: socks5.CONNECT, Address: addr}, resolver); err != nil {
+		t.Fatal(err)
+	}
+	if resolver.ctx == nil || socks5.SessionFromContext(resolver.ctx) != s {
+		t.Error("resolve did not use the session context")
+	}
+}
@@ -0,0 +1,268 @@
+package socks5
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ConnStats accounts the traffic of the sessions of servers, such as to
+// bill or monitor usage: set Server.Stats to it. It records the bytes up
+// (client to destination) and down, the duration, destination and user
+// of each session, and aggregates them per user and per tag, such as to
+// bill the teams tagged by rules or authenticators (see Session.Tag).
+// Several servers may share a ConnStats.
+//
+// ConnStats is an http.Handler serving its Snapshot as JSON, for an
+// internal counters endpoint:
+//
+//	stats := &socks5.ConnStats{}
+//	srv := &socks5.Server{Stats: stats}
+//	http.Handle("/debug/socks5", stats)
+type ConnStats struct {
+	// Recent is the number of closed sessions kept for Snapshot.
+	// Zero means 100, negative keeps none.
+	Recent int
+
+	mu sync.Mutex
+	// active holds the fields of sessions set by their goroutine, copied
+	// once they are final, so Snapshot does not race with it.
+	active map[*Session]*ConnStat
+	recent []ConnStat
+	next   int
+	totals StatsTotals
+	users  map[string]*UserStats
+	tags   map[string]*UserStats
+}
+
+// ConnStat is the traffic of a session.
+type ConnStat struct {
+	ID         uint64 `json:"id"`
+	ClientAddr string `json:"client_addr"`
+	// Username is the authenticated user, empty for anonymous sessions.
+	Username string `json:"username,omitempty"`
+	// Command, Dest and Route of active sessions are empty until their
+	// relay starts.
+	Command   string        `json:"command,omitempty"`
+	Dest      string        `json:"dest,omitempty"`
+	Route     string        `json:"route,omitempty"`
+	Start     time.Time     `json:"start"`
+	Duration  time.Duration `json:"duration"`
+	BytesUp   uint64        `json:"bytes_up"`
+	BytesDown uint64        `json:"bytes_down"`
+	// WriteStallClient and WriteStallRemote are the time the relay was
+	// blocked writing to each leg, see Session.WriteStall, and
+	// WriteStalls the number of writes blocked past
+	// Server.WriteStallThreshold. They are zero unless the server
+	// measures write stalls.
+	WriteStallClient time.Duration `json:"write_stall_client,omitempty"`
+	WriteStallRemote time.Duration `json:"write_stall_remote,omitempty"`
+	WriteStalls      uint64        `json:"write_stalls,omitempty"`
+	// Closed is false while the session is served.
+	Closed bool `json:"closed"`
+	// CloseReason is why the server closed the session, see
+	// Session.CloseReason.
+	CloseReason string `json:"close_reason,omitempty"`
+	// Tags are the tags of the session, see Session.Tag.
+	Tags map[string]string `json:"tags,omitempty"`
+}
+
+// StatsTotals are the counters of all sessions.
+type StatsTotals struct {
+	// Sessions is the number of sessions served, including Active ones.
+	Sessions uint64 `json:"sessions"`
+	// Active is the number of sessions being served.
+	Active    int    `json:"active"`
+	BytesUp   uint64 `json:"bytes_up"`
+	BytesDown uint64 `json:"bytes_down"`
+}
+
+// UserStats are the counters of the sessions of a user, or of a tag.
+type UserStats struct {
+	Sessions  uint64 `json:"sessions"`
+	BytesUp   uint64 `json:"bytes_up"`
+	BytesDown uint64 `json:"bytes_down"`
+}
+
+// StatsSnapshot is the state of a ConnStats at a point in time. Counters
+// include the bytes relayed so far by active sessions.
+type StatsSnapshot struct {
+	Totals StatsTotals `json:"totals"`
+	// Users are the counters per user, anonymous sessions under "".
+	Users map[string]UserStats `json:"users"`
+	// Tags are the counters per tag, by "key=value". Tags set after the
+	// relay started are only counted once the session ends.
+	Tags map[string]UserStats `json:"tags"`
+	// Active are the sessions being served.
+	Active []ConnStat `json:"active"`
+	// Recent are the last closed sessions, oldest first.
+	Recent []ConnStat `json:"recent"`
+}
+
+// open start accounting s.
+func (c *ConnStats) open(s *Session) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.active == nil {
+		c.active = make(map[*Session]*ConnStat)
+	}
+	stat := &ConnStat{ID: s.ID, Start: s.start}
+	if s.ClientAddr != nil {
+		stat.ClientAddr = s.ClientAddr.String()
+	}
+	c.active[s] = stat
+	c.totals.Sessions++
+}
+
+// relay record the user, request and route of s, once the relay starts.
+// It must be called by the goroutine of s.
+func (c *ConnStats) relay(s *Session) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if stat, ok := c.active[s]; ok {
+		stat.fill(s)
+	}
+}
+
+// close stop accounting s, adding its traffic to the counters.
+func (c *ConnStats) close(s *Session) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	stat := *c.active[s]
+	stat.fill(s)
+	stat.count(s)
+	stat.Closed = true
+	stat.CloseReason = s.CloseReason()
+	delete(c.active, s)
+	c.totals.BytesUp += stat.BytesUp
+	c.totals.BytesDown += stat.BytesDown
+	if c.users == nil {
+		c.users = make(map[string]*UserStats)
+	}
+	u, ok := c.users[stat.Username]
+	if !ok {
+		u = &UserStats{}
+		c.users[stat.Username] = u
+	}
+	u.Sessions++
+	u.BytesUp += stat.BytesUp
+	u.BytesDown += stat.BytesDown
+	for k, v := range stat.Tags {
+		if c.tags == nil {
+			c.tags = make(map[string]*UserStats)
+		}
+		tag := Tag{k, v}.String()
+		t, ok := c.tags[tag]
+		if !ok {
+			t = &UserStats{}
+			c.tags[tag] = t
+		}
+		t.Sessions++
+		t.BytesUp += stat.BytesUp
+		t.BytesDown += stat.BytesDown
+	}
+
+	n := c.Recent
+	if n == 0 {
+		n = 100
+	}
+	if n < 0 {
+		return
+	}
+	if len(c.recent) < n {
+		c.recent = append(c.recent, stat)
+		return
+	}
+	c.recent[c.next] = stat
+	c.next = (c.next + 1) % len(c.recent)
+}
+
+// fill copy the fields of s set by its goroutine.
+func (stat *ConnStat) fill(s *Session) {
+	stat.Username = s.Username
+	stat.Route = s.route.Name
+	stat.Tags = s.tagMap()
+	if req := s.Request; req != nil {
+		stat.Command = cmdName(req.CMD)
+		stat.Dest = req.Address.String()
+	}
+}
+
+// count set the duration, bytes and write stalls of s so far.
+func (stat *ConnStat) count(s *Session) {
+	stat.Duration = time.Since(s.start)
+	stat.BytesUp = s.BytesUp()
+	stat.BytesDown = s.BytesDown()
+	stat.WriteStallClient = s.WriteStall(ClientLeg)
+	stat.WriteStallRemote = s.WriteStall(RemoteLeg)
+	stat.WriteStalls = atomic.LoadUint64(&s.stalls)
+}
+
+// Snapshot return the counters and the sessions accounted.
+func (c *ConnStats) Snapshot() StatsSnapshot {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	snap := StatsSnapshot{
+		Totals: c.totals,
+		Users:  make(map[string]UserStats, len(c.users)),
+		Tags:   make(map[string]UserStats, len(c.tags)),
+		Active: make([]ConnStat, 0, len(c.active)),
+		Recent: make([]ConnStat, 0, len(c.recent)),
+	}
+	snap.Totals.Active = len(c.active)
+	for name, u := range c.users {
+		snap.Users[name] = *u
+	}
+	for tag, t := range c.tags {
+		snap.Tags[tag] = *t
+	}
+	for s, active := range c.active {
+		stat := *active
+		stat.count(s)
+		snap.Active = append(snap.Active, stat)
+		snap.Totals.BytesUp += stat.BytesUp
+		snap.Totals.BytesDown += stat.BytesDown
+		u := snap.Users[stat.Username]
+		u.Sessions++
+		u.BytesUp += stat.BytesUp
+		u.BytesDown += stat.BytesDown
+		snap.Users[stat.Username] = u
+		for k, v := range stat.Tags {
+			tag := Tag{k, v}.String()
+			t := snap.Tags[tag]
+			t.Sessions++
+			t.BytesUp += stat.BytesUp
+			t.BytesDown += stat.BytesDown
+			snap.Tags[tag] = t
+		}
+	}
+	snap.Recent = append(snap.Recent, c.recent[c.next:]...)
+	snap.Recent = append(snap.Recent, c.recent[:c.next]...)
+	return snap
+}
+
+// ServeHTTP write the Snapshot as JSON.
+func (c *ConnStats) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(c.Snapshot())
+}
+
+// trackStats account s in Stats until the returned function is called.
+func (srv *Server) trackStats(s *Session) (done func()) {
+	if srv.Stats == nil {
+		return func() {}
+	}
+	srv.Stats.open(s)
+	return func() { srv.Stats.close(s) }
+}
+
+// statsRelay record the request of s in Stats as its relay starts.
+func (srv *Server) statsRelay(s *Session) {
+	if srv.Stats != nil {
+		srv.Stats.relay(s)
+	}
+}
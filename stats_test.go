@@ -0,0 +1,110 @@
+package socks5
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// waitSnapshot wait until ok reports true for a snapshot of stats.
+func waitSnapshot(t *testing.T, stats *ConnStats, ok func(StatsSnapshot) bool) StatsSnapshot {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		snap := stats.Snapshot()
+		if ok(snap) {
+			return snap
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("snapshot %+v", snap)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestConnStats(t *testing.T) {
+	store := NewMemeryStore(sha256.New(), "")
+	store.Set("alice", "a")
+	stats := &ConnStats{Recent: 2}
+	srv := &Server{
+		Authenticators: map[METHOD]Authenticator{
+			NO_AUTHENTICATION_REQUIRED: NoAuth{},
+			USERNAME_PASSWORD:          UserPwdAuth{store},
+		},
+		MethodPriority: []METHOD{USERNAME_PASSWORD, NO_AUTHENTICATION_REQUIRED},
+		Stats:          stats,
+		Hooks:          Hooks{OnAuthSuccess: func(s *Session) { s.Tag("team", "video") }},
+	}
+	addr := serveTest(t, srv)
+	echo := echoTest(t)
+	client := &Client{ProxyAddr: addr, Username: "alice", Password: "a"}
+
+	conn, err := client.Dial("tcp", echo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Write([]byte("ping"))
+	ReadNBytes(conn, 4)
+	snap := waitSnapshot(t, stats, func(snap StatsSnapshot) bool {
+		return len(snap.Active) == 1 && snap.Active[0].BytesDown == 4
+	})
+	active := snap.Active[0]
+	if active.Username != "alice" || active.Dest != echo || active.Command != "CONNECT" || active.Route != "direct" || active.Tags["team"] != "video" || active.Closed {
+		t.Errorf("active session %+v", active)
+	}
+	conn.Close()
+
+	for i := 0; i < 2; i++ {
+		conn, err := (&Client{ProxyAddr: addr}).Dial("tcp", echo)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.Write([]byte("pong"))
+		ReadNBytes(conn, 4)
+		conn.Close()
+	}
+	snap = waitSnapshot(t, stats, func(snap StatsSnapshot) bool { return len(snap.Active) == 0 })
+	if totals := snap.Totals; totals.Sessions != 3 || totals.BytesUp != 12 || totals.BytesDown != 12 {
+		t.Errorf("totals %+v", totals)
+	}
+	if u := snap.Users["alice"]; u.Sessions != 1 || u.BytesUp != 4 || u.BytesDown != 4 {
+		t.Errorf("alice %+v", u)
+	}
+	if u := snap.Users[""]; u.Sessions != 2 || u.BytesUp != 8 {
+		t.Errorf("anonymous %+v", u)
+	}
+	if tag := snap.Tags["team=video"]; tag.Sessions != 1 || tag.BytesUp != 4 || tag.BytesDown != 4 || len(snap.Tags) != 1 {
+		t.Errorf("tags %+v", snap.Tags)
+	}
+	if len(snap.Recent) != 2 || snap.Recent[0].ID >= snap.Recent[1].ID || !snap.Recent[1].Closed || snap.Recent[0].Username != "" {
+		t.Errorf("recent sessions %+v", snap.Recent)
+	}
+
+	w := httptest.NewRecorder()
+	stats.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	var served StatsSnapshot
+	if err := json.Unmarshal(w.Body.Bytes(), &served); err != nil || served.Totals != snap.Totals {
+		t.Errorf("served %s, %v", w.Body, err)
+	}
+}
+
+func TestConnStats_UDP(t *testing.T) {
+	echo := udpEchoTest(t)
+	stats := &ConnStats{}
+	client := &Client{ProxyAddr: serveTest(t, &Server{Stats: stats})}
+	conn, err := client.DialUDP(echo.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	conn.Write([]byte("ping"))
+	b := make([]byte, 16)
+	if _, err := conn.Read(b); err != nil {
+		t.Fatal(err)
+	}
+	waitSnapshot(t, stats, func(snap StatsSnapshot) bool {
+		return snap.Totals.BytesUp == 4 && snap.Totals.BytesDown == 4
+	})
+}
@@ -0,0 +1,74 @@
+package socks5
+
+import (
+	"sort"
+	"strings"
+)
+
+// Tag is a key=value label attached to a session, see Session.Tag.
+type Tag struct {
+	Key   string
+	Value string
+}
+
+func (t Tag) String() string {
+	return t.Key + "=" + t.Value
+}
+
+// Tag attach the tag key=value to the session, replacing the value of
+// key if it is already set. Rules, authenticators and hooks tag sessions,
+// such as "team=video" or "route=upstream-eu", to slice logs, metrics and
+// accounting: they are logged with errors and in the records of
+// AccessLog, reported in ConnStat, and exported by PrometheusMetrics for
+// the keys of its TagLabels, so their values should be taken from a
+// small set.
+func (s *Session) Tag(key, value string) {
+	s.tagsMu.Lock()
+	defer s.tagsMu.Unlock()
+	if s.tags == nil {
+		s.tags = make(map[string]string)
+	}
+	s.tags[key] = value
+}
+
+// TagValue return the value of the tag key, "" if it is not set.
+func (s *Session) TagValue(key string) string {
+	s.tagsMu.Lock()
+	defer s.tagsMu.Unlock()
+	return s.tags[key]
+}
+
+// Tags return the tags of the session sorted by key.
+func (s *Session) Tags() []Tag {
+	s.tagsMu.Lock()
+	tags := make([]Tag, 0, len(s.tags))
+	for k, v := range s.tags {
+		tags = append(tags, Tag{k, v})
+	}
+	s.tagsMu.Unlock()
+	sort.Slice(tags, func(i, j int) bool { return tags[i].Key < tags[j].Key })
+	return tags
+}
+
+// tagMap return a copy of the tags of the session, nil if there is none.
+func (s *Session) tagMap() map[string]string {
+	s.tagsMu.Lock()
+	defer s.tagsMu.Unlock()
+	if len(s.tags) == 0 {
+		return nil
+	}
+	tags := make(map[string]string, len(s.tags))
+	for k, v := range s.tags {
+		tags[k] = v
+	}
+	return tags
+}
+
+// formatTags format tags as "key=value key=value".
+func formatTags(tags []Tag) string {
+	strs := make([]string, len(tags))
+	for i, t := range tags {
+		strs[i] = t.String()
+	}
+	return strings.Join(strs, " ")
+}
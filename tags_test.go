@@ -0,0 +1,40 @@
+package socks5
+
+import (
+	"log"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestSession_Tags(t *testing.T) {
+	s := &Session{}
+	s.Tag("team", "video")
+	s.Tag("route", "direct")
+	s.Tag("route", "upstream-eu")
+	if str := formatTags(s.Tags()); str != "route=upstream-eu team=video" {
+		t.Errorf("tags: %s", str)
+	}
+	if v := s.TagValue("team"); v != "video" {
+		t.Errorf("team: %q", v)
+	}
+}
+
+func TestServer_LogTags(t *testing.T) {
+	logs := make(chan string, 1)
+	srv := &Server{
+		Router: RouterFunc(func(s *Session, dest *Address) []Route {
+			s.Tag("team", "video")
+			return []Route{{Name: "upstream", Dialer: failDialer{}}}
+		}),
+		ErrorLog: log.New(writerFunc(func(b []byte) (int, error) {
+			logs <- string(b)
+			return len(b), nil
+		}), "", 0),
+	}
+	addr := serveTest(t, srv)
+	connectTest(t, addr, &Address{net.IPv4(127, 0, 0, 1).To4(), IPV4_ADDRESS, 80})
+	if msg := <-logs; !strings.Contains(msg, "upstream down [team=video]") {
+		t.Errorf("log: %s", msg)
+	}
+}
@@ -0,0 +1,126 @@
+package socks5
+
+import (
+	"errors"
+	"net"
+	"time"
+)
+
+// errHandshakeTooLarge is a handshake over Server.MaxHandshakeBytes.
+var errHandshakeTooLarge = errors.New("handshake too large")
+
+// handshakeDeadline return the deadline of the handshake of s, zero
+// without HandshakeTimeout.
+func (srv *Server) handshakeDeadline(s *Session) time.Time {
+	if srv.HandshakeTimeout <= 0 {
+		return time.Time{}
+	}
+	return s.start.Add(srv.HandshakeTimeout)
+}
+
+// limitHandshake set the deadline of the handshake of s on the client
+// connection, and return the connection to read the handshake from,
+// enforcing HandshakeReadTimeout and MaxHandshakeBytes, and the function
+// lifting the limits once the request was read.
+func (srv *Server) limitHandshake(s *Session, conn net.Conn) (net.Conn, func()) {
+	deadline := srv.handshakeDeadline(s)
+	if !deadline.IsZero() {
+		conn.SetDeadline(deadline)
+	}
+	if srv.HandshakeReadTimeout <= 0 && srv.MaxHandshakeBytes <= 0 {
+		if deadline.IsZero() {
+			return conn, func() {}
+		}
+		return conn, func() { conn.SetDeadline(time.Time{}) }
+	}
+	c := &handshakeConn{Conn: conn, srv: srv, s: s, deadline: deadline}
+	return c, func() {
+		c.done = true
+		conn.SetDeadline(time.Time{})
+	}
+}
+
+// limitAuth set the deadline of the authentication sub-negotiation of s
+// on the client connection, and return the function restoring the
+// deadline of the handshake.
+func (srv *Server) limitAuth(s *Session, conn net.Conn) (restore func()) {
+	if srv.AuthTimeout <= 0 {
+		return func() {}
+	}
+	deadline := time.Now().Add(srv.AuthTimeout)
+	if hs := srv.handshakeDeadline(s); !hs.IsZero() && hs.Before(deadline) {
+		deadline = hs
+	}
+	conn.SetDeadline(deadline)
+	return func() { conn.SetDeadline(srv.handshakeDeadline(s)) }
+}
+
+// handshakeLimited report the limit the handshake of s exceeded, if err
+// is due to one, as its failure.
+func (srv *Server) handshakeLimited(s *Session, err error) {
+	switch {
+	case s.limited != "":
+		s.failure = s.limited
+	case (srv.HandshakeTimeout > 0 || srv.AuthTimeout > 0) && isTimeout(err):
+		s.failure = FailureTimeout
+	}
+}
+
+// handshakeConn is the client connection of a session during its
+// handshake, enforcing HandshakeReadTimeout and MaxHandshakeBytes. It is
+// only read by the goroutine of the session until done.
+type handshakeConn struct {
+	net.Conn
+	srv *Server
+	s   *Session
+	// deadline is the deadline set on the connection, which the read
+	// timeout does not extend.
+	deadline time.Time
+	read     int
+	done     bool
+}
+
+func (c *handshakeConn) Read(b []byte) (int, error) {
+	if c.done {
+		return c.Conn.Read(b)
+	}
+	if max := c.srv.MaxHandshakeBytes; max > 0 {
+		if c.read >= max {
+			c.s.limited = FailureOversized
+			return 0, errHandshakeTooLarge
+		}
+		if len(b) > max-c.read {
+			b = b[:max-c.read]
+		}
+	}
+	slow := false
+	if timeout := c.srv.HandshakeReadTimeout; timeout > 0 {
+		deadline := time.Now().Add(timeout)
+		if c.deadline.IsZero() || deadline.Before(c.deadline) {
+			slow = true
+		} else {
+			deadline = c.deadline
+		}
+		c.Conn.SetReadDeadline(deadline)
+	}
+	n, err := c.Conn.Read(b)
+	c.read += n
+	if slow && err != nil && isTimeout(err) {
+		c.s.limited = FailureSlow
+	}
+	return n, err
+}
+
+func (c *handshakeConn) SetDeadline(t time.Time) error {
+	if !c.done {
+		c.deadline = t
+	}
+	return c.Conn.SetDeadline(t)
+}
+
+func (c *handshakeConn) SetReadDeadline(t time.Time) error {
+	if !c.done {
+		c.deadline = t
+	}
+	return c.Conn.SetReadDeadline(t)
+}
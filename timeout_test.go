@@ -0,0 +1,178 @@
+package socks5
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"testing"
+	"time"
+)
+
+// closedTest wait until the server closes or resets conn, failing after
+// 5 seconds.
+func closedTest(t *testing.T, conn net.Conn) {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.Copy(io.Discard, conn); isTimeout(err) {
+		t.Error("connection not closed")
+	}
+}
+
+func TestServer_HandshakeTimeout(t *testing.T) {
+	failures := make(chan error, 2)
+	srv := &Server{
+		HandshakeTimeout: 50 * time.Millisecond,
+		ErrorLog:         log.New(io.Discard, "", 0),
+		Hooks: Hooks{OnHandshake: func(s *Session, err error) {
+			if err != nil {
+				failures <- err
+			}
+		}},
+	}
+	addr := serveTest(t, srv)
+
+	// silent client
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	closedTest(t, conn)
+	if err := <-failures; !isTimeout(err) {
+		t.Errorf("handshake failure %v, want a timeout", err)
+	}
+
+	// the deadline does not outlive the handshake.
+	echo := echoTest(t)
+	conn, err = (&Client{ProxyAddr: addr}).Dial("tcp", echo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	time.Sleep(100 * time.Millisecond)
+	conn.Write([]byte("ping"))
+	if b, err := ReadNBytes(conn, 4); err != nil || string(b) != "ping" {
+		t.Errorf("echo %q, %v", b, err)
+	}
+}
+
+func TestServer_AuthTimeout(t *testing.T) {
+	srv := &Server{
+		Authenticators:   map[METHOD]Authenticator{USERNAME_PASSWORD: UserPwdAuth{NewMemeryStore(sha256.New(), "")}},
+		MethodPriority:   []METHOD{USERNAME_PASSWORD},
+		HandshakeTimeout: time.Minute,
+		AuthTimeout:      50 * time.Millisecond,
+		ErrorLog:         log.New(io.Discard, "", 0),
+	}
+	addr := serveTest(t, srv)
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.Write([]byte{Version5, 1, USERNAME_PASSWORD})
+	if reply, err := ReadNBytes(conn, 2); err != nil || reply[1] != USERNAME_PASSWORD {
+		t.Fatalf("method reply %v, %v", reply, err)
+	}
+	start := time.Now()
+	closedTest(t, conn)
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("closed after %s", elapsed)
+	}
+}
+
+func TestServer_HandshakeTimeoutOverLimit(t *testing.T) {
+	srv := &Server{
+		MaxConnections:   1,
+		RefuseOverLimit:  true,
+		HandshakeTimeout: 50 * time.Millisecond,
+		ErrorLog:         log.New(io.Discard, "", 0),
+	}
+	addr := serveTest(t, srv)
+	conn, err := (&Client{ProxyAddr: addr}).Dial("tcp", echoTest(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// a silent client over the limit is closed.
+	silent, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer silent.Close()
+	closedTest(t, silent)
+}
+
+func TestServer_DialTimeout(t *testing.T) {
+	srv := &Server{
+		Dialer: dialContextFunc(func(ctx context.Context, network, address string) (net.Conn, error) {
+			<-ctx.Done()
+			return nil, ctx.Err()
+		}),
+		DialTimeout: 50 * time.Millisecond,
+		ErrorLog:    log.New(io.Discard, "", 0),
+	}
+	dialErrs := make(chan *DialError, 1)
+	srv.Hooks.OnDialError = func(s *Session, e *DialError) { dialErrs <- e }
+	_, reply := connectTest(t, serveTest(t, srv), &Address{net.IPv4(192, 0, 2, 1), IPV4_ADDRESS, 80})
+	if reply[1] == SUCCESSED {
+		t.Fatal("blackholed destination connected")
+	}
+	if dialErr := <-dialErrs; !errors.Is(dialErr.Err, context.DeadlineExceeded) {
+		t.Errorf("dial error %v, want the deadline of DialTimeout", dialErr)
+	}
+}
+
+func TestServer_HandshakeReadTimeout(t *testing.T) {
+	metrics := &PrometheusMetrics{}
+	srv := &Server{
+		HandshakeTimeout:     time.Minute,
+		HandshakeReadTimeout: 50 * time.Millisecond,
+		MaxHandshakeBytes:    64,
+		Metrics:              metrics,
+		ErrorLog:             log.New(io.Discard, "", 0),
+	}
+	addr := serveTest(t, srv)
+
+	// trickling client
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.Write([]byte{Version5})
+	closedTest(t, conn)
+
+	// endless method selection
+	conn, err = net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	methods := make([]byte, 255)
+	conn.Write(append([]byte{Version5, 255}, methods...))
+	closedTest(t, conn)
+
+	waitMetrics(t, metrics,
+		`socks5_handshake_failures_total{reason="oversized"} 1`,
+		`socks5_handshake_failures_total{reason="slow"} 1`,
+	)
+
+	// the limits do not outlive the handshake.
+	echo := echoTest(t)
+	conn, err = (&Client{ProxyAddr: addr}).Dial("tcp", echo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	time.Sleep(100 * time.Millisecond)
+	msg := make([]byte, 100)
+	conn.Write(msg)
+	if _, err := ReadNBytes(conn, len(msg)); err != nil {
+		t.Errorf("echo: %v", err)
+	}
+}
@@ -0,0 +1,66 @@
+package socks5
+
+import (
+	"crypto/tls"
+	"net"
+)
+
+// ListenAndServeTLS listens on Server.Addr and serves socks over TLS,
+// the "socks5s" scheme of ParseURL. certFile and keyFile are the
+// certificate and key of the server, they may be empty if
+// Server.TLSConfig holds them.
+func (srv *Server) ListenAndServeTLS(certFile, keyFile string) error {
+	addr := srv.Addr
+	if addr == "" {
+		addr = "0.0.0.0:1080"
+	}
+	address, err := ParseAddress(addr)
+	if err != nil {
+		return err
+	}
+	srv.addr = address
+
+	if srv.shuttingDown() {
+		return ErrServerClosed
+	}
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return srv.ServeTLS(ln, certFile, keyFile)
+}
+
+// ServeTLS accepts connections on l and serves socks over TLS, as
+// ListenAndServeTLS. Like Serve, it always returns a non-nil error and
+// closes l.
+func (srv *Server) ServeTLS(l net.Listener, certFile, keyFile string) error {
+	config := &tls.Config{}
+	if srv.TLSConfig != nil {
+		config = srv.TLSConfig.Clone()
+	}
+	if certFile != "" || keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			l.Close()
+			return err
+		}
+		config.Certificates = append(config.Certificates, cert)
+	}
+	return srv.Serve(tls.NewListener(l, config))
+}
+
+// tlsHandshake run the TLS handshake of client if it is a TLS connection,
+// so its failure is told apart, and record its state in s.TLS.
+func (srv *Server) tlsHandshake(s *Session, client net.Conn) error {
+	tlsConn, ok := client.(*tls.Conn)
+	if !ok {
+		return nil
+	}
+	if err := tlsConn.Handshake(); err != nil {
+		s.failure = FailureTLS
+		return &OpError{Version5, "", client.RemoteAddr(), "\"tls handshake\"", err}
+	}
+	state := tlsConn.ConnectionState()
+	s.TLS = &state
+	return nil
+}
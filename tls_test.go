@@ -0,0 +1,108 @@
+package socks5
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io"
+	"log"
+	"math/big"
+	"net"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// clientCertTest return a self-signed client certificate for cn.
+func clientCertTest(t *testing.T, cn string) (tls.Certificate, *x509.Certificate) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}, leaf
+}
+
+func TestServer_ServeTLS(t *testing.T) {
+	ts := httptest.NewUnstartedServer(nil)
+	ts.StartTLS()
+	serverCert := ts.TLS.Certificates[0]
+	roots := x509.NewCertPool()
+	roots.AddCert(ts.Certificate())
+	ts.Close()
+
+	cert, leaf := clientCertTest(t, "alice")
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(leaf)
+
+	var mu sync.Mutex
+	var peer string
+	metrics := &PrometheusMetrics{}
+	srv := &Server{
+		TLSConfig: &tls.Config{
+			Certificates: []tls.Certificate{serverCert},
+			ClientAuth:   tls.RequireAndVerifyClientCert,
+			ClientCAs:    clientCAs,
+		},
+		Hooks: Hooks{OnMethods: func(s *Session, offered []METHOD) {
+			mu.Lock()
+			peer = s.TLS.PeerCertificates[0].Subject.CommonName
+			mu.Unlock()
+		}},
+		Metrics:  metrics,
+		ErrorLog: log.New(io.Discard, "", 0),
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.ServeTLS(ln, "", "")
+	t.Cleanup(func() { ln.Close() })
+
+	client, err := ParseURL("socks5s://" + ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.TLSConfig.ServerName = "example.com"
+	client.TLSConfig.RootCAs = roots
+	client.TLSConfig.Certificates = []tls.Certificate{cert}
+	conn, err := client.Dial("tcp", echoTest(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Write([]byte("ping"))
+	if b, err := ReadNBytes(conn, 4); err != nil || string(b) != "ping" {
+		t.Errorf("echo %q, %v", b, err)
+	}
+	conn.Close()
+	mu.Lock()
+	if peer != "alice" {
+		t.Errorf("client certificate of %q", peer)
+	}
+	mu.Unlock()
+
+	anonymous := &Client{ProxyAddr: ln.Addr().String(), TLSConfig: &tls.Config{ServerName: "example.com", RootCAs: roots}}
+	if _, err := anonymous.Dial("tcp", echoTest(t)); err == nil {
+		t.Error("client without certificate served")
+	}
+	waitMetrics(t, metrics, `socks5_handshake_failures_total{reason="tls"} 1`)
+}
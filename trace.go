@@ -0,0 +1,432 @@
+package socks5
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/haochen233/socks5/internal/parser"
+)
+
+// TraceDir is the direction of traced bytes.
+type TraceDir byte
+
+const (
+	// TraceClient are bytes sent by the client.
+	TraceClient TraceDir = 'C'
+	// TraceServer are bytes sent by the server.
+	TraceServer TraceDir = 'S'
+)
+
+// TraceEvent is one read or write of the negotiation.
+type TraceEvent struct {
+	// At is the time of the event since the start of the trace.
+	At   time.Duration
+	Dir  TraceDir
+	Data []byte
+}
+
+// Trace is the record of the negotiation bytes of a session, from the
+// version byte to the reply of the request.
+type Trace struct {
+	SessionID uint64
+	Client    string
+	Start     time.Time
+	Events    []TraceEvent
+}
+
+// Tracer receives the trace of each session negotiation, when the
+// negotiation ended, successfully or not. Tracing is meant to debug
+// interoperability problems: traces contain client credentials.
+type Tracer interface {
+	Trace(s *Session, t *Trace)
+}
+
+// TracerFunc is an adapter to allow the use of ordinary functions as Tracer.
+type TracerFunc func(s *Session, t *Trace)
+
+// Trace call f(s, t).
+func (f TracerFunc) Trace(s *Session, t *Trace) {
+	f(s, t)
+}
+
+// trace return the connection to negotiate s on, recording the bytes if
+// the server has a Tracer, and the function ending the trace.
+func (srv *Server) trace(s *Session, conn net.Conn) (net.Conn, func()) {
+	if srv.Tracer == nil {
+		return conn, func() {}
+	}
+	tc := newTraceConn(s, conn)
+	return tc, func() {
+		if t := tc.stop(); t != nil {
+			srv.Tracer.Trace(s, t)
+		}
+	}
+}
+
+// traceConn records the bytes read and written on conn until stop.
+type traceConn struct {
+	net.Conn
+	mu    sync.Mutex
+	trace *Trace
+}
+
+func newTraceConn(s *Session, conn net.Conn) *traceConn {
+	t := &Trace{SessionID: s.ID, Start: time.Now()}
+	if s.ClientAddr != nil {
+		t.Client = s.ClientAddr.String()
+	}
+	return &traceConn{Conn: conn, trace: t}
+}
+
+func (c *traceConn) record(dir TraceDir, b []byte) {
+	if len(b) == 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.trace != nil {
+		at := time.Since(c.trace.Start)
+		c.trace.Events = append(c.trace.Events, TraceEvent{at, dir, append([]byte(nil), b...)})
+	}
+}
+
+func (c *traceConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.record(TraceClient, b[:n])
+	return n, err
+}
+
+func (c *traceConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	c.record(TraceServer, b[:n])
+	return n, err
+}
+
+// stop recording and return the trace, or nil if already stopped.
+func (c *traceConn) stop() *Trace {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	t := c.trace
+	c.trace = nil
+	return t
+}
+
+// WriteTo write t in the text trace format:
+//
+//	# session 1 client 127.0.0.1:50000 start 2006-01-02T15:04:05.999999999Z
+//	12.5µs C 050100
+//	40.1µs S 0500
+//
+// Each event line holds its time since the start, its direction and its
+// bytes in hexadecimal.
+func (t *Trace) WriteTo(w io.Writer) (int64, error) {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "# session %d client %s start %s\n", t.SessionID, t.Client, t.Start.Format(time.RFC3339Nano))
+	for _, e := range t.Events {
+		fmt.Fprintf(&buf, "%s %c %x\n", e.At, e.Dir, e.Data)
+	}
+	return buf.WriteTo(w)
+}
+
+var errTraceFormat = errors.New("invalid trace format")
+
+// ReadTrace read a trace written by Trace.WriteTo.
+func ReadTrace(r io.Reader) (*Trace, error) {
+	t := &Trace{}
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 1<<20)
+	header := false
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		fields := strings.Fields(line)
+		if !header {
+			if len(fields) != 7 || fields[0] != "#" || fields[1] != "session" || fields[3] != "client" || fields[5] != "start" {
+				return nil, errTraceFormat
+			}
+			var err error
+			t.SessionID, err = strconv.ParseUint(fields[2], 10, 64)
+			if err != nil {
+				return nil, errTraceFormat
+			}
+			t.Client = fields[4]
+			t.Start, err = time.Parse(time.RFC3339Nano, fields[6])
+			if err != nil {
+				return nil, errTraceFormat
+			}
+			header = true
+			continue
+		}
+
+		if len(fields) != 3 || len(fields[1]) != 1 {
+			return nil, fmt.Errorf("%w: %q", errTraceFormat, line)
+		}
+		at, err := time.ParseDuration(fields[0])
+		if err != nil {
+			return nil, fmt.Errorf("%w: %q", errTraceFormat, line)
+		}
+		dir := TraceDir(fields[1][0])
+		if dir != TraceClient && dir != TraceServer {
+			return nil, fmt.Errorf("%w: %q", errTraceFormat, line)
+		}
+		data, err := hex.DecodeString(fields[2])
+		if err != nil {
+			return nil, fmt.Errorf("%w: %q", errTraceFormat, line)
+		}
+		t.Events = append(t.Events, TraceEvent{at, dir, data})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if !header {
+		return nil, errTraceFormat
+	}
+	return t, nil
+}
+
+// traceStream is the bytes of one direction of a trace.
+type traceStream struct {
+	data []byte
+	// ends[i] is the offset following the bytes of at[i].
+	ends []int
+	at   []time.Duration
+	r    *bytes.Reader
+}
+
+func newTraceStream(t *Trace, dir TraceDir) *traceStream {
+	s := &traceStream{}
+	for _, e := range t.Events {
+		if e.Dir == dir {
+			s.data = append(s.data, e.Data...)
+			s.ends = append(s.ends, len(s.data))
+			s.at = append(s.at, e.At)
+		}
+	}
+	s.r = bytes.NewReader(s.data)
+	return s
+}
+
+// time return the time the next unread byte was traced.
+func (s *traceStream) time() time.Duration {
+	off := len(s.data) - s.r.Len()
+	for i, end := range s.ends {
+		if off < end {
+			return s.at[i]
+		}
+	}
+	return 0
+}
+
+// rest return the unread bytes.
+func (s *traceStream) rest() []byte {
+	return s.data[len(s.data)-s.r.Len():]
+}
+
+// Decode pretty-print the messages of t to w: method names, address
+// types and reply meanings. Passwords are not printed. Malformed or
+// unexpected bytes are printed in hexadecimal.
+func (t *Trace) Decode(w io.Writer) error {
+	client, server := newTraceStream(t, TraceClient), newTraceStream(t, TraceServer)
+	d := &traceDecoder{w: w}
+	fmt.Fprintf(w, "session %d client %s start %s\n", t.SessionID, t.Client, t.Start.Format(time.RFC3339Nano))
+
+	ver, err := client.r.ReadByte()
+	if err == nil {
+		client.r.UnreadByte()
+		switch ver {
+		case Version5:
+			d.decode5(client, server)
+		case Version4:
+			d.decode4(client, server)
+		default:
+			d.line(client, TraceClient, "unknown version %#x", ver)
+			client.r.ReadByte()
+		}
+	}
+	d.trailing(client, TraceClient)
+	d.trailing(server, TraceServer)
+	return d.err
+}
+
+type traceDecoder struct {
+	w   io.Writer
+	err error
+}
+
+func (d *traceDecoder) line(s *traceStream, dir TraceDir, format string, args ...interface{}) {
+	d.lineAt(s.time(), dir, format, args...)
+}
+
+// malformed print the error of a message and stop the decoding of s.
+func (d *traceDecoder) malformed(s *traceStream, dir TraceDir, what string, err error) {
+	if err == io.EOF {
+		return
+	}
+	d.line(s, dir, "malformed %s: %v", what, err)
+}
+
+func (d *traceDecoder) trailing(s *traceStream, dir TraceDir) {
+	if s.r.Len() > 0 {
+		d.line(s, dir, "unexpected bytes: %x", s.rest())
+	}
+}
+
+func (d *traceDecoder) decode5(client, server *traceStream) {
+	at := client.time()
+	client.r.ReadByte()
+	methods, err := parser.ReadMethods(client.r)
+	if err != nil {
+		d.malformed(client, TraceClient, "method selection", err)
+		return
+	}
+	names := make([]string, len(methods))
+	for i, m := range methods {
+		names[i] = methodName(m)
+	}
+	d.lineAt(at, TraceClient, "method selection: %s", strings.Join(names, ", "))
+
+	at = server.time()
+	b, err := readTraceN(server, 2)
+	if err != nil {
+		d.malformed(server, TraceServer, "method reply", err)
+		return
+	}
+	d.lineAt(at, TraceServer, "method selected: %s", methodName(b[1]))
+
+	switch b[1] {
+	case NO_AUTHENTICATION_REQUIRED:
+	case USERNAME_PASSWORD:
+		at = client.time()
+		u, err := parser.ReadUserPass(client.r)
+		if err != nil {
+			d.malformed(client, TraceClient, "authentication", err)
+			return
+		}
+		d.lineAt(at, TraceClient, "authentication: version %d, user %q, password of %d bytes", u.Version, u.Username, len(u.Password))
+		at = server.time()
+		b, err = readTraceN(server, 2)
+		if err != nil {
+			d.malformed(server, TraceServer, "authentication status", err)
+			return
+		}
+		status := "success"
+		if b[1] != 0 {
+			status = fmt.Sprintf("failure %#x", b[1])
+		}
+		d.lineAt(at, TraceServer, "authentication status: %s", status)
+	default:
+		return
+	}
+
+	at = client.time()
+	req, err := parser.ReadRequest(client.r)
+	if err != nil {
+		d.malformed(client, TraceClient, "request", err)
+		return
+	}
+	d.lineAt(at, TraceClient, "request: version %d, %s %s", req.Version, cmdName(req.Command), traceAddress(req.Address))
+
+	at = server.time()
+	b, err = readTraceN(server, 3)
+	if err != nil {
+		d.malformed(server, TraceServer, "reply", err)
+		return
+	}
+	addr, err := parser.ReadAddress(server.r)
+	if err != nil && b[1] == SUCCESSED {
+		d.malformed(server, TraceServer, "reply", err)
+		return
+	}
+	if err != nil {
+		d.lineAt(at, TraceServer, "reply: %s", repName(b[1]))
+		return
+	}
+	d.lineAt(at, TraceServer, "reply: %s, bound %s", repName(b[1]), traceAddress(addr))
+}
+
+func (d *traceDecoder) decode4(client, server *traceStream) {
+	at := client.time()
+	b, err := readTraceN(client, 2)
+	if err != nil {
+		d.malformed(client, TraceClient, "socks4 request", err)
+		return
+	}
+	req, err := parser.ReadSocks4Request(client.r)
+	if err != nil {
+		d.malformed(client, TraceClient, "socks4 request", err)
+		return
+	}
+	d.lineAt(at, TraceClient, "socks4 request: %s %s, user id %q", cmdName(b[1]), traceAddress(req.Address), req.UserID)
+
+	at = server.time()
+	b, err = readTraceN(server, 8)
+	if err != nil {
+		d.malformed(server, TraceServer, "socks4 reply", err)
+		return
+	}
+	rep := fmt.Sprintf("%#x", b[1])
+	switch b[1] {
+	case PERMIT:
+		rep = "PERMIT"
+	case REJECT:
+		rep = "REJECT"
+	}
+	d.lineAt(at, TraceServer, "socks4 reply: %s, bound %s", rep, net.JoinHostPort(net.IP(b[4:8]).String(), strconv.Itoa(int(b[2])<<8|int(b[3]))))
+}
+
+func (d *traceDecoder) lineAt(at time.Duration, dir TraceDir, format string, args ...interface{}) {
+	if d.err != nil {
+		return
+	}
+	_, d.err = fmt.Fprintf(d.w, "%12s %c %s\n", at, dir, fmt.Sprintf(format, args...))
+}
+
+func readTraceN(s *traceStream, n int) ([]byte, error) {
+	b := make([]byte, n)
+	_, err := io.ReadFull(s.r, b)
+	return b, err
+}
+
+func traceAddress(a *parser.Address) string {
+	addr := &Address{net.IP(a.Host), a.Type, a.Port}
+	return fmt.Sprintf("%s (%s)", addr, atypeName(a.Type))
+}
+
+func methodName(m METHOD) string {
+	if name, ok := method2Str[m]; ok {
+		return name
+	}
+	return fmt.Sprintf("%#x", m)
+}
+
+func cmdName(c CMD) string {
+	if name, ok := cmd2Str[c]; ok {
+		return name
+	}
+	return fmt.Sprintf("command %#x", c)
+}
+
+func repName(r REP) string {
+	if name, ok := rep2Str[r]; ok {
+		return name
+	}
+	return fmt.Sprintf("%#x", r)
+}
+
+func atypeName(a ATYPE) string {
+	if name, ok := atype2Str[a]; ok {
+		return name
+	}
+	return fmt.Sprintf("%#x", a)
+}
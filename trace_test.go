@@ -0,0 +1,96 @@
+package socks5
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestServer_Tracer(t *testing.T) {
+	store := NewMemeryStore(sha256.New(), "secret")
+	store.Set("admin", "123456")
+	traces := make(chan *Trace, 1)
+	srv := &Server{
+		Authenticators: map[METHOD]Authenticator{USERNAME_PASSWORD: UserPwdAuth{store}},
+		Tracer:         TracerFunc(func(s *Session, t *Trace) { traces <- t }),
+	}
+	client := &Client{ProxyAddr: serveTest(t, srv), Username: "admin", Password: "123456"}
+	conn, err := client.Dial("tcp", echoTest(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Write([]byte("relayed data"))
+	ReadNBytes(conn, 12)
+	conn.Close()
+
+	var trace *Trace
+	select {
+	case trace = <-traces:
+	case <-time.After(5 * time.Second):
+		t.Fatal("no trace")
+	}
+
+	var buf bytes.Buffer
+	err = trace.Decode(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := buf.String()
+	for _, expected := range []string{
+		"C method selection: NO_AUTHENTICATION_REQUIRED, USERNAME_PASSWORD",
+		"S method selected: USERNAME_PASSWORD",
+		`C authentication: version 1, user "admin", password of 6 bytes`,
+		"S authentication status: success",
+		"C request: version 5, CONNECT 127.0.0.1:",
+		"S reply: SUCCESSED, bound 127.0.0.1:",
+	} {
+		if !strings.Contains(out, expected) {
+			t.Errorf("missing %q in\n%s", expected, out)
+		}
+	}
+	if strings.Contains(out, "123456") || strings.Contains(out, "unexpected") {
+		t.Errorf("decoded trace:\n%s", out)
+	}
+
+	buf.Reset()
+	trace.WriteTo(&buf)
+	read, err := ReadTrace(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(read.Events, trace.Events) || read.SessionID != trace.SessionID || !read.Start.Equal(trace.Start) {
+		t.Errorf("read %+v\nwritten %+v", read, trace)
+	}
+}
+
+func TestTrace_DecodeMalformed(t *testing.T) {
+	trace, err := ReadTrace(strings.NewReader(`# session 7 client 10.0.0.1:4000 start 2026-01-02T15:04:05Z
+1ms C 050100
+2ms S 0500
+3ms C 0501000200
+4ms S 050800010000000000
+5ms S 00
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	trace.Decode(&buf)
+	out := buf.String()
+	for _, expected := range []string{
+		"3ms C malformed request: unknown address type 0x2",
+		"4ms S unexpected bytes: 050800010000000000",
+	} {
+		if !strings.Contains(out, expected) {
+			t.Errorf("missing %q in\n%s", expected, out)
+		}
+	}
+
+	_, err = ReadTrace(strings.NewReader("# session 7 client 10.0.0.1:4000 start 2026-01-02T15:04:05Z\n1ms X 05\n"))
+	if err == nil {
+		t.Error("invalid direction accepted")
+	}
+}
@@ -1,58 +1,308 @@
 package socks5
 
 import (
+	"context"
+	"errors"
 	"io"
+	"math/bits"
 	"net"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
-// Transporter transmit data between client and dest server.
+// Transporter transmit data between client and dest server, it is the
+// relay step of a session. Replace it to record, throttle or translate
+// the relayed traffic, server wide by Server.Transporter or per route by
+// Route.Transporter. Implementations may wrap DefaultTransporter.
 type Transporter interface {
+	// TransportTCP relay data between client and remote until both sides
+	// are done, or either fails. The server closes both connections once
+	// it returns.
 	TransportTCP(client net.Conn, remote net.Conn) error
+	// TransportUDP relay datagrams of an UDP ASSOCIATE session.
 	TransportUDP(Server *net.UDPConn) error
 }
 
-type transport struct {
-	BufSize int
-	errCh   chan error
+// PooledTransport is a Transporter relaying TCP data through buffers of
+// BufferSize bytes taken from a pool, so sessions do not allocate their
+// own.
+//
+// When both legs are *net.TCPConn on Linux, the relay needs no buffer:
+// it splices the data from socket to socket in the kernel with splice(2),
+// the zero-copy path of io.Copy, which saves a copy of every byte through
+// user space and the CPU it costs. The server only relays the bare
+// connections if nothing observes their bytes: it wraps the legs, which
+// are then copied through buffers, to count their bytes (Server.Metrics,
+// Stats, AccessLog, IdleTimeout, MaxSessionBytes, MemoryLimit.CloseIdle
+// and Hooks.OnUsage), to time them (Server.Latency and
+// MeasureWriteStalls), to shape them (Server.RateLimit) and for
+// Hooks.WrapLeg and Server.Interceptors. Leave these unset on servers
+// where the throughput of bulk transfers matters most.
+type PooledTransport struct {
+	// BufferSize is the size of the buffer of each relay direction,
+	// rounded up to a power of two. Zero means 32KiB.
+	BufferSize int
+
+	// HalfCloseTimeout bounds the relay once a side is done sending: its
+	// end is passed on to the other side with CloseWrite, and the other
+	// direction is relayed until it ends too or relays no byte for that
+	// long. Zero means 30s.
+	HalfCloseTimeout time.Duration
 }
 
-// Transport use io.CopyBuffer transmit data
-func (t *transport) TransportTCP(client net.Conn, remote net.Conn) error {
-	if t.errCh == nil {
-		t.errCh = make(chan error, 2)
+// TransportTCP relay data between client and remote until both sides are
+// done, or either fails.
+func (t *PooledTransport) TransportTCP(client net.Conn, remote net.Conn) error {
+	size := t.BufferSize
+	if size <= 0 {
+		size = 32 << 10
 	}
+	size = roundPow2(size)
+	return relayTCP(client, remote, t.HalfCloseTimeout, func(dst net.Conn, src net.Conn) (int64, error) {
+		return copyPooled(dst, src, size)
+	})
+}
 
+// defaultHalfCloseTimeout is the HalfCloseTimeout of transports without
+// one.
+const defaultHalfCloseTimeout = 30 * time.Second
+
+// relayTCP relay client and remote with copy in both directions. The end
+// of a direction is passed on with CloseWrite, and the other direction
+// relayed until it ends too, or relays no byte for linger. The relay ends
+// at once if the end cannot be passed on. It return the first error of a
+// direction.
+func relayTCP(client net.Conn, remote net.Conn, linger time.Duration, copy func(dst net.Conn, src net.Conn) (int64, error)) error {
+	if linger <= 0 {
+		linger = defaultHalfCloseTimeout
+	}
+	var lingering int32
+	errCh := make(chan error, 2)
 	f := func(dst net.Conn, src net.Conn) {
-		inBuf := make([]byte, t.BufSize)
-		_, err := io.CopyBuffer(dst, src, inBuf)
-		if err != nil {
-			if tcpRead, ok := src.(*net.TCPConn); ok {
-				tcpRead.CloseRead()
-			}
-			if tcpWrite, ok := dst.(*net.TCPConn); ok {
-				tcpWrite.CloseWrite()
-			}
-			t.errCh <- err
+		n, err := copy(dst, src)
+		// a lingering direction relaying bytes is given more time.
+		for n > 0 && isTimeout(err) && atomic.LoadInt32(&lingering) == 1 {
+			src.SetReadDeadline(time.Now().Add(linger))
+			n, err = copy(dst, src)
+		}
+		if err == nil && closeWrite(dst) != nil {
+			// the peer of dst cannot learn about EOF, end the relay.
+			err = errNoHalfClose
 		}
-		t.errCh <- nil
+		errCh <- err
 	}
 	go f(remote, client)
 	go f(client, remote)
 
-	for i := 0; i < 1; i++ {
-		err := <-t.errCh
+	if err := <-errCh; err == errNoHalfClose {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	atomic.StoreInt32(&lingering, 1)
+	deadline := time.Now().Add(linger)
+	client.SetReadDeadline(deadline)
+	remote.SetReadDeadline(deadline)
+	if err := <-errCh; err != nil && err != errNoHalfClose && !isTimeout(err) {
+		return err
+	}
+	return nil
+}
+
+// closeWriter is implemented by connections which can be half-closed,
+// such as *net.TCPConn and the connections wrapping them in the package.
+type closeWriter interface {
+	CloseWrite() error
+}
+
+// closeWrite shut down the writing side of c, if it can be.
+func closeWrite(c net.Conn) error {
+	if cw, ok := c.(closeWriter); ok {
+		return cw.CloseWrite()
+	}
+	return errNoHalfClose
+}
+
+// errNoHalfClose is returned by closeWrite for connections which cannot be
+// half-closed.
+var errNoHalfClose = errors.New("connection cannot be half-closed")
+
+// TransportUDP relay the datagrams of an UDP association until Server
+// is closed. The client is the source of the first datagram.
+func (t *PooledTransport) TransportUDP(Server *net.UDPConn) error {
+	r := &udpRelay{
+		conn:     newUDPConn(Server, UDPOffloadAuto),
+		ctx:      context.Background(),
+		resolver: netResolver{net.DefaultResolver},
+	}
+	return r.run()
+}
+
+// DefaultTransporter is the Transporter of servers without one.
+var DefaultTransporter Transporter = &PooledTransport{}
+
+// zeroCopy report whether io.Copy between TCP connections splices the
+// data in the kernel. Elsewhere it allocates a buffer.
+var zeroCopy = runtime.GOOS == "linux"
+
+// copyPooled copy src to dst until EOF, with a pooled buffer of size
+// bytes unless both are TCP connections which splice the data.
+func copyPooled(dst net.Conn, src net.Conn, size int) (int64, error) {
+	if zeroCopy {
+		_, srcTCP := src.(*net.TCPConn)
+		_, dstTCP := dst.(*net.TCPConn)
+		if srcTCP && dstTCP {
+			return io.Copy(dst, src)
+		}
+	}
+	buf := getBuffer(size)
+	defer putBuffer(buf)
+	return io.CopyBuffer(onlyWriter{dst}, onlyReader{src}, buf)
+}
+
+// onlyReader and onlyWriter hide the ReadFrom and WriteTo methods of
+// connections, which would copy without the pooled buffer.
+type onlyReader struct{ io.Reader }
+
+type onlyWriter struct{ io.Writer }
+
+// AdaptiveTransport is a Transporter sizing the copy buffer of each
+// relay direction by its observed throughput: a direction starts with a
+// MinBuffer buffer, doubles it while reads fill it, up to MaxBuffer, and
+// halves it after a run of small reads. Interactive and idle sessions so
+// keep small buffers, while bulk transfers get large ones. Buffers are
+// pooled by size.
+//
+// When both legs are *net.TCPConn on Linux the relay uses the zero-copy
+// path of io.Copy, which needs no buffer, as PooledTransport does.
+type AdaptiveTransport struct {
+	// MinBuffer is the initial and smallest buffer size, rounded up to a
+	// power of two. Zero means 1KiB.
+	MinBuffer int
+	// MaxBuffer is the largest buffer size, rounded up to a power of two.
+	// Zero means 64KiB.
+	MaxBuffer int
+
+	// HalfCloseTimeout is the one of PooledTransport.
+	HalfCloseTimeout time.Duration
+}
+
+// TransportTCP relay data between client and remote until both sides are
+// done, or either fails.
+func (t *AdaptiveTransport) TransportTCP(client net.Conn, remote net.Conn) error {
+	return relayTCP(client, remote, t.HalfCloseTimeout, t.copy)
+}
+
+// TransportUDP relay datagrams with DefaultTransporter.
+func (t *AdaptiveTransport) TransportUDP(Server *net.UDPConn) error {
+	return DefaultTransporter.TransportUDP(Server)
+}
+
+// copy src to dst until EOF with an adaptive buffer, and return the
+// bytes copied.
+func (t *AdaptiveTransport) copy(dst net.Conn, src net.Conn) (int64, error) {
+	if zeroCopy {
+		_, srcTCP := src.(*net.TCPConn)
+		_, dstTCP := dst.(*net.TCPConn)
+		if srcTCP && dstTCP {
+			return io.Copy(dst, src)
+		}
+	}
+
+	a := newAdaptiveBuffer(t.MinBuffer, t.MaxBuffer)
+	buf := getBuffer(a.size)
+	defer func() { putBuffer(buf) }()
+	var written int64
+	for {
+		n, err := src.Read(buf)
+		if n > 0 {
+			m, werr := dst.Write(buf[:n])
+			written += int64(m)
+			if werr != nil {
+				return written, werr
+			}
+		}
+		if err == io.EOF {
+			return written, nil
+		}
 		if err != nil {
-			return err
+			return written, err
+		}
+		if size := a.next(n); size != len(buf) {
+			putBuffer(buf)
+			buf = getBuffer(size)
 		}
 	}
-	return nil
 }
 
-func (t *transport) TransportUDP(Server *net.UDPConn) error {
-	panic("not implement this method currently!")
+// shrinkAfter is the number of consecutive small reads after which an
+// adaptive buffer is halved.
+const shrinkAfter = 8
+
+// adaptiveBuffer computes the buffer size of a relay direction.
+type adaptiveBuffer struct {
+	min, max int
+	size     int
+	// small counts consecutive reads under a quarter of size.
+	small int
+}
+
+func newAdaptiveBuffer(min, max int) *adaptiveBuffer {
+	if min <= 0 {
+		min = 1 << 10
+	}
+	if max <= 0 {
+		max = 64 << 10
+	}
+	min, max = roundPow2(min), roundPow2(max)
+	if max < min {
+		max = min
+	}
+	return &adaptiveBuffer{min: min, max: max, size: min}
+}
+
+// next return the buffer size after a read of n bytes.
+func (a *adaptiveBuffer) next(n int) int {
+	switch {
+	case n == a.size && a.size < a.max:
+		a.size *= 2
+		a.small = 0
+	case n < a.size/4 && a.size > a.min:
+		a.small++
+		if a.small >= shrinkAfter {
+			a.size /= 2
+			a.small = 0
+		}
+	default:
+		a.small = 0
+	}
+	return a.size
+}
+
+// roundPow2 round n up to a power of two.
+func roundPow2(n int) int {
+	p := 1
+	for p < n {
+		p <<= 1
+	}
+	return p
+}
+
+// bufferPools pool buffers by size, bufferPools[i] holds 1<<i bytes
+// buffers.
+var bufferPools [32]sync.Pool
+
+func getBuffer(size int) []byte {
+	i := bits.Len(uint(size)) - 1
+	if b, ok := bufferPools[i].Get().(*[]byte); ok {
+		return *b
+	}
+	return make([]byte, size)
 }
 
-var DefaultTransporter Transporter = &transport{
-	BufSize: 1024,
-	errCh:   nil,
+func putBuffer(b []byte) {
+	i := bits.Len(uint(len(b))) - 1
+	bufferPools[i].Put(&b)
 }
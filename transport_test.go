@@ -0,0 +1,209 @@
+package socks5
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestAdaptiveBuffer(t *testing.T) {
+	a := newAdaptiveBuffer(1000, 4096)
+	if a.size != 1024 || a.max != 4096 {
+		t.Fatalf("size %d, max %d", a.size, a.max)
+	}
+	// Bulk reads fill the buffer, it grows up to max.
+	for _, expected := range []int{2048, 4096, 4096} {
+		if size := a.next(a.size); size != expected {
+			t.Errorf("grown to %d, expected %d", size, expected)
+		}
+	}
+	// Interactive reads shrink it after shrinkAfter reads.
+	for i := 1; i < shrinkAfter; i++ {
+		a.next(10)
+	}
+	if a.size != 4096 {
+		t.Errorf("shrunk to %d too early", a.size)
+	}
+	if size := a.next(10); size != 2048 {
+		t.Errorf("shrunk to %d, expected 2048", size)
+	}
+	for i := 0; i < 10*shrinkAfter; i++ {
+		a.next(10)
+	}
+	if a.size != 1024 {
+		t.Errorf("shrunk to %d, expected min", a.size)
+	}
+}
+
+func TestAdaptiveTransport(t *testing.T) {
+	client, clientPeer := net.Pipe()
+	remote, remotePeer := net.Pipe()
+	tr := &AdaptiveTransport{MinBuffer: 16, MaxBuffer: 256, HalfCloseTimeout: 100 * time.Millisecond}
+	done := make(chan error, 1)
+	go func() { done <- tr.TransportTCP(clientPeer, remote) }()
+
+	data := bytes.Repeat([]byte("0123456789"), 1000)
+	go func() {
+		client.Write(data)
+		client.Close()
+	}()
+	read := make(chan []byte)
+	go func() {
+		got, _ := io.ReadAll(remotePeer)
+		read <- got
+	}()
+	if err := <-done; err != nil {
+		t.Error(err)
+	}
+	// The server closes both legs once the transport returns.
+	remote.Close()
+	clientPeer.Close()
+	if got := <-read; !bytes.Equal(got, data) {
+		t.Errorf("relayed %d bytes, expected %d", len(got), len(data))
+	}
+}
+
+// tcpPair return both ends of a loopback TCP connection.
+func tcpPair(tb testing.TB) (net.Conn, net.Conn) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	defer ln.Close()
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, _ := ln.Accept()
+		accepted <- conn
+	}()
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		tb.Fatal(err)
+	}
+	peer := <-accepted
+	if peer == nil {
+		tb.Fatal("accept failed")
+	}
+	return conn, peer
+}
+
+// plainConn hide the type of a connection, as legs wrapped by the server.
+type plainConn struct{ net.Conn }
+
+func TestPooledTransport(t *testing.T) {
+	for _, wrap := range []bool{false, true} {
+		client, clientPeer := tcpPair(t)
+		remote, remotePeer := tcpPair(t)
+		legClient, legRemote := clientPeer, remote
+		if wrap {
+			legClient, legRemote = plainConn{clientPeer}, plainConn{remote}
+		}
+		tr := &PooledTransport{BufferSize: 100, HalfCloseTimeout: 100 * time.Millisecond}
+		done := make(chan error, 1)
+		go func() { done <- tr.TransportTCP(legClient, legRemote) }()
+
+		data := bytes.Repeat([]byte("0123456789"), 10000)
+		go func() {
+			client.Write(data)
+			client.(*net.TCPConn).CloseWrite()
+		}()
+		read := make(chan []byte)
+		go func() {
+			got, _ := io.ReadAll(remotePeer)
+			read <- got
+		}()
+		if err := <-done; err != nil {
+			t.Error(err)
+		}
+		remote.Close()
+		clientPeer.Close()
+		if got := <-read; !bytes.Equal(got, data) {
+			t.Errorf("wrapped %v: relayed %d bytes, expected %d", wrap, len(got), len(data))
+		}
+		client.Close()
+		remotePeer.Close()
+	}
+}
+
+// benchmarkTransportTCP relay b.N chunks of 32KiB from a client to a
+// destination through tr, with legs wrapped by wrap.
+func benchmarkTransportTCP(b *testing.B, tr Transporter, wrap func(net.Conn) net.Conn) {
+	client, clientPeer := tcpPair(b)
+	remote, remotePeer := tcpPair(b)
+	defer client.Close()
+	defer remotePeer.Close()
+	go func() {
+		tr.TransportTCP(wrap(clientPeer), wrap(remote))
+		clientPeer.Close()
+		remote.Close()
+	}()
+	go io.Copy(io.Discard, client)
+
+	chunk := make([]byte, 32<<10)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		io.CopyN(io.Discard, remotePeer, int64(b.N*len(chunk)))
+	}()
+	b.SetBytes(int64(len(chunk)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := client.Write(chunk); err != nil {
+			b.Fatal(err)
+		}
+	}
+	<-done
+}
+
+func BenchmarkTransportTCP(b *testing.B) {
+	tcp := func(c net.Conn) net.Conn { return c }
+	wrapped := func(c net.Conn) net.Conn { return plainConn{c} }
+	b.Run("pooled/tcp", func(b *testing.B) {
+		benchmarkTransportTCP(b, &PooledTransport{}, tcp)
+	})
+	b.Run("pooled/wrapped", func(b *testing.B) {
+		benchmarkTransportTCP(b, &PooledTransport{}, wrapped)
+	})
+	b.Run("adaptive/wrapped", func(b *testing.B) {
+		benchmarkTransportTCP(b, &AdaptiveTransport{}, wrapped)
+	})
+}
+
+func TestTransport_HalfClose(t *testing.T) {
+	for _, tr := range []Transporter{
+		&PooledTransport{HalfCloseTimeout: time.Second},
+		&AdaptiveTransport{HalfCloseTimeout: time.Second},
+	} {
+		client, clientPeer := tcpPair(t)
+		remote, remotePeer := tcpPair(t)
+		var up, down uint64
+		var active int64
+		legClient := &countConn{Conn: clientPeer, n: &up, active: &active}
+		legRemote := &countConn{Conn: remote, n: &down, active: &active}
+		done := make(chan error, 1)
+		go func() { done <- tr.TransportTCP(legClient, legRemote) }()
+
+		// the remote answers the whole request after its end.
+		go func() {
+			req, _ := io.ReadAll(remotePeer)
+			time.Sleep(50 * time.Millisecond)
+			remotePeer.Write(append([]byte("re: "), req...))
+			remotePeer.Close()
+		}()
+		client.Write([]byte("request"))
+		client.(*net.TCPConn).CloseWrite()
+		client.SetReadDeadline(time.Now().Add(2 * time.Second))
+		got, err := io.ReadAll(client)
+		if err != nil || string(got) != "re: request" {
+			t.Errorf("%T: got %q, %v", tr, got, err)
+		}
+		if err := <-done; err != nil {
+			t.Errorf("%T: %v", tr, err)
+		}
+		client.Close()
+		clientPeer.Close()
+		remote.Close()
+	}
+}
@@ -0,0 +1,56 @@
+package socks5
+
+import (
+	"encoding/binary"
+	"net"
+
+	"github.com/haochen233/socks5/internal/parser"
+)
+
+// Address return the destination address of the header.
+func (h *UDPHeader) Address() *Address {
+	return &Address{h.DestAddr, h.ATYPE, h.DestPort}
+}
+
+// Bytes return the UDP request header followed by h.Data.
+func (h *UDPHeader) Bytes() ([]byte, error) {
+	addr, err := h.Address().Bytes(Version5)
+	if err != nil {
+		return nil, err
+	}
+	b := make([]byte, 3, 3+len(addr)+len(h.Data))
+	binary.BigEndian.PutUint16(b, h.RSV)
+	b[2] = h.FRAG
+	b = append(b, addr...)
+	return append(b, h.Data...), nil
+}
+
+// ParseUDPHeader parse a datagram relayed by a socks5 UDP association.
+// The returned header's Data shares memory with b.
+func ParseUDPHeader(b []byte) (*UDPHeader, error) {
+	h, err := parser.ParseUDPHeader(b)
+	if err != nil {
+		return nil, err
+	}
+	return &UDPHeader{
+		RSV:      h.Rsv,
+		FRAG:     h.Frag,
+		ATYPE:    h.Address.Type,
+		DestAddr: h.Address.Host,
+		DestPort: h.Address.Port,
+		Data:     h.Data,
+	}, nil
+}
+
+// newUDPHeader return an unfragmented header to addr carrying data.
+func newUDPHeader(addr *Address, data []byte) *UDPHeader {
+	return &UDPHeader{ATYPE: addr.ATYPE, DestAddr: addr.Addr, DestPort: addr.Port, Data: data}
+}
+
+// udpAddr return addr as *net.UDPAddr if its host is an IP address.
+func udpAddr(addr *Address) *net.UDPAddr {
+	if addr.ATYPE == DOMAINNAME {
+		return nil
+	}
+	return &net.UDPAddr{IP: addr.Addr, Port: int(addr.Port)}
+}
@@ -0,0 +1,32 @@
+package socks5
+
+// UDPFiltering is the filtering behavior of UDP relays (RFC 4787 section
+// 5): the sources from which datagrams are relayed to the client of an
+// UDP association. Restricted sources are the destinations of the NAT
+// table, see Server.UDPPeerTimeout, others are dropped.
+type UDPFiltering uint8
+
+const (
+	// PortRestricted relays datagrams from the addresses and ports the
+	// client sent to, the default.
+	PortRestricted UDPFiltering = iota
+	// AddressRestricted relays datagrams from any port of the addresses
+	// the client sent to.
+	AddressRestricted
+	// FullCone relays datagrams from any source, such as for P2P
+	// applications whose peers learn the relay address elsewhere.
+	FullCone
+)
+
+var udpFiltering2Str = map[UDPFiltering]string{
+	PortRestricted:    "port restricted",
+	AddressRestricted: "address restricted",
+	FullCone:          "full cone",
+}
+
+func (f UDPFiltering) String() string {
+	if str, ok := udpFiltering2Str[f]; ok {
+		return str
+	}
+	return "unknown"
+}
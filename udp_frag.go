@@ -0,0 +1,67 @@
+package socks5
+
+import (
+	"bytes"
+	"time"
+)
+
+// udpReassemblyTimeout is the REASSEMBLY TIMER of RFC 1928 section 7, the
+// time a fragment sequence may take, it must not be under 5 seconds.
+const udpReassemblyTimeout = 5 * time.Second
+
+// udpFragments is the reassembly queue of the fragmented datagrams of an
+// UDP association. FRAG is the position of a fragment in its sequence,
+// from 1, with the high-order bit set on the last fragment. Fragments
+// must arrive in order and to the same destination, the queue is
+// abandoned otherwise, or after udpReassemblyTimeout.
+type udpFragments struct {
+	// head is the header of the first fragment, with the data of the
+	// fragments queued so far.
+	head  *UDPHeader
+	pos   byte
+	count int
+	start time.Time
+}
+
+// add queue the fragment h, received at now. It return the reassembled
+// datagram after the last fragment of a sequence, and the number of
+// fragments dropped, h included if it was dropped.
+func (q *udpFragments) add(h *UDPHeader, now time.Time) (*UDPHeader, int) {
+	pos, last := h.FRAG&0x7f, h.FRAG&0x80 != 0
+	dropped := 0
+	if q.head != nil && (now.Sub(q.start) >= udpReassemblyTimeout || pos != q.pos+1 ||
+		h.ATYPE != q.head.ATYPE || h.DestPort != q.head.DestPort || !bytes.Equal(h.DestAddr, q.head.DestAddr)) {
+		dropped = q.count
+		q.reset()
+	}
+	if q.head == nil {
+		if pos != 1 {
+			return nil, dropped + 1
+		}
+		q.head = &UDPHeader{
+			ATYPE:    h.ATYPE,
+			DestAddr: append([]byte(nil), h.DestAddr...),
+			DestPort: h.DestPort,
+		}
+		q.start = now
+	}
+	if len(q.head.Data)+len(h.Data) > 65535 {
+		dropped += q.count + 1
+		q.reset()
+		return nil, dropped
+	}
+	// h shares the read buffer of the relay.
+	q.head.Data = append(q.head.Data, h.Data...)
+	q.pos = pos
+	q.count++
+	if !last {
+		return nil, dropped
+	}
+	d := q.head
+	q.reset()
+	return d, dropped
+}
+
+func (q *udpFragments) reset() {
+	q.head, q.pos, q.count = nil, 0, 0
+}
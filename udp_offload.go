@@ -0,0 +1,115 @@
+package socks5
+
+import (
+	"net"
+)
+
+// UDPOffload controls the use of UDP generic segmentation offload (GSO)
+// and generic receive offload (GRO) on the server's UDP relay sockets.
+// Offload lets the kernel send or receive a batch of datagrams in a single
+// syscall, which removes the per-packet syscall bottleneck of the relay.
+type UDPOffload uint8
+
+const (
+	// UDPOffloadAuto enables GSO and GRO when the kernel supports them.
+	UDPOffloadAuto UDPOffload = iota
+	// UDPOffloadOff never enables GSO or GRO.
+	UDPOffloadOff
+)
+
+// udpConn wraps a relay socket and remembers which offloads are enabled on it.
+type udpConn struct {
+	*net.UDPConn
+	gso bool
+	gro bool
+	// oob receives the control messages of GRO reads, only made by the
+	// goroutine relaying the socket.
+	oob []byte
+}
+
+// newUDPConn wraps c and probes the kernel for GSO/GRO support according to mode.
+func newUDPConn(c *net.UDPConn, mode UDPOffload) *udpConn {
+	conn := &udpConn{UDPConn: c}
+	if mode == UDPOffloadAuto {
+		conn.gso, conn.gro = enableUDPOffload(c)
+	}
+	return conn
+}
+
+// readBatch read datagrams into buf. With GRO enabled the kernel may coalesce
+// several datagrams from the same source into buf; they are split by the
+// segment size reported in the control message. The returned datagrams
+// share memory with buf.
+func (c *udpConn) readBatch(buf []byte) ([][]byte, *net.UDPAddr, error) {
+	if !c.gro {
+		n, addr, err := c.ReadFromUDP(buf)
+		if err != nil {
+			return nil, nil, err
+		}
+		return [][]byte{buf[:n]}, addr, nil
+	}
+
+	if c.oob == nil {
+		c.oob = make([]byte, 64)
+	}
+	n, oobn, _, addr, err := c.ReadMsgUDP(buf, c.oob)
+	if err != nil {
+		return nil, nil, err
+	}
+	size := groSegmentSize(c.oob[:oobn])
+	if size <= 0 || size >= n {
+		return [][]byte{buf[:n]}, addr, nil
+	}
+
+	datagrams := make([][]byte, 0, (n+size-1)/size)
+	for off := 0; off < n; off += size {
+		end := off + size
+		if end > n {
+			end = n
+		}
+		datagrams = append(datagrams, buf[off:end])
+	}
+	return datagrams, addr, nil
+}
+
+// writeBatch write datagrams to addr. With GSO enabled, datagrams of equal
+// size (the last one may be shorter) are sent with a single syscall,
+// otherwise they are sent one by one.
+func (c *udpConn) writeBatch(datagrams [][]byte, addr *net.UDPAddr) error {
+	if c.gso && len(datagrams) > 1 && segmentable(datagrams) {
+		size := len(datagrams[0])
+		buf := make([]byte, 0, size*len(datagrams))
+		for _, d := range datagrams {
+			buf = append(buf, d...)
+		}
+		_, _, err := c.WriteMsgUDP(buf, gsoControl(size), addr)
+		if err == nil {
+			return nil
+		}
+		// Some devices refuse segmentation offload (EIO), fall back to
+		// plain writes and stop trying on this socket.
+		c.gso = false
+	}
+
+	for _, d := range datagrams {
+		_, err := c.WriteToUDP(d, addr)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// segmentable report whether datagrams can be sent as one GSO buffer.
+func segmentable(datagrams [][]byte) bool {
+	size := len(datagrams[0])
+	if size == 0 {
+		return false
+	}
+	for i, d := range datagrams[1:] {
+		if len(d) > size || (len(d) < size && i != len(datagrams)-2) {
+			return false
+		}
+	}
+	return true
+}
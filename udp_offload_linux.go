@@ -0,0 +1,60 @@
+package socks5
+
+import (
+	"net"
+	"syscall"
+	"unsafe"
+)
+
+// Socket options not exported by the syscall package.
+// Please see udp(7).
+const (
+	udpSegment = 103 // UDP_SEGMENT, since linux 4.18
+	udpGRO     = 104 // UDP_GRO, since linux 5.0
+)
+
+// enableUDPOffload probe GSO support and turn on GRO for c.
+func enableUDPOffload(c *net.UDPConn) (gso bool, gro bool) {
+	rc, err := c.SyscallConn()
+	if err != nil {
+		return false, false
+	}
+	rc.Control(func(fd uintptr) {
+		_, err := syscall.GetsockoptInt(int(fd), syscall.IPPROTO_UDP, udpSegment)
+		gso = err == nil
+		err = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_UDP, udpGRO, 1)
+		gro = err == nil
+	})
+	return gso, gro
+}
+
+// gsoControl build the UDP_SEGMENT control message for segment size.
+func gsoControl(size int) []byte {
+	b := make([]byte, syscall.CmsgSpace(2))
+	h := (*syscall.Cmsghdr)(unsafe.Pointer(&b[0]))
+	h.Level = syscall.IPPROTO_UDP
+	h.Type = udpSegment
+	h.SetLen(syscall.CmsgLen(2))
+	*(*uint16)(unsafe.Pointer(&b[syscall.CmsgLen(0)])) = uint16(size)
+	return b
+}
+
+// groSegmentSize return the segment size of a coalesced read, or 0.
+func groSegmentSize(oob []byte) int {
+	msgs, err := syscall.ParseSocketControlMessage(oob)
+	if err != nil {
+		return 0
+	}
+	for _, m := range msgs {
+		if m.Header.Level != syscall.IPPROTO_UDP || m.Header.Type != udpGRO {
+			continue
+		}
+		if len(m.Data) >= 4 {
+			return int(*(*int32)(unsafe.Pointer(&m.Data[0])))
+		}
+		if len(m.Data) >= 2 {
+			return int(*(*uint16)(unsafe.Pointer(&m.Data[0])))
+		}
+	}
+	return 0
+}
@@ -0,0 +1,19 @@
+//go:build !linux
+// +build !linux
+
+package socks5
+
+import "net"
+
+// enableUDPOffload GSO/GRO is only available on linux.
+func enableUDPOffload(c *net.UDPConn) (gso bool, gro bool) {
+	return false, false
+}
+
+func gsoControl(size int) []byte {
+	return nil
+}
+
+func groSegmentSize(oob []byte) int {
+	return 0
+}
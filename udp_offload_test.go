@@ -0,0 +1,53 @@
+package socks5
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestUDPConn_Batch(t *testing.T) {
+	for _, mode := range []UDPOffload{UDPOffloadAuto, UDPOffloadOff} {
+		lc, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		rc, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		sender := newUDPConn(lc, mode)
+		receiver := newUDPConn(rc, mode)
+
+		want := [][]byte{
+			bytes.Repeat([]byte{1}, 100),
+			bytes.Repeat([]byte{2}, 100),
+			bytes.Repeat([]byte{3}, 40),
+		}
+		err = sender.writeBatch(want, rc.LocalAddr().(*net.UDPAddr))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var got [][]byte
+		buf := make([]byte, 65535)
+		receiver.SetReadDeadline(time.Now().Add(time.Second))
+		for len(got) < len(want) {
+			datagrams, _, err := receiver.readBatch(buf)
+			if err != nil {
+				t.Fatalf("mode %d: %v", mode, err)
+			}
+			for _, d := range datagrams {
+				got = append(got, append([]byte(nil), d...))
+			}
+		}
+		for i := range want {
+			if !bytes.Equal(got[i], want[i]) {
+				t.Errorf("mode %d datagram %d: got %v, want %v", mode, i, got[i], want[i])
+			}
+		}
+		lc.Close()
+		rc.Close()
+	}
+}
@@ -0,0 +1,390 @@
+package socks5
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// defaultUDPPeerTimeout is the default of Server.UDPPeerTimeout.
+	defaultUDPPeerTimeout = 2 * time.Minute
+	// defaultMaxUDPPeers is the default of Server.MaxUDPPeers.
+	defaultMaxUDPPeers = 4096
+)
+
+// udpRelay relays the datagrams of an UDP association between the client
+// and its destinations over a single relay socket, the association of a
+// single client address. Datagrams from the client carry the UDP request
+// header, they are unwrapped and sent to their destination, which enters
+// the NAT table of the association. Datagrams from destinations of the
+// table are wrapped in a header with their source and sent to the
+// client, others are dropped, as filtering allows. Fragmented datagrams
+// are reassembled if frags is set, dropped otherwise, fragmentation is
+// optional (RFC 1928 section 7).
+type udpRelay struct {
+	conn     *udpConn
+	s        *Session
+	ctx      context.Context
+	resolver NameResolver
+	family   AddressFamily
+	metrics  Metrics
+
+	// clientIP and clientPort restrict the source of client datagrams,
+	// nil and zero accept any. client is the source of the first client
+	// datagram, the only one accepted afterwards.
+	clientIP   net.IP
+	clientPort int
+	client     *net.UDPAddr
+
+	// peers is the NAT table, the time each destination last exchanged a
+	// datagram, evicted after peerTimeout. maxPeers caps its size. hosts
+	// is the same by IP address, for AddressRestricted filtering.
+	peers       map[string]time.Time
+	hosts       map[string]time.Time
+	filtering   UDPFiltering
+	peerTimeout time.Duration
+	maxPeers    int
+	// sweep is the time of the next eviction of idle peers.
+	sweep time.Time
+
+	// rules and policy check the destinations named by the client, as
+	// they check requests. dests caches their verdicts and addresses by
+	// destination, evicted with the NAT table, so names are resolved once
+	// and not for each datagram.
+	rules  RuleSet
+	policy Policy
+	dests  map[string]udpDest
+	// private denies the destinations in private networks, see
+	// Server.blocksPrivate.
+	private bool
+
+	frags *udpFragments
+}
+
+// udpDest is a destination named by the client: its address, nil with
+// the reason to drop its datagrams otherwise, and the time the client
+// last sent to it.
+type udpDest struct {
+	addr   *net.UDPAddr
+	reason string
+	last   time.Time
+}
+
+// relayUDP relay the datagrams of the UDP association of s on relay,
+// accepting client datagrams from the client address only, and the port
+// of the request if not zero.
+func (srv *Server) relayUDP(s *Session, relay *net.UDPConn) error {
+	r := &udpRelay{
+		conn:     newUDPConn(relay, srv.UDPOffload),
+		s:        s,
+		ctx:      s.Context(),
+		resolver: srv.resolver(),
+		family:   srv.AddressFamily,
+		metrics:  srv.Metrics,
+
+		filtering:   srv.UDPFiltering,
+		peerTimeout: srv.UDPPeerTimeout,
+		maxPeers:    srv.MaxUDPPeers,
+
+		rules:   srv.ruleSet(),
+		policy:  srv.policy(),
+		private: srv.blocksPrivate(),
+	}
+	if srv.UDPReassembly {
+		r.frags = &udpFragments{}
+	}
+	r.clientIP = s.ClientIP()
+	if s.Request != nil && s.Request.Address != nil {
+		r.clientPort = int(s.Request.Address.Port)
+	}
+	return r.run()
+}
+
+// transportUDP relay the datagrams of the UDP association of s, with the
+// Transporter of s if it is not one of the package, which relay
+// datagrams as the server does.
+func (srv *Server) transportUDP(s *Session, relay *net.UDPConn) error {
+	switch t := srv.transport(s); t.(type) {
+	case *PooledTransport, *AdaptiveTransport:
+		return srv.relayUDP(s, relay)
+	default:
+		return t.TransportUDP(relay)
+	}
+}
+
+// watchAssociation close relay once the control connection of its UDP
+// association is closed: the association lives as long as it.
+func watchAssociation(ctrl net.Conn, relay *net.UDPConn) {
+	io.Copy(io.Discard, ctrl)
+	relay.Close()
+}
+
+// run relay datagrams until the relay socket is closed.
+func (r *udpRelay) run() error {
+	if r.peerTimeout <= 0 {
+		r.peerTimeout = defaultUDPPeerTimeout
+	}
+	if r.maxPeers <= 0 {
+		r.maxPeers = defaultMaxUDPPeers
+	}
+	buf := make([]byte, 65535)
+	for {
+		datagrams, from, err := r.conn.readBatch(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+		now := time.Now()
+		r.evict(now)
+		if r.fromClient(from) {
+			for _, d := range datagrams {
+				r.forward(d, now)
+			}
+			continue
+		}
+		if err := r.reply(datagrams, from, now); errors.Is(err, net.ErrClosed) {
+			return nil
+		}
+	}
+}
+
+// fromClient report whether from is the client, learning the client
+// address from its first datagram.
+func (r *udpRelay) fromClient(from *net.UDPAddr) bool {
+	if r.client != nil {
+		return r.client.IP.Equal(from.IP) && r.client.Port == from.Port
+	}
+	if r.clientIP != nil && !r.clientIP.IsUnspecified() && !r.clientIP.Equal(from.IP) {
+		return false
+	}
+	if r.clientPort != 0 && r.clientPort != from.Port {
+		return false
+	}
+	r.client = &net.UDPAddr{IP: append(net.IP(nil), from.IP...), Port: from.Port, Zone: from.Zone}
+	return true
+}
+
+// forward send the client datagram d to its destination. Malformed
+// datagrams, denied and unresolved destinations are dropped.
+func (r *udpRelay) forward(d []byte, now time.Time) {
+	h, err := ParseUDPHeader(d)
+	if err != nil {
+		r.drop(UDPDropMalformed, 1)
+		return
+	}
+	if h.FRAG != 0 {
+		if r.frags == nil {
+			r.drop(UDPDropFragment, 1)
+			return
+		}
+		var dropped int
+		h, dropped = r.frags.add(h, now)
+		r.drop(UDPDropFragment, dropped)
+		if h == nil {
+			return
+		}
+	}
+	dest, reason := r.destination(h.Address(), now)
+	if dest == nil {
+		r.drop(reason, 1)
+		return
+	}
+	key := dest.String()
+	if _, ok := r.peers[key]; !ok {
+		if r.peers == nil {
+			r.peers = make(map[string]time.Time)
+		}
+		if len(r.peers) >= r.maxPeers {
+			r.drop(UDPDropTableFull, 1)
+			return
+		}
+	}
+	r.peers[key] = now
+	if r.filtering == AddressRestricted {
+		if r.hosts == nil {
+			r.hosts = make(map[string]time.Time)
+		}
+		r.hosts[string(dest.IP.To16())] = now
+	}
+	// send errors, such as unreachable destinations, only lose d.
+	if _, err := r.conn.WriteToUDP(h.Data, dest); err != nil {
+		r.drop(UDPDropSend, 1)
+		return
+	}
+	r.count(true, len(h.Data))
+	if r.metrics != nil {
+		r.metrics.UDPDatagram(r.s, true, len(h.Data))
+	}
+}
+
+// destination return the address to send the client datagrams for dest
+// to, or nil and the reason to drop them. The rules and the policy of the
+// relay check dest as they would check a request to it, the policy may
+// deny it but its rewrites and routes do not apply to datagrams. Domain
+// names are resolved to their first address of the address family, which
+// is checked again if the relay denies private networks: the rules may
+// have resolved the name to another address.
+//
+// The destinations are cached. Those the client keeps sending to keep
+// their address, failed ones are tried again once evicted.
+func (r *udpRelay) destination(dest *Address, now time.Time) (*net.UDPAddr, string) {
+	key := dest.String()
+	if d, ok := r.dests[key]; ok {
+		if d.addr != nil {
+			d.last = now
+			r.dests[key] = d
+		}
+		return d.addr, d.reason
+	}
+	d := udpDest{last: now}
+	d.addr, d.reason = r.resolve(dest)
+	if len(r.dests) < r.maxPeers {
+		if r.dests == nil {
+			r.dests = make(map[string]udpDest)
+		}
+		r.dests[key] = d
+	}
+	return d.addr, d.reason
+}
+
+// resolve check dest with the rules and the policy of the relay and
+// resolve it, see destination.
+func (r *udpRelay) resolve(dest *Address) (*net.UDPAddr, string) {
+	req := &Request{VER: Version5, CMD: UDP_ASSOCIATE, Address: dest}
+	if r.rules != nil && !r.rules.Allow(r.s, req) {
+		return nil, UDPDropDenied
+	}
+	if r.policy != nil {
+		if d, err := r.policy.Decide(r.s, req, r.resolver); err != nil || d.Deny {
+			return nil, UDPDropDenied
+		}
+	}
+	addr := udpAddr(dest)
+	if addr == nil {
+		ips, err := r.resolver.Resolve(r.ctx, string(dest.Addr))
+		if err != nil {
+			return nil, UDPDropUnresolved
+		}
+		if ips = r.family.apply(ips); len(ips) == 0 {
+			return nil, UDPDropUnresolved
+		}
+		addr = &net.UDPAddr{IP: ips[0], Port: int(dest.Port)}
+	} else if len(r.family.apply([]net.IP{addr.IP})) == 0 {
+		return nil, UDPDropUnresolved
+	}
+	if r.private && IsPrivateIP(addr.IP) {
+		return nil, UDPDropDenied
+	}
+	return addr, ""
+}
+
+// evict remove the peers idle for peerTimeout from the NAT table, at
+// most once per peerTimeout.
+func (r *udpRelay) evict(now time.Time) {
+	if now.Before(r.sweep) {
+		return
+	}
+	r.sweep = now.Add(r.peerTimeout)
+	for _, table := range []map[string]time.Time{r.peers, r.hosts} {
+		for key, last := range table {
+			if now.Sub(last) >= r.peerTimeout {
+				delete(table, key)
+			}
+		}
+	}
+	for key, d := range r.dests {
+		if now.Sub(d.last) >= r.peerTimeout {
+			delete(r.dests, key)
+		}
+	}
+}
+
+// allowed report whether the datagrams of from are relayed to the client
+// by the filtering of the relay, refreshing its NAT table entries.
+func (r *udpRelay) allowed(from *net.UDPAddr, now time.Time) bool {
+	if r.client == nil {
+		return false
+	}
+	key := from.String()
+	last, ok := r.peers[key]
+	ok = ok && now.Sub(last) < r.peerTimeout
+	switch r.filtering {
+	case FullCone:
+		ok = true
+	case AddressRestricted:
+		host := string(from.IP.To16())
+		if last, found := r.hosts[host]; found && now.Sub(last) < r.peerTimeout {
+			r.hosts[host] = now
+			ok = true
+		}
+	}
+	if _, found := r.peers[key]; found && ok {
+		r.peers[key] = now
+	}
+	return ok
+}
+
+// drop report n dropped datagrams for reason.
+func (r *udpRelay) drop(reason string, n int) {
+	if r.metrics == nil {
+		return
+	}
+	for i := 0; i < n; i++ {
+		r.metrics.UDPDropped(r.s, reason)
+	}
+}
+
+// count add n relayed bytes to the counters of the session, up from the
+// client. The relays of Transporter.TransportUDP have no session.
+func (r *udpRelay) count(up bool, n int) {
+	if r.s == nil {
+		return
+	}
+	counter := &r.s.bytesDown
+	if up {
+		counter = &r.s.bytesUp
+	}
+	atomic.AddUint64(counter, uint64(n))
+	atomic.StoreInt64(&r.s.lastActive, time.Now().UnixNano())
+}
+
+// reply send the datagrams of the destination from to the client.
+func (r *udpRelay) reply(datagrams [][]byte, from *net.UDPAddr, now time.Time) error {
+	if !r.allowed(from, now) {
+		r.drop(UDPDropUnknownSource, len(datagrams))
+		return nil
+	}
+	ip := from.IP
+	atype := IPV6_ADDRESS
+	if ip4 := ip.To4(); ip4 != nil {
+		ip, atype = ip4, IPV4_ADDRESS
+	}
+	src := &Address{ip, atype, uint16(from.Port)}
+	wrapped := make([][]byte, 0, len(datagrams))
+	n := 0
+	for _, d := range datagrams {
+		b, err := newUDPHeader(src, d).Bytes()
+		if err != nil {
+			return nil
+		}
+		wrapped = append(wrapped, b)
+		n += len(d)
+	}
+	if err := r.conn.writeBatch(wrapped, r.client); err != nil {
+		r.drop(UDPDropSend, len(datagrams))
+		return err
+	}
+	r.count(false, n)
+	if r.metrics != nil {
+		for _, d := range datagrams {
+			r.metrics.UDPDatagram(r.s, false, len(d))
+		}
+	}
+	return nil
+}
@@ -0,0 +1,401 @@
+package socks5
+
+import (
+	"context"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// udpEchoTest start an UDP echo server and return its address.
+func udpEchoTest(t *testing.T) *net.UDPAddr {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	go func() {
+		buf := make([]byte, 65535)
+		for {
+			n, addr, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			conn.WriteToUDP(buf[:n], addr)
+		}
+	}()
+	return conn.LocalAddr().(*net.UDPAddr)
+}
+
+func TestServer_UDPAssociate(t *testing.T) {
+	echo := udpEchoTest(t)
+	srv := &Server{Resolver: &HostsResolver{Hosts: map[string][]net.IP{"echo.test": {echo.IP}}}}
+	client := &Client{ProxyAddr: serveTest(t, srv)}
+
+	for _, dest := range []string{echo.String(), net.JoinHostPort("echo.test", strconv.Itoa(echo.Port))} {
+		conn, err := client.DialUDP(dest)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		if _, err := conn.Write([]byte("ping")); err != nil {
+			t.Fatal(err)
+		}
+		b := make([]byte, 16)
+		n, err := conn.Read(b)
+		if err != nil || string(b[:n]) != "ping" {
+			t.Errorf("%s: %q, %v", dest, b[:n], err)
+		}
+		conn.Close()
+	}
+
+	// the association ends with its control connection.
+	deadline := time.Now().Add(5 * time.Second)
+	for len(srv.Sessions()) > 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d sessions left", len(srv.Sessions()))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestServer_UDPAssociateResolveOnce(t *testing.T) {
+	echo := udpEchoTest(t)
+	var lookups int32
+	srv := &Server{Resolver: NameResolverFunc(func(ctx context.Context, fqdn string) ([]net.IP, error) {
+		atomic.AddInt32(&lookups, 1)
+		return []net.IP{echo.IP}, nil
+	})}
+	conn, relay := associateTest(t, serveTest(t, srv))
+
+	b, _ := newUDPHeader(&Address{[]byte("echo.test"), DOMAINNAME, uint16(echo.Port)}, []byte("ping")).Bytes()
+	buf := make([]byte, 64)
+	for i := 0; i < 3; i++ {
+		if _, err := conn.WriteToUDP(b, relay); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := conn.Read(buf); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := atomic.LoadInt32(&lookups); n != 1 {
+		t.Errorf("%d lookups", n)
+	}
+}
+
+func TestServer_UDPAssociatePrivate(t *testing.T) {
+	echo := udpEchoTest(t)
+	// the rules see a public address, the relay a private one.
+	block := &BlockPrivateNetworks{Resolver: &HostsResolver{Hosts: map[string][]net.IP{"echo.test": {net.IPv4(198, 51, 100, 1)}}}}
+	metrics := &PrometheusMetrics{}
+	srv := &Server{
+		Metrics:  metrics,
+		Resolver: &HostsResolver{Hosts: map[string][]net.IP{"echo.test": {echo.IP}}},
+		Rules: RuleSetFunc(func(s *Session, req *Request) bool {
+			return req.Address.ATYPE != DOMAINNAME || block.Allow(s, req)
+		}),
+		Dialer: block.Dialer(nil),
+	}
+	conn, relay := associateTest(t, serveTest(t, srv))
+
+	b, _ := newUDPHeader(&Address{[]byte("echo.test"), DOMAINNAME, uint16(echo.Port)}, []byte("ping")).Bytes()
+	if _, err := conn.WriteToUDP(b, relay); err != nil {
+		t.Fatal(err)
+	}
+	waitMetrics(t, metrics, `socks5_udp_dropped_total{reason="denied"} 1`)
+	conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	if n, err := conn.Read(make([]byte, 64)); err == nil {
+		t.Errorf("private destination replied %d bytes", n)
+	}
+}
+
+func TestServer_UDPAssociateForeignSource(t *testing.T) {
+	echo := udpEchoTest(t)
+	client := &Client{ProxyAddr: serveTest(t, &Server{})}
+	u, err := client.ListenPacket(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer u.Close()
+	relay, err := u.association()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a source the client did not send to is dropped.
+	stranger, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stranger.Close()
+	if _, err := u.WriteTo([]byte("ping"), echo); err != nil {
+		t.Fatal(err)
+	}
+	u.SetReadDeadline(time.Now().Add(5 * time.Second))
+	b := make([]byte, 16)
+	if n, from, err := u.ReadFrom(b); err != nil || string(b[:n]) != "ping" || from.String() != echo.String() {
+		t.Fatalf("echo: %q from %v, %v", b[:n], from, err)
+	}
+	stranger.WriteToUDP([]byte("spoof"), relay)
+	u.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	if n, from, err := u.ReadFrom(b); err == nil {
+		t.Errorf("received %q from %v", b[:n], from)
+	}
+}
+
+// associateTest open an UDP association on the server at addr and return
+// an UDP socket of the client and the relay address.
+func associateTest(t *testing.T, addr string) (*net.UDPConn, *net.UDPAddr) {
+	_, reply := requestTest(t, addr, UDP_ASSOCIATE, &Address{net.IPv4zero.To4(), IPV4_ADDRESS, 0})
+	if reply[1] != SUCCESSED {
+		t.Fatalf("reply: %#x", reply[1])
+	}
+	relay := &net.UDPAddr{IP: net.IP(reply[4:8]), Port: int(reply[8])<<8 | int(reply[9])}
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	return conn, relay
+}
+
+func TestServer_UDPReassembly(t *testing.T) {
+	echo := udpEchoTest(t)
+	metrics := &PrometheusMetrics{}
+	srv := &Server{UDPReassembly: true, Metrics: metrics}
+	conn, relay := associateTest(t, serveTest(t, srv))
+
+	dest := &Address{echo.IP.To4(), IPV4_ADDRESS, uint16(echo.Port)}
+	send := func(frag byte, data string) {
+		h := newUDPHeader(dest, []byte(data))
+		h.FRAG = frag
+		b, err := h.Bytes()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := conn.WriteToUDP(b, relay); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// a sequence missing its second fragment is abandoned.
+	send(1, "lost")
+	send(3|0x80, "lost")
+	send(1, "pi")
+	send(2, "n")
+	send(3|0x80, "g")
+
+	b := make([]byte, 64)
+	n, err := conn.Read(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h, err := ParseUDPHeader(b[:n])
+	if err != nil || string(h.Data) != "ping" {
+		t.Errorf("reply: %q, %v", b[:n], err)
+	}
+	waitMetrics(t, metrics, `socks5_udp_dropped_total{reason="fragment"} 2`)
+}
+
+func TestServer_UDPPeerTimeout(t *testing.T) {
+	peer, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer peer.Close()
+	metrics := &PrometheusMetrics{}
+	srv := &Server{UDPPeerTimeout: 50 * time.Millisecond, Metrics: metrics}
+	conn, relay := associateTest(t, serveTest(t, srv))
+
+	addr := peer.LocalAddr().(*net.UDPAddr)
+	b, _ := newUDPHeader(&Address{addr.IP.To4(), IPV4_ADDRESS, uint16(addr.Port)}, []byte("ping")).Bytes()
+	if _, err := conn.WriteToUDP(b, relay); err != nil {
+		t.Fatal(err)
+	}
+	peer.SetDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 64)
+	_, from, err := peer.ReadFromUDP(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the peer was evicted before it replied.
+	time.Sleep(100 * time.Millisecond)
+	peer.WriteToUDP([]byte("late"), from)
+	waitMetrics(t, metrics, `socks5_udp_dropped_total{reason="unknown_source"} 1`)
+
+	// the client sending again adds it back.
+	conn.WriteToUDP(b, relay)
+	if _, _, err := peer.ReadFromUDP(buf); err != nil {
+		t.Fatal(err)
+	}
+	peer.WriteToUDP([]byte("pong"), from)
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h, err := ParseUDPHeader(buf[:n]); err != nil || string(h.Data) != "pong" {
+		t.Errorf("reply: %q, %v", buf[:n], err)
+	}
+}
+
+func TestUDPFragments(t *testing.T) {
+	now := time.Now()
+	dest := &Address{net.IPv4(192, 0, 2, 1).To4(), IPV4_ADDRESS, 53}
+	frag := func(pos byte, data string) *UDPHeader {
+		h := newUDPHeader(dest, []byte(data))
+		h.FRAG = pos
+		return h
+	}
+	q := &udpFragments{}
+	if d, dropped := q.add(frag(2, "x"), now); d != nil || dropped != 1 {
+		t.Errorf("sequence not starting at 1: %v, %d dropped", d, dropped)
+	}
+	q.add(frag(1, "a"), now)
+	q.add(frag(2, "b"), now)
+	// the reassembly timer expired, the sequence is abandoned.
+	if d, dropped := q.add(frag(3|0x80, "c"), now.Add(udpReassemblyTimeout)); d != nil || dropped != 3 {
+		t.Errorf("expired sequence: %v, %d dropped", d, dropped)
+	}
+	q.add(frag(1, "a"), now)
+	d, dropped := q.add(frag(2|0x80, "b"), now)
+	if d == nil || string(d.Data) != "ab" || d.FRAG != 0 || dropped != 0 {
+		t.Errorf("reassembled %v, %d dropped", d, dropped)
+	}
+}
+
+func TestServer_UDPFiltering(t *testing.T) {
+	listen := func(ip net.IP) *net.UDPConn {
+		conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: ip})
+		if err != nil {
+			t.Skip(err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		return conn
+	}
+	tests := []struct {
+		filtering UDPFiltering
+		expected  string
+	}{
+		{PortRestricted, "peer"},
+		{AddressRestricted, "peer,port"},
+		{FullCone, "peer,port,host"},
+	}
+	for _, test := range tests {
+		t.Run(test.filtering.String(), func(t *testing.T) {
+			peer := listen(net.IPv4(127, 0, 0, 1))
+			otherPort := listen(net.IPv4(127, 0, 0, 1))
+			otherHost := listen(net.IPv4(127, 0, 0, 2))
+			conn, relay := associateTest(t, serveTest(t, &Server{UDPFiltering: test.filtering}))
+
+			addr := peer.LocalAddr().(*net.UDPAddr)
+			b, _ := newUDPHeader(&Address{addr.IP.To4(), IPV4_ADDRESS, uint16(addr.Port)}, []byte("ping")).Bytes()
+			conn.WriteToUDP(b, relay)
+			peer.SetDeadline(time.Now().Add(5 * time.Second))
+			buf := make([]byte, 64)
+			if _, _, err := peer.ReadFromUDP(buf); err != nil {
+				t.Fatal(err)
+			}
+			otherHost.WriteToUDP([]byte("host"), relay)
+			otherPort.WriteToUDP([]byte("port"), relay)
+			peer.WriteToUDP([]byte("peer"), relay)
+
+			var got []string
+			conn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+			for {
+				n, err := conn.Read(buf)
+				if err != nil {
+					break
+				}
+				if h, err := ParseUDPHeader(buf[:n]); err == nil {
+					got = append(got, string(h.Data))
+				}
+			}
+			sort.Strings(got)
+			expected := strings.Split(test.expected, ",")
+			sort.Strings(expected)
+			if strings.Join(got, ",") != strings.Join(expected, ",") {
+				t.Errorf("relayed %v, expected %v", got, expected)
+			}
+		})
+	}
+}
+
+func TestTransporter_TransportUDP(t *testing.T) {
+	echo := udpEchoTest(t)
+	relay, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer relay.Close()
+	done := make(chan error, 1)
+	go func() { done <- DefaultTransporter.TransportUDP(relay) }()
+
+	// relays without session count nothing.
+	conn, err := net.DialUDP("udp", nil, relay.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	dest := &Address{echo.IP.To4(), IPV4_ADDRESS, uint16(echo.Port)}
+	b, err := newUDPHeader(dest, []byte("ping")).Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.Write(b); err != nil {
+		t.Fatal(err)
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 64)
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h, err := ParseUDPHeader(buf[:n])
+	if err != nil || string(h.Data) != "ping" {
+		t.Fatalf("%v, %v", h, err)
+	}
+
+	relay.Close()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("TransportUDP not returned")
+	}
+}
+
+func TestServer_UDPAssociateRules(t *testing.T) {
+	allowed, denied := udpEchoTest(t), udpEchoTest(t)
+	metrics := &PrometheusMetrics{}
+	srv := &Server{
+		Metrics: metrics,
+		Rules: RuleSetFunc(func(s *Session, req *Request) bool {
+			return req.Address.Port != uint16(denied.Port)
+		}),
+	}
+	conn, relay := associateTest(t, serveTest(t, srv))
+
+	buf := make([]byte, 64)
+	for _, dest := range []*net.UDPAddr{denied, allowed} {
+		b, _ := newUDPHeader(&Address{dest.IP.To4(), IPV4_ADDRESS, uint16(dest.Port)}, []byte("ping")).Bytes()
+		if _, err := conn.WriteToUDP(b, relay); err != nil {
+			t.Fatal(err)
+		}
+	}
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h, err := ParseUDPHeader(buf[:n])
+	if err != nil || string(h.Data) != "ping" || int(h.DestPort) != allowed.Port {
+		t.Errorf("reply: %q, %v", buf[:n], err)
+	}
+	waitMetrics(t, metrics, `socks5_udp_dropped_total{reason="denied"} 1`)
+	conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	if n, err := conn.Read(buf); err == nil {
+		t.Errorf("denied destination replied %q", buf[:n])
+	}
+}
@@ -0,0 +1,106 @@
+package socks5
+
+import (
+	"errors"
+	"sync"
+)
+
+// Credentials are a user name and password.
+type Credentials struct {
+	Username string
+	Password string
+}
+
+// IsolatedUpstream is a Router chaining sessions to an upstream socks5
+// proxy with upstream credentials chosen per local user, for stream
+// isolation: upstreams keeping the streams of distinct credentials apart,
+// such as Tor with IsolateSOCKSAuth, then map different local users to
+// separate circuits or identities. Domain names are passed to the
+// upstream, see Route.RemoteDNS, so they are resolved on its side.
+type IsolatedUpstream struct {
+	// Name is the name of the route, "upstream" if empty.
+	Name string
+
+	// Upstream is the configuration of the connections to the upstream
+	// proxy. Its Username and Password are replaced by the credentials of
+	// each session.
+	Upstream *Client
+
+	// Credentials return the upstream credentials of s. If nil, the local
+	// user name is used as upstream user name and password, and sessions
+	// without user name use the credentials of Upstream.
+	Credentials func(s *Session) Credentials
+
+	mu      sync.Mutex
+	clients map[Credentials]*Client
+}
+
+// maxIsolatedClients caps the clients cached by IsolatedUpstream, the
+// cache is reset past it.
+const maxIsolatedClients = 4096
+
+// Route implements Router.
+func (u *IsolatedUpstream) Route(s *Session, dest *Address) []Route {
+	name := u.Name
+	if name == "" {
+		name = "upstream"
+	}
+	return []Route{{Name: name, Dialer: u.client(u.credentials(s)), RemoteDNS: true}}
+}
+
+func (u *IsolatedUpstream) credentials(s *Session) Credentials {
+	if u.Credentials != nil {
+		return u.Credentials(s)
+	}
+	if s.Username == "" {
+		return Credentials{u.Upstream.Username, u.Upstream.Password}
+	}
+	return Credentials{s.Username, s.Username}
+}
+
+// client return the upstream client authenticating with creds. Clients
+// are cached, so that dials with the same credentials share their TLS
+// session cache.
+func (u *IsolatedUpstream) client(creds Credentials) *Client {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if c, ok := u.clients[creds]; ok {
+		return c
+	}
+	if u.clients == nil || len(u.clients) >= maxIsolatedClients {
+		u.clients = make(map[Credentials]*Client)
+	}
+	c := u.Upstream.withCredentials(creds.Username, creds.Password)
+	u.clients[creds] = c
+	return c
+}
+
+// UpstreamRoute return a route named name chaining to the upstream proxy
+// of c, such as a socks5 server or an HTTP CONNECT proxy. Domain names are
+// passed to the upstream unless c.LocalDNS is set, see Route.RemoteDNS.
+func UpstreamRoute(name string, c *Client) Route {
+	return Route{Name: name, Dialer: c, RemoteDNS: !c.LocalDNS}
+}
+
+// Chain return a Client connecting through hops in order, each hop being
+// reached through the previous ones, for multi-hop chains such as
+//
+//	chain, err := socks5.Chain(
+//		&socks5.Client{ProxyAddr: "entry.example:1080"},
+//		&socks5.Client{ProxyAddr: "exit.example:8080", Protocol: socks5.ProtocolHTTP},
+//	)
+//
+// The first hop is dialed with its own Dialer, the Dialer of the others
+// is replaced. hops are not modified.
+func Chain(hops ...*Client) (*Client, error) {
+	if len(hops) == 0 {
+		return nil, errors.New("empty proxy chain")
+	}
+	chain := hops[0]
+	for _, hop := range hops[1:] {
+		next := hop.clone()
+		next.Dialer = chain
+		chain = next
+	}
+	return chain, nil
+}
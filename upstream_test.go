@@ -0,0 +1,140 @@
+package socks5
+
+import (
+	"crypto/sha256"
+	"net"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestIsolatedUpstream(t *testing.T) {
+	upstreamStore := NewMemeryStore(sha256.New(), "")
+	upstreamStore.Set("alice", "alice")
+	upstream := serveTest(t, &Server{Authenticators: map[METHOD]Authenticator{
+		USERNAME_PASSWORD: UserPwdAuth{upstreamStore},
+	}})
+
+	store := NewMemeryStore(sha256.New(), "")
+	store.Set("alice", "a")
+	store.Set("bob", "b")
+	isolated := &IsolatedUpstream{Upstream: &Client{ProxyAddr: upstream, Timeout: 5 * time.Second}}
+	proxy := serveTest(t, &Server{
+		Authenticators: map[METHOD]Authenticator{USERNAME_PASSWORD: UserPwdAuth{store}},
+		Router:         isolated,
+	})
+	echo := echoTest(t)
+
+	conn, err := (&Client{ProxyAddr: proxy, Username: "alice", Password: "a"}).Dial("tcp", echo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	// the upstream has no bob user.
+	if _, err := (&Client{ProxyAddr: proxy, Username: "bob", Password: "b"}).Dial("tcp", echo); err == nil {
+		t.Error("bob reached the upstream as alice")
+	}
+
+	alice := &Session{Username: "alice"}
+	a := isolated.Route(alice, nil)[0]
+	if a.Name != "upstream" || a.Dialer != isolated.Route(alice, nil)[0].Dialer {
+		t.Errorf("route %+v not cached", a)
+	}
+	if c := a.Dialer.(*Client); c.Username != "alice" || c.ProxyAddr != upstream {
+		t.Errorf("alice dials as %q via %s", c.Username, c.ProxyAddr)
+	}
+	if c := isolated.Route(&Session{}, nil)[0].Dialer.(*Client); c.Username != "" {
+		t.Errorf("anonymous dials as %q", c.Username)
+	}
+}
+
+func TestChain(t *testing.T) {
+	echo := echoTest(t)
+	var hops []string
+	var mu sync.Mutex
+	record := func(name string) RuleSet {
+		return RuleSetFunc(func(s *Session, req *Request) bool {
+			mu.Lock()
+			hops = append(hops, name)
+			mu.Unlock()
+			return true
+		})
+	}
+	entry := serveTest(t, &Server{Rules: record("entry")})
+	middle := serveTest(t, &Server{Rules: record("middle")})
+
+	chain, err := Chain(
+		&Client{ProxyAddr: entry},
+		&Client{ProxyAddr: middle},
+		&Client{ProxyAddr: httpProxyTest(t), Protocol: ProtocolHTTP, Username: "admin", Password: "123456"},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := chain.Dial("tcp", echo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.Write([]byte("ping"))
+	// the HTTP proxy greets first
+	if b, err := ReadNBytes(conn, 9); err != nil || string(b) != "helloping" {
+		t.Errorf("echo %q, %v", b, err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if !reflect.DeepEqual(hops, []string{"entry", "middle"}) {
+		t.Errorf("hops %v", hops)
+	}
+
+	if _, err := Chain(); err == nil {
+		t.Error("empty chain")
+	}
+}
+
+func TestRuleRouter(t *testing.T) {
+	echo := echoTest(t)
+	_, port, _ := net.SplitHostPort(echo)
+	dests := make(chan *Address, 1)
+	upstream := serveTest(t, &Server{
+		Resolver: &HostsResolver{Hosts: map[string][]net.IP{"echo.test": {net.IPv4(127, 0, 0, 1)}}},
+		Rules: RuleSetFunc(func(s *Session, req *Request) bool {
+			dests <- req.Address
+			return true
+		}),
+	})
+	store := NewMemeryStore(sha256.New(), "")
+	store.Set("crawler", "c")
+	store.Set("admin", "a")
+	proxy := serveTest(t, &Server{
+		Authenticators: map[METHOD]Authenticator{USERNAME_PASSWORD: UserPwdAuth{store}},
+		Resolver:       &HostsResolver{Hosts: map[string][]net.IP{"echo.test": {net.IPv4(127, 0, 0, 1)}}},
+		Router: &RuleRouter{Rules: []RuleRoute{{
+			Rules:  &Match{Users: []string{"crawler"}},
+			Routes: []Route{UpstreamRoute("upstream", &Client{ProxyAddr: upstream})},
+		}}},
+	})
+
+	crawler := &Client{ProxyAddr: proxy, Username: "crawler", Password: "c"}
+	conn, err := crawler.Dial("tcp", "echo.test:"+port)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	if dest := <-dests; dest.ATYPE != DOMAINNAME || string(dest.Addr) != "echo.test" {
+		t.Errorf("upstream request to %s", dest)
+	}
+
+	admin := &Client{ProxyAddr: proxy, Username: "admin", Password: "a"}
+	conn, err = admin.Dial("tcp", "echo.test:"+port)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	select {
+	case dest := <-dests:
+		t.Errorf("admin routed upstream to %s", dest)
+	default:
+	}
+}
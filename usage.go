@@ -0,0 +1,126 @@
+package socks5
+
+import (
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// countConn counts the bytes read from conn, and the time blocked
+// writing to it if stall is not nil.
+type countConn struct {
+	net.Conn
+	n      *uint64
+	active *int64
+	limit  *byteLimit
+	stall  *stall
+}
+
+func (c *countConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		atomic.AddUint64(c.n, uint64(n))
+		atomic.StoreInt64(c.active, time.Now().UnixNano())
+	}
+	if c.limit != nil {
+		c.limit.check()
+	}
+	return n, err
+}
+
+func (c *countConn) Write(b []byte) (int, error) {
+	if c.stall == nil {
+		return c.Conn.Write(b)
+	}
+	start := time.Now()
+	n, err := c.Conn.Write(b)
+	c.stall.add(time.Since(start))
+	return n, err
+}
+
+// CloseWrite half-close the counted connection.
+func (c *countConn) CloseWrite() error {
+	return closeWrite(c.Conn)
+}
+
+// BytesUp return the bytes relayed from the client to the destination so far.
+func (s *Session) BytesUp() uint64 {
+	return atomic.LoadUint64(&s.bytesUp)
+}
+
+// BytesDown return the bytes relayed from the destination to the client so far.
+func (s *Session) BytesDown() uint64 {
+	return atomic.LoadUint64(&s.bytesDown)
+}
+
+// Idle return the time since the session last relayed a byte, or since
+// it started. It is only tracked when the server counts bytes, such as
+// for Server.MemoryLimit, otherwise it is the time since the start.
+func (s *Session) Idle() time.Duration {
+	if t := atomic.LoadInt64(&s.lastActive); t != 0 {
+		return time.Since(time.Unix(0, t))
+	}
+	return time.Since(s.start)
+}
+
+// reportsUsage report whether the server sends OnUsage events.
+func (srv *Server) reportsUsage() bool {
+	return srv.Hooks.OnUsage != nil && srv.UsageInterval > 0
+}
+
+// countBytes report whether the server needs byte counts of sessions.
+func (srv *Server) countBytes() bool {
+	return srv.reportsUsage() || srv.measuresStalls() || srv.Stats != nil || srv.AccessLog != nil || srv.Metrics != nil || srv.MemoryLimit != nil && srv.MemoryLimit.CloseIdle > 0
+}
+
+// countLegs wrap both legs of s to count relayed bytes if needed.
+func (srv *Server) countLegs(s *Session, client, remote net.Conn) (net.Conn, net.Conn) {
+	var limit *byteLimit
+	max, soft := srv.maxBytes(s), uint64(srv.SoftLimits.SessionBytes)
+	if max > 0 || soft > 0 {
+		limit = &byteLimit{srv: srv, s: s, soft: soft, max: max, conns: []net.Conn{client, remote}}
+	} else if !srv.countBytes() && srv.idleTimeout(s) == 0 && srv.SoftLimits.IdleTimeout <= 0 {
+		return client, remote
+	}
+	return &countConn{client, &s.bytesUp, &s.lastActive, limit, srv.stall(s, ClientLeg)},
+		&countConn{remote, &s.bytesDown, &s.lastActive, limit, srv.stall(s, RemoteLeg)}
+}
+
+// reportUsage call OnUsage every UsageInterval with byte count deltas of s
+// until the returned stop function is called, which reports the rest.
+func (srv *Server) reportUsage(s *Session) (stop func()) {
+	if !srv.reportsUsage() {
+		return func() {}
+	}
+
+	done := make(chan struct{})
+	finished := make(chan struct{})
+	go func() {
+		defer close(finished)
+		ticker := time.NewTicker(srv.UsageInterval)
+		defer ticker.Stop()
+
+		var lastUp, lastDown uint64
+		report := func() {
+			up, down := s.BytesUp(), s.BytesDown()
+			if up != lastUp || down != lastDown {
+				srv.Hooks.OnUsage(s, up-lastUp, down-lastDown)
+				lastUp, lastDown = up, down
+			}
+		}
+		for {
+			select {
+			case <-ticker.C:
+				report()
+			case <-done:
+				report()
+				return
+			}
+		}
+	}()
+
+	return func() {
+		close(done)
+		<-finished
+	}
+}
@@ -0,0 +1,61 @@
+package socks5
+
+import (
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestHooks_OnUsage(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		io.Copy(conn, conn)
+		conn.Close()
+	}()
+
+	var up, down uint64
+	done := make(chan struct{})
+	srv := &Server{
+		UsageInterval: 10 * time.Millisecond,
+		Hooks: Hooks{
+			OnUsage: func(s *Session, u, d uint64) {
+				atomic.AddUint64(&up, u)
+				if atomic.AddUint64(&down, d) == 2000 {
+					close(done)
+				}
+			},
+		},
+	}
+	addr := serveTest(t, srv)
+	dest, _ := ParseAddress(ln.Addr().String())
+	conn, reply := connectTest(t, addr, dest)
+	if reply[1] != SUCCESSED {
+		t.Fatalf("reply: %#x", reply[1])
+	}
+
+	for i := 0; i < 2; i++ {
+		conn.Write(make([]byte, 1000))
+		if _, err := ReadNBytes(conn, 1000); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("usage events not reported")
+	}
+	if u := atomic.LoadUint64(&up); u != 2000 {
+		t.Errorf("up: %d, want 2000", u)
+	}
+}
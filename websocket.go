@@ -0,0 +1,330 @@
+package socks5
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// websocketGUID is appended to the key of a WebSocket handshake to make
+// its accept value (RFC 6455 section 1.3).
+const websocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// WebSocket opcodes (RFC 6455 section 5.2).
+const (
+	wsContinuation = 0x0
+	wsText         = 0x1
+	wsBinary       = 0x2
+	wsClose        = 0x8
+	wsPing         = 0x9
+	wsPong         = 0xa
+)
+
+// WebSocketHandler is an http.Handler serving socks over WebSocket, such
+// as to reach the server through networks allowing HTTP(S) only, or to
+// share a port with a web site. Each WebSocket connection carries one
+// socks session in binary messages:
+//
+//	http.Handle("/socks", &socks5.WebSocketHandler{Server: srv})
+//
+// Clients connect with the ws and wss schemes of ParseURL, or
+// Client.WebSocketURL.
+type WebSocketHandler struct {
+	// Server serves the socks sessions.
+	Server *Server
+
+	// CheckOrigin optionally rejects handshakes by their Origin header,
+	// which browsers set, such as to forbid web pages to use the proxy.
+	// If nil, all origins are accepted.
+	CheckOrigin func(r *http.Request) bool
+}
+
+// ServeHTTP upgrade the request to a WebSocket connection and serve it.
+func (h *WebSocketHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if r.Method != http.MethodGet || !headerContains(r.Header, "Connection", "upgrade") ||
+		!headerContains(r.Header, "Upgrade", "websocket") || key == "" {
+		http.Error(w, "websocket upgrade required", http.StatusUpgradeRequired)
+		return
+	}
+	if r.Header.Get("Sec-WebSocket-Version") != "13" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		http.Error(w, "unsupported websocket version", http.StatusBadRequest)
+		return
+	}
+	if h.CheckOrigin != nil && !h.CheckOrigin(r) {
+		http.Error(w, "origin not allowed", http.StatusForbidden)
+		return
+	}
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "websocket not supported", http.StatusInternalServerError)
+		return
+	}
+	conn, rw, err := hijacker.Hijack()
+	if err != nil {
+		return
+	}
+	rw.WriteString("HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + websocketAccept(key) + "\r\n\r\n")
+	if err := rw.Flush(); err != nil {
+		conn.Close()
+		return
+	}
+	srv := h.Server
+	if srv == nil {
+		srv = &Server{}
+	}
+	srv.ServeConn(r.Context(), newWebSocketConn(conn, rw.Reader, false))
+}
+
+// headerContains report whether a comma separated value of the header
+// name is token, ignoring case.
+func headerContains(h http.Header, name, token string) bool {
+	for _, v := range h[name] {
+		for _, s := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(s), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// websocketAccept return the Sec-WebSocket-Accept value of key.
+func websocketAccept(key string) string {
+	sum := sha1.Sum([]byte(key + websocketGUID))
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// websocketHandshake upgrade conn, a connection to the server of rawurl,
+// to a WebSocket connection.
+func websocketHandshake(conn net.Conn, rawurl string) (net.Conn, error) {
+	req, err := http.NewRequest(http.MethodGet, rawurl, nil)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	key := base64.StdEncoding.EncodeToString(nonce)
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Sec-WebSocket-Key", key)
+	req.Header.Set("Sec-WebSocket-Version", "13")
+	if err := req.Write(conn); err != nil {
+		return nil, err
+	}
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		return nil, &HTTPStatusError{resp.StatusCode, resp.Status}
+	}
+	if resp.Header.Get("Sec-WebSocket-Accept") != websocketAccept(key) {
+		return nil, errors.New("websocket: invalid Sec-WebSocket-Accept")
+	}
+	return newWebSocketConn(conn, br, true), nil
+}
+
+// websocketConn is a net.Conn carrying a byte stream in the binary
+// messages of a WebSocket connection. Messages may be split in any
+// number of frames. Clients mask the frames they send, servers do not.
+type websocketConn struct {
+	net.Conn
+	r      *bufio.Reader
+	client bool
+
+	// state of the frame being read, used by Read only
+	remaining uint64
+	masked    bool
+	mask      [4]byte
+	maskPos   int
+	eof       bool
+
+	// wmu serializes frames written by Write and Read, which answers
+	// pings and closes
+	wmu    sync.Mutex
+	closed bool
+}
+
+func newWebSocketConn(conn net.Conn, r *bufio.Reader, client bool) *websocketConn {
+	return &websocketConn{Conn: conn, r: r, client: client}
+}
+
+// maxControlPayload is the largest payload of control frames.
+const maxControlPayload = 125
+
+// wsCloseTimeout bounds the write of the close frame by Close, which a
+// Write blocked on a slow peer would delay otherwise.
+const wsCloseTimeout = time.Second
+
+func (c *websocketConn) Read(b []byte) (int, error) {
+	for c.remaining == 0 {
+		if c.eof {
+			return 0, io.EOF
+		}
+		if err := c.nextFrame(); err != nil {
+			return 0, err
+		}
+	}
+	if uint64(len(b)) > c.remaining {
+		b = b[:c.remaining]
+	}
+	n, err := c.r.Read(b)
+	c.unmask(b[:n])
+	c.remaining -= uint64(n)
+	return n, err
+}
+
+// nextFrame read the header of the next data frame, handling the control
+// frames before it.
+func (c *websocketConn) nextFrame() error {
+	var head [2]byte
+	if _, err := io.ReadFull(c.r, head[:]); err != nil {
+		return err
+	}
+	opcode := head[0] & 0xf
+	c.masked = head[1]&0x80 != 0
+	length := uint64(head[1] & 0x7f)
+	switch length {
+	case 126:
+		var ext [2]byte
+		if _, err := io.ReadFull(c.r, ext[:]); err != nil {
+			return err
+		}
+		length = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err := io.ReadFull(c.r, ext[:]); err != nil {
+			return err
+		}
+		length = binary.BigEndian.Uint64(ext[:])
+	}
+	if c.masked {
+		if _, err := io.ReadFull(c.r, c.mask[:]); err != nil {
+			return err
+		}
+	}
+	c.maskPos = 0
+	if c.masked == c.client {
+		return errors.New("websocket: invalid frame masking")
+	}
+
+	switch opcode {
+	case wsContinuation, wsText, wsBinary:
+		c.remaining = length
+		return nil
+	case wsClose, wsPing, wsPong:
+		if length > maxControlPayload {
+			return errors.New("websocket: control frame too long")
+		}
+		payload := make([]byte, length)
+		if _, err := io.ReadFull(c.r, payload); err != nil {
+			return err
+		}
+		c.unmask(payload)
+		switch opcode {
+		case wsPing:
+			return c.writeFrame(wsPong, payload)
+		case wsClose:
+			// the close frame is sent back by Close, so the rest of the
+			// stream may still be written after a CloseWrite of the peer.
+			c.eof = true
+		}
+		return nil
+	}
+	return fmt.Errorf("websocket: unknown opcode %#x", opcode)
+}
+
+func (c *websocketConn) unmask(b []byte) {
+	if !c.masked {
+		return
+	}
+	for i := range b {
+		b[i] ^= c.mask[c.maskPos&3]
+		c.maskPos++
+	}
+}
+
+func (c *websocketConn) Write(b []byte) (int, error) {
+	if err := c.writeFrame(wsBinary, b); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// writeFrame write payload in a single frame of opcode. Nothing is
+// written after a close frame.
+func (c *websocketConn) writeFrame(opcode byte, payload []byte) error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	if c.closed {
+		return net.ErrClosed
+	}
+	if opcode == wsClose {
+		c.closed = true
+	}
+	frame := make([]byte, 0, 14+len(payload))
+	frame = append(frame, 0x80|opcode)
+	var maskBit byte
+	if c.client {
+		maskBit = 0x80
+	}
+	switch n := len(payload); {
+	case n < 126:
+		frame = append(frame, maskBit|byte(n))
+	case n <= 0xffff:
+		frame = append(frame, maskBit|126, byte(n>>8), byte(n))
+	default:
+		frame = append(frame, maskBit|127)
+		frame = append(frame, make([]byte, 8)...)
+		binary.BigEndian.PutUint64(frame[len(frame)-8:], uint64(n))
+	}
+	if !c.client {
+		frame = append(frame, payload...)
+		_, err := c.Conn.Write(frame)
+		return err
+	}
+	var mask [4]byte
+	if _, err := rand.Read(mask[:]); err != nil {
+		return err
+	}
+	frame = append(frame, mask[:]...)
+	for i, v := range payload {
+		frame = append(frame, v^mask[i&3])
+	}
+	_, err := c.Conn.Write(frame)
+	return err
+}
+
+// Close send a close frame within wsCloseTimeout, then close the
+// connection.
+func (c *websocketConn) Close() error {
+	// the deadline also fails a blocked Write, releasing wmu.
+	c.Conn.SetWriteDeadline(time.Now().Add(wsCloseTimeout))
+	c.writeFrame(wsClose, []byte{0x03, 0xe8}) // 1000, normal closure
+	return c.Conn.Close()
+}
+
+// CloseWrite send a close frame, the peer closes the connection once it
+// read the rest of the stream.
+func (c *websocketConn) CloseWrite() error {
+	return c.writeFrame(wsClose, []byte{0x03, 0xe8})
+}
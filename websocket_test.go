@@ -0,0 +1,103 @@
+package socks5
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWebSocketHandler(t *testing.T) {
+	ts := httptest.NewServer(&WebSocketHandler{Server: &Server{}})
+	defer ts.Close()
+	client, err := ParseURL(strings.Replace(ts.URL, "http://", "ws://", 1) + "/socks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var phases []Phase
+	client.Hooks.OnPhase = func(phase Phase, _ time.Duration, err error) {
+		phases = append(phases, phase)
+	}
+	conn, err := client.Dial("tcp", echoTest(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	// 70000 bytes need 64-bit frame lengths, the echo replies in frames
+	// of any size.
+	data := make([]byte, 70000)
+	rand.Read(data)
+	go conn.Write(data)
+	echoed := make([]byte, len(data))
+	if _, err := io.ReadFull(conn, echoed); err != nil || !bytes.Equal(echoed, data) {
+		t.Errorf("echo: %v", err)
+	}
+	if len(phases) < 2 || phases[1] != PhaseWebSocket {
+		t.Errorf("phases %v", phases)
+	}
+
+	resp, err := http.Get(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUpgradeRequired {
+		t.Errorf("plain GET: %s", resp.Status)
+	}
+}
+
+func TestWebSocketHandler_TLS(t *testing.T) {
+	ts := httptest.NewTLSServer(&WebSocketHandler{
+		Server:      &Server{},
+		CheckOrigin: func(r *http.Request) bool { return r.Header.Get("Origin") == "" },
+	})
+	defer ts.Close()
+	roots := x509.NewCertPool()
+	roots.AddCert(ts.Certificate())
+	client, err := ParseURL(strings.Replace(ts.URL, "https://", "wss://", 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.TLSConfig = &tls.Config{ServerName: "example.com", RootCAs: roots}
+	conn, err := client.Dial("tcp", echoTest(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.Write([]byte("ping"))
+	if b, err := ReadNBytes(conn, 4); err != nil || string(b) != "ping" {
+		t.Errorf("echo %q, %v", b, err)
+	}
+}
+
+func TestWebSocketConn_CloseBlockedWrite(t *testing.T) {
+	conn, peer := net.Pipe()
+	defer peer.Close()
+	ws := newWebSocketConn(conn, nil, false)
+
+	// the peer reads nothing, the write blocks holding the write lock.
+	written := make(chan error, 1)
+	go func() {
+		_, err := ws.Write([]byte("data"))
+		written <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	closed := make(chan error, 1)
+	go func() { closed <- ws.Close() }()
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Close blocked by Write")
+	}
+	if err := <-written; err == nil {
+		t.Error("Write succeeded")
+	}
+}
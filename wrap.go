@@ -0,0 +1,67 @@
+package socks5
+
+import (
+	"io"
+	"net"
+)
+
+// Leg identifies one side of a relayed session.
+type Leg uint8
+
+const (
+	// ClientLeg is the connection between the client and the server.
+	ClientLeg Leg = iota
+	// RemoteLeg is the connection between the server and the destination.
+	RemoteLeg
+)
+
+func (l Leg) String() string {
+	if l == ClientLeg {
+		return "client"
+	}
+	return "remote"
+}
+
+// WrapConn return conn with its Read replaced by r and its Write replaced
+// by w, a nil r or w leaves the method unchanged. Typical r and w read
+// from or write to conn, such as io.TeeReader(conn, hash). Close and
+// the other methods are conn's, CloseWrite too if w is nil.
+func WrapConn(conn net.Conn, r io.Reader, w io.Writer) net.Conn {
+	if r == nil {
+		r = conn
+	}
+	if w == nil {
+		w = conn
+	}
+	return &wrappedConn{Conn: conn, r: r, w: w}
+}
+
+type wrappedConn struct {
+	net.Conn
+	r io.Reader
+	w io.Writer
+}
+
+func (c *wrappedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+func (c *wrappedConn) Write(b []byte) (int, error) {
+	return c.w.Write(b)
+}
+
+// CloseWrite half-close conn, unless writes go elsewhere.
+func (c *wrappedConn) CloseWrite() error {
+	if c.w != io.Writer(c.Conn) {
+		return errNoHalfClose
+	}
+	return closeWrite(c.Conn)
+}
+
+// wrapLegs apply Hooks.WrapLeg to both legs of s.
+func (srv *Server) wrapLegs(s *Session, client, remote net.Conn) (net.Conn, net.Conn) {
+	if srv.Hooks.WrapLeg == nil {
+		return client, remote
+	}
+	return srv.Hooks.WrapLeg(s, ClientLeg, client), srv.Hooks.WrapLeg(s, RemoteLeg, remote)
+}
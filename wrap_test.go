@@ -0,0 +1,64 @@
+package socks5
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"sync"
+	"testing"
+)
+
+func TestHooks_WrapLeg(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		io.Copy(conn, conn)
+		conn.Close()
+	}()
+
+	var mu sync.Mutex
+	upload := &bytes.Buffer{}
+	srv := &Server{
+		Hooks: Hooks{
+			WrapLeg: func(s *Session, leg Leg, conn net.Conn) net.Conn {
+				if leg != ClientLeg {
+					return conn
+				}
+				return WrapConn(conn, io.TeeReader(conn, writerFunc(func(b []byte) (int, error) {
+					mu.Lock()
+					defer mu.Unlock()
+					return upload.Write(b)
+				})), nil)
+			},
+		},
+	}
+	addr := serveTest(t, srv)
+	dest, _ := ParseAddress(ln.Addr().String())
+	conn, reply := connectTest(t, addr, dest)
+	if reply[1] != SUCCESSED {
+		t.Fatalf("reply: %#x", reply[1])
+	}
+
+	conn.Write([]byte("inspect me"))
+	if _, err := ReadNBytes(conn, 10); err != nil {
+		t.Fatal(err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if upload.String() != "inspect me" {
+		t.Errorf("inspected: %q", upload.String())
+	}
+}
+
+type writerFunc func(b []byte) (int, error)
+
+func (f writerFunc) Write(b []byte) (int, error) {
+	return f(b)
+}
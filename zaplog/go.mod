@@ -0,0 +1,12 @@
+module github.com/haochen233/socks5/zaplog
+
+go 1.26.0
+
+require (
+	github.com/haochen233/socks5 v0.0.0
+	go.uber.org/zap v1.28.0
+)
+
+require go.uber.org/multierr v1.10.0 // indirect
+
+replace github.com/haochen233/socks5 => ../
@@ -0,0 +1,45 @@
+// Package zaplog adapts a zap logger to socks5.Logger, so that servers
+// log to zap. It is a module of its own so that the socks5 package keeps
+// no dependencies.
+//
+//	logger, _ := zap.NewProduction()
+//	srv := &socks5.Server{Logger: zaplog.New(logger)}
+package zaplog
+
+import (
+	"github.com/haochen233/socks5"
+	"go.uber.org/zap"
+)
+
+// Logger is a socks5.Logger logging to a zap.SugaredLogger, fields are
+// its loosely typed key-value pairs.
+type Logger struct {
+	*zap.SugaredLogger
+}
+
+// New return a Logger logging to l.
+func New(l *zap.Logger) Logger {
+	return Logger{l.Sugar()}
+}
+
+// Debug implements socks5.Logger.
+func (l Logger) Debug(msg string, keyvals ...interface{}) {
+	l.Debugw(msg, keyvals...)
+}
+
+// Info implements socks5.Logger.
+func (l Logger) Info(msg string, keyvals ...interface{}) {
+	l.Infow(msg, keyvals...)
+}
+
+// Warn implements socks5.Logger.
+func (l Logger) Warn(msg string, keyvals ...interface{}) {
+	l.Warnw(msg, keyvals...)
+}
+
+// Error implements socks5.Logger.
+func (l Logger) Error(msg string, keyvals ...interface{}) {
+	l.Errorw(msg, keyvals...)
+}
+
+var _ socks5.Logger = Logger{}
@@ -0,0 +1,24 @@
+package zaplog
+
+import (
+	"testing"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func TestLogger(t *testing.T) {
+	core, logs := observer.New(zapcore.DebugLevel)
+	l := New(zap.New(core))
+	l.Debug("dial failed", "route", "direct")
+	l.Warn("handshake failed", "session", uint64(1), "reason", "version")
+
+	entries := logs.All()
+	if len(entries) != 2 {
+		t.Fatalf("entries %v", entries)
+	}
+	if e := entries[1]; e.Level != zapcore.WarnLevel || e.Message != "handshake failed" || e.ContextMap()["reason"] != "version" {
+		t.Errorf("entry %+v", e)
+	}
+}